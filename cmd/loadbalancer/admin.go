@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// adminEndpoint is an admin API endpoint, described in the OpenAPI document
+type adminEndpoint struct {
+	method, path string
+	summary      string
+	handler      http.HandlerFunc
+	request      any // Zero value of the JSON body's type, nil = no body
+	response     any // Zero value of the JSON response's type, []byte for a gzip download
+}
+
+// Returns every admin API endpoint
+func adminEndpoints(lb *balancer) []adminEndpoint {
+	return []adminEndpoint{
+		{"GET", "/admin/backends", "List backends with their pool, weight, health, state and circuit, filtered by ?pool=, ?health= and ?state=",
+			lb.handleListBackends, nil, []backendStatus{}},
+		{"GET", "/admin/routes", "List routes with their label selector and backends",
+			lb.handleListRoutes, nil, []routeStatus{}},
+		{"POST", "/admin/routes/{name}/cutover", "Blue/green cutover of a route to another pool, rolled back on a high error rate",
+			lb.handleCutover, cutoverRequest{}, cutoverResult{}},
+		{"PUT", "/admin/routes/{name}/strategy", "Switch a route's load balancing strategy, an empty one follows the top-level strategy",
+			lb.handleSetStrategy, strategyRequest{}, strategyResponse{}},
+		{"GET", "/admin/tenants/usage", "Per-tenant request and byte usage",
+			lb.handleTenantUsage, nil, []tenantUsage{}},
+		{"PUT", "/admin/debug/trace", "Switch debug tracing on or off",
+			lb.handleDebugTrace, traceToggle{}, traceToggle{}},
+		{"GET", "/admin/debug/failures", "Most recent requests that ended in a 5xx or had a backend attempt fail, newest first",
+			lb.handleDebugFailures, nil, []failedRequest{}},
+		{"POST", "/admin/debug/replay", "Send a request to a chosen backend out of band and return its full response and timing",
+			lb.handleDebugReplay, replayRequest{}, replayResponse{}},
+		{"PUT", "/admin/backends/{id}/weight", "Change a backend's weight, 0 drains it",
+			lb.handleSetWeight, weightRequest{}, weightResponse{}},
+		{"GET", "/admin/health/summary", "Per-pool backend health counts and availability",
+			lb.handleHealthSummary, nil, healthSummary{}},
+		{"GET", "/admin/autoscaling", "Per-pool utilization, queue depth, p95 latency and suggested backend count as of the last interval, filtered by ?pool=",
+			lb.handleAutoscaling, nil, []poolSignal{}},
+		{"GET", "/admin/listeners", "Per-listener requests, 5xx errors, TLS handshakes and certificate expiry",
+			lb.handleListListeners, nil, []listenerStatus{}},
+		{"GET", "/admin/jobs", "Periodic background jobs with their runs, errors, last run and duration, and next run",
+			lb.handleListJobs, nil, []jobStatus{}},
+		{"PUT", "/admin/config", "Converge to a complete desired config, ?dry_run=true to only diff and ?persist=true to save it",
+			lb.handleApplyConfig, config.Config{}, applyResponse{}},
+		{"POST", "/admin/config/plan", "Preview the backends and routes added, removed and changed and the settings altered by a candidate config, without applying it",
+			lb.handlePlanConfig, config.Config{}, planResponse{}},
+		{"GET", "/admin/cluster", "Cluster leader and peers, also used by peers to check each other",
+			lb.handleClusterStatus, nil, clusterStatus{}},
+		{"POST", "/admin/cluster/prepare", "Check a config document a cluster leader rolls out and stage it for the version in X-Config-Version",
+			lb.handleClusterPrepare, config.Config{}, applyResponse{}},
+		{"POST", "/admin/cluster/commit", "Apply the config document staged for the version in X-Config-Version",
+			lb.handleClusterCommit, nil, applyResponse{}},
+		{"POST", "/admin/cluster/abort", "Drop the config document staged for the version in X-Config-Version",
+			lb.handleClusterAbort, nil, clusterStatus{}},
+		{"GET", "/admin/debug/bundle", "Gzipped tarball of the redacted config, backend and circuit states, recent logs, goroutines and metrics for bug reports",
+			lb.handleDebugBundle, nil, []byte(nil)},
+	}
+}
+
+// Requires the admin credentials on every request to next, if the config sets any
+func adminAuth(cfg config.AdminConfig, next http.Handler) http.Handler {
+	if !cfg.Authenticated() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.BearerToken, cfg.BasicAuth) {
+			if cfg.BasicAuth != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			}
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reports whether admin changes may be written to the config file, answering the request itself if not.
+// It takes admin.persist, which is only valid along with admin credentials.
+func (lb *balancer) canPersist(w http.ResponseWriter) bool {
+	switch {
+	case !lb.currentConfig().Admin.Persist:
+		writeAdminError(w, http.StatusForbidden, "persisting is off, admin.persist enables it")
+		return false
+	case lb.configPath == "":
+		writeAdminError(w, http.StatusConflict, "no config file to persist to")
+		return false
+	}
+	return true
+}
+
+// Adds the admin credentials to a request for an admin API sharing them, like a cluster peer's
+func setAdminAuth(req *http.Request, cfg config.AdminConfig) {
+	switch {
+	case cfg.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+cfg.BearerToken)
+	case cfg.BasicAuth != nil:
+		req.SetBasicAuth(cfg.BasicAuth.Username, cfg.BasicAuth.Password)
+	}
+}
+
+// Creates the handler for the admin API
+func adminHandler(lb *balancer) http.Handler {
+	mux := http.NewServeMux()
+	endpoints := adminEndpoints(lb)
+	for _, endpoint := range endpoints {
+		mux.HandleFunc(endpoint.method+" "+endpoint.path, endpoint.handler)
+	}
+	mux.Handle("GET /admin/openapi.json", openAPIHandler(endpoints))
+	return mux
+}
+
+// routeStatus describes a route in admin API responses
+type routeStatus struct {
+	Name     string            `json:"name"`
+	Selector map[string]string `json:"selector"`
+	Strategy string            `json:"strategy"`
+	Backends []string          `json:"backends"`
+	Canary   *canaryStatus     `json:"canary,omitempty"`
+}
+
+// canaryStatus describes a route's canary split
+type canaryStatus struct {
+	Backends []string `json:"backends"`
+	Weight   int64    `json:"weight"` // 0 once rolled back
+}
+
+func (lb *balancer) handleListRoutes(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]routeStatus, 0, len(lb.routes))
+	for _, rt := range lb.routes {
+		status := routeStatus{Name: rt.name, Selector: rt.currentSelector(), Strategy: rt.currentStrategy(lb.currentConfig().Strategy)}
+		for _, b := range rt.currentBackends() {
+			status.Backends = append(status.Backends, b.cfg.URL)
+		}
+		if rt.canary != nil {
+			status.Canary = &canaryStatus{Weight: rt.canary.weight.Load()}
+			for _, b := range rt.canary.backends {
+				status.Canary.Backends = append(status.Canary.Backends, b.cfg.URL)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	writeList(w, r, statuses)
+}
+
+func (lb *balancer) handleTenantUsage(w http.ResponseWriter, r *http.Request) {
+	if lb.quotas == nil {
+		writeAdminError(w, http.StatusNotFound, "tenant quotas are not enabled")
+		return
+	}
+	writeList(w, r, lb.quotas.snapshot())
+}
+
+// traceToggle is the body and response of a debug trace switch
+type traceToggle struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// Switches debug tracing on or off, body {"enabled": true}
+func (lb *balancer) handleDebugTrace(w http.ResponseWriter, r *http.Request) {
+	var req traceToggle
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		writeAdminError(w, http.StatusBadRequest, `body must be {"enabled": true|false}`)
+		return
+	}
+	if *req.Enabled && lb.currentConfig().DebugTrace.Token == "" {
+		writeAdminError(w, http.StatusForbidden, "tracing needs debug_trace.token to be set")
+		return
+	}
+	lb.traceEnabled.Store(*req.Enabled)
+	writeJSON(w, http.StatusOK, req)
+}
+
+// weightRequest is the body of a weight change
+type weightRequest struct {
+	Weight  *int `json:"weight"`  // 0 drains the backend
+	Persist bool `json:"persist"` // Also write the weight back to the config file
+}
+
+// weightResponse is the response of a weight change
+type weightResponse struct {
+	Backend   string `json:"backend"`
+	Weight    int64  `json:"weight"`
+	Previous  int64  `json:"previous"`
+	Persisted bool   `json:"persisted"`
+}
+
+// Changes a backend's weight live. The id is the backend's configured id, its position in the config by default.
+func (lb *balancer) handleSetWeight(w http.ResponseWriter, r *http.Request) {
+	idx := slices.IndexFunc(lb.pool, func(b *backend) bool { return b.cfg.ID == r.PathValue("id") })
+	if idx < 0 {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("unknown backend %q", r.PathValue("id")))
+		return
+	}
+
+	var req weightRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil || *req.Weight < 0 {
+		writeAdminError(w, http.StatusBadRequest, `body must be {"weight": <0 or more>, "persist": false}`)
+		return
+	}
+
+	b := lb.pool[idx]
+	if req.Persist {
+		if !lb.canPersist(w) {
+			return
+		}
+		// The config only has a weight for all the addresses of a resolved entry together
+		if b.addr != "" {
+			writeAdminError(w, http.StatusConflict, "the weight of one address of a resolved backend can't be persisted")
+			return
+		}
+		if err := config.SaveBackendWeight(lb.configPath, b.entry, *req.Weight); err != nil {
+			log.Printf("Failed to persist weight of %s: %v", b.cfg.URL, err)
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	previous := b.weight.Load()
+	lb.setBackendWeight(b, int64(*req.Weight))
+	log.Printf("Admin API set weight of %s from %d to %d", b.cfg.URL, previous, *req.Weight)
+	writeJSON(w, http.StatusOK, weightResponse{
+		Backend:   b.cfg.URL,
+		Weight:    int64(*req.Weight),
+		Previous:  previous,
+		Persisted: req.Persist,
+	})
+}
+
+// strategyRequest is the body of a strategy switch
+type strategyRequest struct {
+	Strategy *string `json:"strategy"` // Empty to follow the top-level strategy
+}
+
+// strategyResponse is the response of a strategy switch
+type strategyResponse struct {
+	Route    string `json:"route"`
+	Strategy string `json:"strategy"`
+	Previous string `json:"previous"`
+}
+
+// Switches a route's strategy live, placing its next requests by the new one. Like weight changes
+// it lasts until the process restarts or a PUT /admin/config converges routes to their config.
+func (lb *balancer) handleSetStrategy(w http.ResponseWriter, r *http.Request) {
+	rt := lb.route(r.PathValue("name"))
+	if rt == nil {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("unknown route %q", r.PathValue("name")))
+		return
+	}
+
+	var req strategyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Strategy == nil || !config.ValidStrategy(*req.Strategy) {
+		writeAdminError(w, http.StatusBadRequest, `body must be {"strategy": "round_robin"|"weighted_least_connections"|"probe_latency"|""}`)
+		return
+	}
+
+	global := lb.currentConfig().Strategy
+	previous := rt.currentStrategy(global)
+	rt.setStrategy(*req.Strategy)
+	current := rt.currentStrategy(global)
+	if current != previous {
+		rt.announceStrategy(previous, current)
+	}
+	writeJSON(w, http.StatusOK, strategyResponse{Route: rt.name, Strategy: current, Previous: previous})
+}
+
+// Writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Writes an admin API error as {"error": message}
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
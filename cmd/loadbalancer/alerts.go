@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// alerter evaluates the built-in alert rules against the balancer's state
+type alerter struct {
+	lb    *balancer
+	cfg   config.AlertConfig
+	rules []*alertRule
+
+	// Request counts at the previous evaluation, error rates cover the interval since
+	lastRequests, lastErrors uint64
+}
+
+// alertRule is a rule's evaluation state
+type alertRule struct {
+	cfg    config.AlertRuleConfig
+	above  time.Time // When the metric went above the threshold, zero while below
+	firing bool
+}
+
+func newAlerter(lb *balancer, cfg config.AlertConfig) *alerter {
+	a := &alerter{lb: lb, cfg: cfg}
+	for _, ruleCfg := range cfg.Rules {
+		a.rules = append(a.rules, &alertRule{cfg: ruleCfg})
+	}
+	a.lastRequests, a.lastErrors = a.requestCounts()
+	return a
+}
+
+// Takes one sample of every metric and fires or resolves the rules. Run every interval.
+func (a *alerter) evaluate(now time.Time) {
+	requests, errors := a.requestCounts()
+	deltaRequests, deltaErrors := requests-a.lastRequests, errors-a.lastErrors
+	a.lastRequests, a.lastErrors = requests, errors
+
+	var unhealthy, open int
+	for _, b := range a.lb.pool {
+		if !a.lb.healthChecker.IsHealthy(b.idx) {
+			unhealthy++
+		}
+		if b.breaker.IsOpen() {
+			open++
+		}
+	}
+
+	for _, rule := range a.rules {
+		var value float64
+		switch rule.cfg.Metric {
+		case config.AlertMetricUnhealthyPercent:
+			value = 100 * float64(unhealthy) / float64(len(a.lb.pool))
+		case config.AlertMetricErrorRatePercent:
+			// Too few requests to judge, the rule keeps its state until there are enough
+			if deltaRequests < rule.cfg.MinRequests {
+				continue
+			}
+			value = 100 * float64(deltaErrors) / float64(deltaRequests)
+		case config.AlertMetricOpenCircuits:
+			value = float64(open)
+		}
+		a.update(rule, value, now)
+	}
+}
+
+// Moves a rule between firing and resolved for a new sample of its metric
+func (a *alerter) update(rule *alertRule, value float64, now time.Time) {
+	if value <= rule.cfg.Threshold {
+		rule.above = time.Time{}
+		if rule.firing {
+			rule.firing = false
+			a.notify("alert_resolved", rule, value)
+		}
+		return
+	}
+
+	if rule.above.IsZero() {
+		rule.above = now
+	}
+	if !rule.firing && now.Sub(rule.above) >= rule.cfg.For {
+		rule.firing = true
+		a.notify("alert_firing", rule, value)
+	}
+}
+
+// Logs a rule changing state and calls the webhook, if any
+func (a *alerter) notify(event string, rule *alertRule, value float64) {
+	firing := 0.0
+	if rule.firing {
+		firing = 1
+		slog.Warn("alert firing", "rule", rule.cfg.Name, "metric", rule.cfg.Metric, "value", value, "threshold", rule.cfg.Threshold)
+	} else {
+		slog.Info("alert resolved", "rule", rule.cfg.Name, "metric", rule.cfg.Metric, "value", value, "threshold", rule.cfg.Threshold)
+	}
+	a.lb.metrics.alertFiring.WithLabelValues(rule.cfg.Name).Set(firing)
+
+	if a.cfg.Webhook == "" {
+		return
+	}
+	postWebhook(a.cfg.Webhook, "Alert", map[string]any{
+		"event":     event,
+		"rule":      rule.cfg.Name,
+		"metric":    rule.cfg.Metric,
+		"value":     value,
+		"threshold": rule.cfg.Threshold,
+	})
+}
+
+// Sums requests and 5xx errors over all routes
+func (a *alerter) requestCounts() (requests, errors uint64) {
+	for _, rt := range a.lb.routes {
+		requests += rt.requests.Load()
+		errors += rt.errors.Load()
+	}
+	return requests, errors
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"slices"
+)
+
+type annotationsKey struct{}
+
+// Returns configured annotations as headers, with ${VAR} references in their values taken from
+// the environment. Nil without any.
+func annotationHeaders(annotations map[string]string) http.Header {
+	if len(annotations) == 0 {
+		return nil
+	}
+	headers := make(http.Header, len(annotations))
+	for name, value := range annotations {
+		headers.Set(name, os.ExpandEnv(value))
+	}
+	return headers
+}
+
+// Attaches the route's annotations to the request, if it has any
+func withAnnotations(r *http.Request, annotations http.Header) *http.Request {
+	if annotations == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), annotationsKey{}, annotations))
+}
+
+// Called from the director on the request going to the backend, sets the annotations of the
+// backend's pool and then those of the request's route, replacing any the client sent
+func addAnnotations(req *http.Request) {
+	if state, ok := req.Context().Value(attemptKey{}).(*attemptState); ok {
+		setHeaders(req.Header, state.backend.annotations)
+	}
+	if annotations, ok := req.Context().Value(annotationsKey{}).(http.Header); ok {
+		setHeaders(req.Header, annotations)
+	}
+}
+
+func setHeaders(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = slices.Clone(values)
+	}
+}
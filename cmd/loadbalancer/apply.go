@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Largest config document accepted by PUT /admin/config
+const maxConfigBytes = 1 << 20 // 1 MiB
+
+// Settings a running balancer picks up without a restart, by path prefix as reported by config.Diff.
+// Other settings are baked into listeners, transports or background workers at startup.
+var liveSettings = []string{
+	"strategy",
+	"retry.",
+	"timeouts.total",
+	"debug_trace.",
+	"server_timing.",
+	"warmup.",
+	"load_signals.",
+	"no_healthy_backends.retry_after",
+	"backends[*].weight",
+	"backends[*].drained",
+	"routes[*].backend_labels",
+	"routes[*].strategy",
+}
+
+// applyResponse is the response of PUT /admin/config
+type applyResponse struct {
+	Applied  bool             `json:"applied"`            // False for dry runs and when a restart would be needed
+	Changes  []config.Change  `json:"changes"`            // Empty when the running config already matches
+	Restart  []string         `json:"restart,omitempty"`  // Changed settings that need a restart
+	Warnings []config.Warning `json:"warnings,omitempty"` // Risky combinations of settings in the document
+}
+
+// Takes a complete desired config, validates it and converges the running balancer to it.
+// Applying the same document again changes nothing. Nothing is applied if any of the changes
+// needs a restart. ?dry_run=true only reports the changes and ?persist=true also writes the
+// document to the config file, if admin.persist allows it.
+func (lb *balancer) handleApplyConfig(w http.ResponseWriter, r *http.Request) {
+	data, desired, ok := lb.readDesiredConfig(w, r)
+	if !ok {
+		return
+	}
+
+	resp := lb.diffDesired(desired)
+	if len(resp.Restart) > 0 {
+		writeJSON(w, http.StatusConflict, resp)
+		return
+	}
+	if r.URL.Query().Get("dry_run") == "true" {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	if r.URL.Query().Get("persist") == "true" {
+		if !lb.canPersist(w) {
+			return
+		}
+		if !lb.keepsInstanceSettings(data) {
+			writeAdminError(w, http.StatusConflict, "the document's admin and cluster sections must match the running ones to be persisted")
+			return
+		}
+		if err := config.SaveConfig(lb.configPath, data); err != nil {
+			log.Printf("Failed to persist applied config: %v", err)
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	lb.applyConfig(desired, resp.Changes)
+	if lb.cluster != nil {
+		lb.cluster.setVersion(r.Header.Get(configVersionHeader))
+	}
+	resp.Applied = true
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Returns the changes from the running config to desired and those of them that need a restart,
+// as answered before anything is applied
+func (lb *balancer) diffDesired(desired *config.Config) applyResponse {
+	resp := applyResponse{Changes: config.Diff(lb.currentConfig(), desired), Warnings: desired.Warnings()}
+	if resp.Changes == nil {
+		resp.Changes = []config.Change{}
+	}
+	for _, change := range resp.Changes {
+		if !liveSetting(change.Path) {
+			resp.Restart = append(resp.Restart, change.Path)
+		}
+	}
+	return resp
+}
+
+// Reads the config document in the request body and validates it, answering the request itself
+// if it's too large or invalid
+func (lb *balancer) readDesiredConfig(w http.ResponseWriter, r *http.Request) ([]byte, *config.Config, bool) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxConfigBytes+1))
+	if err != nil || len(data) > maxConfigBytes {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("config must be at most %d bytes", maxConfigBytes))
+		return nil, nil, false
+	}
+	desired, err := config.Parse(data)
+	if err != nil {
+		var invalid *config.ValidationError
+		if errors.As(err, &invalid) {
+			// Names the setting so clients can point at it
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error(), "field": invalid.Field})
+			return nil, nil, false
+		}
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return nil, nil, false
+	}
+
+	// Cluster and admin settings are per instance, so a document rolled out to every peer can't
+	// change them, nor needs to carry the admin credentials
+	desired.Cluster = lb.currentConfig().Cluster
+	desired.Admin = lb.currentConfig().Admin
+	return data, desired, true
+}
+
+// Reports whether the document has this instance's own admin and cluster settings, which applying
+// it leaves alone, so writing it to the config file doesn't change them either
+func (lb *balancer) keepsInstanceSettings(data []byte) bool {
+	document, err := config.Parse(data)
+	if err != nil {
+		return false
+	}
+	current := lb.currentConfig()
+	return reflect.DeepEqual(document.Admin, current.Admin) && reflect.DeepEqual(document.Cluster, current.Cluster)
+}
+
+// Reports whether a setting can be changed without a restart
+func liveSetting(path string) bool {
+	// Entries of backends and routes are matched whatever their key. Backend URLs may hold
+	// brackets themselves, setting names never do.
+	if open := strings.Index(path, "["); open >= 0 {
+		if end := strings.LastIndex(path, "]"); end > open {
+			path = path[:open+1] + "*" + path[end:]
+		}
+	}
+	return slices.ContainsFunc(liveSettings, func(setting string) bool {
+		if strings.HasSuffix(setting, ".") {
+			return strings.HasPrefix(path, setting)
+		}
+		return path == setting
+	})
+}
+
+// Converges the running balancer to a desired config differing only in live settings
+func (lb *balancer) applyConfig(desired *config.Config, changes []config.Change) {
+	for _, b := range lb.pool {
+		backendCfg := desired.Backends[b.entry]
+		weight := int64(backendCfg.Weight)
+		if backendCfg.Drained {
+			weight = 0
+		}
+		if b.weight.Load() != weight {
+			lb.setBackendWeight(b, weight)
+		}
+	}
+
+	for _, routeCfg := range desired.Routes {
+		rt := lb.route(routeCfg.Name)
+		if rt != nil && !maps.Equal(rt.currentSelector(), routeCfg.BackendLabels) {
+			lb.setRouteSelector(rt, routeCfg.BackendLabels, selectByLabels(rt.pool, routeCfg.BackendLabels))
+		}
+	}
+
+	// Routes without an override, the default one included, follow the top-level strategy
+	for _, rt := range lb.routes {
+		var override string
+		if i := slices.IndexFunc(desired.Routes, func(c config.RouteConfig) bool { return c.Name == rt.name }); i >= 0 {
+			override = desired.Routes[i].Strategy
+		}
+		from := rt.currentStrategy(lb.currentConfig().Strategy)
+		rt.setStrategy(override)
+		if to := rt.currentStrategy(desired.Strategy); to != from {
+			rt.announceStrategy(from, to)
+		}
+	}
+
+	if lb.currentConfig().DebugTrace.Enabled != desired.DebugTrace.Enabled {
+		lb.traceEnabled.Store(desired.DebugTrace.Enabled)
+	}
+	lb.cfg.Store(desired)
+
+	for _, change := range changes {
+		log.Printf("Admin API applied config change %s: %v -> %v", change.Path, change.From, change.To)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Request durations kept per pool and interval for the p95, a random sample once there are more
+const latencySamples = 1024
+
+// poolSignal is a pool's utilization as computed at the last autoscaling interval
+type poolSignal struct {
+	Pool            string  `json:"pool"`
+	Backends        int     `json:"backends"` // Available backends: healthy, not draining and circuit not open
+	Inflight        int64   `json:"inflight"` // Requests in flight to any of the pool's backends
+	Capacity        int64   `json:"capacity"` // In-flight requests the available backends handle when fully used
+	Utilization     float64 `json:"utilization"`
+	QueueDepth      int64   `json:"queue_depth"`    // Requests waiting for a connection under max_conns
+	LatencyP95Ms    float64 `json:"latency_p95_ms"` // Over the interval, 0 without requests
+	DesiredBackends int     `json:"desired_backends"`
+}
+
+// autoscaler computes per-pool utilization signals for scaling backend fleets
+type autoscaler struct {
+	lb  *balancer
+	cfg config.AutoscalingConfig
+
+	mu        sync.Mutex
+	latencies map[string]*latencySample // By pool, since the last interval
+	signals   []poolSignal
+}
+
+// latencySample is a uniform random sample of request durations
+type latencySample struct {
+	seen      int
+	durations []time.Duration
+}
+
+func newAutoscaler(lb *balancer, cfg config.AutoscalingConfig) *autoscaler {
+	return &autoscaler{lb: lb, cfg: cfg, latencies: make(map[string]*latencySample)}
+}
+
+// Records how long a request served by b took
+func (a *autoscaler) record(b *backend, duration time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sample := a.latencies[b.pool()]
+	if sample == nil {
+		sample = &latencySample{}
+		a.latencies[b.pool()] = sample
+	}
+	sample.seen++
+	if len(sample.durations) < latencySamples {
+		sample.durations = append(sample.durations, duration)
+	} else if i := rand.IntN(sample.seen); i < latencySamples {
+		sample.durations[i] = duration
+	}
+}
+
+// Computes the signals and posts them to the webhook, if any. Run every interval.
+func (a *autoscaler) publish() {
+	signals := a.update()
+	if a.cfg.Webhook != "" {
+		postWebhook(a.cfg.Webhook, "Autoscaling", map[string]any{"pools": signals})
+	}
+}
+
+// Computes the signals of every pool from the backends' current state and the request durations
+// recorded since the last call, then exports them
+func (a *autoscaler) update() []poolSignal {
+	a.mu.Lock()
+	latencies := a.latencies
+	a.latencies = make(map[string]*latencySample)
+	a.mu.Unlock()
+
+	pools := make(map[string]*poolSignal)
+	for _, b := range a.lb.pool {
+		signal := pools[b.pool()]
+		if signal == nil {
+			signal = &poolSignal{Pool: b.pool()}
+			pools[b.pool()] = signal
+		}
+		inflight := b.inflight.Load()
+		signal.Inflight += inflight
+		if b.cfg.MaxConns > 0 && b.cfg.MaxConnsPolicy != config.MaxConnsSpill {
+			signal.QueueDepth += max(inflight-int64(b.cfg.MaxConns), 0)
+		}
+		if a.lb.healthChecker.IsHealthy(b.idx) && !b.breaker.IsOpen() && !b.drained.Load() && !b.warmup.warming.Load() {
+			signal.Backends++
+			signal.Capacity += int64(cmp.Or(b.cfg.MaxConns, a.cfg.BackendCapacity))
+		}
+	}
+
+	signals := make([]poolSignal, 0, len(pools))
+	for name, signal := range pools {
+		if signal.Capacity > 0 {
+			signal.Utilization = float64(signal.Inflight) / float64(signal.Capacity)
+		} else if signal.Inflight > 0 {
+			signal.Utilization = 1
+		}
+		var p95 time.Duration
+		if sample := latencies[name]; sample != nil {
+			p95 = percentile(sample.durations, 0.95)
+		}
+		signal.LatencyP95Ms = float64(p95.Microseconds()) / 1000
+		signal.DesiredBackends = a.desiredBackends(signal, p95)
+
+		a.lb.metrics.poolUtilization.WithLabelValues(name).Set(signal.Utilization)
+		a.lb.metrics.poolQueueDepth.WithLabelValues(name).Set(float64(signal.QueueDepth))
+		a.lb.metrics.poolLatencyP95.WithLabelValues(name).Set(p95.Seconds())
+		a.lb.metrics.poolDesiredBackends.WithLabelValues(name).Set(float64(signal.DesiredBackends))
+		signals = append(signals, *signal)
+	}
+	slices.SortFunc(signals, func(a, b poolSignal) int { return cmp.Compare(a.Pool, b.Pool) })
+
+	a.mu.Lock()
+	a.signals = signals
+	a.mu.Unlock()
+	return signals
+}
+
+// Scales the available backends by how far the pool is from its targets, the way the Kubernetes
+// HPA does: utilization over the target utilization, or p95 latency over the latency target if
+// that is further off. Never suggests fewer than one backend.
+func (a *autoscaler) desiredBackends(signal *poolSignal, p95 time.Duration) int {
+	ratio := signal.Utilization / a.cfg.TargetUtilization
+	if a.cfg.LatencyTarget > 0 {
+		ratio = max(ratio, float64(p95)/float64(a.cfg.LatencyTarget))
+	}
+	return max(int(math.Ceil(float64(max(signal.Backends, 1))*ratio)), 1)
+}
+
+// Returns the duration below which the given share of the durations fall, 0 for none
+func percentile(durations []time.Duration, share float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+	return sorted[int(math.Ceil(share*float64(len(sorted))))-1]
+}
+
+// Serves the signals computed at the last interval, only the ?pool= one if given
+func (lb *balancer) handleAutoscaling(w http.ResponseWriter, r *http.Request) {
+	if lb.autoscaler == nil {
+		writeAdminError(w, http.StatusNotFound, "autoscaling signals are not enabled")
+		return
+	}
+	lb.autoscaler.mu.Lock()
+	signals := lb.autoscaler.signals
+	lb.autoscaler.mu.Unlock()
+	if pool := r.URL.Query().Get("pool"); pool != "" {
+		signals = slices.DeleteFunc(slices.Clone(signals), func(s poolSignal) bool { return s.Pool != pool })
+	}
+	if signals == nil {
+		signals = []poolSignal{} // Before the first interval
+	}
+	writeList(w, r, signals)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/circuitbreaker"
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// backend holds the runtime state of a single backend server
+type backend struct {
+	idx       int    // Position in the pool, also used by the health checker
+	entry     int    // Position of the backend's entry in the config, shared by the addresses of a resolved entry
+	addr      string // Address dialled instead of resolving the URL's host, set for resolved entries
+	cfg       config.BackendConfig
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+	breaker   *circuitbreaker.CircuitBreaker
+	inflight  atomic.Int64  // Requests currently being forwarded to the backend
+	weight    atomic.Int64  // Current weight, starts at the configured one and can be changed at runtime
+	drained   atomic.Bool   // Set while the weight is 0, the backend then only gets traffic as a last resort
+	warmup    warmupState   // Progress back into rotation after recovering
+	load      loadSignal    // Load reported in the backend's responses
+	latency   latencyWindow // Durations of recent attempts, recorded for deadline-aware selection
+	connTrace *httptrace.ClientTrace
+	conns     *connSet   // Open connections to the backend, for the idle connection reaper
+	metrics   *metrics   // Of the balancer the backend serves, set by newBalancer
+	upgrades  upgradeSet // Client connections of WebSocket and other switched protocol streams
+
+	clientCert *x509.Certificate // Presented to the backend for mTLS, nil without one
+	egress     *url.URL          // Proxy connections and health probes go through, with its credentials, nil for none
+
+	annotations http.Header // Set on requests to the backend, from its pool's annotations
+}
+
+// Creates the proxy, transport and circuit breaker for a configured backend
+func newBackend(idx int, cfg config.BackendConfig, timeouts config.TimeoutConfig) (*backend, error) {
+	return newBackendAt(idx, cfg, timeouts, "")
+}
+
+// Like newBackend, but connecting to addr (host:port) instead of resolving the URL's host if set
+func newBackendAt(idx int, cfg config.BackendConfig, timeouts config.TimeoutConfig, addr string) (*backend, error) {
+	name := cfg.URL
+	if addr != "" {
+		name += " at " + addr
+	}
+	breaker := circuitbreaker.New(name, 3, 30*time.Second)
+
+	proxy, err := createProxy(cfg.URL, breaker)
+	if err != nil {
+		return nil, err
+	}
+	conns := new(connSet)
+	transport := newTransport(cfg, timeouts, conns)
+	var clientCert *x509.Certificate
+	if cfg.TLS != nil {
+		transport.TLSClientConfig, clientCert, err = backendTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var egress *url.URL
+	if cfg.Proxy != nil {
+		if egress, err = egressProxyURL(*cfg.Proxy); err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(egress)
+	}
+	if addr != "" {
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+	}
+	proxy.Transport = transport
+
+	b := &backend{
+		idx:       idx,
+		entry:     idx,
+		addr:      addr,
+		cfg:       cfg,
+		proxy:     proxy,
+		transport: transport,
+		breaker:   breaker,
+		conns:     conns,
+
+		clientCert: clientCert,
+		egress:     egress,
+	}
+	b.connTrace = b.connReuseTrace()
+	b.setMetrics(discardMetrics)
+	b.setWeight(int64(cfg.Weight))
+	if cfg.Drained {
+		b.setWeight(0)
+	}
+	return b, nil
+}
+
+// Returns the URL of an egress proxy carrying its credentials, as the transport takes them
+func egressProxyURL(proxy config.EgressProxyConfig) (*url.URL, error) {
+	u, err := url.Parse(proxy.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	if proxy.Username != "" {
+		u.User = url.UserPassword(proxy.Username, proxy.Password)
+	}
+	return u, nil
+}
+
+// Creates the backends of the pool, one per config entry or, for entries with resolve set, one per
+// address their host resolves to through lookup. Backends get their pool's egress proxy unless
+// they have one of their own.
+func newPool(cfg *config.Config, lookup func(ctx context.Context, host string) ([]string, error)) ([]*backend, error) {
+	var pool []*backend
+	for i, backendCfg := range cfg.Backends {
+		backendCfg.Proxy = cfg.BackendProxy(backendCfg)
+		if !backendCfg.Resolve {
+			b, err := newBackend(len(pool), backendCfg, cfg.Timeouts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create proxy for %s: %w", backendCfg.URL, err)
+			}
+			b.entry = i
+			b.annotations = annotationHeaders(cfg.PoolAnnotations[backendCfg.Labels[poolLabel]])
+			pool = append(pool, b)
+			continue
+		}
+
+		addrs, err := resolveBackend(backendCfg, lookup)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Backend %s resolved to %s", backendCfg.URL, strings.Join(addrs, ", "))
+		for _, addr := range addrs {
+			addrCfg := backendCfg
+			addrCfg.ID = backendCfg.ID + "@" + addr
+			b, err := newBackendAt(len(pool), addrCfg, cfg.Timeouts, addr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create proxy for %s at %s: %w", backendCfg.URL, addr, err)
+			}
+			b.entry = i
+			b.annotations = annotationHeaders(cfg.PoolAnnotations[backendCfg.Labels[poolLabel]])
+			pool = append(pool, b)
+		}
+	}
+	if timeout := cfg.IdleConnections.IdleTimeout; timeout > 0 {
+		for _, b := range pool {
+			b.transport.IdleConnTimeout = timeout
+		}
+	}
+	return pool, nil
+}
+
+// Returns the addresses (host:port) to dial for a backend entry with resolve set, in the order
+// lookup returned them without duplicates
+func resolveBackend(cfg config.BackendConfig, lookup func(ctx context.Context, host string) ([]string, error)) ([]string, error) {
+	target, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse backend server url %s: %w", cfg.URL, err)
+	}
+	port := urlPort(target)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, err := lookup(ctx, target.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", target.Hostname(), err)
+	}
+	var addrs []string
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+		if (cfg.AddressFamily == config.AddressFamilyIPv4 && parsed.To4() == nil) ||
+			(cfg.AddressFamily == config.AddressFamilyIPv6 && parsed.To4() != nil) {
+			continue
+		}
+		if addr := net.JoinHostPort(ip, port); !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s resolved to no usable addresses", target.Hostname())
+	}
+	return addrs, nil
+}
+
+// Returns the port of u, or the default one of its scheme
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// Changes the backend's weight at runtime, 0 drains it
+func (b *backend) setWeight(weight int64) {
+	b.weight.Store(weight)
+	b.drained.Store(weight == 0)
+}
+
+// Reports whether the backend is at its connection limit and new requests should spill to other backends
+func (b *backend) full() bool {
+	return b.cfg.MaxConnsPolicy == config.MaxConnsSpill && b.cfg.MaxConns > 0 && b.inflight.Load() >= int64(b.cfg.MaxConns)
+}
+
+// Reports whether the backend carries all the given labels
+func (b *backend) hasLabels(selector map[string]string) bool {
+	for name, value := range selector {
+		if b.cfg.Labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the backend's pool label, "default" without one
+func (b *backend) pool() string {
+	if name := b.cfg.Labels[poolLabel]; name != "" {
+		return name
+	}
+	return "default"
+}
+
+// Label values identifying the backend in per-backend request metrics: its URL, its ID then any configured backend labels
+func (b *backend) metricLabels() []string {
+	values := []string{b.cfg.URL, b.cfg.ID}
+	for _, name := range b.metrics.backendLabels {
+		values = append(values, b.cfg.Labels[name])
+	}
+	return values
+}
+
+// Closes the backend's idle pooled connections so they aren't reused once the instance is gone or unhealthy.
+// Connections serving in-flight requests are left to finish.
+func (b *backend) drainIdleConnections() {
+	b.transport.CloseIdleConnections()
+	log.Printf("Closed idle connections to %s", b.cfg.URL)
+}
+
+// Creates the transport used to reach a backend, applying the first byte timeout, connection limit and protocol settings.
+// The connections it opens are kept in conns until closed.
+func newTransport(cfg config.BackendConfig, timeouts config.TimeoutConfig, conns *connSet) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeouts.FirstByte
+
+	// Requests beyond the limit wait in the transport for a connection to free up
+	transport.MaxConnsPerHost = cfg.MaxConns
+	transport.DisableKeepAlives = cfg.DisableKeepAlives
+
+	switch cfg.Protocol {
+	case config.ProtocolHTTP1:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+		transport.ForceAttemptHTTP2 = false
+	case config.ProtocolHTTP2:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:       30 * time.Second,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: cfg.FallbackDelay,
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch cfg.AddressFamily {
+		case config.AddressFamilyIPv4:
+			network = "tcp4"
+		case config.AddressFamilyIPv6:
+			network = "tcp6"
+		}
+		conn, err := dialBackend(ctx, dialer, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tracked := &trackedConn{Conn: conn, opened: time.Now()}
+		tracked.onClose = func() {
+			conns.remove(tracked)
+		}
+		conns.add(tracked)
+		return tracked, nil
+	}
+
+	return transport
+}
+
+// trackedConn runs onClose once when the connection is closed, and keeps track of the requests
+// using it for the idle connection reaper
+type trackedConn struct {
+	net.Conn
+	onClose   func()
+	closeOnce sync.Once
+
+	opened time.Time
+	busy   atomic.Int32 // Requests currently using it
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// Counts whether each request to the backend got a new or a reused connection. Mostly new ones
+// point at keep-alive being off or idle connections closing before they are reused.
+func (b *backend) connReuseTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			state := "new"
+			if info.Reused {
+				state = "reused"
+			}
+			b.metrics.backendConnReuse.WithLabelValues(b.cfg.URL, state).Inc()
+		},
+	}
+}
+
+// Makes the backend record into the metrics of the balancer it serves
+func (b *backend) setMetrics(m *metrics) {
+	b.metrics = m
+	m.backendConnectionsLimit.WithLabelValues(b.cfg.URL).Set(float64(b.cfg.MaxConns))
+	b.conns.setGauge(m.backendConnections.WithLabelValues(b.cfg.URL))
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+	"github.com/vinzmyko/load-balancer/internal/health"
+)
+
+// balancer holds the runtime state shared by the proxy handler and the admin API
+type balancer struct {
+	cfg           atomic.Pointer[config.Config] // Swapped when a new config is applied through the admin API
+	pool          []*backend
+	routes        []*route
+	healthChecker *health.Checker
+	identities    *identityTracker    // nil unless identity metrics are enabled
+	maintenance   atomic.Bool         // When set every request is answered with 503
+	shedder       *loadShedder        // nil unless load shedding is enabled
+	quotas        *tenantQuotas       // nil unless tenant quotas are enabled
+	staleCache    *staleCache         // nil unless the no healthy backends policy is cache
+	failures      *failureJournal     // nil when no failed requests are kept
+	autoscaler    *autoscaler         // nil unless autoscaling signals are enabled
+	fairness      *fairnessAudit      // nil unless backend selection is audited
+	listeners     listenerSet         // Main listeners, added once listening
+	certs         *certMonitor        // Listener and backend client certificates, watched for their expiry
+	deadlines     *deadlineSelector   // nil unless requests can have a deadline budget
+	panicMode     *panicGuard         // nil unless routes can panic
+	traceEnabled  atomic.Bool         // Whether requests with the debug header get a trace
+	configPath    string              // File the config was loaded from, admin changes can be persisted to it
+	cluster       *cluster            // nil unless clustering is configured
+	synthetic     *syntheticTraffic   // nil unless a synthetic traffic header is configured
+	gatherer      prometheus.Gatherer // Registry the metrics are served from, nil = the default one
+	jobs          jobScheduler        // Periodic background work
+	metrics       *metrics            // Collectors of this balancer, registered by the caller
+}
+
+func newBalancer(pool []*backend, cfg *config.Config, healthChecker *health.Checker) *balancer {
+	return newBalancerWithMetrics(pool, cfg, healthChecker, newMetrics(cfg.Metrics))
+}
+
+// Like newBalancer, recording into m, which the caller may have registered already or shares with
+// the backend resolver
+func newBalancerWithMetrics(pool []*backend, cfg *config.Config, healthChecker *health.Checker, m *metrics) *balancer {
+	lb := &balancer{
+		pool:          pool,
+		routes:        buildRoutes(cfg.Routes, pool, m),
+		healthChecker: healthChecker,
+		shedder:       newLoadShedder(cfg.LoadShedding, m),
+		certs:         newCertMonitor(cfg.CertExpiry, m),
+		listeners:     listenerSet{metrics: m},
+		jobs:          jobScheduler{metrics: m},
+		metrics:       m,
+	}
+	for _, b := range pool {
+		b.setMetrics(m)
+		if b.clientCert != nil {
+			lb.certs.add(certUsageBackendClient, b.cfg.TLS.CertFile, b.clientCert)
+		}
+	}
+	if cfg.IdentityMetrics.Enabled {
+		lb.identities = newIdentityTracker(cfg.IdentityMetrics, m)
+	}
+	lb.cfg.Store(cfg)
+	lb.traceEnabled.Store(cfg.DebugTrace.Enabled)
+	if cfg.NoHealthyBackends.Policy == config.NoHealthyCache {
+		lb.staleCache = newStaleCache(cfg.NoHealthyBackends.CacheEntries, cfg.NoHealthyBackends.CacheBodyBytes)
+	}
+	if entries := cfg.FailureJournal.Entries; entries != nil && *entries > 0 {
+		lb.failures = newFailureJournal(cfg)
+	}
+	if cfg.Panic.UnhealthyPercent > 0 {
+		lb.panicMode = newPanicGuard(cfg.Panic, pool, m)
+	}
+	if cfg.Deadlines.Enabled() {
+		lb.deadlines = newDeadlineSelector(cfg.Deadlines)
+	}
+	if cfg.Autoscaling.Enabled {
+		lb.autoscaler = newAutoscaler(lb, cfg.Autoscaling)
+	}
+	if cfg.FairnessAudit.Enabled {
+		lb.fairness = newFairnessAudit(cfg.FairnessAudit, m)
+	}
+	if cfg.TenantQuotas.Enabled() {
+		lb.quotas = newTenantQuotas(cfg.TenantQuotas, m)
+	}
+	if cfg.Synthetic.Header != "" {
+		lb.synthetic = newSyntheticTraffic(cfg.Synthetic, pool)
+	}
+	return lb
+}
+
+// Returns the config currently in effect
+func (lb *balancer) currentConfig() *config.Config {
+	return lb.cfg.Load()
+}
+
+// Returns the route with the given name, or nil
+func (lb *balancer) route(name string) *route {
+	for _, rt := range lb.routes {
+		if rt.name == name {
+			return rt
+		}
+	}
+	return nil
+}
+
+// Reports whether a backend is healthy and its circuit is closed
+func (lb *balancer) available(b *backend) bool {
+	return lb.healthChecker.IsHealthy(b.idx) && b.breaker.CanAttempt()
+}
+
+// backendChoice is the backends a request picks from: its route's, its region's, the canary's,
+// the synthetic pool or the panic fallback
+type backendChoice struct {
+	backends []*backend
+	next     *uint64    // Round-robin position among them
+	view     healthView // Ignores health checks when panic mode spreads requests over every backend
+	toCanary bool
+	spread   bool
+}
+
+// Returns the backends a request on rt picks from. The simulator routes through this as well, so
+// it follows the same canary split, regions and panic mode as live traffic.
+func (lb *balancer) chooseBackends(rt *route, synthetic bool, now time.Time) backendChoice {
+	choice := backendChoice{backends: rt.currentBackends(), next: &rt.counter, view: lb.healthChecker}
+	if synthetic && lb.synthetic.backends != nil {
+		choice.backends, choice.next = lb.synthetic.backends, &lb.synthetic.counter
+	} else if rt.canary != nil && rt.canary.take() {
+		choice.toCanary = true
+		choice.backends, choice.next = rt.canary.backends, &rt.canary.counter
+	} else {
+		if rt.regions != nil {
+			if regional, regionNext, ok := rt.regions.pick(choice.backends, lb.healthChecker, now); ok {
+				choice.backends, choice.next = regional, regionNext
+			}
+		}
+		// Judged on the backends of the route or its region, canary and synthetic ones are too few
+		if lb.panicMode != nil {
+			choice.backends, choice.next, choice.spread = lb.panicMode.apply(rt, choice.backends, choice.next, lb.healthChecker)
+		}
+	}
+	if choice.spread {
+		choice.view = ignoringHealth{lb.healthChecker}
+	}
+	return choice
+}
+
+// Reports whether a request can be sent to one of the choice's backends, any of them when panic
+// mode spreads requests
+func (lb *balancer) anyChoice(choice backendChoice) bool {
+	return choice.spread || lb.anyAvailable(choice.backends)
+}
+
+// Returns the backends an attempt leaves out: those tried already and, with a time budget, those
+// whose recent latency doesn't fit in what remains of it
+func (lb *balancer) skipped(rt *route, choice backendChoice, tried map[int]bool, remaining time.Duration, hasBudget bool, now time.Time) map[int]bool {
+	if !hasBudget {
+		return tried
+	}
+	return lb.deadlines.exclude(rt.name, choice.backends, tried, remaining, choice.view, now)
+}
+
+// Forwards requests to backends
+func (lb *balancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := lb.currentConfig()
+	start := time.Now()
+
+	if lb.maintenance.Load() {
+		writeError(w, r, http.StatusServiceUnavailable, "maintenance", "")
+		return
+	}
+
+	// The total limit covers the whole exchange, so it is attached to the request context
+	// while the first byte limit lives on the backend transport
+	if cfg.Timeouts.Total > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.Timeouts.Total)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Passed on to the backend and echoed back so both sides can correlate logs
+	requestID := ensureRequestID(r)
+	w.Header().Set(requestIDHeader, requestID)
+
+	// Matched on the request as the client sent it, before anything is translated
+	rt := matchRoute(lb.routes, r)
+
+	synthetic := lb.synthetic != nil && lb.synthetic.matches(r)
+	// Synthetic requests are left out of what production alerting and canary analysis look at
+	recorded := !synthetic || lb.synthetic.cfg.IncludeInMetrics
+	if recorded {
+		lb.metrics.methodRequests.WithLabelValues(rt.name, methodLabel(r)).Inc()
+	}
+
+	// Ahead of the signature check, browsers don't sign preflights
+	if answerLocally(w, r, rt.local) {
+		lb.metrics.localResponses.WithLabelValues(rt.name, methodLabel(r)).Inc()
+		return
+	}
+
+	if rt.signing != nil {
+		if reason := rt.signing.verify(r, time.Now()); reason != "" {
+			lb.metrics.signatureRejections.WithLabelValues(rt.name, reason).Inc()
+			status := http.StatusUnauthorized
+			switch reason {
+			case signatureBodyLarge:
+				status = http.StatusRequestEntityTooLarge
+			case signatureCacheFull:
+				status = http.StatusServiceUnavailable
+			}
+			writeError(w, r, status, "signature_"+reason, "")
+			return
+		}
+	}
+	if rt.body != nil {
+		if status, code := checkBody(r, rt.body); status != 0 {
+			lb.metrics.bodyRejections.WithLabelValues(rt.name, code).Inc()
+			writeError(w, r, status, code, "")
+			return
+		}
+	}
+
+	var tenant string
+	if lb.quotas != nil {
+		tenant = lb.quotas.tenant(r)
+		retryAfter, ok := lb.quotas.admit(tenant)
+		if !ok {
+			w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+			writeError(w, r, http.StatusTooManyRequests, "quota_exceeded", "")
+			return
+		}
+	}
+
+	// Counted as read, Content-Length is missing for chunked uploads
+	requestBody := &countingReader{ReadCloser: r.Body}
+	if hasBody(r) {
+		r.Body = requestBody
+	}
+
+	if cfg.GRPCWeb && isGRPCWeb(r) {
+		r = translateGRPCWebRequest(r)
+	}
+
+	body, err := prepareRetryBody(r, cfg.Retry)
+	if err != nil {
+		log.Printf("Failed to buffer request body: %v", err)
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "")
+		return
+	}
+	if body != nil {
+		defer body.Close()
+	}
+	bodyTooBig := cfg.Retry.Attempts > 0 && hasBody(r) && (body == nil || !body.Complete())
+
+	wrapped := wrapResponseWriter(w)
+	wrapped.websocket = strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	r = withRewrite(r, rt.rewrite)
+	r = withCacheControl(r, rt.cacheControl)
+	r = withAnnotations(r, rt.annotations)
+
+	if lb.shedder != nil {
+		class := lb.shedder.classify(r, rt.name)
+		if !lb.shedder.admit(class) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, "overloaded", "")
+			return
+		}
+		defer lb.shedder.release(class)
+	}
+
+	choice := lb.chooseBackends(rt, synthetic, time.Now())
+	lb.mirrorToWarming(r, choice.backends)
+
+	if !lb.anyChoice(choice) {
+		policy := cfg.NoHealthyBackends.Policy
+		lb.metrics.noHealthyBackends.WithLabelValues(rt.name, policy).Inc()
+		slog.Warn("no healthy backends", "route", rt.name, "policy", policy, "path", r.URL.Path, "request_id", requestID)
+
+		switch policy {
+		case config.NoHealthyCache:
+			if cacheable(r) && lb.staleCache.serve(w, r) {
+				return
+			}
+			fallthrough
+		case config.NoHealthyReject:
+			w.Header().Set("Retry-After", retryAfterSeconds(cfg.NoHealthyBackends.RetryAfter))
+			writeError(w, r, http.StatusServiceUnavailable, "no_healthy_backends", "")
+			return
+		}
+	}
+	var trace *requestTrace
+	if lb.tracing(r) {
+		trace = lb.newTrace(requestID, rt, choice.toCanary, choice.backends)
+		wrapped = wrapResponseWriter(&discardWriter{header: make(http.Header)})
+	} else if lb.staleCache != nil && cacheable(r) {
+		lb.staleCache.capture(wrapped)
+		defer lb.staleCache.store(r, wrapped)
+	}
+
+	var budget time.Duration
+	hasBudget := false
+	if lb.deadlines != nil {
+		budget, hasBudget = lb.deadlines.budget(r, start)
+	}
+
+	tried := make(map[int]bool)
+	var attempts []attemptTrace
+	var selected *backend
+	var attempt int
+	for ; ; attempt++ {
+		exclude := lb.skipped(rt, choice, tried, budget-time.Since(start), hasBudget, time.Now())
+		strategy := rt.currentStrategy(cfg.Strategy)
+		var shares []float64
+		if attempt == 0 && recorded && lb.fairness != nil {
+			shares = expectedShares(strategy, choice.backends, choice.view, exclude)
+		}
+		idx := pickBackend(strategy, choice.backends, choice.view, exclude, choice.next)
+		tried[idx] = true
+		selected = choice.backends[idx]
+		if shares != nil {
+			lb.fairness.record(rt.name, choice.backends, shares, idx, time.Now())
+		}
+		backendURL := selected.cfg.URL
+
+		// Increment backend request counter
+		if recorded {
+			lb.metrics.requestsTotal.WithLabelValues(selected.metricLabels()...).Inc()
+		}
+
+		state := &attemptState{
+			retryable:  attempt < cfg.Retry.Attempts && !bodyTooBig,
+			bodyTooBig: bodyTooBig,
+			retryOn:    cfg.Retry.On,
+
+			backend:     selected,
+			loadSignals: cfg.LoadSignals,
+
+			requestStart: start,
+			start:        time.Now(),
+			serverTiming: cfg.ServerTiming,
+		}
+		req := r.WithContext(context.WithValue(r.Context(), attemptKey{}, state))
+		if body != nil {
+			req.Body = body.Reader()
+		}
+
+		// Forward request to backend
+		wrapped.upgrades = &selected.upgrades
+		attemptStart := state.start
+		serveAttempt(selected, wrapped, req)
+		attempts = append(attempts, newAttemptTrace(selected, state, wrapped.statusCode, attemptStart))
+		if lb.deadlines != nil || rt.regions != nil {
+			selected.latency.record(time.Now(), time.Since(attemptStart))
+		}
+
+		if state.err == nil {
+			break
+		}
+		log.Printf("Retrying request on another backend after error from %s: %v", backendURL, state.err)
+		lb.metrics.retriesTotal.WithLabelValues(backendURL).Inc()
+	}
+	backendURL := selected.cfg.URL
+	if recorded {
+		lb.metrics.servedAttempt.WithLabelValues(rt.name, strconv.Itoa(attempt+1)).Inc()
+	}
+
+	duration := time.Since(start).Seconds()
+	if synthetic {
+		lb.metrics.syntheticRequests.WithLabelValues(backendURL, rt.name).Inc()
+	}
+	if recorded {
+		lb.metrics.requestDuration.WithLabelValues(selected.metricLabels()...).Observe(duration) // Add measurement to histogram
+		rt.record(wrapped.statusCode)
+		if rt.slo != nil {
+			rt.slo.record(wrapped.statusCode, time.Since(start), time.Now())
+		}
+		lb.metrics.requestSize.WithLabelValues(backendURL, rt.name).Observe(float64(requestBody.n))
+		lb.metrics.responseSize.WithLabelValues(backendURL, rt.name).Observe(float64(wrapped.bytes))
+		if rt.canary != nil {
+			rt.canary.record(choice.toCanary, wrapped.statusCode, time.Since(start))
+		}
+
+		if lb.identities != nil {
+			lb.identities.record(r, wrapped.statusCode)
+		}
+		if lb.autoscaler != nil {
+			lb.autoscaler.record(selected, time.Since(start))
+		}
+	}
+	if lb.quotas != nil {
+		// Request bytes are taken from Content-Length, chunked uploads only count their response
+		lb.quotas.recordBytes(tenant, max(r.ContentLength, 0)+wrapped.bytes)
+	}
+
+	if lb.failures != nil {
+		lb.failures.record(r, rt, wrapped.statusCode, attempts, start)
+	}
+
+	if trace != nil {
+		trace.Attempts = attempts
+		trace.Status = wrapped.statusCode
+		trace.DurationMs = duration * 1000
+		writeJSON(w, http.StatusOK, trace)
+	}
+
+	slog.Info("request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"route", rt.name,
+		"canary", choice.toCanary,
+		"synthetic", synthetic,
+		"backend", backendURL,
+		"status", wrapped.statusCode,
+		"duration_ms", duration*1000,
+		"remote_addr", r.RemoteAddr,
+		"attempts", attempt+1,
+		"request_id", requestID,
+	)
+}
+
+// Forwards a single attempt to a backend. ReverseProxy aborts the handler with a panic when
+// the response body copy fails part way through, so the cause is counted before re-panicking.
+func serveAttempt(b *backend, w http.ResponseWriter, r *http.Request) {
+	backendURL := b.cfg.URL
+
+	b.inflight.Add(1)
+	defer b.inflight.Add(-1)
+	var use connUse
+	defer use.done()
+	ctx := httptrace.WithClientTrace(r.Context(), b.connTrace)
+	r = r.WithContext(httptrace.WithClientTrace(ctx, use.trace()))
+
+	defer func() {
+		if err := recover(); err != nil {
+			if err == http.ErrAbortHandler {
+				// The body copied so far is cut short, it mustn't be cached
+				if rw, ok := w.(*responseWriter); ok {
+					rw.capture = nil
+				}
+				if clientGone(r) {
+					log.Printf("Client closed connection while receiving response from %s", backendURL)
+					b.metrics.clientAborted.WithLabelValues(backendURL).Inc()
+				} else {
+					log.Printf("Response from %s aborted mid-stream", backendURL)
+					b.metrics.backendFailures.WithLabelValues(backendURL).Inc()
+				}
+			}
+			panic(err)
+		}
+	}()
+
+	b.proxy.ServeHTTP(w, r)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Checks a request body against the route's policy before it is forwarded, returning the
+// status and error code to reject it with, or 0 if it may go ahead. JSON bodies that are
+// inspected are read in full and replaced so they can still be forwarded.
+func checkBody(r *http.Request, policy *config.BodyPolicyConfig) (int, string) {
+	if !hasBody(r) {
+		return 0, ""
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if len(policy.ContentTypes) > 0 && (err != nil || !slices.ContainsFunc(policy.ContentTypes, func(allowed string) bool {
+		return mediaTypeMatches(allowed, mediaType)
+	})) {
+		return http.StatusUnsupportedMediaType, "unsupported_media_type"
+	}
+
+	if policy.MaxJSONDepth == 0 || !isJSONMediaType(mediaType) {
+		return 0, ""
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, policy.MaxBodyBytes+1))
+	if err != nil {
+		return http.StatusBadRequest, "invalid_body"
+	}
+	if int64(len(body)) > policy.MaxBodyBytes {
+		return http.StatusRequestEntityTooLarge, "body_too_large"
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(body), r.Body}
+	if !validJSON(body, policy.MaxJSONDepth) {
+		return http.StatusBadRequest, "invalid_json"
+	}
+	return 0, ""
+}
+
+// Reports whether a media type matches an allowed one, which may be a type/* wildcard
+func mediaTypeMatches(allowed, mediaType string) bool {
+	allowed = strings.ToLower(allowed)
+	if prefix, ok := strings.CutSuffix(allowed, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return allowed == mediaType
+}
+
+// application/json and the structured +json types such as application/problem+json
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// Reports whether body is a single well-formed JSON value nested at most maxDepth deep
+func validJSON(body []byte, maxDepth int) bool {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return false
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	depth := 0
+	for {
+		token, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return depth == 0
+		}
+		if err != nil {
+			return false
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			if depth++; depth > maxDepth {
+				return false
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		// Trailing values after the top-level one aren't a single document
+		if depth == 0 && dec.More() {
+			return false
+		}
+	}
+}
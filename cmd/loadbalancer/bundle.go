@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v3"
+
+	"github.com/vinzmyko/load-balancer/internal/circuitbreaker"
+)
+
+// Log lines kept for support bundles
+const recentLogLines = 500
+
+// Recent log output, the standard logger and slog write through it once main starts
+var recentLogs = &logRing{}
+
+// logRing keeps the last lines written to it
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.lines) < recentLogLines {
+		l.lines = append(l.lines, string(p))
+	} else {
+		l.lines[l.next] = string(p)
+		l.next = (l.next + 1) % recentLogLines
+	}
+	return len(p), nil
+}
+
+// Returns the kept lines, oldest first
+func (l *logRing) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b bytes.Buffer
+	for i := range l.lines {
+		b.WriteString(l.lines[(l.next+i)%len(l.lines)])
+	}
+	return b.String()
+}
+
+// bundleBackend is a backend's runtime state in support bundles
+type bundleBackend struct {
+	ID             string                  `json:"id"`
+	URL            string                  `json:"url"`
+	Healthy        bool                    `json:"healthy"`
+	ProbeLatencyMs float64                 `json:"probe_latency_ms"`
+	Weight         int64                   `json:"weight"`
+	Drained        bool                    `json:"drained"`
+	Warming        bool                    `json:"warming"`
+	Inflight       int64                   `json:"inflight"`
+	Circuit        circuitbreaker.Snapshot `json:"circuit"`
+	ProbeError     string                  `json:"probe_error,omitempty"` // Why the last health probe failed
+}
+
+// Serves a gzipped tarball of everything useful in a bug report: the config with secrets
+// redacted, backend and circuit breaker states, recent log lines, a goroutine dump and the metrics
+func (lb *balancer) handleDebugBundle(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	files, err := lb.bundleFiles()
+	if err != nil {
+		log.Printf("Failed to build debug bundle: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="loadbalancer-bundle-%s.tar.gz"`, now.UTC().Format("20060102T150405Z")))
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: 0o644, Size: int64(len(file.data)), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			log.Printf("Failed to write debug bundle: %v", err)
+			return
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			log.Printf("Failed to write debug bundle: %v", err)
+			return
+		}
+	}
+	tw.Close()
+	gz.Close()
+}
+
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+func (lb *balancer) bundleFiles() ([]bundleFile, error) {
+	configYAML, err := yaml.Marshal(lb.currentConfig().Redacted())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	backends := make([]bundleBackend, 0, len(lb.pool))
+	for _, b := range lb.pool {
+		backendURL := b.cfg.URL
+		if u, err := url.Parse(backendURL); err == nil {
+			backendURL = u.Redacted()
+		}
+		backends = append(backends, bundleBackend{
+			ID:             b.cfg.ID,
+			URL:            backendURL,
+			Healthy:        lb.healthChecker.IsHealthy(b.idx),
+			ProbeLatencyMs: float64(lb.healthChecker.Latency(b.idx).Microseconds()) / 1000,
+			Weight:         b.weight.Load(),
+			Drained:        b.drained.Load(),
+			Warming:        b.warmup.warming.Load(),
+			Inflight:       b.inflight.Load(),
+			Circuit:        b.breaker.Snapshot(),
+			ProbeError:     errorString(lb.healthChecker.LastError(b.idx)),
+		})
+	}
+	backendsJSON, err := json.MarshalIndent(backends, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode backends: %w", err)
+	}
+
+	var goroutines bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&goroutines, 2); err != nil {
+		return nil, fmt.Errorf("failed to dump goroutines: %w", err)
+	}
+
+	gatherer := lb.gatherer
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	var metrics bytes.Buffer
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(&metrics, family); err != nil {
+			return nil, fmt.Errorf("failed to encode metrics: %w", err)
+		}
+	}
+
+	return []bundleFile{
+		{"config.yaml", configYAML},
+		{"backends.json", backendsJSON},
+		{"recent.log", []byte(recentLogs.String())},
+		{"goroutines.txt", goroutines.Bytes()},
+		{"metrics.txt", metrics.Bytes()},
+	}, nil
+}
+
+// Returns the error's message, or "" for nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
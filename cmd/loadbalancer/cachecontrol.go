@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+type cacheControlKey struct{}
+
+// Statuses caches may store without explicit freshness (RFC 9110 section 15.1), the only ones a
+// forced max-age applies to so errors aren't pinned at the edge
+var heuristicallyCacheable = []int{200, 203, 204, 206, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// Directives dropped when max-age is forced, as they would contradict it
+var forcedAgeConflicts = []string{"max-age", "s-maxage", "no-cache"}
+
+// Directives of per-user responses, which a forced max-age never applies to and the stale cache
+// doesn't store
+var perUserDirectives = []string{"no-store", "private"}
+
+// Attaches the route's caching header overrides to the request, if it has any
+func withCacheControl(r *http.Request, cfg *config.CacheControlConfig) *http.Request {
+	if cfg == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), cacheControlKey{}, cfg))
+}
+
+// Called from ModifyResponse, applies the overrides of the request's route to the caching headers.
+// Responses setting cookies and responses to requests with credentials are left alone, so a forced
+// TTL or a stripped private directive can't let a shared cache hand one client's data to another.
+// For the same reason max-age isn't forced on responses the backend marked no-store or private.
+func overrideCacheControl(resp *http.Response) {
+	cfg, ok := resp.Request.Context().Value(cacheControlKey{}).(*config.CacheControlConfig)
+	if !ok || len(resp.Header.Values("Set-Cookie")) > 0 || resp.Request.Header.Get("Authorization") != "" {
+		return
+	}
+
+	directives := cacheDirectives(resp.Header.Values("Cache-Control"))
+	perUser := slices.ContainsFunc(directives, func(d string) bool { return slices.Contains(perUserDirectives, directiveName(d)) })
+	changed := false
+	if cfg.StripPrivate {
+		before := len(directives)
+		directives = slices.DeleteFunc(directives, func(d string) bool { return directiveName(d) == "private" })
+		changed = len(directives) != before
+	}
+	if cfg.MaxAge > 0 && !perUser && slices.Contains(heuristicallyCacheable, resp.StatusCode) {
+		directives = slices.DeleteFunc(directives, func(d string) bool {
+			return slices.Contains(forcedAgeConflicts, directiveName(d))
+		})
+		directives = append(directives, "max-age="+strconv.Itoa(int(cfg.MaxAge.Seconds())))
+		resp.Header.Del("Expires")
+		changed = true
+	}
+	if changed {
+		if len(directives) == 0 {
+			resp.Header.Del("Cache-Control")
+		} else {
+			resp.Header.Set("Cache-Control", strings.Join(directives, ", "))
+		}
+	}
+
+	if cfg.SurrogateControl != "" {
+		resp.Header.Set("Surrogate-Control", cfg.SurrogateControl)
+	}
+}
+
+// Splits Cache-Control header values into their directives, keeping commas in quoted
+// arguments such as private="Set-Cookie, Authorization"
+func cacheDirectives(values []string) []string {
+	var directives []string
+	for _, value := range values {
+		start, quoted := 0, false
+		for i := 0; i <= len(value); i++ {
+			if i < len(value) && value[i] == '"' {
+				quoted = !quoted
+			}
+			if i == len(value) || (value[i] == ',' && !quoted) {
+				if directive := strings.TrimSpace(value[start:i]); directive != "" {
+					directives = append(directives, directive)
+				}
+				start = i + 1
+			}
+		}
+	}
+	return directives
+}
+
+// Returns a directive's lower-cased name, e.g. max-age for max-age=60
+func directiveName(directive string) string {
+	name, _, _ := strings.Cut(directive, "=")
+	return strings.ToLower(strings.TrimSpace(name))
+}
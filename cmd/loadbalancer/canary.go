@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// canary splits part of a route's traffic off to canary backends and compares how they do
+// against the route's stable backends
+type canary struct {
+	route    string
+	cfg      config.CanaryConfig
+	metrics  *metrics
+	backends []*backend
+	counter  uint64       // Round-robin position within the canary backends
+	weight   atomic.Int64 // Current percentage of traffic, 0 once rolled back
+
+	stable, canary windowStats
+}
+
+// windowStats accumulates request outcomes for the current comparison window
+type windowStats struct {
+	requests atomic.Uint64
+	errors   atomic.Uint64
+	micros   atomic.Uint64 // Total latency in microseconds
+}
+
+// canaryStats is a finished window in webhook payloads
+type canaryStats struct {
+	Requests      uint64  `json:"requests"`
+	ErrorRate     float64 `json:"error_rate"`
+	MeanLatencyMs float64 `json:"mean_latency_ms"`
+}
+
+func newCanary(route string, cfg config.CanaryConfig, pool []*backend, m *metrics) *canary {
+	c := &canary{route: route, cfg: cfg, metrics: m, backends: selectByLabels(pool, cfg.BackendLabels)}
+	c.weight.Store(int64(cfg.Weight))
+	m.canaryWeight.WithLabelValues(route).Set(float64(cfg.Weight))
+	return c
+}
+
+// Decides whether a request goes to the canary backends
+func (c *canary) take() bool {
+	weight := c.weight.Load()
+	return weight > 0 && rand.Int64N(100) < weight
+}
+
+// Records a request served by either side of the split
+func (c *canary) record(toCanary bool, status int, duration time.Duration) {
+	stats := &c.stable
+	if toCanary {
+		stats = &c.canary
+	}
+	stats.requests.Add(1)
+	if status >= 500 {
+		stats.errors.Add(1)
+	}
+	stats.micros.Add(uint64(duration.Microseconds()))
+}
+
+// Resets the window and returns what it held
+func (s *windowStats) take() canaryStats {
+	requests, errors, micros := s.requests.Swap(0), s.errors.Swap(0), s.micros.Swap(0)
+	if requests == 0 {
+		return canaryStats{}
+	}
+	return canaryStats{
+		Requests:      requests,
+		ErrorRate:     float64(errors) / float64(requests),
+		MeanLatencyMs: float64(micros) / float64(requests) / 1000,
+	}
+}
+
+// Compares the canary and stable traffic of the window just ended, rolling the split back the
+// first time the canary regresses. Run every window.
+func (c *canary) analyse() {
+	if c.weight.Load() == 0 {
+		return
+	}
+	stable, canary := c.stable.take(), c.canary.take()
+	if reason := c.regression(stable, canary); reason != "" {
+		c.rollback(reason, stable, canary)
+	}
+}
+
+// Returns why the canary window is worse than the stable one, or "" if it is acceptable
+func (c *canary) regression(stable, canary canaryStats) string {
+	if canary.Requests < c.cfg.MinRequests {
+		return ""
+	}
+	if canary.ErrorRate-stable.ErrorRate > c.cfg.MaxErrorRateIncrease {
+		return "error_rate"
+	}
+	if stable.MeanLatencyMs > 0 && canary.MeanLatencyMs/stable.MeanLatencyMs > c.cfg.MaxLatencyRatio {
+		return "latency"
+	}
+	return ""
+}
+
+// Sends all traffic back to the stable backends and notifies the webhook, if any
+func (c *canary) rollback(reason string, stable, canary canaryStats) {
+	c.weight.Store(0)
+	c.metrics.canaryWeight.WithLabelValues(c.route).Set(0)
+	log.Printf("Rolled back canary of route %s (%s): canary error rate %.3f latency %.1fms, stable error rate %.3f latency %.1fms",
+		c.route, reason, canary.ErrorRate, canary.MeanLatencyMs, stable.ErrorRate, stable.MeanLatencyMs)
+
+	if c.cfg.Webhook == "" {
+		return
+	}
+	postWebhook(c.cfg.Webhook, "Canary rollback", map[string]any{
+		"event":  "canary_rollback",
+		"route":  c.route,
+		"reason": reason,
+		"stable": stable,
+		"canary": canary,
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+const (
+	certCheckInterval = time.Hour      // How often certificates are checked for their expiry
+	certWarnRepeat    = 24 * time.Hour // How often a certificate inside the warn window is logged again
+)
+
+// Uses of a loaded certificate, the usage label of the expiry metric
+const (
+	certUsageListener      = "listener"
+	certUsageBackendClient = "backend_client"
+)
+
+// loadedCert is a certificate the balancer serves or presents to backends
+type loadedCert struct {
+	usage  string
+	file   string
+	cert   *x509.Certificate
+	warned time.Time // When a warning inside the warn window was last logged
+}
+
+// certMonitor exports the expiry of the loaded certificates and logs warnings as it nears,
+// once a day inside the warn window and at every check inside the critical one
+type certMonitor struct {
+	cfg     config.CertExpiryConfig
+	metrics *metrics
+
+	mu    sync.Mutex
+	certs []*loadedCert
+}
+
+func newCertMonitor(cfg config.CertExpiryConfig, metrics *metrics) *certMonitor {
+	return &certMonitor{cfg: cfg, metrics: metrics}
+}
+
+// Watches cert, loaded from file for usage. A file loaded for the same usage more than once, such
+// as a client certificate shared by backends, is watched once.
+func (m *certMonitor) add(usage, file string, cert *x509.Certificate) {
+	if cert == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.certs {
+		if c.usage == usage && c.file == file {
+			return
+		}
+	}
+	m.certs = append(m.certs, &loadedCert{usage: usage, file: file, cert: cert})
+	m.metrics.certNotAfter.WithLabelValues(usage, file).Set(float64(cert.NotAfter.Unix()))
+}
+
+// Logs the certificates inside the warn window that are due a warning
+func (m *certMonitor) check(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.certs {
+		remaining := c.cert.NotAfter.Sub(now)
+		attrs := []any{
+			"usage", c.usage,
+			"file", c.file,
+			"subject", c.cert.Subject.CommonName,
+			"not_after", c.cert.NotAfter.UTC().Format(time.RFC3339),
+		}
+		switch {
+		case remaining <= 0:
+			slog.Error("certificate expired", attrs...)
+		case remaining <= m.cfg.CriticalBefore:
+			slog.Error("certificate expires soon", append(attrs, "expires_in", remaining.Truncate(time.Minute))...)
+		case remaining <= m.cfg.WarnBefore && now.Sub(c.warned) >= certWarnRepeat:
+			slog.Warn("certificate expires soon", append(attrs, "expires_in", remaining.Truncate(time.Minute))...)
+			c.warned = now
+		}
+	}
+}
+
+// Builds the TLS client config of a backend, returning its client certificate if it has one
+func backendTLSConfig(cfg *config.BackendTLSConfig) (*tls.Config, *x509.Certificate, error) {
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read tls ca_file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in tls ca_file %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile == "" {
+		return tlsConfig, nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load tls client certificate: %w", err)
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, cert.Leaf, nil
+}
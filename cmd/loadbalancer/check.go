@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// User-Agent of the requests the check command sends
+const checkUserAgent = "loadbalancer-check"
+
+// Durations in the report are rounded to this
+const checkPrecision = 100 * time.Microsecond
+
+// Outcomes of a check
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// checkResult is one line of the check report
+type checkResult struct {
+	name, outcome, detail string
+}
+
+// selfCheck runs the checks of a running instance, as set up by its config
+type selfCheck struct {
+	cfg        *config.Config
+	target     string // Main listener
+	metricsURL string
+	adminURL   string // Empty without an admin API
+	path       string
+	requests   int
+	client     *http.Client
+	results    []checkResult
+}
+
+// Runs the check subcommand, which verifies a running instance after a deploy: that it's ready,
+// answers requests sent through it without a 5xx, serves its metrics and reaches every backend
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	target := flags.String("target", "", "main listener of the instance, e.g. http://localhost:8080")
+	configFile := flags.String("config", configPath, "config the instance runs with")
+	metricsURL := flags.String("metrics", "", "metrics endpoint, default taken from the config and target host")
+	adminURL := flags.String("admin", "", "admin API, default taken from the config and target host")
+	path := flags.String("path", "/", "path requested through the instance and from each backend")
+	requests := flags.Int("requests", 20, "requests sent through the instance")
+	timeout := flags.Duration("timeout", 5*time.Second, "limit of each request")
+	insecure := flags.Bool("insecure", false, "skip verifying the target's TLS certificate")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	targetURL, err := url.Parse(*target)
+	if *target == "" || err != nil || targetURL.Host == "" {
+		fmt.Fprintln(stderr, "check needs -target, the URL of the instance's main listener")
+		return 2
+	}
+	if !strings.HasPrefix(*path, "/") || *requests < 1 {
+		fmt.Fprintln(stderr, "check needs a -path starting with / and at least 1 of -requests")
+		return 2
+	}
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load config: %s\n", describeConfigError(err))
+		return 1
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: *insecure}
+	c := &selfCheck{
+		cfg:        cfg,
+		target:     strings.TrimSuffix(targetURL.String(), "/"),
+		metricsURL: cmp.Or(*metricsURL, defaultMetricsURL(cfg, targetURL)),
+		adminURL:   strings.TrimSuffix(cmp.Or(*adminURL, defaultAdminURL(cfg, targetURL)), "/"),
+		path:       *path,
+		requests:   *requests,
+		client:     &http.Client{Transport: transport, Timeout: *timeout},
+	}
+	c.run()
+	if !c.print(stdout) {
+		return 1
+	}
+	return 0
+}
+
+// Returns where the instance serves metrics: the main listener with metrics.on_main_port, its own
+// port on the target's host otherwise
+func defaultMetricsURL(cfg *config.Config, target *url.URL) string {
+	if cfg.Metrics.OnMainPort {
+		return strings.TrimSuffix(target.String(), "/") + "/metrics"
+	}
+	return "http://" + net.JoinHostPort(target.Hostname(), strconv.Itoa(cfg.Metrics.Port)) + "/metrics"
+}
+
+// Returns the admin API on the target's host, empty if the config doesn't enable it
+func defaultAdminURL(cfg *config.Config, target *url.URL) string {
+	if cfg.Admin.Port == 0 {
+		return ""
+	}
+	return "http://" + net.JoinHostPort(target.Hostname(), strconv.Itoa(cfg.Admin.Port))
+}
+
+func (c *selfCheck) run() {
+	c.checkReady()
+	c.checkTraffic()
+	c.checkMetrics()
+	c.checkBackends()
+}
+
+func (c *selfCheck) add(name, outcome, detail string, args ...any) {
+	c.results = append(c.results, checkResult{name, outcome, fmt.Sprintf(detail, args...)})
+}
+
+// Checks the instance reports ready on its health endpoint
+func (c *selfCheck) checkReady() {
+	if c.cfg.HealthEndpoint.Passthrough {
+		c.add("ready", checkSkip, "health endpoint is passed through to the backends")
+		return
+	}
+	start := time.Now()
+	resp, err := c.client.Get(c.target + c.cfg.HealthEndpoint.Path)
+	if err != nil {
+		c.add("ready", checkFail, "%v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.add("ready", checkFail, "%s answered %d", c.cfg.HealthEndpoint.Path, resp.StatusCode)
+		return
+	}
+	c.add("ready", checkPass, "%s answered 200 in %s", c.cfg.HealthEndpoint.Path, time.Since(start).Round(checkPrecision))
+}
+
+// Sends requests through the instance, marked as synthetic traffic if the config recognises it,
+// and checks none of them fails or gets a 5xx
+func (c *selfCheck) checkTraffic() {
+	var failed int
+	var slowest time.Duration
+	var firstFailure string
+	for range c.requests {
+		req, err := http.NewRequest(http.MethodGet, c.target+c.path, nil)
+		if err != nil {
+			c.add("traffic", checkFail, "%v", err)
+			return
+		}
+		req.Header.Set("User-Agent", checkUserAgent)
+		if header := c.cfg.Synthetic.Header; header != "" {
+			req.Header.Set(header, c.cfg.Synthetic.Value)
+		}
+
+		start := time.Now()
+		resp, err := c.client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				err = fmt.Errorf("got %d", resp.StatusCode)
+			}
+		}
+		slowest = max(slowest, time.Since(start))
+		if err != nil {
+			failed++
+			if firstFailure == "" {
+				firstFailure = err.Error()
+			}
+		}
+	}
+	if failed > 0 {
+		c.add("traffic", checkFail, "%d of %d requests to %s failed, first: %s", failed, c.requests, c.path, firstFailure)
+		return
+	}
+	c.add("traffic", checkPass, "%d requests to %s answered without a 5xx, slowest in %s", c.requests, c.path, slowest.Round(checkPrecision))
+}
+
+// Checks the metrics endpoint serves metrics the balancer exports, including the health of its backends
+func (c *selfCheck) checkMetrics() {
+	req, err := http.NewRequest(http.MethodGet, c.metricsURL, nil)
+	if err != nil {
+		c.add("metrics", checkFail, "%v", err)
+		return
+	}
+	if token := c.cfg.Metrics.BearerToken; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if auth := c.cfg.Metrics.BasicAuth; auth != nil {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.add("metrics", checkFail, "%v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.add("metrics", checkFail, "%s answered %d", c.metricsURL, resp.StatusCode)
+		return
+	}
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		c.add("metrics", checkFail, "unreadable metrics: %v", err)
+		return
+	}
+
+	name := "loadbalancer_backend_healthy"
+	if ns := c.cfg.Metrics.Namespace; ns != "" {
+		name = ns + "_" + name
+	}
+	family, ok := families[name]
+	if !ok {
+		c.add("metrics", checkFail, "%s has no %s, not a load balancer's metrics?", c.metricsURL, name)
+		return
+	}
+	c.add("metrics", checkPass, "%d metric families, health exported for %d backends", len(families), len(family.GetMetric()))
+}
+
+// Requests the path from every backend of the instance through the admin API's replay, which goes
+// out on the backend's own transport with its TLS settings and egress proxy, and checks each
+// answers without a 5xx and passes its health checks
+func (c *selfCheck) checkBackends() {
+	if c.adminURL == "" {
+		c.add("backends", checkSkip, "admin API not enabled, backends can't be checked one by one")
+		return
+	}
+	var backends []backendStatus
+	if err := c.admin(http.MethodGet, "/admin/backends", nil, &backends); err != nil {
+		c.add("backends", checkFail, "listing backends: %v", err)
+		return
+	}
+	if len(backends) == 0 {
+		c.add("backends", checkFail, "the instance has no backends")
+		return
+	}
+	for _, b := range backends {
+		name := "backend " + b.ID
+		var resp replayResponse
+		if err := c.admin(http.MethodPost, "/admin/debug/replay", replayRequest{Backend: b.ID, Path: c.path}, &resp); err != nil {
+			c.add(name, checkFail, "replay: %v", err)
+			continue
+		}
+		took := time.Duration(resp.Timing.TotalMs * float64(time.Millisecond)).Round(checkPrecision)
+		switch {
+		case resp.Error != "":
+			c.add(name, checkFail, "unreachable: %s", resp.Error)
+		case resp.Status >= 500:
+			c.add(name, checkFail, "%s answered %d", c.path, resp.Status)
+		case !b.Healthy:
+			c.add(name, checkFail, "answered %d in %s but fails health checks", resp.Status, took)
+		default:
+			c.add(name, checkPass, "answered %d in %s, %s", resp.Status, took, b.State)
+		}
+	}
+}
+
+// Calls the admin API with the config's credentials, decoding its JSON answer into out
+func (c *selfCheck) admin(method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.adminURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", checkUserAgent)
+	setAdminAuth(req, c.cfg.Admin)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API answered %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Prints the report, returning whether every check passed or was skipped
+func (c *selfCheck) print(w io.Writer) bool {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	var failed int
+	for _, r := range c.results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.name, strings.ToUpper(r.outcome), r.detail)
+		if r.outcome == checkFail {
+			failed++
+		}
+	}
+	tw.Flush()
+	if failed > 0 {
+		fmt.Fprintf(w, "\nFAIL: %d of %d checks failed\n", failed, len(c.results))
+		return false
+	}
+	fmt.Fprintf(w, "\nPASS: %d checks\n", len(c.results))
+	return true
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Header carrying the version of the document a cluster leader rolls out, which the peer
+// reports back on GET /admin/cluster once it applied it
+const configVersionHeader = "X-Config-Version"
+
+// How long a peer holds a staged document for the leader to commit. One neither committed nor
+// aborted by then is dropped, so a leader that went away mid-rollout can't switch to it later.
+const stagedConfigTTL = time.Minute
+
+// cluster keeps a group of instances on the same config document. Every instance takes the first
+// reachable peer as leader, and only the leader pulls the remote document and rolls it out. A
+// partition can briefly leave two leaders, but applying a document is idempotent and both pull it
+// from the same source, so the peers still converge.
+//
+// A rollout is a two-phase commit. Every peer first checks the document and stages it without
+// applying it; only once all of them have staged it does the leader tell each to commit, which
+// switches it over, and if any refuses the others are told to abort. A peer can then only be left
+// behind by becoming unreachable between the two phases: the leader reports it and, as documents
+// are versioned by their content hash and every peer reports the version it runs, rolls the
+// document out to it again on the next poll, like to peers that restarted or were changed by hand.
+type cluster struct {
+	lb     *balancer
+	cfg    config.ClusterConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	leader  string
+	version string        // Version of the document this instance last applied from a leader
+	staged  *stagedConfig // Document prepared for a commit, nil if none
+	synced  time.Time     // When this instance last rolled out a document as leader
+}
+
+// stagedConfig is a document a peer checked in the prepare phase of a rollout
+type stagedConfig struct {
+	version string
+	desired *config.Config
+	expires time.Time
+}
+
+// clusterStatus is the response of GET /admin/cluster, which peers also use to check each other
+type clusterStatus struct {
+	Enabled  bool      `json:"enabled"`
+	Self     string    `json:"self,omitempty"`
+	Leader   string    `json:"leader,omitempty"`
+	Peers    []string  `json:"peers,omitempty"`
+	Version  string    `json:"version,omitempty"`  // Document version applied, empty if none or changed since
+	Staged   string    `json:"staged,omitempty"`   // Document version prepared and waiting for the leader's commit
+	SyncedAt time.Time `json:"synced_at,omitzero"` // Last rollout, only set on the leader
+}
+
+func newCluster(lb *balancer, cfg config.ClusterConfig) *cluster {
+	return &cluster{lb: lb, cfg: cfg, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// Elects a leader and, if this instance is it, syncs the config. Run every poll interval.
+func (c *cluster) tick(ctx context.Context) error {
+	leader := c.elect(ctx)
+	c.mu.Lock()
+	if leader != c.leader {
+		log.Printf("Cluster leader is now %s", leader)
+		c.leader = leader
+	}
+	c.mu.Unlock()
+
+	if leader != c.cfg.Self {
+		return nil
+	}
+	if err := c.sync(ctx); err != nil {
+		return fmt.Errorf("cluster config sync failed: %w", err)
+	}
+	return nil
+}
+
+// Returns the first peer in list order that answers, counting this instance as always reachable
+func (c *cluster) elect(ctx context.Context) string {
+	for _, peer := range c.cfg.Peers {
+		if peer == c.cfg.Self || c.reachable(ctx, peer) {
+			return peer
+		}
+	}
+	return c.cfg.Self
+}
+
+func (c *cluster) reachable(ctx context.Context, peer string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/admin/cluster", nil)
+	if err != nil {
+		return false
+	}
+	setAdminAuth(req, c.lb.currentConfig().Admin)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// Pulls the remote document and rolls it out to the peers not running its version: it is staged
+// on all of them before any of them applies it. A peer that fails the commit keeps its old
+// version and gets the document again on the next poll.
+func (c *cluster) sync(ctx context.Context) error {
+	data, err := c.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := config.Parse(data); err != nil {
+		return fmt.Errorf("remote config is invalid: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	version := hex.EncodeToString(sum[:])
+
+	var stale []string
+	for _, peer := range c.cfg.Peers {
+		if c.peerVersion(ctx, peer) != version {
+			stale = append(stale, peer)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	var prepared []string
+	for _, peer := range stale {
+		if err := c.send(ctx, peer, "prepare", data, version); err != nil {
+			c.abort(ctx, prepared, version)
+			return fmt.Errorf("peer %s rejected config, aborted the rollout: %w", peer, err)
+		}
+		prepared = append(prepared, peer)
+	}
+	var failed []string
+	for _, peer := range stale {
+		if err := c.send(ctx, peer, "commit", nil, version); err != nil {
+			log.Printf("Cluster peer %s failed to commit config: %v", peer, err)
+			failed = append(failed, peer)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d peers failed to commit config and keep their old one until the next poll: %v", len(failed), len(stale), failed)
+	}
+
+	c.mu.Lock()
+	c.synced = time.Now()
+	c.mu.Unlock()
+	log.Printf("Cluster config %s rolled out to %d peers", version[:12], len(stale))
+	return nil
+}
+
+// Returns the document version a peer runs, empty if it can't tell, which counts as stale
+func (c *cluster) peerVersion(ctx context.Context, peer string) string {
+	if peer == c.cfg.Self {
+		return c.status().Version
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/admin/cluster", nil)
+	if err != nil {
+		return ""
+	}
+	setAdminAuth(req, c.lb.currentConfig().Admin)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	var status clusterStatus
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&status) != nil {
+		return ""
+	}
+	return status.Version
+}
+
+// Records the document version this instance now runs, empty once it runs a document that
+// didn't come from a leader
+func (c *cluster) setVersion(version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version = version
+}
+
+func (c *cluster) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.ConfigURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config request: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch remote config: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch remote config: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote config: %w", err)
+	}
+	if len(data) > maxConfigBytes {
+		return nil, fmt.Errorf("remote config is larger than %d bytes", maxConfigBytes)
+	}
+	return data, nil
+}
+
+// Tells the peers that staged a document to drop it, after another one refused it
+func (c *cluster) abort(ctx context.Context, peers []string, version string) {
+	for _, peer := range peers {
+		if err := c.send(ctx, peer, "abort", nil, version); err != nil {
+			log.Printf("Cluster peer %s failed to abort config, it drops it within %s: %v", peer, stagedConfigTTL, err)
+		}
+	}
+}
+
+// POSTs a phase of a rollout to a peer's admin API: prepare with the document, commit or abort
+func (c *cluster) send(ctx context.Context, peer, phase string, data []byte, version string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/admin/cluster/"+phase, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create %s request: %w", phase, err)
+	}
+	req.Header.Set(configVersionHeader, version)
+	setAdminAuth(req, c.lb.currentConfig().Admin)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %w", phase, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	var result struct {
+		Error   string   `json:"error"`
+		Restart []string `json:"restart"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	switch {
+	case len(result.Restart) > 0:
+		return fmt.Errorf("changes need a restart: %v", result.Restart)
+	case result.Error != "":
+		return fmt.Errorf("status %d: %s", resp.StatusCode, result.Error)
+	default:
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func (c *cluster) status() clusterStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := clusterStatus{Enabled: true, Self: c.cfg.Self, Leader: c.leader, Peers: c.cfg.Peers, Version: c.version}
+	if c.staged != nil && time.Now().Before(c.staged.expires) {
+		status.Staged = c.staged.version
+	}
+	if c.leader == c.cfg.Self {
+		status.SyncedAt = c.synced
+	}
+	return status
+}
+
+func (lb *balancer) handleClusterStatus(w http.ResponseWriter, _ *http.Request) {
+	if lb.cluster == nil {
+		writeJSON(w, http.StatusOK, clusterStatus{})
+		return
+	}
+	writeJSON(w, http.StatusOK, lb.cluster.status())
+}
+
+// Holds desired as the document of version until it is committed, aborted or expires
+func (c *cluster) stage(version string, desired *config.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.staged = &stagedConfig{version: version, desired: desired, expires: time.Now().Add(stagedConfigTTL)}
+}
+
+// Returns the staged document of version and drops it, nil if a document of that version isn't
+// staged or it expired
+func (c *cluster) unstage(version string) *config.Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	staged := c.staged
+	if staged == nil || staged.version != version {
+		return nil
+	}
+	c.staged = nil
+	if time.Now().After(staged.expires) {
+		return nil
+	}
+	return staged.desired
+}
+
+// Checks the document like PUT /admin/config?dry_run=true, then stages it for a commit of the
+// version in the X-Config-Version header
+func (lb *balancer) handleClusterPrepare(w http.ResponseWriter, r *http.Request) {
+	version, ok := clusterVersion(w, r, lb.cluster)
+	if !ok {
+		return
+	}
+	_, desired, ok := lb.readDesiredConfig(w, r)
+	if !ok {
+		return
+	}
+	resp := lb.diffDesired(desired)
+	if len(resp.Restart) > 0 {
+		writeJSON(w, http.StatusConflict, resp)
+		return
+	}
+	lb.cluster.stage(version, desired)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Applies the document staged for the version in the X-Config-Version header
+func (lb *balancer) handleClusterCommit(w http.ResponseWriter, r *http.Request) {
+	version, ok := clusterVersion(w, r, lb.cluster)
+	if !ok {
+		return
+	}
+	desired := lb.cluster.unstage(version)
+	if desired == nil {
+		writeAdminError(w, http.StatusConflict, fmt.Sprintf("no config of version %s is staged", version))
+		return
+	}
+	// The running config may have been changed by hand since the prepare
+	resp := lb.diffDesired(desired)
+	if len(resp.Restart) > 0 {
+		writeJSON(w, http.StatusConflict, resp)
+		return
+	}
+	lb.applyConfig(desired, resp.Changes)
+	lb.cluster.setVersion(version)
+	resp.Applied = true
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Drops the document staged for the version in the X-Config-Version header, if it still is
+func (lb *balancer) handleClusterAbort(w http.ResponseWriter, r *http.Request) {
+	version, ok := clusterVersion(w, r, lb.cluster)
+	if !ok {
+		return
+	}
+	lb.cluster.unstage(version)
+	writeJSON(w, http.StatusOK, lb.cluster.status())
+}
+
+// Returns the document version a rollout phase is for, answering the request itself if clustering
+// is off or the header is missing
+func clusterVersion(w http.ResponseWriter, r *http.Request, c *cluster) (string, bool) {
+	if c == nil {
+		writeAdminError(w, http.StatusConflict, "clustering is off, cluster.config_url enables it")
+		return "", false
+	}
+	version := r.Header.Get(configVersionHeader)
+	if version == "" {
+		writeAdminError(w, http.StatusBadRequest, configVersionHeader+" header is required")
+		return "", false
+	}
+	return version, true
+}
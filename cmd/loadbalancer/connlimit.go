@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/clock"
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// connLimiter caps the accept rate and the number of open client connections, shared by every
+// listener so a flood on one port can't exhaust the process either
+type connLimiter struct {
+	maxConns int64
+	open     atomic.Int64
+
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second, 0 = no rate limit
+	burst  float64
+	tokens float64
+	last   time.Time
+	clock  clock.Clock
+
+	metrics *metrics
+}
+
+// Returns nil when neither limit is configured
+func newConnLimiter(cfg config.ServerConfig, m *metrics) *connLimiter {
+	if cfg.MaxConns == 0 && cfg.AcceptRate == 0 {
+		return nil
+	}
+	burst := float64(max(cfg.AcceptBurst, 1))
+	return &connLimiter{
+		maxConns: int64(cfg.MaxConns),
+		rate:     cfg.AcceptRate,
+		burst:    burst,
+		tokens:   burst,
+		last:     clock.Real.Now(),
+		clock:    clock.Real,
+		metrics:  m,
+	}
+}
+
+// Makes the accept rate go by clk (for testing), starting with a full burst
+func (c *connLimiter) setClock(clk clock.Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clk
+	c.last = clk.Now()
+	c.tokens = c.burst
+}
+
+// Reports whether a new connection may be accepted under the rate, using up a token if so
+func (c *connLimiter) allowRate() bool {
+	if c.rate == 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	c.tokens = min(c.burst, c.tokens+now.Sub(c.last).Seconds()*c.rate)
+	c.last = now
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// Takes a connection slot, reporting false if all are in use
+func (c *connLimiter) acquire() bool {
+	if c.maxConns == 0 {
+		c.open.Add(1)
+		return true
+	}
+	for {
+		open := c.open.Load()
+		if open >= c.maxConns {
+			return false
+		}
+		if c.open.CompareAndSwap(open, open+1) {
+			return true
+		}
+	}
+}
+
+func (c *connLimiter) release() {
+	c.open.Add(-1)
+}
+
+// limitListener closes connections over the limits as soon as they are accepted
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.limiter.allowRate() {
+			l.limiter.metrics.rejectedConnections.WithLabelValues("rate").Inc()
+			conn.Close()
+			continue
+		}
+		if !l.limiter.acquire() {
+			l.limiter.metrics.rejectedConnections.WithLabelValues("max_conns").Inc()
+			conn.Close()
+			continue
+		}
+		l.limiter.metrics.clientConnections.Set(float64(l.limiter.open.Load()))
+		return &limitConn{Conn: conn, limiter: l.limiter}, nil
+	}
+}
+
+// limitConn gives its slot back when closed
+type limitConn struct {
+	net.Conn
+	limiter *connLimiter
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(func() {
+		c.limiter.release()
+		c.limiter.metrics.clientConnections.Set(float64(c.limiter.open.Load()))
+	})
+	return c.Conn.Close()
+}
+
+// Half-closes the connection for the raw TCP proxy
+func (c *limitConn) CloseWrite() error {
+	if tcpConn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return tcpConn.CloseWrite()
+	}
+	return c.Close()
+}
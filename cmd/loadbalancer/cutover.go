@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Label identifying which pool (e.g. blue or green) a backend belongs to
+const poolLabel = config.PoolLabel
+
+// cutoverRequest is the body of POST /admin/routes/{name}/cutover
+type cutoverRequest struct {
+	Pool         string  `json:"pool"`           // Pool to move all of the route's traffic to
+	Watch        string  `json:"watch"`          // How long to watch the new pool before committing, default 30s
+	MaxErrorRate float64 `json:"max_error_rate"` // 5xx rate above which the cutover is rolled back, default 0.05
+	MinRequests  uint64  `json:"min_requests"`   // Requests needed before the error rate is trusted, default 10
+}
+
+// cutoverResult is the response of a cutover
+type cutoverResult struct {
+	Route     string            `json:"route"`
+	From      map[string]string `json:"from"`
+	To        map[string]string `json:"to"`
+	Status    string            `json:"status"` // "completed" or "rolled_back"
+	Requests  uint64            `json:"requests"`
+	Errors    uint64            `json:"errors"`
+	ErrorRate float64           `json:"error_rate"`
+}
+
+// Shifts a route from its current pool to another once all of the new pool's backends are healthy.
+// The request blocks for the watch window and rolls back if the new pool's error rate is too high.
+func (lb *balancer) handleCutover(w http.ResponseWriter, r *http.Request) {
+	rt := lb.route(r.PathValue("name"))
+	if rt == nil {
+		writeAdminError(w, http.StatusNotFound, "route not found")
+		return
+	}
+
+	var req cutoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if req.Pool == "" {
+		writeAdminError(w, http.StatusBadRequest, "pool is required")
+		return
+	}
+	watch := 30 * time.Second
+	if req.Watch != "" {
+		var err error
+		if watch, err = time.ParseDuration(req.Watch); err != nil || watch <= 0 {
+			writeAdminError(w, http.StatusBadRequest, "watch must be a positive duration")
+			return
+		}
+	}
+	if req.MaxErrorRate == 0 {
+		req.MaxErrorRate = 0.05
+	}
+	if req.MinRequests == 0 {
+		req.MinRequests = 10
+	}
+
+	if !rt.cutoverActive.CompareAndSwap(false, true) {
+		writeAdminError(w, http.StatusConflict, "a cutover is already in progress for this route")
+		return
+	}
+	defer rt.cutoverActive.Store(false)
+
+	from := rt.currentSelector()
+	to := maps.Clone(from)
+	if to == nil {
+		to = make(map[string]string)
+	}
+	to[poolLabel] = req.Pool
+
+	target := selectByLabels(rt.pool, to)
+	if len(target) == 0 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("pool %q has no backends for this route", req.Pool))
+		return
+	}
+	for _, b := range target {
+		if !lb.available(b) {
+			writeAdminError(w, http.StatusConflict, fmt.Sprintf("backend %s in pool %q is not healthy", b.cfg.URL, req.Pool))
+			return
+		}
+	}
+	previous := rt.currentBackends()
+
+	lb.setRouteSelector(rt, to, target)
+	log.Printf("Cutover of route %s to pool %s, watching for %s", rt.name, req.Pool, watch)
+
+	result := cutoverResult{Route: rt.name, From: from, To: to, Status: "completed"}
+	result.Requests, result.Errors = rt.watchErrors(r.Context().Done(), watch, req.MinRequests, req.MaxErrorRate)
+	if result.Requests > 0 {
+		result.ErrorRate = float64(result.Errors) / float64(result.Requests)
+	}
+
+	if result.Requests >= req.MinRequests && result.ErrorRate > req.MaxErrorRate {
+		lb.setRouteSelector(rt, from, previous)
+		result.Status = "rolled_back"
+		log.Printf("Rolled back cutover of route %s: error rate %.3f exceeds %.3f", rt.name, result.ErrorRate, req.MaxErrorRate)
+	} else {
+		log.Printf("Cutover of route %s to pool %s completed", rt.name, req.Pool)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Counts the route's requests and 5xx errors for the given window, returning early once
+// enough requests have been seen to show the error rate is over the limit
+func (rt *route) watchErrors(cancel <-chan struct{}, window time.Duration, minRequests uint64, maxErrorRate float64) (requests, errors uint64) {
+	startRequests, startErrors := rt.requests.Load(), rt.errors.Load()
+	deadline := time.After(window)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		requests, errors = rt.requests.Load()-startRequests, rt.errors.Load()-startErrors
+		if requests >= minRequests && float64(errors)/float64(requests) > maxErrorRate {
+			return requests, errors
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return rt.requests.Load() - startRequests, rt.errors.Load() - startErrors
+		case <-cancel:
+			return rt.requests.Load() - startRequests, rt.errors.Load() - startErrors
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+const (
+	latencyWindowSize = 256         // Recent attempt durations kept per backend
+	latencyCacheFor   = time.Second // How long a computed p95 is reused before the samples are sorted again
+)
+
+// latencyWindow keeps the durations of a backend's most recent attempts
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencyWindowSize]latencyRecord
+	next    int // Where the next sample goes, the oldest one once the ring is full
+	count   int
+
+	cachedAt time.Time // When p95 and recent were last computed, zero before the first time
+	p95      time.Duration
+	recent   int
+}
+
+type latencyRecord struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// Records an attempt that ended at now
+func (w *latencyWindow) record(now time.Time, duration time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = latencyRecord{at: now, duration: duration}
+	w.next = (w.next + 1) % latencyWindowSize
+	w.count = min(w.count+1, latencyWindowSize)
+}
+
+// Returns the p95 of the attempts that ended within window before now, and how many there were
+func (w *latencyWindow) p95Within(now time.Time, window time.Duration) (time.Duration, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.cachedAt.IsZero() && now.Sub(w.cachedAt) < latencyCacheFor {
+		return w.p95, w.recent
+	}
+	durations := make([]time.Duration, 0, w.count)
+	for _, sample := range w.samples[:w.count] {
+		if now.Sub(sample.at) <= window {
+			durations = append(durations, sample.duration)
+		}
+	}
+	w.cachedAt, w.p95, w.recent = now, percentile(durations, 0.95), len(durations)
+	return w.p95, w.recent
+}
+
+// Appends the durations of the attempts that ended within window before now to dst
+func (w *latencyWindow) appendWithin(dst []time.Duration, now time.Time, window time.Duration) []time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, sample := range w.samples[:w.count] {
+		if now.Sub(sample.at) <= window {
+			dst = append(dst, sample.duration)
+		}
+	}
+	return dst
+}
+
+// deadlineSelector steers requests with little time left away from backends that are recently slow
+type deadlineSelector struct {
+	cfg config.DeadlineConfig
+}
+
+func newDeadlineSelector(cfg config.DeadlineConfig) *deadlineSelector {
+	return &deadlineSelector{cfg: cfg}
+}
+
+// Returns the time a request has in total, from its header, the configured budget or its context
+// deadline, whichever is shortest. Reports false for requests without any.
+func (d *deadlineSelector) budget(r *http.Request, start time.Time) (time.Duration, bool) {
+	var budget time.Duration
+	if value := r.Header.Get(d.cfg.Header); d.cfg.Header != "" && value != "" {
+		budget = parseBudget(value)
+	}
+	if budget <= 0 {
+		budget = d.cfg.Budget
+	}
+	if deadline, ok := r.Context().Deadline(); ok && (budget <= 0 || deadline.Sub(start) < budget) {
+		budget = deadline.Sub(start)
+	}
+	return budget, budget > 0
+}
+
+// Parses a budget header value, whole milliseconds or a duration like 250ms. Returns 0 if invalid.
+func parseBudget(value string) time.Duration {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond
+	}
+	budget, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return budget
+}
+
+// Returns tried along with the backends whose recent p95 exceeds remaining, as the exclusions for
+// the next pick. Slow backends aren't excluded if that would leave no selectable backend, a slow
+// answer still beats none.
+func (d *deadlineSelector) exclude(route string, backends []*backend, tried map[int]bool, remaining time.Duration, healthChecker healthView, now time.Time) map[int]bool {
+	var slow []int
+	fastLeft := false
+	for idx, b := range backends {
+		if tried[idx] || !healthChecker.IsHealthy(b.idx) || b.breaker.IsOpen() || b.drained.Load() || b.warmup.warming.Load() {
+			continue
+		}
+		if p95, n := b.latency.p95Within(now, d.cfg.Window); n >= d.cfg.MinSamples && p95 > remaining {
+			slow = append(slow, idx)
+		} else {
+			fastLeft = true
+		}
+	}
+	if len(slow) == 0 || !fastLeft {
+		return tried
+	}
+
+	exclude := make(map[int]bool, len(tried)+len(slow))
+	for idx := range tried {
+		exclude[idx] = true
+	}
+	for _, idx := range slow {
+		exclude[idx] = true
+		backends[idx].metrics.deadlineSkips.WithLabelValues(route, backends[idx].cfg.URL).Inc()
+	}
+	return exclude
+}
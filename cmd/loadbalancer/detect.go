@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// How long a new connection may stay silent before it is treated as raw TCP, for protocols
+// where the server speaks first
+const detectTimeout = time.Second
+
+// Time a TLS client detected has to complete its handshake
+const detectHandshakeTimeout = 10 * time.Second
+
+// detectListener sorts incoming connections by their first bytes. HTTP and TLS connections are
+// returned from Accept for the HTTP server, raw TCP is handed to the TCP proxy.
+type detectListener struct {
+	net.Listener
+	tlsConfig *tls.Config  // nil when TLS isn't configured
+	tcp       *tcpProxy    // nil when raw TCP isn't forwarded
+	stats     *listenerSet // Counts the TLS handshakes, nil for none
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newDetectListener(inner net.Listener, tlsConfig *tls.Config, tcp *tcpProxy, stats *listenerSet) *detectListener {
+	l := &detectListener{
+		Listener:  inner,
+		tlsConfig: tlsConfig,
+		tcp:       tcp,
+		stats:     stats,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *detectListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+		// Detection waits on the client, so it mustn't hold up the accept loop
+		go l.dispatch(conn)
+	}
+}
+
+func (l *detectListener) dispatch(conn net.Conn) {
+	peeked := &peekedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetReadDeadline(time.Now().Add(detectTimeout))
+	kind := detectProtocol(peeked.reader)
+	conn.SetReadDeadline(time.Time{})
+
+	var httpConn net.Conn
+	switch {
+	case kind == "tls" && l.tlsConfig != nil:
+		tlsConn := tls.Server(peeked, l.tlsConfig)
+		if !l.handshake(tlsConn) {
+			conn.Close()
+			return
+		}
+		httpConn = tlsConn
+	case kind == "http":
+		httpConn = peeked
+	case kind == "tcp" && l.tcp != nil:
+		l.tcp.serve(peeked)
+		return
+	default:
+		log.Printf("Closing %s connection from %s, nothing is configured to serve it", kind, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- httpConn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Completes the TLS handshake of a detected connection, counting it against its listener, and
+// returns whether it succeeded
+func (l *detectListener) handshake(conn *tls.Conn) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), detectHandshakeTimeout)
+	defer cancel()
+	err := conn.HandshakeContext(ctx)
+	if l.stats != nil {
+		if stats := l.stats.forAddr(conn.LocalAddr()); stats != nil {
+			l.stats.recordHandshake(stats, err == nil)
+		}
+	}
+	return err == nil
+}
+
+// Returns "tls", "http" or "tcp" from the first bytes of a connection. HTTP is told by a request
+// line of any method, the HTTP/2 connection preface included, read as far as its version.
+func detectProtocol(r *bufio.Reader) string {
+	first, err := r.Peek(1)
+	if err != nil {
+		return "tcp"
+	}
+	// TLS records start with the handshake content type
+	if first[0] == 0x16 {
+		return "tls"
+	}
+
+	// Waits for more bytes only while what arrived can still start a request line
+	for {
+		buffered, _ := r.Peek(r.Buffered())
+		if kind := requestLineKind(buffered); kind != "" {
+			return kind
+		}
+		if _, err := r.Peek(len(buffered) + 1); err != nil {
+			// A request target filling the whole buffer is as far as it can be read
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return "http"
+			}
+			return "tcp"
+		}
+	}
+}
+
+// Returns "http" if b starts with a request line up to its HTTP version, "tcp" if it can't be the
+// start of one, and "" if it can but is too short to tell
+func requestLineKind(b []byte) string {
+	method := bytes.IndexByte(b, ' ')
+	if method < 0 {
+		method = len(b)
+	}
+	if method == 0 || !isToken(b[:method]) {
+		return "tcp"
+	}
+	if method == len(b) {
+		return ""
+	}
+
+	rest := b[method+1:]
+	target := bytes.IndexByte(rest, ' ')
+	if target < 0 {
+		target = len(rest)
+	}
+	if bytes.ContainsFunc(rest[:target], unicode.IsControl) {
+		return "tcp"
+	}
+	if target == len(rest) {
+		return ""
+	}
+	if target == 0 {
+		return "tcp"
+	}
+
+	// HTTP/ followed by a digit, a dot and a digit
+	version := rest[target+1:]
+	const pattern = "HTTP/0.0"
+	for i, c := range version[:min(len(version), len(pattern))] {
+		want := pattern[i]
+		if want == '0' && '0' <= c && c <= '9' || c == want && want != '0' {
+			continue
+		}
+		return "tcp"
+	}
+	if len(version) < len(pattern) {
+		return ""
+	}
+	return "http"
+}
+
+// Reports whether b is an HTTP token, RFC 9110 section 5.6.2
+func isToken(b []byte) bool {
+	for _, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *detectListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *detectListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// peekedConn replays the bytes read during detection before reading from the connection
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Passes half-closes through to TCP connections for the TCP proxy
+func (c *peekedConn) CloseWrite() error {
+	if tcpConn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return tcpConn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// DNS wire format values, RFC 1035
+const (
+	dnsHeaderLen = 12
+	dnsMaxUDPLen = 512 // Without EDNS, longer answers are truncated
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+	dnsClassANY = 255
+
+	dnsFlagResponse      = 1 << 15
+	dnsFlagAuthoritative = 1 << 10
+	dnsFlagTruncated     = 1 << 9
+	dnsFlagRecursion     = 1 << 8
+
+	dnsRcodeOK       = 0
+	dnsRcodeFormat   = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImpl  = 4
+	dnsRcodeRefused  = 5
+)
+
+var dnsRcodeNames = map[int]string{
+	dnsRcodeOK:       "NOERROR",
+	dnsRcodeFormat:   "FORMERR",
+	dnsRcodeNXDomain: "NXDOMAIN",
+	dnsRcodeNotImpl:  "NOTIMP",
+	dnsRcodeRefused:  "REFUSED",
+}
+
+// dnsServer answers queries for the configured names with the addresses of healthy nodes
+type dnsServer struct {
+	lb       *balancer
+	cfg      config.DNSConfig
+	records  map[string][]config.DNSNodeConfig // By lower case name without the trailing dot
+	backends map[string]*backend               // By ID
+}
+
+func newDNSServer(lb *balancer, cfg config.DNSConfig) *dnsServer {
+	d := &dnsServer{
+		lb:       lb,
+		cfg:      cfg,
+		records:  make(map[string][]config.DNSNodeConfig),
+		backends: make(map[string]*backend),
+	}
+	for _, record := range cfg.Records {
+		d.records[dnsName(record.Name)] = record.Nodes
+	}
+	for _, b := range lb.pool {
+		d.backends[b.cfg.ID] = b
+	}
+	return d
+}
+
+// Answers queries arriving on conn until it is closed
+func (d *dnsServer) serve(conn net.PacketConn) {
+	buf := make([]byte, dnsMaxUDPLen)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("DNS read failed: %v", err)
+			continue
+		}
+		if resp := d.answer(buf[:n]); resp != nil {
+			if _, err := conn.WriteTo(resp, addr); err != nil {
+				log.Printf("DNS reply to %s failed: %v", addr, err)
+			}
+		}
+	}
+}
+
+// Builds the response to a query, nil for messages that get no response at all
+func (d *dnsServer) answer(query []byte) []byte {
+	if len(query) < dnsHeaderLen {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&dnsFlagResponse != 0 {
+		return nil
+	}
+	opcode := flags >> 11 & 0xf
+
+	resp := make([]byte, dnsHeaderLen, dnsMaxUDPLen)
+	copy(resp, query[:2])
+	var truncated uint16
+	reply := func(rcode int) []byte {
+		binary.BigEndian.PutUint16(resp[2:], dnsFlagResponse|opcode<<11|dnsFlagAuthoritative|flags&dnsFlagRecursion|truncated|uint16(rcode))
+		d.lb.metrics.dnsQueries.WithLabelValues(dnsRcodeNames[rcode]).Inc()
+		return resp
+	}
+	if opcode != 0 {
+		return reply(dnsRcodeNotImpl)
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		return reply(dnsRcodeFormat)
+	}
+	name, end, ok := parseDNSName(query, dnsHeaderLen)
+	if !ok || len(query) < end+4 {
+		return reply(dnsRcodeFormat)
+	}
+	qtype, qclass := binary.BigEndian.Uint16(query[end:]), binary.BigEndian.Uint16(query[end+2:])
+
+	// The question is echoed back and answers point at its name
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, query[dnsHeaderLen:end+4]...)
+
+	nodes, ok := d.records[name]
+	if !ok {
+		return reply(dnsRcodeNXDomain)
+	}
+	if qclass != dnsClassIN && qclass != dnsClassANY {
+		return reply(dnsRcodeRefused)
+	}
+
+	var answers uint16
+	for _, ip := range d.addresses(nodes, qtype) {
+		rrType, rdata := uint16(dnsTypeA), ip.To4()
+		if rdata == nil {
+			rrType, rdata = dnsTypeAAAA, ip.To16()
+		}
+		if len(resp)+12+len(rdata) > dnsMaxUDPLen {
+			truncated = dnsFlagTruncated
+			break
+		}
+		resp = append(resp, 0xc0, dnsHeaderLen) // Pointer to the question's name
+		resp = binary.BigEndian.AppendUint16(resp, rrType)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, uint32(d.cfg.TTL.Seconds()))
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+		resp = append(resp, rdata...)
+		answers++
+	}
+	binary.BigEndian.PutUint16(resp[6:], answers)
+	return reply(dnsRcodeOK)
+}
+
+// Returns the addresses of the query type to answer with, healthy nodes in a weighted random
+// order. If none of the nodes is healthy all of them are returned, as the checks may be wrong.
+func (d *dnsServer) addresses(nodes []config.DNSNodeConfig, qtype uint16) []net.IP {
+	if qtype != dnsTypeA && qtype != dnsTypeAAAA && qtype != dnsTypeANY {
+		return nil
+	}
+	var candidates, healthy []config.DNSNodeConfig
+	for _, node := range nodes {
+		isV4 := net.ParseIP(node.Address).To4() != nil
+		if (qtype == dnsTypeA && !isV4) || (qtype == dnsTypeAAAA && isV4) {
+			continue
+		}
+		candidates = append(candidates, node)
+		if b := d.backends[node.Backend]; b == nil || d.lb.healthChecker.IsHealthy(b.idx) {
+			healthy = append(healthy, node)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = candidates
+	}
+
+	// Weighted shuffle: each position is drawn from the remaining nodes by weight
+	var ips []net.IP
+	for len(healthy) > 0 && (d.cfg.Answers == 0 || len(ips) < d.cfg.Answers) {
+		total := 0
+		for _, node := range healthy {
+			total += node.Weight
+		}
+		pick, i := rand.IntN(total), 0
+		for ; pick >= healthy[i].Weight; i++ {
+			pick -= healthy[i].Weight
+		}
+		ips = append(ips, net.ParseIP(healthy[i].Address))
+		healthy = append(healthy[:i:i], healthy[i+1:]...)
+	}
+	return ips
+}
+
+// Reads an uncompressed name starting at off, returning it in lower case and the offset after it
+func parseDNSName(msg []byte, off int) (name string, end int, ok bool) {
+	var labels []string
+	length := 0
+	for {
+		if off >= len(msg) {
+			return "", 0, false
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		// Queries have nothing earlier to point at, so compressed labels aren't valid here
+		if n&0xc0 != 0 || off+n > len(msg) {
+			return "", 0, false
+		}
+		if length += n + 1; length > 255 {
+			return "", 0, false
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	return dnsName(strings.Join(labels, ".")), off, true
+}
+
+func dnsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
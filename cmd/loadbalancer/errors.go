@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// errorResponse is the JSON body of errors generated by the load balancer itself
+type errorResponse struct {
+	Error     string `json:"error"`             // Machine-readable error code e.g. "gateway_timeout"
+	Message   string `json:"message"`           // Human-readable status text
+	Status    int    `json:"status"`            // HTTP status code
+	RequestID string `json:"request_id"`        // Same as the X-Request-ID response header
+	Backend   string `json:"backend,omitempty"` // Backend that was attempted, if any
+}
+
+// Template for errors shown to browsers, nil = plain text. Executed with an errorResponse.
+var errorPage *template.Template
+
+// Parses the configured error page template, an empty path keeps plain text errors
+func loadErrorPage(path string) error {
+	if path == "" {
+		return nil
+	}
+	page, err := template.ParseFiles(path)
+	if err != nil {
+		return fmt.Errorf("failed to parse error page %s: %w", path, err)
+	}
+	errorPage = page
+	return nil
+}
+
+// Writes an error generated by the load balancer, as JSON if the client accepts it, the error page
+// for browsers, or plain text otherwise
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, backendURL string) {
+	body := errorResponse{
+		Error:     code,
+		Message:   http.StatusText(status),
+		Status:    status,
+		RequestID: r.Header.Get(requestIDHeader),
+		Backend:   backendURL,
+	}
+
+	switch {
+	case accepts(r, isJSON):
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	case errorPage != nil && accepts(r, isHTML):
+		// Rendered up front so a template error can still fall back to plain text
+		var page bytes.Buffer
+		if err := errorPage.Execute(&page, body); err != nil {
+			log.Printf("Failed to render error page: %v", err)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		w.Write(page.Bytes())
+	default:
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// Reports whether the Accept header lists a media type matching the predicate. Types with q=0
+// are ones the client doesn't accept.
+func accepts(r *http.Request, match func(mediaType string) bool) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if weight, err := strconv.ParseFloat(q, 64); err != nil || weight <= 0 {
+				continue
+			}
+		}
+		if match(mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func isHTML(mediaType string) bool {
+	return mediaType == "text/html"
+}
+
+// Makes sure the request carries an ID, generating one if the client didn't send it, and returns it
+func ensureRequestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	r.Header.Set(requestIDHeader, id)
+	return id
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// failedRequest is a journaled request that ended in a 5xx or had an attempt fail
+type failedRequest struct {
+	Time       time.Time         `json:"time"`
+	RequestID  string            `json:"request_id"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Route      string            `json:"route"`
+	Headers    map[string]string `json:"headers,omitempty"` // Only the configured request headers
+	Status     int               `json:"status"`
+	Attempts   []attemptTrace    `json:"attempts"`
+	DurationMs float64           `json:"duration_ms"`
+}
+
+// Request headers carrying credentials, journaled as REDACTED so only their presence shows
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// failureJournal keeps the last failed requests
+type failureJournal struct {
+	headers []string
+	redact  []string // Canonical names of the headers journaled as REDACTED
+
+	mu      sync.Mutex
+	entries []failedRequest
+	size    int
+	next    int
+}
+
+// Creates the journal of cfg, which also redacts the headers cfg takes secrets in: API keys,
+// signatures, and the debug trace and synthetic values
+func newFailureJournal(cfg *config.Config) *failureJournal {
+	j := &failureJournal{headers: cfg.FailureJournal.Headers, size: *cfg.FailureJournal.Entries}
+	secret := append(slices.Clone(credentialHeaders), cfg.TenantQuotas.Header, cfg.DebugTrace.Header, cfg.Synthetic.Header)
+	for _, route := range cfg.Routes {
+		if route.Signing != nil {
+			secret = append(secret, route.Signing.Header)
+		}
+	}
+	for _, name := range secret {
+		if name != "" {
+			j.redact = append(j.redact, http.CanonicalHeaderKey(name))
+		}
+	}
+	return j
+}
+
+// Records r if its final status or any of its attempts failed
+func (j *failureJournal) record(r *http.Request, rt *route, status int, attempts []attemptTrace, start time.Time) {
+	failed := status >= 500
+	for _, attempt := range attempts {
+		failed = failed || attempt.Error != ""
+	}
+	if !failed {
+		return
+	}
+
+	entry := failedRequest{
+		Time:       start,
+		RequestID:  r.Header.Get(requestIDHeader),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Route:      rt.name,
+		Status:     status,
+		Attempts:   attempts,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	for _, name := range j.headers {
+		if value := r.Header.Get(name); value != "" {
+			if entry.Headers == nil {
+				entry.Headers = make(map[string]string)
+			}
+			name = http.CanonicalHeaderKey(name)
+			if slices.Contains(j.redact, name) {
+				value = "REDACTED"
+			}
+			entry.Headers[name] = value
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if len(j.entries) < j.size {
+		j.entries = append(j.entries, entry)
+	} else {
+		j.entries[j.next] = entry
+		j.next = (j.next + 1) % j.size
+	}
+}
+
+// Returns the kept requests, newest first
+func (j *failureJournal) snapshot() []failedRequest {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := make([]failedRequest, 0, len(j.entries))
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		entries = append(entries, j.entries[(j.next+i)%len(j.entries)])
+	}
+	return entries
+}
+
+func (lb *balancer) handleDebugFailures(w http.ResponseWriter, r *http.Request) {
+	if lb.failures == nil {
+		writeAdminError(w, http.StatusNotFound, "the failure journal is not enabled")
+		return
+	}
+	writeList(w, r, lb.failures.snapshot())
+}
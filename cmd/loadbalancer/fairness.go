@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Buckets the fairness window is split into, it slides by one bucket at a time
+const fairnessBuckets = 10
+
+// selectionCounts are a backend's share of a route's selections over some span of time
+type selectionCounts struct {
+	expected float64 // Sum of the chances it had of being picked
+	actual   uint64  // Times it was picked
+}
+
+// fairnessAudit compares the backends each route's selections went to with the share of them the
+// strategy should have given each backend
+type fairnessAudit struct {
+	cfg     config.FairnessAuditConfig
+	metrics *metrics
+
+	mu     sync.Mutex
+	routes map[string]*selectionRing
+}
+
+func newFairnessAudit(cfg config.FairnessAuditConfig, m *metrics) *fairnessAudit {
+	return &fairnessAudit{cfg: cfg, metrics: m, routes: make(map[string]*selectionRing)}
+}
+
+// Records that the backend at picked was selected for a request on route, shares being the chance
+// each of the backends had
+func (f *fairnessAudit) record(route string, backends []*backend, shares []float64, picked int, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ring := f.routes[route]
+	if ring == nil {
+		ring = newSelectionRing(max(f.cfg.Window/fairnessBuckets, time.Second), f.cfg.Window)
+		f.routes[route] = ring
+	}
+	bucket := ring.bucket(now)
+	for idx, share := range shares {
+		if share > 0 {
+			bucket.counts(backends[idx].cfg.URL).expected += share
+		}
+	}
+	bucket.counts(backends[picked].cfg.URL).actual++
+}
+
+// Drops the selections recorded for route
+func (f *fairnessAudit) forget(route string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.routes, route)
+}
+
+// Compares each route's selections over the window ending now with the expected ones, exporting
+// the shares and their divergence and warning about routes diverging by more than the threshold
+func (f *fairnessAudit) compare(now time.Time) {
+	f.mu.Lock()
+	totals := make(map[string]map[string]selectionCounts, len(f.routes))
+	for route, ring := range f.routes {
+		totals[route] = ring.sum(now, f.cfg.Window)
+	}
+	f.mu.Unlock()
+
+	for route, backends := range totals {
+		var selections uint64
+		for _, counts := range backends {
+			selections += counts.actual
+		}
+		if selections < uint64(f.cfg.MinSelections) {
+			continue
+		}
+
+		// Total variation distance: the fraction of selections that would have to move backend
+		// for the distributions to match
+		var divergence, worstExcess float64
+		var worst string
+		for url, counts := range backends {
+			expected := counts.expected / float64(selections)
+			actual := float64(counts.actual) / float64(selections)
+			f.metrics.selectionShare.WithLabelValues(route, url, "expected").Set(expected)
+			f.metrics.selectionShare.WithLabelValues(route, url, "actual").Set(actual)
+			divergence += math.Abs(actual-expected) / 2
+			if excess := actual - expected; excess > worstExcess {
+				worst, worstExcess = url, excess
+			}
+		}
+		f.metrics.selectionDivergence.WithLabelValues(route).Set(divergence)
+
+		if divergence > f.cfg.Threshold {
+			slog.Warn("backend selection diverges from strategy",
+				"route", route,
+				"divergence", divergence,
+				"selections", selections,
+				"most_overpicked", worst,
+				"excess_share", worstExcess,
+			)
+		}
+	}
+}
+
+// Adds a job comparing the recorded selections with the expected ones, if the audit is enabled
+func (lb *balancer) addFairnessJob() {
+	f := lb.fairness
+	if f == nil {
+		return
+	}
+	lb.jobs.add("fairness_audit", every(f.cfg.Interval), false, func(_ context.Context, now time.Time) error {
+		f.compare(now)
+		return nil
+	})
+}
+
+// selectionRing holds selection counts by backend URL in fixed width buckets, overwriting the
+// oldest as time moves on
+type selectionRing struct {
+	width   time.Duration
+	buckets []selectionBucket
+	starts  []int64 // Bucket number, time divided by width, each slot currently holds
+}
+
+type selectionBucket map[string]*selectionCounts
+
+func newSelectionRing(width, span time.Duration) *selectionRing {
+	n := max(int(span/width), 1)
+	return &selectionRing{width: width, buckets: make([]selectionBucket, n), starts: make([]int64, n)}
+}
+
+// Returns the bucket now falls in, emptied first if it held an older one
+func (r *selectionRing) bucket(now time.Time) selectionBucket {
+	bucket := now.UnixNano() / int64(r.width)
+	slot := int(bucket % int64(len(r.buckets)))
+	if r.starts[slot] != bucket || r.buckets[slot] == nil {
+		r.starts[slot] = bucket
+		r.buckets[slot] = make(selectionBucket)
+	}
+	return r.buckets[slot]
+}
+
+func (b selectionBucket) counts(url string) *selectionCounts {
+	counts := b[url]
+	if counts == nil {
+		counts = &selectionCounts{}
+		b[url] = counts
+	}
+	return counts
+}
+
+// Sums the buckets of the window ending now by backend, the current bucket counting in full
+func (r *selectionRing) sum(now time.Time, window time.Duration) map[string]selectionCounts {
+	current := now.UnixNano() / int64(r.width)
+	oldest := current - int64(window/r.width) + 1
+	total := make(map[string]selectionCounts)
+	for slot, start := range r.starts {
+		if start < oldest || start > current {
+			continue
+		}
+		for url, counts := range r.buckets[slot] {
+			sum := total[url]
+			sum.expected += counts.expected
+			sum.actual += counts.actual
+			total[url] = sum
+		}
+	}
+	return total
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	grpcContentType = "application/grpc"
+	grpcWebPrefix   = "application/grpc-web"
+	grpcWebText     = "application/grpc-web-text" // Base64 encoded for clients that can't read binary streams
+)
+
+// Flag on the gRPC-Web frame carrying the trailers after the last message
+const grpcWebTrailerFrame = 0x80
+
+type grpcWebKey struct{}
+
+// Reports whether r is a gRPC-Web request
+func isGRPCWeb(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), grpcWebPrefix)
+}
+
+// Turns a gRPC-Web request into a gRPC one. The response is translated back in ModifyResponse.
+func translateGRPCWebRequest(r *http.Request) *http.Request {
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, grpcWebText)
+	if text {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{&base64Chunks{src: r.Body}, r.Body}
+		r.ContentLength = -1
+		r.Header.Del("Content-Length")
+		contentType = strings.TrimPrefix(contentType, grpcWebText)
+	} else {
+		contentType = strings.TrimPrefix(contentType, grpcWebPrefix)
+	}
+
+	r.Header.Set("Content-Type", grpcContentType+contentType)
+	r.Header.Set("Te", "trailers")
+	r.Header.Del("X-Grpc-Web")
+	return r.WithContext(context.WithValue(r.Context(), grpcWebKey{}, text))
+}
+
+// Called from ModifyResponse, turns a gRPC response back into gRPC-Web for translated requests.
+// Trailers can't reach browsers, so they are sent as a final frame of the body.
+func translateGRPCWebResponse(resp *http.Response) {
+	text, ok := resp.Request.Context().Value(grpcWebKey{}).(bool)
+	if !ok {
+		return
+	}
+
+	contentType := strings.TrimPrefix(resp.Header.Get("Content-Type"), grpcContentType)
+	if text {
+		resp.Header.Set("Content-Type", grpcWebText+contentType)
+	} else {
+		resp.Header.Set("Content-Type", grpcWebPrefix+contentType)
+	}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	// Trailers-only responses carry the status in the headers
+	headerTrailers := make(http.Header)
+	for _, name := range []string{"Grpc-Status", "Grpc-Message"} {
+		if value := resp.Header.Get(name); value != "" {
+			headerTrailers.Set(name, value)
+			resp.Header.Del(name)
+		}
+	}
+
+	var body io.ReadCloser = &grpcWebBody{resp: resp, body: resp.Body, trailers: headerTrailers}
+	if text {
+		body = base64Body(body)
+	}
+	resp.Body = body
+	resp.Trailer = nil
+}
+
+// grpcWebBody passes the gRPC messages through and appends the trailer frame once the backend
+// body ends, at which point the transport has filled in resp.Trailer
+type grpcWebBody struct {
+	resp     *http.Response
+	body     io.ReadCloser
+	trailers http.Header
+	frame    *bytes.Reader
+}
+
+func (b *grpcWebBody) Read(p []byte) (int, error) {
+	if b.frame != nil {
+		return b.frame.Read(p)
+	}
+
+	n, err := b.body.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+
+	for name, values := range b.resp.Trailer {
+		b.trailers[name] = values
+	}
+	// Keep the reverse proxy from also sending them as HTTP trailers
+	b.resp.Trailer = nil
+	b.frame = bytes.NewReader(trailerFrame(b.trailers))
+	if n > 0 {
+		return n, nil
+	}
+	return b.frame.Read(p)
+}
+
+func (b *grpcWebBody) Close() error {
+	return b.body.Close()
+}
+
+// Encodes trailers as a gRPC-Web trailer frame: a flag byte, a 4 byte length and HTTP/1 style headers
+func trailerFrame(trailers http.Header) []byte {
+	var block bytes.Buffer
+	for name, values := range trailers {
+		for _, value := range values {
+			fmt.Fprintf(&block, "%s: %s\r\n", strings.ToLower(name), value)
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFrame
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	return append(frame, block.Bytes()...)
+}
+
+// base64Chunks decodes a base64 body made of padded chunks one after the other, as clients encode
+// each message they send on its own. base64.NewDecoder stops at the first chunk's padding.
+type base64Chunks struct {
+	src io.Reader
+	buf []byte
+	in  []byte // Read but not decoded yet, short of a whole 4 character quantum
+	out []byte // Decoded but not returned yet
+	err error  // Of the last read from src, or of decoding
+}
+
+func (d *base64Chunks) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			if d.err == io.EOF && len(d.in) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, d.err
+		}
+		if d.buf == nil {
+			d.buf = make([]byte, 4096)
+		}
+		n, err := d.src.Read(d.buf)
+		d.err = err
+		for _, c := range d.buf[:n] {
+			if c != '\r' && c != '\n' {
+				d.in = append(d.in, c)
+			}
+		}
+
+		// Each chunk ends with the quantum holding its padding, or at the end of what was read
+		whole := len(d.in) / 4 * 4
+		for start := 0; start < whole; {
+			end := whole
+			if i := bytes.IndexByte(d.in[start:whole], '='); i >= 0 {
+				end = start + (i/4+1)*4
+			}
+			if d.out, err = base64.StdEncoding.AppendDecode(d.out, d.in[start:end]); err != nil {
+				d.err, d.in = err, nil
+				break
+			}
+			start = end
+		}
+		if d.in != nil {
+			d.in = append(d.in[:0], d.in[whole:]...)
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// Base64 encodes body as it is read
+func base64Body(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		encoder := base64.NewEncoder(base64.StdEncoding, pw)
+		_, err := io.Copy(encoder, body)
+		if err == nil {
+			err = encoder.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return struct {
+		io.Reader
+		io.Closer
+	}{pr, closerFunc(func() error {
+		pr.Close()
+		return body.Close()
+	})}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
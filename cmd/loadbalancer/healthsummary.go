@@ -0,0 +1,68 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+)
+
+// poolHealth counts a pool's backends by state. Healthy and unhealthy add up to the total,
+// draining and open circuit backends are counted among them.
+type poolHealth struct {
+	Pool                string  `json:"pool"`
+	Total               int     `json:"total"`
+	Healthy             int     `json:"healthy"`
+	Unhealthy           int     `json:"unhealthy"`
+	Draining            int     `json:"draining"`     // Weight 0 or still warming up
+	OpenCircuit         int     `json:"open_circuit"` // Circuit breaker open
+	Available           int     `json:"available"`    // Healthy, not draining and circuit not open
+	AvailabilityPercent float64 `json:"availability_percent"`
+}
+
+// healthSummary is the response of GET /admin/health/summary
+type healthSummary struct {
+	Pools   []poolHealth `json:"pools"` // By pool label, backends without one are in "default"
+	Overall poolHealth   `json:"overall"`
+}
+
+func (h *poolHealth) add(lb *balancer, b *backend) {
+	h.Total++
+	healthy := lb.healthChecker.IsHealthy(b.idx)
+	draining := b.drained.Load() || b.warmup.warming.Load()
+	open := b.breaker.IsOpen()
+	if healthy {
+		h.Healthy++
+	} else {
+		h.Unhealthy++
+	}
+	if draining {
+		h.Draining++
+	}
+	if open {
+		h.OpenCircuit++
+	}
+	if healthy && !draining && !open {
+		h.Available++
+	}
+	h.AvailabilityPercent = 100 * float64(h.Available) / float64(h.Total)
+}
+
+// Summarises backend health per pool, for monitors that don't read Prometheus metrics
+func (lb *balancer) handleHealthSummary(w http.ResponseWriter, _ *http.Request) {
+	pools := make(map[string]*poolHealth)
+	summary := healthSummary{Overall: poolHealth{Pool: "overall"}}
+	for _, b := range lb.pool {
+		name := b.pool()
+		if pools[name] == nil {
+			pools[name] = &poolHealth{Pool: name}
+		}
+		pools[name].add(lb, b)
+		summary.Overall.add(lb, b)
+	}
+
+	for _, pool := range pools {
+		summary.Pools = append(summary.Pools, *pool)
+	}
+	slices.SortFunc(summary.Pools, func(a, b poolHealth) int { return cmp.Compare(a.Pool, b.Pool) })
+	writeJSON(w, http.StatusOK, summary)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+const (
+	identityAnonymous = "anonymous" // Requests without credentials
+	identityOther     = "other"     // Identities seen after the cardinality limit was reached
+)
+
+// identityTracker turns request credentials into bounded metric labels.
+// Credentials are never exported as-is, only a short hash of the API key or JWT subject.
+type identityTracker struct {
+	cfg     config.IdentityMetricsConfig
+	metrics *metrics
+	mu      sync.Mutex
+	seen    map[string]bool
+}
+
+func newIdentityTracker(cfg config.IdentityMetricsConfig, m *metrics) *identityTracker {
+	return &identityTracker{cfg: cfg, metrics: m, seen: make(map[string]bool)}
+}
+
+// Returns the metric label for the caller of r
+func (t *identityTracker) label(r *http.Request) string {
+	identity := requestIdentity(r, t.cfg.Header)
+	if identity == "" {
+		return identityAnonymous
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.seen[identity] {
+		if len(t.seen) >= t.cfg.MaxIdentities {
+			return identityOther
+		}
+		t.seen[identity] = true
+	}
+	return identity
+}
+
+// Records a finished request for the caller's identity
+func (t *identityTracker) record(r *http.Request, status int) {
+	label := t.label(r)
+	t.metrics.identityRequests.WithLabelValues(label).Inc()
+	if status >= 400 {
+		t.metrics.identityErrors.WithLabelValues(label, strconv.Itoa(status/100)+"xx").Inc()
+	}
+}
+
+// Extracts a hashed identity from the API key header or a bearer JWT's subject, "" if there is none.
+// The JWT isn't verified, authentication is left to the backend or auth middleware.
+func requestIdentity(r *http.Request, apiKeyHeader string) string {
+	if apiKeyHeader != "" {
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			return "key:" + shortHash(key)
+		}
+	}
+
+	subject, _ := bearerClaims(r)["sub"].(string)
+	if subject == "" {
+		return ""
+	}
+	return "sub:" + shortHash(subject)
+}
+
+// Decodes the claims of a bearer JWT without verifying it, nil if there is none
+func bearerClaims(r *http.Request) map[string]any {
+	parts := bearerJWT(r)
+	if parts == nil {
+		return nil
+	}
+	var claims map[string]any
+	if decodeJWTPart(parts[1], &claims) != nil {
+		return nil
+	}
+	return claims
+}
+
+// Decodes the claims of a bearer JWT signed with HS256 under secret, nil if there is none, it
+// isn't signed with secret or it has expired at now
+func verifiedClaims(r *http.Request, secret string, now time.Time) map[string]any {
+	parts := bearerJWT(r)
+	if parts == nil {
+		return nil
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if decodeJWTPart(parts[0], &header) != nil || header.Alg != "HS256" {
+		return nil
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil
+	}
+
+	var claims map[string]any
+	if decodeJWTPart(parts[1], &claims) != nil {
+		return nil
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+		return nil
+	}
+	return claims
+}
+
+// Returns the header, payload and signature of the request's bearer JWT, nil if there is none
+func bearerJWT(r *http.Request) []string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	return parts
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// First 12 hex characters of the SHA-256 of s, enough to tell clients apart without exposing secrets
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
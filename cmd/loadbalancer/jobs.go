@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/clock"
+)
+
+// job is a piece of the balancer's periodic background work
+type job struct {
+	name    string
+	next    func(now time.Time) time.Time // When to run after now, zero to stop
+	run     func(ctx context.Context, now time.Time) error
+	metrics *metrics
+	clock   clock.Clock
+
+	mu           sync.Mutex
+	runs, errors uint64
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastError    string
+	nextRun      time.Time
+}
+
+// jobScheduler runs the balancer's periodic work, each job on a goroutine of its own so a slow one
+// doesn't hold the others up, and keeps per-job stats for metrics and the admin API. Jobs are
+// added before it starts.
+type jobScheduler struct {
+	metrics *metrics
+	clock   clock.Clock // Times the jobs, nil for the real clock. Set before adding any.
+	jobs    []*job
+	running sync.WaitGroup
+}
+
+// Returns a job timing that runs every interval
+func every(interval time.Duration) func(time.Time) time.Time {
+	return func(now time.Time) time.Time { return now.Add(interval) }
+}
+
+// Adds a job run at the times next gives, and straight away at start if atStart is set
+func (s *jobScheduler) add(name string, next func(time.Time) time.Time, atStart bool, run func(ctx context.Context, now time.Time) error) {
+	clk := s.clock
+	if clk == nil {
+		clk = clock.Real
+	}
+	j := &job{name: name, next: next, run: run, metrics: s.metrics, clock: clk}
+	if atStart {
+		j.nextRun = clk.Now()
+	} else {
+		j.nextRun = next(clk.Now())
+	}
+	s.jobs = append(s.jobs, j)
+	s.metrics.jobLastRun.WithLabelValues(name).Set(0)
+}
+
+// Runs the jobs until ctx is done
+func (s *jobScheduler) start(ctx context.Context) {
+	for _, j := range s.jobs {
+		s.running.Go(func() { j.loop(ctx) })
+	}
+}
+
+// Blocks until every job has returned after the context passed to start was cancelled, including
+// any run in progress
+func (s *jobScheduler) wait() {
+	s.running.Wait()
+}
+
+func (j *job) loop(ctx context.Context) {
+	for {
+		j.mu.Lock()
+		next := j.nextRun
+		j.mu.Unlock()
+		if next.IsZero() {
+			log.Printf("Job %s has no further runs, stopping it", j.name)
+			return
+		}
+
+		timer := j.clock.NewTimer(next.Sub(j.clock.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case now := <-timer.C():
+			j.runOnce(ctx, now)
+		}
+	}
+}
+
+// Runs the job and records how it went
+func (j *job) runOnce(ctx context.Context, now time.Time) {
+	start := j.clock.Now()
+	err := j.run(ctx, now)
+	duration := j.clock.Now().Sub(start)
+
+	j.metrics.jobRuns.WithLabelValues(j.name).Inc()
+	j.metrics.jobDuration.WithLabelValues(j.name).Observe(duration.Seconds())
+	j.metrics.jobLastRun.WithLabelValues(j.name).Set(float64(start.Unix()))
+	if err != nil {
+		log.Printf("Job %s failed: %v", j.name, err)
+		j.metrics.jobErrors.WithLabelValues(j.name).Inc()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.runs++
+	j.lastRun, j.lastDuration = start, duration
+	j.lastError = ""
+	if err != nil {
+		j.errors++
+		j.lastError = err.Error()
+	}
+	j.nextRun = j.next(j.clock.Now())
+}
+
+// Adds the balancer's periodic work to its scheduler
+func (lb *balancer) addJobs() {
+	cfg := lb.currentConfig()
+	for _, b := range lb.pool {
+		gauge := lb.metrics.backendHealthy.WithLabelValues(b.cfg.URL, b.cfg.ID)
+		lb.jobs.add("health:"+b.cfg.ID, every(lb.healthChecker.ProbeInterval()), false, func(ctx context.Context, _ time.Time) error {
+			lb.healthChecker.Check(ctx, b.idx, b.cfg.URL, gauge)
+			return nil
+		})
+	}
+	lb.addResolverJobs()
+	for _, rt := range lb.routes {
+		if c := rt.canary; c != nil {
+			lb.jobs.add("canary:"+rt.name, every(c.cfg.Window), false, func(context.Context, time.Time) error {
+				c.analyse()
+				return nil
+			})
+		}
+	}
+	lb.addScheduleJobs()
+	lb.addSLOJob()
+	lb.addFairnessJob()
+	lb.addReaperJob()
+	if len(cfg.Alerts.Rules) > 0 {
+		a := newAlerter(lb, cfg.Alerts)
+		lb.jobs.add("alerts", every(cfg.Alerts.Interval), false, func(_ context.Context, now time.Time) error {
+			a.evaluate(now)
+			return nil
+		})
+	}
+	if a := lb.autoscaler; a != nil {
+		lb.jobs.add("autoscaling", every(a.cfg.Interval), false, func(context.Context, time.Time) error {
+			a.publish()
+			return nil
+		})
+	}
+	if c := lb.cluster; c != nil {
+		lb.jobs.add("cluster_sync", every(c.cfg.PollInterval), true, func(ctx context.Context, _ time.Time) error {
+			return c.tick(ctx)
+		})
+	}
+	lb.jobs.add("listener_export", every(listenerExportInterval), true, func(_ context.Context, now time.Time) error {
+		lb.listeners.export(now)
+		return nil
+	})
+	lb.jobs.add("cert_expiry", every(certCheckInterval), true, func(_ context.Context, now time.Time) error {
+		lb.certs.check(now)
+		return nil
+	})
+}
+
+// jobStatus describes a job in admin API responses
+type jobStatus struct {
+	Name           string     `json:"name"`
+	Runs           uint64     `json:"runs"`
+	Errors         uint64     `json:"errors"`
+	LastRun        *time.Time `json:"last_run,omitempty"`
+	LastDurationMs float64    `json:"last_duration_ms"`
+	LastError      string     `json:"last_error,omitempty"` // Of the last run, empty if it succeeded
+	NextRun        *time.Time `json:"next_run,omitempty"`   // Left out once the job has stopped
+}
+
+func (lb *balancer) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]jobStatus, 0, len(lb.jobs.jobs))
+	for _, j := range lb.jobs.jobs {
+		j.mu.Lock()
+		status := jobStatus{
+			Name:           j.name,
+			Runs:           j.runs,
+			Errors:         j.errors,
+			LastDurationMs: milliseconds(j.lastDuration),
+			LastError:      j.lastError,
+		}
+		if !j.lastRun.IsZero() {
+			lastRun := j.lastRun
+			status.LastRun = &lastRun
+		}
+		if !j.nextRun.IsZero() {
+			nextRun := j.nextRun
+			status.NextRun = &nextRun
+		}
+		j.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	writeList(w, r, statuses)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the certificate expiry countdowns are refreshed
+const listenerExportInterval = time.Minute
+
+type listenerKey struct{}
+
+// listenerStats counts the traffic of one main listener
+type listenerStats struct {
+	name    string            // Address as configured, host:port with an empty host for every interface
+	addr    *net.TCPAddr      // Address listened on, an unspecified IP for every interface
+	cert    *x509.Certificate // Certificate served, nil without TLS
+	metrics *metrics
+
+	requests          atomic.Uint64
+	errors            atomic.Uint64 // Requests answered with a 5xx
+	handshakes        atomic.Uint64 // Completed TLS handshakes
+	handshakeFailures atomic.Uint64 // Connections closed before their TLS handshake completed
+}
+
+// Records a request served through the listener
+func (s *listenerStats) record(status int) {
+	s.requests.Add(1)
+	if status >= 500 {
+		s.errors.Add(1)
+	}
+	s.metrics.listenerRequests.WithLabelValues(s.name, strconv.Itoa(status/100)+"xx").Inc()
+}
+
+// listenerSet tracks the main listeners and the TLS handshakes in progress on them
+type listenerSet struct {
+	metrics     *metrics
+	listeners   []*listenerStats
+	handshaking sync.Map // *tls.Conn to its listener, until the handshake's outcome is counted
+}
+
+// Starts tracking the listener configured as name listening on addr, serving cert or nil for plaintext
+func (s *listenerSet) add(name string, addr *net.TCPAddr, cert *x509.Certificate) {
+	s.listeners = append(s.listeners, &listenerStats{name: name, addr: addr, cert: cert, metrics: s.metrics})
+}
+
+// Returns the listener a connection to local was accepted on, nil if it isn't a main listener
+func (s *listenerSet) forAddr(local net.Addr) *listenerStats {
+	tcpAddr, ok := local.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	for _, l := range s.listeners {
+		// A listener on every interface sees connections to whichever address the client used
+		if l.addr.Port == tcpAddr.Port && (l.addr.IP.IsUnspecified() || l.addr.IP.Equal(tcpAddr.IP)) {
+			return l
+		}
+	}
+	return nil
+}
+
+// Used as the server's ConnContext, tags requests with the listener their connection came in on
+func (s *listenerSet) connContext(ctx context.Context, c net.Conn) context.Context {
+	l := s.forAddr(c.LocalAddr())
+	if l == nil {
+		return ctx
+	}
+	// Protocol detection completes the handshake, and counts it, before handing the connection over
+	if tlsConn, ok := c.(*tls.Conn); ok && !tlsConn.ConnectionState().HandshakeComplete {
+		s.handshaking.Store(tlsConn, l)
+	}
+	return context.WithValue(ctx, listenerKey{}, l)
+}
+
+// Used as the server's ConnState, counts a TLS handshake as completed once its connection serves
+// a request, or by whether it completed when the connection is closed or hijacked first
+func (s *listenerSet) connState(c net.Conn, state http.ConnState) {
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok || state == http.StateNew || state == http.StateIdle {
+		return
+	}
+	value, ok := s.handshaking.LoadAndDelete(tlsConn)
+	if !ok {
+		return
+	}
+	s.recordHandshake(value.(*listenerStats), tlsConn.ConnectionState().HandshakeComplete)
+}
+
+// Counts a TLS handshake on the listener by whether it completed
+func (s *listenerSet) recordHandshake(l *listenerStats, completed bool) {
+	if completed {
+		l.handshakes.Add(1)
+		s.metrics.listenerHandshakes.WithLabelValues(l.name, "ok").Inc()
+	} else {
+		l.handshakeFailures.Add(1)
+		s.metrics.listenerHandshakes.WithLabelValues(l.name, "failed").Inc()
+	}
+}
+
+// Wraps the main handler to count each request against the listener it came in on
+func (s *listenerSet) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l, ok := r.Context().Value(listenerKey{}).(*listenerStats)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		wrapped := wrapResponseWriter(w)
+		next.ServeHTTP(wrapped, r)
+		l.record(wrapped.statusCode)
+	})
+}
+
+// Sets the certificate expiry countdowns
+func (s *listenerSet) export(now time.Time) {
+	for _, l := range s.listeners {
+		if l.cert != nil {
+			s.metrics.listenerCertExpiry.WithLabelValues(l.name).Set(l.cert.NotAfter.Sub(now).Seconds())
+		}
+	}
+}
+
+// listenerStatus describes a main listener in admin API responses
+type listenerStatus struct {
+	Listener             string     `json:"listener"`
+	TLS                  bool       `json:"tls"`
+	Requests             uint64     `json:"requests"`
+	Errors               uint64     `json:"errors"` // Answered with a 5xx
+	TLSHandshakes        uint64     `json:"tls_handshakes"`
+	TLSHandshakeFailures uint64     `json:"tls_handshake_failures"`
+	CertNotAfter         *time.Time `json:"cert_not_after,omitempty"`
+	CertExpiresInSeconds float64    `json:"cert_expires_in_seconds,omitempty"`
+	Routes               []string   `json:"routes"` // Route table the listener serves, in match order
+}
+
+func (lb *balancer) handleListListeners(w http.ResponseWriter, r *http.Request) {
+	var routes []string
+	for _, rt := range lb.routes {
+		routes = append(routes, rt.name)
+	}
+
+	now := time.Now()
+	statuses := make([]listenerStatus, 0, len(lb.listeners.listeners))
+	for _, l := range lb.listeners.listeners {
+		status := listenerStatus{
+			Listener:             l.name,
+			TLS:                  l.cert != nil,
+			Requests:             l.requests.Load(),
+			Errors:               l.errors.Load(),
+			TLSHandshakes:        l.handshakes.Load(),
+			TLSHandshakeFailures: l.handshakeFailures.Load(),
+			Routes:               routes,
+		}
+		if l.cert != nil {
+			status.CertNotAfter = &l.cert.NotAfter
+			status.CertExpiresInSeconds = l.cert.NotAfter.Sub(now).Seconds()
+		}
+		statuses = append(statuses, status)
+	}
+	writeList(w, r, statuses)
+}
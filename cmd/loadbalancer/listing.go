@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Query parameters every admin list endpoint takes, described in the OpenAPI document
+var listParams = []struct{ name, kind, description string }{
+	{"limit", "integer", "Most items to return, all by default"},
+	{"offset", "integer", "Items to skip before the first one returned"},
+	{"fields", "string", "Comma separated JSON fields to keep in each item, all by default"},
+}
+
+// Writes a page of items as a JSON array, as selected by the limit, offset and fields query
+// parameters. X-Total-Count holds the number of items before paging and, if there are more, a
+// Link header points at the next page.
+func writeList[T any](w http.ResponseWriter, r *http.Request, items []T) {
+	query := r.URL.Query()
+	offset, err := listParam(query.Get("offset"), 0, 0)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "offset "+err.Error())
+		return
+	}
+	limit, err := listParam(query.Get("limit"), len(items), 1)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "limit "+err.Error())
+		return
+	}
+
+	total := len(items)
+	start := min(offset, total)
+	// Clamped before adding, a limit near the largest int would overflow
+	end := start + min(limit, total-start)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if end < total {
+		next := *r.URL
+		params := next.Query()
+		params.Set("offset", strconv.Itoa(end))
+		params.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = params.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	}
+	page := items[start:end]
+
+	fields := query.Get("fields")
+	if fields == "" {
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+	sparse, err := selectFields(page, strings.Split(fields, ","))
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sparse)
+}
+
+// Parses a paging parameter of at least least, def if unset
+func listParam(value string, def, least int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < least {
+		return 0, fmt.Errorf("must be a whole number of %d or more, got %q", least, value)
+	}
+	return n, nil
+}
+
+// Returns items as JSON objects holding only the given fields. Fields an item doesn't have, such as
+// empty omitempty ones, are left out of it.
+func selectFields[T any](items []T, fields []string) ([]map[string]json.RawMessage, error) {
+	sparse := make([]map[string]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(data, &all); err != nil {
+			return nil, fmt.Errorf("fields can only be selected from objects: %w", err)
+		}
+		kept := make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if value, ok := all[strings.TrimSpace(field)]; ok {
+				kept[strings.TrimSpace(field)] = value
+			}
+		}
+		sparse = append(sparse, kept)
+	}
+	return sparse, nil
+}
+
+// backendStatus describes a backend in admin API responses
+type backendStatus struct {
+	ID       string            `json:"id"`
+	URL      string            `json:"url"`
+	Pool     string            `json:"pool"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Weight   int64             `json:"weight"`
+	Healthy  bool              `json:"healthy"`
+	State    string            `json:"state"`   // active, drained or warming
+	Circuit  string            `json:"circuit"` // closed, open or half_open
+	Inflight int64             `json:"inflight"`
+}
+
+// Backend states in backendStatus and the state filter
+const (
+	stateActive  = "active"
+	stateDrained = "drained"
+	stateWarming = "warming"
+)
+
+func (lb *balancer) backendStatus(b *backend) backendStatus {
+	state := stateActive
+	switch {
+	case b.drained.Load():
+		state = stateDrained
+	case b.warmup.warming.Load():
+		state = stateWarming
+	}
+	return backendStatus{
+		ID:       b.cfg.ID,
+		URL:      b.cfg.URL,
+		Pool:     b.pool(),
+		Labels:   b.cfg.Labels,
+		Weight:   b.weight.Load(),
+		Healthy:  lb.healthChecker.IsHealthy(b.idx),
+		State:    state,
+		Circuit:  b.breaker.State().String(),
+		Inflight: b.inflight.Load(),
+	}
+}
+
+// Lists the backends in config order, filtered by ?pool=, ?health=healthy|unhealthy and
+// ?state=active|drained|warming
+func (lb *balancer) handleListBackends(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pool, health, state := query.Get("pool"), query.Get("health"), query.Get("state")
+	if health != "" && health != "healthy" && health != "unhealthy" {
+		writeAdminError(w, http.StatusBadRequest, `health must be "healthy" or "unhealthy"`)
+		return
+	}
+	if state != "" && state != stateActive && state != stateDrained && state != stateWarming {
+		writeAdminError(w, http.StatusBadRequest, `state must be "active", "drained" or "warming"`)
+		return
+	}
+
+	statuses := make([]backendStatus, 0, len(lb.pool))
+	for _, b := range lb.pool {
+		status := lb.backendStatus(b)
+		if (pool != "" && status.Pool != pool) ||
+			(health != "" && status.Healthy != (health == "healthy")) ||
+			(state != "" && status.State != state) {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	writeList(w, r, statuses)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// loadSignal is the load a backend last reported in its responses
+type loadSignal struct {
+	kept  atomic.Int64 // Thousandths of the weight the backend keeps while the signal holds
+	until atomic.Int64 // Unix nanoseconds the signal holds until
+}
+
+// Weight used by the weighted strategies, in thousandths: the current weight scaled down while
+// the backend signals it is loaded
+func (b *backend) effectiveWeight() int64 {
+	kept := int64(1000)
+	if time.Now().UnixNano() < b.load.until.Load() {
+		kept = b.load.kept.Load()
+	}
+	return b.weight.Load() * kept
+}
+
+// Called from ModifyResponse, lowers the backend's effective weight if the response says it is
+// loaded. The load header is internal to the backends and isn't passed on to the client.
+func recordLoadSignal(resp *http.Response) {
+	state, ok := resp.Request.Context().Value(attemptKey{}).(*attemptState)
+	if !ok || state.backend == nil {
+		return
+	}
+	cfg := state.loadSignals
+	now := time.Now()
+
+	if cfg.RetryAfter && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			state.backend.signalLoad(1, min(wait, cfg.MaxRetryAfter), cfg, now)
+			state.backend.metrics.loadSignals.WithLabelValues(state.backend.cfg.URL, "retry_after").Inc()
+		}
+	}
+
+	if cfg.Header == "" {
+		return
+	}
+	value := resp.Header.Get(cfg.Header)
+	resp.Header.Del(cfg.Header)
+	load, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if value == "" || err != nil {
+		return
+	}
+	state.backend.signalLoad(min(max(load, 0), 1), cfg.Duration, cfg, now)
+	state.backend.metrics.loadSignals.WithLabelValues(state.backend.cfg.URL, "header").Inc()
+}
+
+// Keeps the share of the weight left over by load, at least the configured minimum, for d
+func (b *backend) signalLoad(load float64, d time.Duration, cfg config.LoadSignalConfig, now time.Time) {
+	kept := max(int64((1-load)*1000), int64(*cfg.MinWeightPercent)*10)
+	// A heavier load that holds for longer isn't cut short by a lighter one, e.g. a Retry-After
+	if now.UnixNano() < b.load.until.Load() && b.load.kept.Load() < kept && now.Add(d).UnixNano() < b.load.until.Load() {
+		return
+	}
+	b.load.kept.Store(kept)
+	b.load.until.Store(now.Add(d).UnixNano())
+}
+
+// Parses a Retry-After of delay seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
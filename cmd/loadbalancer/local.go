@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Methods counted under their own name in method labels, anything else is "other" to keep the
+// label bounded whatever clients send
+var labelledMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// Returns the method label of a request, "preflight" for CORS preflights
+func methodLabel(r *http.Request) string {
+	if isPreflight(r) {
+		return "preflight"
+	}
+	if slices.Contains(labelledMethods, r.Method) {
+		return r.Method
+	}
+	return "other"
+}
+
+// Reports whether r is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Answers r if the route is configured to, reporting whether it did
+func answerLocally(w http.ResponseWriter, r *http.Request, cfg *config.LocalConfig) bool {
+	switch {
+	case cfg == nil:
+		return false
+	case isPreflight(r):
+		if !cfg.Preflight {
+			return false
+		}
+		answerPreflight(w, r, cfg)
+	case r.Method == http.MethodOptions:
+		if !cfg.Options {
+			return false
+		}
+		w.Header().Set("Allow", strings.Join(cfg.AllowMethods, ", "))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead:
+		if !cfg.Head {
+			return false
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		return false
+	}
+	return true
+}
+
+// Allows a preflight from one of the configured origins, rejecting others with a 403
+func answerPreflight(w http.ResponseWriter, r *http.Request, cfg *config.LocalConfig) {
+	origin := r.Header.Get("Origin")
+	if !slices.Contains(cfg.AllowOrigins, "*") && !slices.Contains(cfg.AllowOrigins, origin) {
+		writeError(w, r, http.StatusForbidden, "origin_not_allowed", "")
+		return
+	}
+
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(cfg.AllowMethods, ", "))
+	if len(cfg.AllowHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	header.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+}
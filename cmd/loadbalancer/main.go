@@ -1,39 +1,66 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
-	"time"
-
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/vinzmyko/load-balancer/internal/circuitbreaker"
 	"github.com/vinzmyko/load-balancer/internal/config"
 	"github.com/vinzmyko/load-balancer/internal/health"
 )
 
-var (
-	counter uint64
+var counter uint64
 
-	// Prometheus metrics
-	requestsTotal   *prometheus.CounterVec
-	requestDuration *prometheus.HistogramVec
-	backendHealthy  *prometheus.GaugeVec
-)
+const configPath = "config.yaml"
+
+// Non-standard status (from nginx) logged when the client disconnects before getting a response
+const statusClientClosedRequest = 499
 
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64 // Response body bytes written
+
+	capture      *bytes.Buffer // Copy of the body for the stale cache, nil when not capturing
+	captureLimit int64         // Capture is abandoned past this size
+
+	upgrades  *upgradeSet // Tracks the connection if the backend switches protocols, nil = untracked
+	websocket bool        // The request asks to switch to WebSocket
+}
+
+// Hands the client connection over for a protocol switch, keeping track of it so it can be wound
+// down at shutdown or when the backend is drained
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rw.statusCode = http.StatusSwitchingProtocols
+	if rw.upgrades == nil {
+		return conn, brw, nil
+	}
+	return rw.upgrades.add(conn, rw.websocket), brw, nil
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -41,6 +68,19 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	if rw.capture != nil {
+		if rw.bytes > rw.captureLimit {
+			rw.capture = nil
+		} else {
+			rw.capture.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
 func wrapResponseWriter(w http.ResponseWriter) *responseWriter {
 	return &responseWriter{
 		ResponseWriter: w,
@@ -48,144 +88,416 @@ func wrapResponseWriter(w http.ResponseWriter) *responseWriter {
 	}
 }
 
-// Health checking function handler
-func healthHandler(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+// Health checking function handler, reports unavailable until ready is set
+func healthHandler(ready *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "No healthy backends", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}
 }
 
-// Forwards requests to backends
-func proxyHandler(proxies []*httputil.ReverseProxy, backends []config.BackendConfig, circuitBreakers []*circuitbreaker.CircuitBreaker, healthChecker *health.Checker) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+// Probes every backend once in parallel and returns how many are healthy
+func initialProbe(ctx context.Context, pool []*backend, healthChecker *health.Checker) int {
+	var healthyCount atomic.Int64
+	var wg sync.WaitGroup
+	for _, b := range pool {
+		wg.Go(func() {
+			if healthChecker.Check(ctx, b.idx, b.cfg.URL, b.metrics.backendHealthy.WithLabelValues(b.cfg.URL, b.cfg.ID)) {
+				healthyCount.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	return int(healthyCount.Load())
+}
 
-		wrapped := wrapResponseWriter(w)
+// Points the health checks of a backend at its health_url, if any, and at its address if it is one
+// of a resolved entry. A health_url on another port of the same host is probed at that address too.
+// Backends behind an egress proxy are probed through it, and with tls settings using them.
+func setProbeTarget(healthChecker *health.Checker, b *backend) {
+	if b.cfg.HealthURL != "" {
+		healthChecker.SetProbeURL(b.idx, b.cfg.HealthURL)
+	}
+	if b.egress != nil {
+		healthChecker.SetProbeProxy(b.idx, b.egress)
+	}
+	if b.cfg.TLS != nil {
+		healthChecker.SetProbeTLS(b.idx, b.transport.TLSClientConfig)
+	}
+	if b.addr == "" {
+		return
+	}
+	target, err := url.Parse(b.cfg.URL)
+	if err != nil {
+		return
+	}
+	probe, err := url.Parse(cmp.Or(b.cfg.HealthURL, b.cfg.URL))
+	if err != nil || probe.Hostname() != target.Hostname() {
+		return
+	}
+	ip, _, _ := net.SplitHostPort(b.addr)
+	healthChecker.SetProbeAddress(b.idx, net.JoinHostPort(ip, urlPort(probe)))
+}
 
-		backend := selectBackend(proxies, circuitBreakers, healthChecker)
-		backendURL := backends[backend].URL
+// Adds the path of the offending setting to config validation errors
+func describeConfigError(err error) string {
+	var invalid *config.ValidationError
+	if errors.As(err, &invalid) {
+		return fmt.Sprintf("%v (setting %s)", err, invalid.Field)
+	}
+	return err.Error()
+}
 
-		// Increment backend request counter
-		requestsTotal.WithLabelValues(backendURL).Inc()
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(runSimulate(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:], os.Stdout, os.Stderr))
+	}
 
-		// Forward request to backend
-		proxies[backend].ServeHTTP(wrapped, r)
+	// Keep recent log lines for debug bundles
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
 
-		circuitBreakers[backend].RecordSuccess()
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %s", describeConfigError(err))
+	}
+	for _, warning := range cfg.Warnings() {
+		slog.Warn("risky config", "setting", warning.Field, "warning", warning.Message)
+	}
 
-		duration := time.Since(start).Seconds()
-		requestDuration.WithLabelValues(backendURL).Observe(duration) // Add measurement to histogram
+	registry := newMetricsRegistry()
+	lbMetrics := newMetrics(cfg.Metrics)
+	if err := lbMetrics.register(cfg.Metrics, registry); err != nil {
+		log.Fatalf("Failed to set up metrics: %v", err)
+	}
 
-		slog.Info("request",
-			"method", r.Method,
-			"path", r.URL.Path,
-			"backend", backendURL,
-			"status", wrapped.statusCode,
-			"duration_ms", duration*1000,
-			"remote_addr", r.RemoteAddr,
-		)
+	if err := loadErrorPage(cfg.ErrorPage); err != nil {
+		log.Fatalf("Failed to load error page: %v", err)
 	}
-}
 
-func main() {
-	cfg, err := config.Load("config.yaml")
+	// Entries with resolve set are always looked up through it, so their lookups show in the metrics
+	lookups := newResolver(cfg.Resolver, lbMetrics)
+	if cfg.Resolver.Enabled() {
+		backendResolver = lookups
+	}
+	pool, err := newPool(cfg, lookups.LookupHost)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
-
-	requestsTotal = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "loadbalancer_requests_total",
-			Help: "Total number of requests forwarded to each backend",
-		},
-		[]string{"backend"}, // Label
-	)
-
-	requestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "loadbalancer_request_duration_seconds",
-			Help:    "Request duration in seconds",
-			Buckets: prometheus.DefBuckets, // Default ranges e.g. [5ms, 10ms ,25ms ,50ms,  100ms, etc.]
-		},
-		[]string{"backend"},
-	)
-
-	backendHealthy = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "loadbalancer_backend_healthy",
-			Help: "Backend health status (1 = healthy, 0 = unhealthy)",
-		},
-		[]string{"backends"},
-	)
-
-	prometheus.MustRegister(requestsTotal)
-	prometheus.MustRegister(requestDuration)
-	prometheus.MustRegister(backendHealthy)
-
-	var proxies []*httputil.ReverseProxy
-	circuitBreakers := make([]*circuitbreaker.CircuitBreaker, len(cfg.Backends))
-
-	for i, backend := range cfg.Backends {
-		circuitBreakers[i] = circuitbreaker.New(backend.URL, 3, 30*time.Second)
-
-		proxy, err := createProxy(backend.URL, circuitBreakers[i])
-		if err != nil {
-			log.Fatalf("Failed to create proxy for %s: %v", backend.URL, err)
+		log.Fatalf("Failed to create backends: %v", err)
+	}
+
+	var ready atomic.Bool
+	ready.Store(cfg.StartupCheck == "")
+
+	healthChecker := health.NewChecker(len(pool))
+	if backendResolver != nil {
+		healthChecker.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return backendResolver.Dial(ctx, &net.Dialer{}, network, addr)
+		}
+	}
+	for _, b := range pool {
+		setProbeTarget(healthChecker, b)
+	}
+	lb := newBalancerWithMetrics(pool, cfg, healthChecker, lbMetrics)
+	lb.configPath = configPath
+	lb.gatherer = registry
+
+	healthChecker.OnStatusChange = func(idx int, healthy bool) {
+		if healthy {
+			ready.Store(true)
+			lb.startWarmup(pool[idx])
+		} else {
+			pool[idx].drainIdleConnections()
+		}
+	}
+	healthChecker.OnCheck = func(idx int, healthy bool) {
+		lb.warmupProbe(pool[idx], healthy)
+	}
+
+	if cfg.State.File != "" {
+		if err := lb.restoreState(cfg.State.File, cfg.State.MaxAge); err != nil {
+			log.Printf("Failed to restore saved state: %v", err)
 		}
-		proxies = append(proxies, proxy)
 	}
 
-	healthChecker := health.NewChecker(len(cfg.Backends))
+	if cfg.StartupCheck != "" {
+		healthyCount := initialProbe(context.Background(), pool, healthChecker)
+		log.Printf("Initial health probe: %d of %d backends healthy", healthyCount, len(pool))
+		if healthyCount > 0 {
+			ready.Store(true)
+		} else if cfg.StartupCheck == config.StartupExitUnlessHealthy {
+			log.Fatalf("No backend passed the initial health probe")
+		} else {
+			log.Printf("No backend passed the initial health probe, reporting not ready until one does")
+		}
+	}
 
-	for i, backend := range cfg.Backends {
-		healthChecker.StartChecking(i, backend.URL, backendHealthy)
+	// With passthrough the path is forwarded like any other, readiness stays on the admin port
+	if !cfg.HealthEndpoint.Passthrough {
+		http.HandleFunc(cfg.HealthEndpoint.Path, healthHandler(&ready))
 	}
 
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/", proxyHandler(proxies, cfg.Backends, circuitBreakers, healthChecker))
+	if cfg.Cluster.ConfigURL != "" {
+		lb.cluster = newCluster(lb, cfg.Cluster)
+	}
+	http.Handle("/", lb)
 
 	server := &http.Server{
-		Addr: fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:     lb.listeners.handler(requestLinePolicy(cfg.Server, lb.metrics, http.DefaultServeMux)),
+		ConnContext: lb.listeners.connContext,
+		ConnState:   lb.listeners.connState,
 	}
 
-	metricsMux := http.NewServeMux()
-	metricsMux.Handle("/metrics", promhttp.Handler())
+	// Everything is listened on before anything starts, so a port that can't be had stops the
+	// balancer before there is anything to shut down
+	metricsServer := &http.Server{}
+	if cfg.Metrics.OnMainPort {
+		http.Handle("/metrics", metricsHandler(cfg.Metrics, registry))
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metricsHandler(cfg.Metrics, registry))
+		metricsServer.Handler = metricsMux
+	}
+	var metricsListener net.Listener
+	if !cfg.Metrics.OnMainPort {
+		if metricsListener, err = net.Listen("tcp", fmt.Sprintf(":%d", cfg.Metrics.Port)); err != nil {
+			log.Fatalf("Failed to listen for metrics: %v", err)
+		}
+	}
 
-	// Start metrics server in background
-	go func() {
-		metricsAddr := ":9090"
-		log.Printf("Starting metrics server on %s", metricsAddr)
-		if err := http.ListenAndServe(metricsAddr, metricsMux); err != nil {
-			log.Fatalf("Metrics server failed: %v", err)
+	adminServer := &http.Server{}
+	var adminListener net.Listener
+	if cfg.Admin.Port > 0 {
+		admin := http.NewServeMux()
+		admin.Handle("/", adminAuth(cfg.Admin, adminHandler(lb)))
+		admin.HandleFunc("GET /health", healthHandler(&ready))
+		adminServer.Handler = admin
+		if adminListener, err = net.Listen("tcp", net.JoinHostPort(cfg.Admin.Bind, strconv.Itoa(cfg.Admin.Port))); err != nil {
+			log.Fatalf("Failed to listen for the admin API: %v", err)
 		}
-	}()
+	}
 
-	// Start main server in background
-	go func() {
-		addr := fmt.Sprintf(":%d", cfg.Server.Port)
-		log.Printf("Starting load balancer on %s", addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed: %v", err)
+	var dnsConn net.PacketConn
+	if cfg.DNS.Listen != "" {
+		if dnsConn, err = net.ListenPacket("udp", cfg.DNS.Listen); err != nil {
+			log.Fatalf("Failed to listen for DNS: %v", err)
 		}
-	}()
+	}
+
+	listeners, err := mainListeners(server, cfg, &lb.listeners, lb.certs, lb.metrics)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	for i, listener := range listeners {
+		listeners[i] = &closeOnceListener{Listener: listener}
+	}
+
+	// Background work to stop at shutdown
+	runCtx, stopRunning := context.WithCancel(context.Background())
+
+	// Started once the listeners, whose certificates some jobs watch, are all added
+	lb.addJobs()
+	lb.jobs.start(runCtx)
+
+	// A server that stops serving shuts the balancer down like a signal, then exits with an error
+	failed := make(chan error, 1)
+	serve := func(name string, srv *http.Server, listener net.Listener) {
+		log.Printf("Starting %s on %s", name, listener.Addr())
+		err := srv.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			select {
+			case failed <- fmt.Errorf("%s failed: %w", name, err):
+			default:
+			}
+		}
+	}
+	if metricsListener != nil {
+		go serve("metrics server", metricsServer, metricsListener)
+	}
+	if adminListener != nil {
+		go serve("admin API", adminServer, adminListener)
+	}
+	if dnsConn != nil {
+		log.Printf("Starting DNS responder on %s", dnsConn.LocalAddr())
+		go newDNSServer(lb, cfg.DNS).serve(dnsConn)
+	}
+	for _, listener := range listeners {
+		go serve("load balancer", server, listener)
+	}
 
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 
 	// Wait for shutdown signal
-	sig := <-sigChan
-	log.Printf("Received signal %v, shutting down gracefully...", sig)
+	exitCode := 0
+	select {
+	case sig := <-sigChan:
+		log.Printf("Received signal %v, shutting down gracefully...", sig)
+	case err := <-failed:
+		log.Printf("%v, shutting down...", err)
+		exitCode = 1
+	}
 
-	healthChecker.Stop()
+	shutdown([]shutdownStage{
+		// New connections are refused from here on, while the admin API reports not ready
+		{"listeners", cfg.Shutdown.Listeners, func(context.Context) error {
+			ready.Store(false)
+			var errs []error
+			for _, listener := range listeners {
+				errs = append(errs, listener.Close())
+			}
+			if dnsConn != nil {
+				errs = append(errs, dnsConn.Close())
+			}
+			return errors.Join(errs...)
+		}},
+		// Shutdown sends HTTP/2 clients a GOAWAY and waits for their streams, WebSockets are hijacked
+		// connections it knows nothing about so they are closed alongside
+		{"drains", cfg.Drain.Deadline, func(ctx context.Context) error {
+			var drained sync.WaitGroup
+			drained.Go(func() { lb.closeAllUpgraded(cfg.Drain) })
+			err := server.Shutdown(ctx)
+			return errors.Join(err, waitContext(ctx, drained.Wait))
+		}},
+		// Probes in flight are cancelled, so their results can't race the state saved here
+		{"health checkers", cfg.Shutdown.HealthChecks, func(ctx context.Context) error {
+			stopRunning()
+			if err := waitContext(ctx, lb.jobs.wait); err != nil {
+				return err
+			}
+			if cfg.State.File != "" {
+				if err := lb.saveState(cfg.State.File); err != nil {
+					return fmt.Errorf("failed to save state: %w", err)
+				}
+			}
+			return nil
+		}},
+		// Last, so the final values can still be scraped while everything else winds down
+		{"metrics", cfg.Shutdown.Metrics, func(ctx context.Context) error {
+			return errors.Join(metricsServer.Shutdown(ctx), adminServer.Shutdown(ctx))
+		}},
+	})
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	log.Println("Shutdown complete")
+	os.Exit(exitCode)
+}
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Server shutdown error: %v", err)
+// Listens on the main ports of every bind address. With protocol detection TLS, plaintext HTTP/1.1,
+// HTTP/2 prior knowledge and raw TCP share the port, otherwise it serves either TLS or plaintext HTTP.
+// Each listener is added to stats and its certificate to certs.
+func mainListeners(server *http.Server, cfg *config.Config, stats *listenerSet, certs *certMonitor, m *metrics) ([]net.Listener, error) {
+	var tlsConfig *tls.Config
+	var leaf *x509.Certificate
+	if cfg.Server.TLS != nil {
+		cert, err := tls.LoadX509KeyPair(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+		leaf = cert.Leaf
+		certs.add(certUsageListener, cfg.Server.TLS.CertFile, leaf)
 	}
 
-	log.Println("Shutdown complete")
+	addrs, err := listenAddrs(cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	var tcp *tcpProxy
+	if cfg.Server.DetectProtocol {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+		tcp = newTCPProxy(cfg.TCP, m)
+	}
+
+	limiter := newConnLimiter(cfg.Server, m)
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		stats.add(addr, listener.Addr().(*net.TCPAddr), leaf)
+
+		if limiter != nil {
+			listener = &limitListener{Listener: listener, limiter: limiter}
+		}
+		switch {
+		case cfg.Server.DetectProtocol:
+			listener = newDetectListener(listener, tlsConfig, tcp, stats)
+		case tlsConfig != nil:
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Returns the addresses to listen on, every port on each bind address or on all interfaces without any
+func listenAddrs(cfg config.ServerConfig) ([]string, error) {
+	ports, err := cfg.ListenPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []string{""}
+	if len(cfg.Bind) > 0 {
+		hosts = nil
+		for _, bind := range cfg.Bind {
+			bindHosts, err := bindHosts(bind)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, bindHosts...)
+		}
+	}
+
+	var addrs []string
+	for _, host := range hosts {
+		for _, port := range ports {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return addrs, nil
+}
+
+// Resolves a bind address. IP literals (IPv6 with or without brackets) are used as they are,
+// interface names stand for the interface's addresses apart from link-local ones.
+func bindHosts(bind string) ([]string, error) {
+	host := strings.TrimSuffix(strings.TrimPrefix(bind, "["), "]")
+	if _, err := netip.ParseAddr(host); err == nil {
+		return []string{host}, nil
+	}
+
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return nil, fmt.Errorf("bind address %q is neither an IP address nor a network interface", bind)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses of interface %s: %w", host, err)
+	}
+	var hosts []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			hosts = append(hosts, ipNet.IP.String())
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses to bind to", host)
+	}
+	return hosts, nil
 }
 
 func createProxy(backendURL string, circuitBreaker *circuitbreaker.CircuitBreaker) (*httputil.ReverseProxy, error) {
@@ -193,7 +505,11 @@ func createProxy(backendURL string, circuitBreaker *circuitbreaker.CircuitBreake
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse backend server url %s: %w", backendURL, err)
 	}
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := backendDirector(target)
+	proxy := &httputil.ReverseProxy{Director: func(req *http.Request) {
+		director(req)
+		addAnnotations(req)
+	}}
 
 	// Called on success
 	proxy.ModifyResponse = func(resp *http.Response) error {
@@ -204,37 +520,128 @@ func createProxy(backendURL string, circuitBreaker *circuitbreaker.CircuitBreake
 			// 4xx and 5xx are failures
 			circuitBreaker.RecordFailure()
 		}
-		return nil
+		recordLoadSignal(resp)
+		translateGRPCWebResponse(resp)
+		overrideCacheControl(resp)
+		addServerTiming(resp)
+		return rewriteResponse(resp, backendURL)
 	}
 
 	// Called on errors
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("Proxy error for %s: %v", backendURL, err)
+		m := attemptMetrics(r)
+		// The client went away, so there is nobody to respond to and the backend isn't at fault
+		if clientGone(r) {
+			log.Printf("Client closed request to %s: %v", backendURL, err)
+			m.clientAborted.WithLabelValues(backendURL).Inc()
+			if rw, ok := w.(*responseWriter); ok {
+				rw.statusCode = statusClientClosedRequest
+			}
+			return
+		}
+
 		circuitBreaker.RecordFailure()
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		m.backendFailures.WithLabelValues(backendURL).Inc()
+		recordAttemptError(r, err)
+		class := errorClass(r, err)
+		m.proxyErrors.WithLabelValues(backendURL, class).Inc()
+
+		if deferToRetry(r, err, class) {
+			return
+		}
+
+		if kind := timeoutKind(r, err); kind != "" {
+			log.Printf("Proxy %s timeout for %s: %v", kind, backendURL, err)
+			m.backendTimeouts.WithLabelValues(backendURL, kind).Inc()
+			writeError(w, r, http.StatusGatewayTimeout, "gateway_timeout", backendURL)
+			return
+		}
+
+		log.Printf("Proxy error (%s) for %s: %v", class, backendURL, err)
+		writeError(w, r, http.StatusBadGateway, "bad_gateway", backendURL)
 	}
 
 	return proxy, nil
 }
 
-func selectBackend(backends []*httputil.ReverseProxy, circuitBreakers []*circuitbreaker.CircuitBreaker, healthChecker *health.Checker) int {
-	next := atomic.AddUint64(&counter, 1)
-	backendCount := len(backends)
+// Points requests at the backend. A path in the backend URL is a base path that the request
+// path is appended to, so http://host:8080/base serves /users as /base/users. Query parameters
+// in the backend URL come before the request's.
+func backendDirector(target *url.URL) func(*http.Request) {
+	return func(req *http.Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path, req.URL.RawPath = joinBackendPath(target, req.URL)
+		if target.RawQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+		}
+		// Keep Go's default User-Agent off requests that didn't send one
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header.Set("User-Agent", "")
+		}
+	}
+}
 
-	for i := range backendCount {
-		idx := int((next + uint64(i)) % uint64(backendCount))
+// Prepends the base URL's path to the request path with exactly one slash between them,
+// keeping any escaping in either
+func joinBackendPath(base, req *url.URL) (path, rawPath string) {
+	prefix := strings.TrimSuffix(base.Path, "/")
+	if prefix == "" {
+		return req.Path, req.RawPath
+	}
 
-		if !healthChecker.IsHealthy(idx) {
-			continue
-		}
+	path = prefix + ensureLeadingSlash(req.Path)
+	if base.RawPath == "" && req.RawPath == "" {
+		return path, ""
+	}
+	return path, strings.TrimSuffix(base.EscapedPath(), "/") + ensureLeadingSlash(req.EscapedPath())
+}
 
-		if !circuitBreakers[idx].CanAttempt() {
-			continue
-		}
+func ensureLeadingSlash(path string) string {
+	if strings.HasPrefix(path, "/") {
+		return path
+	}
+	return "/" + path
+}
+
+// Reports whether the request was cancelled because the client disconnected
+func clientGone(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// Classifies a backend transport error, see the config.ErrorClass constants
+func errorClass(r *http.Request, err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	switch {
+	case timeoutKind(r, err) != "":
+		return config.ErrorClassTimeout
+	case errors.As(err, &dnsErr):
+		return config.ErrorClassDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return config.ErrorClassConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return config.ErrorClassConnectionReset
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return config.ErrorClassTLS
+	}
+	return config.ErrorClassOther
+}
+
+// Reports which timeout caused a proxy error, or "" if it wasn't a timeout
+func timeoutKind(r *http.Request, err error) string {
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		return "total"
+	}
 
-		return idx
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "first_byte"
 	}
 
-	// All backends unhealthy or circuits open just return the first one
-	return int(next % uint64(len(backends)))
+	return ""
 }
@@ -0,0 +1,768 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// metrics are the Prometheus collectors of one balancer. Each balancer has its own, so balancers
+// sharing a registry under different namespaces count only their own traffic.
+type metrics struct {
+	backendLabels []string // Backend labels added to the per-backend request metrics after the URL and ID
+
+	requestsTotal            *prometheus.CounterVec
+	requestDuration          *prometheus.HistogramVec
+	backendHealthy           *prometheus.GaugeVec
+	signatureRejections      *prometheus.CounterVec
+	sloObjective             *prometheus.GaugeVec
+	sloBurnRate              *prometheus.GaugeVec
+	sloBudgetRemaining       *prometheus.GaugeVec
+	syntheticRequests        *prometheus.CounterVec
+	loadSignals              *prometheus.CounterVec
+	backendConnReuse         *prometheus.CounterVec
+	clientConnections        prometheus.Gauge
+	rejectedConnections      *prometheus.CounterVec
+	requestLineRejections    *prometheus.CounterVec
+	bodyRejections           *prometheus.CounterVec
+	dnsQueries               *prometheus.CounterVec
+	backendTimeouts          *prometheus.CounterVec
+	methodRequests           *prometheus.CounterVec
+	localResponses           *prometheus.CounterVec
+	retriesTotal             *prometheus.CounterVec
+	servedAttempt            *prometheus.CounterVec
+	routePanic               *prometheus.GaugeVec
+	regionRequests           *prometheus.CounterVec
+	regionFailedOver         *prometheus.GaugeVec
+	deadlineSkips            *prometheus.CounterVec
+	dnsLookupDuration        *prometheus.HistogramVec
+	dnsLookupFailures        *prometheus.CounterVec
+	dnsCacheLookups          *prometheus.CounterVec
+	retriesSkipped           *prometheus.CounterVec
+	clientAborted            *prometheus.CounterVec
+	backendFailures          *prometheus.CounterVec
+	backendConnections       *prometheus.GaugeVec
+	backendConnectionsLimit  *prometheus.GaugeVec
+	backendConnectionsReaped *prometheus.CounterVec
+	identityRequests         *prometheus.CounterVec
+	identityErrors           *prometheus.CounterVec
+	priorityRequests         *prometheus.CounterVec
+	shedRequests             *prometheus.CounterVec
+	priorityInflight         *prometheus.GaugeVec
+	quotaRejections          *prometheus.CounterVec
+	noHealthyBackends        *prometheus.CounterVec
+	requestSize              *prometheus.HistogramVec
+	responseSize             *prometheus.HistogramVec
+	backendWarming           *prometheus.GaugeVec
+	alertFiring              *prometheus.GaugeVec
+	proxyErrors              *prometheus.CounterVec
+	tcpConnectionsActive     *prometheus.GaugeVec
+	tcpConnectionsTotal      *prometheus.CounterVec
+	tcpConnectionsClosed     *prometheus.CounterVec
+	tcpConnectErrors         *prometheus.CounterVec
+	tcpBytes                 *prometheus.CounterVec
+	tcpConnectionDuration    *prometheus.HistogramVec
+	canaryWeight             *prometheus.GaugeVec
+	selectionShare           *prometheus.GaugeVec
+	selectionDivergence      *prometheus.GaugeVec
+	poolUtilization          *prometheus.GaugeVec
+	poolQueueDepth           *prometheus.GaugeVec
+	poolLatencyP95           *prometheus.GaugeVec
+	poolDesiredBackends      *prometheus.GaugeVec
+	listenerRequests         *prometheus.CounterVec
+	listenerHandshakes       *prometheus.CounterVec
+	listenerCertExpiry       *prometheus.GaugeVec
+	jobRuns                  *prometheus.CounterVec
+	jobErrors                *prometheus.CounterVec
+	jobDuration              *prometheus.HistogramVec
+	jobLastRun               *prometheus.GaugeVec
+	certNotAfter             *prometheus.GaugeVec
+}
+
+// Metrics of backends and proxies not serving a balancer, like those a test creates on their own.
+// Never registered anywhere.
+var discardMetrics = newMetrics(config.MetricsConfig{})
+
+// Creates the metrics of a balancer, with the configured backend labels on the per-backend request metrics
+func newMetrics(cfg config.MetricsConfig) *metrics {
+	labelNames := append([]string{"backend", "backend_id"}, cfg.BackendLabels...)
+	return &metrics{
+		backendLabels: cfg.BackendLabels,
+
+		requestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_requests_total",
+				Help: "Total number of requests forwarded to each backend",
+			},
+			labelNames,
+		),
+
+		requestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "loadbalancer_request_duration_seconds",
+				Help:    "Request duration in seconds",
+				Buckets: prometheus.DefBuckets, // Default ranges e.g. [5ms, 10ms ,25ms ,50ms,  100ms, etc.]
+			},
+			labelNames,
+		),
+
+		backendHealthy: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_backend_healthy",
+				Help: "Backend health status (1 = healthy, 0 = unhealthy)",
+			},
+			[]string{"backends", "backend_id"},
+		),
+
+		signatureRejections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_signature_rejections_total",
+				Help: "Requests to signed routes rejected before reaching a backend, by reason",
+			},
+			[]string{"route", "reason"},
+		),
+
+		sloObjective: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_slo_objective_ratio",
+				Help: "Target ratio of good requests of each route objective (availability or latency)",
+			},
+			[]string{"route", "objective"},
+		),
+
+		sloBurnRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_slo_burn_rate",
+				Help: "Rate the error budget is spent at over the window, 1 = exactly used up by the end of the period",
+			},
+			[]string{"route", "objective", "window"},
+		),
+
+		sloBudgetRemaining: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_slo_error_budget_remaining_ratio",
+				Help: "Share of the error budget left in the SLO period, negative once overspent",
+			},
+			[]string{"route", "objective"},
+		),
+
+		syntheticRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_synthetic_requests_total",
+				Help: "Requests marked as synthetic traffic, by backend and route",
+			},
+			[]string{"backend", "route"},
+		),
+
+		loadSignals: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_backend_load_signals_total",
+				Help: "Responses in which a backend signalled load, by kind (header or retry_after)",
+			},
+			[]string{"backend", "kind"},
+		),
+
+		backendConnReuse: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_backend_connection_acquisitions_total",
+				Help: "Connections requests to each backend were sent on, by whether it was new or reused",
+			},
+			[]string{"backend", "state"},
+		),
+
+		clientConnections: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_client_connections",
+				Help: "Client connections currently open, tracked when server connection limits are set",
+			},
+		),
+
+		rejectedConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_rejected_connections_total",
+				Help: "Client connections closed on accept, by the limit they hit (rate or max_conns)",
+			},
+			[]string{"reason"},
+		),
+
+		requestLineRejections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_request_line_rejections_total",
+				Help: "Requests refused by the server's http10 or absolute_form policy, by reason",
+			},
+			[]string{"reason"},
+		),
+
+		bodyRejections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_body_rejections_total",
+				Help: "Requests rejected by a route's body policy before reaching a backend, by error code",
+			},
+			[]string{"route", "reason"},
+		),
+
+		dnsQueries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_dns_queries_total",
+				Help: "Queries answered by the DNS responder, by response code",
+			},
+			[]string{"rcode"},
+		),
+
+		backendTimeouts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_backend_timeouts_total",
+				Help: "Requests that timed out, by kind (first_byte = backend hung, total = overall duration limit)",
+			},
+			[]string{"backend", "kind"},
+		),
+
+		methodRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_route_requests_by_method_total",
+				Help: "Requests per route by method, preflight for CORS preflights and other for unusual methods",
+			},
+			[]string{"route", "method"},
+		),
+
+		localResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_local_responses_total",
+				Help: "Preflight, OPTIONS and HEAD requests a route answered itself without a backend",
+			},
+			[]string{"route", "method"},
+		),
+
+		retriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_retries_total",
+				Help: "Requests retried on another backend, by the backend that failed",
+			},
+			[]string{"backend"},
+		),
+
+		servedAttempt: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_responses_by_attempt_total",
+				Help: "Responses by the attempt that served them, 1 for the first try and higher after retries",
+			},
+			[]string{"route", "attempt"},
+		),
+
+		routePanic: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_route_panic",
+				Help: "Whether each route is in panic because too many of its backends are failing (1) or not (0)",
+			},
+			[]string{"route"},
+		),
+
+		regionRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_region_requests_total",
+				Help: "Requests sent to each regional pool of a route",
+			},
+			[]string{"route", "region"},
+		),
+
+		regionFailedOver: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_region_failed_over",
+				Help: "Whether each regional pool of a route is failed over for degraded health or latency (1) or not (0)",
+			},
+			[]string{"route", "region"},
+		),
+
+		deadlineSkips: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_deadline_skips_total",
+				Help: "Backends passed over for a request because their recent p95 latency exceeded its remaining budget",
+			},
+			[]string{"route", "backend"},
+		),
+
+		dnsLookupDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "loadbalancer_dns_lookup_duration_seconds",
+				Help:    "Time taken by backend hostname lookups not answered from the cache, by result (success, not_found or error)",
+				Buckets: prometheus.ExponentialBuckets(0.001, 4, 8), // 1ms to 16s
+			},
+			[]string{"result"},
+		),
+
+		dnsLookupFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_dns_lookup_failures_total",
+				Help: "Backend hostname lookups that failed, by host and reason (not_found or error)",
+			},
+			[]string{"host", "reason"},
+		),
+
+		dnsCacheLookups: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_dns_cache_lookups_total",
+				Help: "Backend hostname lookups by whether the resolver cache answered them (hit or miss)",
+			},
+			[]string{"result"},
+		),
+
+		retriesSkipped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_retries_skipped_total",
+				Help: "Failed requests that could not be retried, by reason",
+			},
+			[]string{"reason"},
+		),
+
+		clientAborted: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_client_aborted_total",
+				Help: "Requests abandoned because the client disconnected before the response finished",
+			},
+			[]string{"backend"},
+		),
+
+		backendFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_backend_failures_total",
+				Help: "Requests that failed because of a transport error or aborted response from the backend",
+			},
+			[]string{"backend"},
+		),
+
+		backendConnections: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_backend_connections",
+				Help: "Open connections to each backend",
+			},
+			[]string{"backend"},
+		),
+
+		backendConnectionsLimit: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_backend_connections_limit",
+				Help: "Configured connection limit of each backend (0 = unlimited)",
+			},
+			[]string{"backend"},
+		),
+
+		backendConnectionsReaped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_backend_connections_reaped_total",
+				Help: "Idle connections to each backend closed by the reaper, by reason (max_age)",
+			},
+			[]string{"backend", "reason"},
+		),
+
+		identityRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_identity_requests_total",
+				Help: "Requests per client identity (hashed API key or JWT subject)",
+			},
+			[]string{"identity"},
+		),
+
+		identityErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_identity_errors_total",
+				Help: "Error responses per client identity, by status class",
+			},
+			[]string{"identity", "class"},
+		),
+
+		priorityRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_priority_requests_total",
+				Help: "Requests admitted per priority class",
+			},
+			[]string{"class"},
+		),
+
+		shedRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_shed_requests_total",
+				Help: "Requests rejected by load shedding per priority class",
+			},
+			[]string{"class"},
+		),
+
+		priorityInflight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_priority_inflight",
+				Help: "In-flight requests per priority class",
+			},
+			[]string{"class"},
+		),
+
+		quotaRejections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_quota_rejections_total",
+				Help: "Requests rejected because a tenant quota was exhausted",
+			},
+			[]string{"limit"},
+		),
+
+		noHealthyBackends: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_no_healthy_backends_total",
+				Help: "Requests that arrived while none of the route's backends was healthy, by policy applied",
+			},
+			[]string{"route", "policy"},
+		),
+
+		requestSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "loadbalancer_request_size_bytes",
+				Help:    "Request body sizes as read from clients",
+				Buckets: prometheus.ExponentialBuckets(64, 4, 10), // 64 B to 16 MiB
+			},
+			[]string{"backend", "route"},
+		),
+
+		responseSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "loadbalancer_response_size_bytes",
+				Help:    "Response body sizes as written to clients",
+				Buckets: prometheus.ExponentialBuckets(64, 4, 10),
+			},
+			[]string{"backend", "route"},
+		),
+
+		backendWarming: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_backend_warming",
+				Help: "Whether a recovered backend is held out of rotation until it finishes warming up (1 = warming)",
+			},
+			[]string{"backend"},
+		),
+
+		alertFiring: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_alert_firing",
+				Help: "Whether a built-in alert rule is firing (1 = firing)",
+			},
+			[]string{"rule"},
+		),
+
+		proxyErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_proxy_errors_total",
+				Help: "Backend transport errors by class e.g. connection_refused, dns, tls, timeout",
+			},
+			[]string{"backend", "class"},
+		),
+
+		tcpConnectionsActive: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_tcp_connections_active",
+				Help: "Open raw TCP connections per backend",
+			},
+			[]string{"backend"},
+		),
+
+		tcpConnectionsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_tcp_connections_total",
+				Help: "Raw TCP connections forwarded per backend",
+			},
+			[]string{"backend"},
+		),
+
+		tcpConnectionsClosed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_tcp_connections_closed_total",
+				Help: "Closed raw TCP connections by reason: eof, idle_timeout or max_lifetime",
+			},
+			[]string{"backend", "reason"},
+		),
+
+		tcpConnectErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_tcp_connect_errors_total",
+				Help: "Failed connection attempts to raw TCP backends",
+			},
+			[]string{"backend"},
+		),
+
+		tcpBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_tcp_bytes_total",
+				Help: "Bytes forwarded over raw TCP connections, in is client to backend",
+			},
+			[]string{"backend", "direction"},
+		),
+
+		tcpConnectionDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "loadbalancer_tcp_connection_duration_seconds",
+				Help:    "Raw TCP connection lifetime",
+				Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+			},
+			[]string{"backend"},
+		),
+
+		canaryWeight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_canary_weight_percent",
+				Help: "Percentage of a route's traffic sent to its canary backends (0 after a rollback)",
+			},
+			[]string{"route"},
+		),
+
+		selectionShare: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_selection_share",
+				Help: "Share of a route's selections over the fairness audit window each backend got (actual) and was due under the strategy (expected)",
+			},
+			[]string{"route", "backend", "share"},
+		),
+
+		selectionDivergence: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_selection_divergence",
+				Help: "Fraction of a route's selections over the fairness audit window that went to a different backend than the strategy's expected distribution, 0-1",
+			},
+			[]string{"route"},
+		),
+
+		poolUtilization: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_pool_utilization_ratio",
+				Help: "In-flight requests of each pool over the capacity of its available backends",
+			},
+			[]string{"pool"},
+		),
+
+		poolQueueDepth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_pool_queue_depth",
+				Help: "Requests of each pool waiting for a backend connection under max_conns",
+			},
+			[]string{"pool"},
+		),
+
+		poolLatencyP95: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_pool_latency_p95_seconds",
+				Help: "95th percentile duration of each pool's requests over the last autoscaling interval",
+			},
+			[]string{"pool"},
+		),
+
+		poolDesiredBackends: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_pool_desired_backends",
+				Help: "Backends each pool would need to meet the autoscaling utilization and latency targets",
+			},
+			[]string{"pool"},
+		),
+
+		listenerRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_listener_requests_total",
+				Help: "Requests served by each main listener by status class",
+			},
+			[]string{"listener", "class"},
+		),
+
+		listenerHandshakes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_listener_tls_handshakes_total",
+				Help: "TLS handshakes on each main listener, ok or failed",
+			},
+			[]string{"listener", "result"},
+		),
+
+		listenerCertExpiry: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_listener_cert_expiry_seconds",
+				Help: "Seconds until the certificate each TLS listener serves expires, negative once expired",
+			},
+			[]string{"listener"},
+		),
+
+		jobRuns: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_job_runs_total",
+				Help: "Runs of each periodic background job",
+			},
+			[]string{"job"},
+		),
+
+		jobErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadbalancer_job_errors_total",
+				Help: "Runs of each periodic background job that failed",
+			},
+			[]string{"job"},
+		),
+
+		jobDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "loadbalancer_job_duration_seconds",
+				Help:    "Time each periodic background job took to run",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"job"},
+		),
+
+		jobLastRun: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_job_last_run_timestamp_seconds",
+				Help: "Unix time each periodic background job last started, 0 until its first run",
+			},
+			[]string{"job"},
+		),
+
+		certNotAfter: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "loadbalancer_cert_not_after_timestamp_seconds",
+				Help: "Unix time each loaded certificate expires, by usage (listener or backend_client) and file",
+			},
+			[]string{"usage", "file"},
+		),
+	}
+}
+
+// Registers the metrics with reg. Each balancer in a process needs its own registry, or a
+// namespace to tell them apart in a shared one.
+func (m *metrics) register(cfg config.MetricsConfig, reg prometheus.Registerer) error {
+	// The namespace prefixes the balancer's own metrics, not the Go runtime and process ones
+	if cfg.Namespace != "" {
+		reg = prometheus.WrapRegistererWithPrefix(cfg.Namespace+"_", reg)
+	}
+	for _, collector := range []prometheus.Collector{
+		m.requestsTotal,
+		m.requestDuration,
+		m.requestSize,
+		m.responseSize,
+		m.backendHealthy,
+		m.backendTimeouts,
+		m.dnsQueries,
+		m.bodyRejections,
+		m.clientConnections,
+		m.rejectedConnections,
+		m.requestLineRejections,
+		m.backendConnReuse,
+		m.loadSignals,
+		m.syntheticRequests,
+		m.sloObjective,
+		m.sloBurnRate,
+		m.sloBudgetRemaining,
+		m.signatureRejections,
+		m.methodRequests,
+		m.localResponses,
+		m.retriesTotal,
+		m.servedAttempt,
+		m.retriesSkipped,
+		m.clientAborted,
+		m.backendFailures,
+		m.backendConnections,
+		m.backendConnectionsLimit,
+		m.backendConnectionsReaped,
+		m.identityRequests,
+		m.identityErrors,
+		m.canaryWeight,
+		m.selectionShare,
+		m.selectionDivergence,
+		m.poolUtilization,
+		m.poolQueueDepth,
+		m.poolLatencyP95,
+		m.poolDesiredBackends,
+		m.listenerRequests,
+		m.listenerHandshakes,
+		m.listenerCertExpiry,
+		m.certNotAfter,
+		m.jobRuns,
+		m.jobErrors,
+		m.jobDuration,
+		m.jobLastRun,
+		m.deadlineSkips,
+		m.regionRequests,
+		m.regionFailedOver,
+		m.dnsLookupDuration,
+		m.dnsLookupFailures,
+		m.dnsCacheLookups,
+		m.routePanic,
+		m.priorityRequests,
+		m.shedRequests,
+		m.priorityInflight,
+		m.quotaRejections,
+		m.proxyErrors,
+		m.noHealthyBackends,
+		m.backendWarming,
+		m.alertFiring,
+		m.tcpConnectionsActive,
+		m.tcpConnectionsTotal,
+		m.tcpConnectionsClosed,
+		m.tcpConnectErrors,
+		m.tcpBytes,
+		m.tcpConnectionDuration,
+	} {
+		if err := reg.Register(collector); err != nil {
+			return fmt.Errorf("failed to register metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// Returns a registry for the metrics along with the Go runtime and process collectors
+func newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return reg
+}
+
+// Serves the metrics in gatherer, requiring the configured basic auth or bearer token if there are any
+func metricsHandler(cfg config.MetricsConfig, gatherer prometheus.Gatherer) http.Handler {
+	handler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+	if cfg.BasicAuth == nil && cfg.BearerToken == "" {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !metricsAuthorized(cfg, r) {
+			if cfg.BasicAuth != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func metricsAuthorized(cfg config.MetricsConfig, r *http.Request) bool {
+	return authorized(r, cfg.BearerToken, cfg.BasicAuth)
+}
+
+// Reports whether the request carries the bearer token or the basic auth credentials, whichever are set
+func authorized(r *http.Request, bearerToken string, basicAuth *config.BasicAuthConfig) bool {
+	if bearerToken != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, bearerToken) {
+			return true
+		}
+	}
+	if auth := basicAuth; auth != nil {
+		username, password, ok := r.BasicAuth()
+		// Both compared regardless, so the time taken doesn't reveal which one was wrong
+		userOK := secureEqual(username, auth.Username)
+		passOK := secureEqual(password, auth.Password)
+		if ok && userOK && passOK {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares secrets in constant time
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Deletes the route's series that describe how its picks spread over its backends, after its
+// selector changed: through the backend_labels of PUT /admin/config, a cutover or its rollback, or
+// a scheduled pool switch. Backends and routes themselves only change with a restart, which starts
+// from empty metrics. The selections recorded so far are dropped too, so the fairness audit starts
+// over on the new backends instead of exporting shares of ones the route no longer picks from.
+// Returns how many series went.
+func (lb *balancer) deleteStaleSeries(route string) int {
+	labels := prometheus.Labels{"route": route}
+	deleted := lb.metrics.selectionShare.DeletePartialMatch(labels)
+	deleted += lb.metrics.selectionDivergence.DeletePartialMatch(labels)
+	if lb.fairness != nil {
+		lb.fairness.forget(route)
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d metric series of route %s after its backends changed", deleted, route)
+	}
+	return deleted
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// staleCache keeps the last good response to GET requests, to serve while no backend is healthy
+type staleCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse // By variantKey
+	vary    map[string][]string        // Request headers the responses to each cacheKey vary on
+	order   []string                   // Variant keys oldest first, for eviction
+}
+
+type cachedResponse struct {
+	key    string // cacheKey of the request, shared by the variants of a response
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newStaleCache(maxEntries int, maxBytes int64) *staleCache {
+	return &staleCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[string]*cachedResponse),
+		vary:       make(map[string][]string),
+	}
+}
+
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// Returns the key of the variant of the response to r, told apart by the request headers in vary
+func variantKey(key string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ": " + strings.Join(r.Header.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// Reports whether the response to r may be cached
+func cacheable(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Authorization") == "" && r.Header.Get("Cookie") == ""
+}
+
+// Returns the request headers a response varies on, with ok false if it can't be stored: it sets
+// a cookie, is marked no-store or private, or varies on something other than request headers
+func storableVariants(header http.Header) (vary []string, ok bool) {
+	if header.Get("Set-Cookie") != "" {
+		return nil, false
+	}
+	for _, directive := range cacheDirectives(header.Values("Cache-Control")) {
+		if slices.Contains(perUserDirectives, directiveName(directive)) {
+			return nil, false
+		}
+	}
+	for _, value := range header.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" && !slices.Contains(vary, name) {
+				vary = append(vary, name)
+			}
+		}
+	}
+	return vary, true
+}
+
+// Starts copying the response body so it can be stored once the request has finished
+func (c *staleCache) capture(w *responseWriter) {
+	w.capture = new(bytes.Buffer)
+	w.captureLimit = c.maxBytes
+}
+
+// Stores a finished response if it was a complete 200 that is allowed to be cached. A copy cut
+// short is dropped by serveAttempt, or caught here by its Content-Length.
+func (c *staleCache) store(r *http.Request, w *responseWriter) {
+	if w.capture == nil || w.statusCode != http.StatusOK {
+		return
+	}
+	if length := w.Header().Get("Content-Length"); length != "" && length != strconv.Itoa(w.capture.Len()) {
+		return
+	}
+	vary, ok := storableVariants(w.Header())
+	if !ok {
+		return
+	}
+	header := w.Header().Clone()
+	// Headers the balancer itself adds per request
+	header.Del(requestIDHeader)
+
+	key := cacheKey(r)
+	variant := variantKey(key, vary, r)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vary[key] = vary
+	if _, ok := c.entries[variant]; !ok {
+		if len(c.order) >= c.maxEntries {
+			c.evictOldest()
+		}
+		c.order = append(c.order, variant)
+	}
+	c.entries[variant] = &cachedResponse{key: key, status: w.statusCode, header: header, body: w.capture.Bytes()}
+}
+
+// Drops the oldest entry, and the headers its key varies on once no other variant has the key
+func (c *staleCache) evictOldest() {
+	evicted := c.entries[c.order[0]]
+	delete(c.entries, c.order[0])
+	c.order = c.order[1:]
+	if !slices.ContainsFunc(c.order, func(variant string) bool { return c.entries[variant].key == evicted.key }) {
+		delete(c.vary, evicted.key)
+	}
+}
+
+// Writes the cached response to r, reporting false if there is none
+func (c *staleCache) serve(w http.ResponseWriter, r *http.Request) bool {
+	key := cacheKey(r)
+	c.mu.Lock()
+	cached, ok := c.entries[variantKey(key, c.vary[key], r)]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	for name, values := range cached.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Cache", "stale")
+	w.Header().Set("Content-Length", fmt.Sprint(len(cached.body)))
+	w.WriteHeader(cached.status)
+	w.Write(cached.body)
+	return true
+}
+
+// Reports whether any of the backends is healthy with a closed circuit
+func (lb *balancer) anyAvailable(backends []*backend) bool {
+	for _, b := range backends {
+		if lb.available(b) {
+			return true
+		}
+	}
+	return false
+}
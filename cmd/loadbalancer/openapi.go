@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Path parameters such as {name} in admin endpoint patterns
+var pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+// Serves an OpenAPI 3 document describing the admin endpoints, built from their request and
+// response types so it can't drift from the handlers
+func openAPIHandler(endpoints []adminEndpoint) http.Handler {
+	doc := openAPIDocument(endpoints)
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, doc)
+	})
+}
+
+func openAPIDocument(endpoints []adminEndpoint) map[string]any {
+	errorSchema := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"error": map[string]any{"type": "string"},
+			"field": map[string]any{"type": "string", "description": "Setting that failed validation, for invalid configs"},
+		},
+	}
+
+	paths := make(map[string]map[string]any)
+	for _, endpoint := range endpoints {
+		ok := jsonContent("OK", schemaFor(reflect.TypeOf(endpoint.response)))
+		if _, binary := endpoint.response.([]byte); binary {
+			ok = map[string]any{
+				"description": "OK",
+				"content": map[string]any{
+					"application/gzip": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+				},
+			}
+		}
+		operation := map[string]any{
+			"summary":     endpoint.summary,
+			"operationId": operationID(endpoint),
+			"responses": map[string]any{
+				"200":     ok,
+				"default": jsonContent("Error", errorSchema),
+			},
+		}
+		if endpoint.request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(endpoint.request))},
+				},
+			}
+		}
+		var params []map[string]any
+		for _, match := range pathParam.FindAllStringSubmatch(endpoint.path, -1) {
+			params = append(params, map[string]any{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		if _, binary := endpoint.response.([]byte); endpoint.method == "GET" && !binary && reflect.TypeOf(endpoint.response).Kind() == reflect.Slice {
+			for _, param := range listParams {
+				params = append(params, map[string]any{
+					"name":        param.name,
+					"in":          "query",
+					"description": param.description,
+					"schema":      map[string]any{"type": param.kind},
+				})
+			}
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+
+		if paths[endpoint.path] == nil {
+			paths[endpoint.path] = make(map[string]any)
+		}
+		paths[endpoint.path][strings.ToLower(endpoint.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Load balancer admin API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+	}
+}
+
+func jsonContent(description string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+// Derives an operation ID such as putAdminBackendsIdWeight from the method and path
+func operationID(endpoint adminEndpoint) string {
+	id := strings.ToLower(endpoint.method)
+	for _, part := range strings.FieldsFunc(endpoint.path, func(r rune) bool { return strings.ContainsRune("/{}_-", r) }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// Returns the JSON schema of a type as encoding/json would write it
+func schemaFor(t reflect.Type) map[string]any {
+	if t == reflect.TypeFor[time.Time]() {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	if t == reflect.TypeFor[time.Duration]() {
+		// Written in config documents as e.g. "10s"
+		return map[string]any{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]any)
+		for i := range t.NumField() {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := fieldName(field)
+			if name == "-" {
+				continue
+			}
+			properties[name] = schemaFor(field.Type)
+		}
+		return map[string]any{"type": "object", "properties": properties}
+	default:
+		return map[string]any{}
+	}
+}
+
+// Returns the name a field is encoded under, from its json tag or, for config types, its yaml tag
+func fieldName(field reflect.StructField) string {
+	for _, tag := range []string{"json", "yaml"} {
+		if name, _, _ := strings.Cut(field.Tag.Get(tag), ","); name != "" {
+			return name
+		}
+	}
+	return field.Name
+}
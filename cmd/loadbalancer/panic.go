@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+	"github.com/vinzmyko/load-balancer/internal/health"
+)
+
+// panicGuard stops routes from piling their traffic onto the last backends passing health checks
+// once too many of them fail
+type panicGuard struct {
+	cfg      config.PanicConfig
+	fallback []*backend // Backends matching the fallback labels, for the fallback mode
+	metrics  *metrics
+}
+
+func newPanicGuard(cfg config.PanicConfig, pool []*backend, m *metrics) *panicGuard {
+	p := &panicGuard{cfg: cfg, metrics: m}
+	if cfg.Mode == config.PanicFallback {
+		p.fallback = selectByLabels(pool, cfg.FallbackLabels)
+	}
+	return p
+}
+
+// Returns the backends and round-robin position a request to rt picks from, and whether it picks
+// ignoring health checks. Outside panic the route's own backends and position are passed through.
+func (p *panicGuard) apply(rt *route, backends []*backend, next *uint64, healthChecker *health.Checker) ([]*backend, *uint64, bool) {
+	var total, failing int
+	for _, b := range backends {
+		if b.drained.Load() {
+			continue
+		}
+		total++
+		if !healthChecker.IsHealthy(b.idx) || b.breaker.IsOpen() {
+			failing++
+		}
+	}
+	panicking := total > 0 && float64(failing*100) > p.cfg.UnhealthyPercent*float64(total)
+
+	if rt.panicking.CompareAndSwap(!panicking, panicking) {
+		if panicking {
+			slog.Warn("route entered panic", "route", rt.name, "mode", p.cfg.Mode, "failing", failing, "backends", total)
+			p.metrics.routePanic.WithLabelValues(rt.name).Set(1)
+		} else {
+			slog.Info("route left panic", "route", rt.name)
+			p.metrics.routePanic.WithLabelValues(rt.name).Set(0)
+		}
+	}
+	switch {
+	case !panicking:
+		return backends, next, false
+	case p.cfg.Mode == config.PanicFallback:
+		return p.fallback, &rt.panicCounter, false
+	default:
+		return backends, next, true
+	}
+}
+
+// ignoringHealth reports every backend healthy, for picking among a panicking route's backends
+type ignoringHealth struct {
+	*health.Checker
+}
+
+func (ignoringHealth) IsHealthy(int) bool { return true }
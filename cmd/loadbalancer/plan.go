@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// planResponse is the response of POST /admin/config/plan
+type planResponse struct {
+	Backends planEntries     `json:"backends"` // Keyed by URL
+	Routes   planEntries     `json:"routes"`   // Keyed by name
+	Settings []config.Change `json:"settings"` // Changes outside backends and routes, and to their order
+
+	Live     bool             `json:"live"`              // Whether PUT /admin/config would apply it without a restart
+	Restart  []string         `json:"restart,omitempty"` // Changed settings that need a restart
+	Warnings []config.Warning `json:"warnings,omitempty"`
+}
+
+// planEntries sorts the changes to backends or routes by entry
+type planEntries struct {
+	Added   []string                   `json:"added"`
+	Removed []string                   `json:"removed"`
+	Changed map[string][]config.Change `json:"changed"` // Paths relative to the entry, e.g. weight
+}
+
+// Takes a candidate config and reports what applying it would change, without applying it
+func (lb *balancer) handlePlanConfig(w http.ResponseWriter, r *http.Request) {
+	_, desired, ok := lb.readDesiredConfig(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, planConfig(lb.currentConfig(), desired))
+}
+
+// Sorts the differences between two configs into entries added, removed and changed
+func planConfig(from, to *config.Config) planResponse {
+	plan := planResponse{
+		Backends: newPlanEntries(),
+		Routes:   newPlanEntries(),
+		Settings: []config.Change{},
+		Warnings: to.Warnings(),
+	}
+	for _, change := range config.Diff(from, to) {
+		if !liveSetting(change.Path) {
+			plan.Restart = append(plan.Restart, change.Path)
+		}
+
+		entries := &plan.Backends
+		list, rest, ok := strings.Cut(change.Path, "[")
+		switch {
+		case ok && list == "routes":
+			entries = &plan.Routes
+		case !ok || list != "backends":
+			plan.Settings = append(plan.Settings, change)
+			continue
+		}
+		// Backend URLs may hold brackets themselves, setting names never do
+		end := strings.LastIndex(rest, "]")
+		key, setting := rest[:end], strings.TrimPrefix(rest[end+1:], ".")
+		switch {
+		case setting != "":
+			entries.Changed[key] = append(entries.Changed[key], config.Change{Path: setting, From: change.From, To: change.To})
+		case change.From == nil:
+			entries.Added = append(entries.Added, key)
+		default:
+			entries.Removed = append(entries.Removed, key)
+		}
+	}
+	plan.Live = len(plan.Restart) == 0
+	return plan
+}
+
+func newPlanEntries() planEntries {
+	return planEntries{Added: []string{}, Removed: []string{}, Changed: map[string][]config.Change{}}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Reason the reaper closes a connection for, as exported in metrics. Idle connections are left to
+// the transport's own idle timeout.
+const reapMaxAge = "max_age"
+
+// connSet holds the open connections of a backend's transport
+type connSet struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+	gauge prometheus.Gauge // Kept at the number of connections, nil for none
+}
+
+func (s *connSet) add(c *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*trackedConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.export()
+}
+
+func (s *connSet) remove(c *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	s.export()
+}
+
+// Exports the number of connections to gauge from now on
+func (s *connSet) setGauge(gauge prometheus.Gauge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gauge = gauge
+	s.export()
+}
+
+func (s *connSet) export() {
+	if s.gauge != nil {
+		s.gauge.Set(float64(len(s.conns)))
+	}
+}
+
+func (s *connSet) list() []*trackedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]*trackedConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// connUse marks the connection an attempt got from the transport as busy until the attempt is done
+type connUse struct {
+	conn *trackedConn
+}
+
+func (u *connUse) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{GotConn: u.got}
+}
+
+func (u *connUse) got(info httptrace.GotConnInfo) {
+	u.done()
+	c := usedConn(info.Conn)
+	if c == nil {
+		return
+	}
+	c.busy.Add(1)
+	u.conn = c
+}
+
+// Releases the connection
+func (u *connUse) done() {
+	if u.conn == nil {
+		return
+	}
+	u.conn.busy.Add(-1)
+	u.conn = nil
+}
+
+// Returns the trackedConn under a connection handed out by the transport, which wraps it for TLS.
+// Nil if there isn't one.
+func usedConn(conn net.Conn) *trackedConn {
+	switch c := conn.(type) {
+	case *trackedConn:
+		return c
+	case interface{ NetConn() net.Conn }:
+		return usedConn(c.NetConn())
+	}
+	return nil
+}
+
+// Returns why the connection should be closed at now under policy, empty if it shouldn't. Only
+// connections no request is using are closed, including ones the transport dialed for a request
+// that went out on another connection and never handed out.
+func (c *trackedConn) expired(policy config.IdleConnectionsConfig, now time.Time) string {
+	if c.busy.Load() > 0 {
+		return ""
+	}
+	if policy.MaxAge > 0 && now.Sub(c.opened) > policy.MaxAge {
+		return reapMaxAge
+	}
+	return ""
+}
+
+// Closes the backend's connections that expired under policy, returning how many. A request can
+// still be handed one the moment it is closed, the transport then retries it on a new connection
+// where it can, as it does when the backend closes a pooled connection.
+func (b *backend) reapConnections(policy config.IdleConnectionsConfig, now time.Time) int {
+	var closed int
+	for _, c := range b.conns.list() {
+		reason := c.expired(policy, now)
+		if reason == "" {
+			continue
+		}
+		c.Close()
+		b.metrics.backendConnectionsReaped.WithLabelValues(b.cfg.URL, reason).Inc()
+		closed++
+	}
+	return closed
+}
+
+// Adds a job closing backend connections past their max age, if idle_connections sets one
+func (lb *balancer) addReaperJob() {
+	policy := lb.currentConfig().IdleConnections
+	if policy.MaxAge <= 0 {
+		return
+	}
+	lb.jobs.add("connection_reaper", every(policy.Interval), false, func(_ context.Context, now time.Time) error {
+		for _, b := range lb.pool {
+			b.reapConnections(policy, now)
+		}
+		return nil
+	})
+}
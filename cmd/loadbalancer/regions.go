@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+const (
+	regionRefresh       = time.Second // How often region health, latency and backends are reassessed
+	regionLatencyWindow = time.Minute // Span of recent attempts a region's p95 is computed over
+	regionMinSamples    = 20          // Attempts a region needs in the window before its latency counts
+)
+
+// regionSplit spreads a route's traffic across its regional pools by weight, moving the share of
+// degraded regions to the healthy ones
+type regionSplit struct {
+	route   string
+	cfg     config.RegionsConfig
+	metrics *metrics
+	regions []*region
+
+	mu          sync.Mutex
+	refreshedAt time.Time
+}
+
+// region is one regional pool of a route
+type region struct {
+	name     string
+	selector map[string]string
+	weight   int
+	counter  uint64 // Round-robin position within the region's backends
+
+	// Set by refresh, read under the split's lock
+	backends []*backend
+	degraded bool
+}
+
+func newRegionSplit(route string, cfg config.RegionsConfig, m *metrics) *regionSplit {
+	s := &regionSplit{route: route, cfg: cfg, metrics: m}
+	for _, regionCfg := range cfg.Pools {
+		s.regions = append(s.regions, &region{name: regionCfg.Name, selector: regionCfg.BackendLabels, weight: regionCfg.Weight})
+		m.regionFailedOver.WithLabelValues(route, regionCfg.Name).Set(0)
+	}
+	return s
+}
+
+// Returns the backends and round-robin position of the region a request goes to, picked by weight
+// among the weighted regions that aren't degraded, else the first healthy standby. Reports false
+// if every region is degraded, the request then goes to the route's backends as a whole.
+func (s *regionSplit) pick(routeBackends []*backend, healthChecker healthView, now time.Time) ([]*backend, *uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.refreshedAt) >= regionRefresh {
+		s.refresh(routeBackends, healthChecker, now)
+	}
+
+	total := 0
+	for _, r := range s.regions {
+		if !r.degraded {
+			total += r.weight
+		}
+	}
+	var chosen *region
+	if total > 0 {
+		n := rand.IntN(total)
+		for _, r := range s.regions {
+			if r.degraded || r.weight == 0 {
+				continue
+			}
+			if n < r.weight {
+				chosen = r
+				break
+			}
+			n -= r.weight
+		}
+	} else {
+		for _, r := range s.regions {
+			if !r.degraded {
+				chosen = r
+				break
+			}
+		}
+	}
+	if chosen == nil {
+		return nil, nil, false
+	}
+	s.metrics.regionRequests.WithLabelValues(s.route, chosen.name).Inc()
+	return chosen.backends, &chosen.counter, true
+}
+
+// Reselects each region's backends from the route's and judges whether it's degraded
+func (s *regionSplit) refresh(routeBackends []*backend, healthChecker healthView, now time.Time) {
+	s.refreshedAt = now
+	for _, r := range s.regions {
+		r.backends = selectByLabels(routeBackends, r.selector)
+
+		var available int
+		var durations []time.Duration
+		for _, b := range r.backends {
+			if healthChecker.IsHealthy(b.idx) && !b.breaker.IsOpen() && !b.drained.Load() {
+				available++
+			}
+			durations = b.latency.appendWithin(durations, now, regionLatencyWindow)
+		}
+		healthyPercent := 0.0
+		if len(r.backends) > 0 {
+			healthyPercent = 100 * float64(available) / float64(len(r.backends))
+		}
+		p95 := percentile(durations, 0.95)
+		slow := s.cfg.MaxLatency > 0 && len(durations) >= regionMinSamples && p95 > s.cfg.MaxLatency
+		degraded := available == 0 || healthyPercent < s.cfg.MinHealthyPercent || slow
+
+		if degraded == r.degraded {
+			continue
+		}
+		r.degraded = degraded
+		if degraded {
+			slog.Warn("region failed over", "route", s.route, "region", r.name, "healthy_percent", healthyPercent, "p95", p95)
+			s.metrics.regionFailedOver.WithLabelValues(s.route, r.name).Set(1)
+		} else {
+			slog.Info("region recovered", "route", s.route, "region", r.name)
+			s.metrics.regionFailedOver.WithLabelValues(s.route, r.name).Set(0)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	replayTimeout     = 30 * time.Second // Longest a replayed request may take
+	replayMaxBodySize = 1 << 20          // Response body bytes returned, the rest is cut off
+)
+
+// replayRequest is the body of a request replay. Method, path and headers take the same shape as
+// a failure journal entry's, so one can be replayed by adding the backend.
+type replayRequest struct {
+	Backend string            `json:"backend"` // ID of the backend to send the request to
+	Method  string            `json:"method"`  // GET if empty
+	Path    string            `json:"path"`    // With any query, joined onto the backend URL like proxied requests
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// replayResponse is the backend's answer to a replayed request
+type replayResponse struct {
+	Backend      string              `json:"backend"`          // ID of the backend, as in the request
+	URL          string              `json:"url"`              // Requested URL
+	Status       int                 `json:"status,omitempty"` // Left out when the request failed
+	Headers      map[string][]string `json:"headers,omitempty"`
+	Body         string              `json:"body,omitempty"`
+	BodyEncoding string              `json:"body_encoding,omitempty"` // base64 for bodies that aren't UTF-8 text
+	Truncated    bool                `json:"truncated,omitempty"`     // Body cut off at 1 MiB
+	Error        string              `json:"error,omitempty"`         // Set when the backend request failed
+	Timing       replayTiming        `json:"timing"`
+}
+
+// replayTiming breaks down how long a replayed request took. Phases that didn't happen are 0.
+type replayTiming struct {
+	DNSMs       float64 `json:"dns_ms"`
+	ConnectMs   float64 `json:"connect_ms"`
+	TLSMs       float64 `json:"tls_ms"`
+	FirstByteMs float64 `json:"first_byte_ms"` // From sending the request to the first response byte
+	TotalMs     float64 `json:"total_ms"`
+}
+
+// Sends a request to a chosen backend out of band, on a connection of its own and past routing,
+// the circuit breaker and metrics, and returns the full response with its timing
+func (lb *balancer) handleDebugReplay(w http.ResponseWriter, r *http.Request) {
+	var req replayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Backend == "" || !strings.HasPrefix(req.Path, "/") {
+		writeAdminError(w, http.StatusBadRequest, `body must be {"backend": "<id>", "method": "GET", "path": "/...", "headers": {}, "body": ""}`)
+		return
+	}
+	idx := slices.IndexFunc(lb.pool, func(b *backend) bool { return b.cfg.ID == req.Backend })
+	if idx < 0 {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("unknown backend %q", req.Backend))
+		return
+	}
+	b := lb.pool[idx]
+
+	target, err := url.Parse(b.cfg.URL)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), replayTimeout)
+	defer cancel()
+	out, err := http.NewRequestWithContext(ctx, cmp.Or(req.Method, http.MethodGet), req.Path, strings.NewReader(req.Body))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for name, value := range req.Headers {
+		out.Header.Set(name, value)
+	}
+	// Go sends out.Host rather than a Host header
+	if host := out.Header.Get("Host"); host != "" {
+		out.Host = host
+		out.Header.Del("Host")
+	}
+	backendDirector(target)(out)
+
+	log.Printf("Admin API replaying %s %s against %s", out.Method, req.Path, b.cfg.URL)
+	writeJSON(w, http.StatusOK, replay(b, out))
+}
+
+// Sends req to b on a new connection, recording the time each phase took
+func replay(b *backend, req *http.Request) replayResponse {
+	// Its own connection, so connect and TLS times are measured and the pool is left alone
+	transport := b.transport.Clone()
+	transport.DisableKeepAlives = true
+	defer transport.CloseIdleConnections()
+
+	var dnsStart, connectStart, tlsStart, wroteRequest time.Time
+	resp := replayResponse{Backend: b.cfg.ID, URL: req.URL.Redacted()}
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { resp.Timing.DNSMs = msSince(dnsStart) },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { resp.Timing.ConnectMs = msSince(connectStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { resp.Timing.TLSMs = msSince(tlsStart) },
+		WroteRequest:      func(httptrace.WroteRequestInfo) { wroteRequest = time.Now() },
+		GotFirstResponseByte: func() {
+			resp.Timing.FirstByteMs = msSince(wroteRequest)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	start := time.Now()
+	backendResp, err := transport.RoundTrip(req)
+	if err != nil {
+		resp.Error = err.Error()
+		resp.Timing.TotalMs = msSince(start)
+		return resp
+	}
+	defer backendResp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(backendResp.Body, replayMaxBodySize+1))
+	resp.Timing.TotalMs = msSince(start)
+	if err != nil {
+		resp.Error = fmt.Sprintf("failed to read response body: %v", err)
+	}
+
+	resp.Status = backendResp.StatusCode
+	resp.Headers = backendResp.Header
+	if len(body) > replayMaxBodySize {
+		body, resp.Truncated = body[:replayMaxBodySize], true
+	}
+	if utf8.Valid(body) {
+		resp.Body = string(body)
+	} else {
+		resp.Body, resp.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return resp
+}
+
+func msSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
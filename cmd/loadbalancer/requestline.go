@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Wraps the main handler to apply the server's policies for HTTP/1.0 clients and request lines
+// with an absolute URI. A request is only ever proxied to the backends of the route it matches, so
+// neither turns the balancer into a forward proxy for the host in the URI.
+func requestLinePolicy(cfg config.ServerConfig, m *metrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 1 && r.ProtoMinor == 0 {
+			switch cfg.HTTP10 {
+			case config.HTTP10Reject:
+				m.requestLineRejections.WithLabelValues("http10").Inc()
+				w.Header().Set("Connection", "close")
+				http.Error(w, "HTTP/1.0 is not supported", http.StatusHTTPVersionNotSupported)
+				return
+			case config.HTTP10Close:
+				w.Header().Set("Connection", "close")
+			}
+		}
+
+		// HTTP/2 requests always carry their path alone, the scheme and authority are separate
+		if r.URL.IsAbs() {
+			if cfg.AbsoluteForm == config.AbsoluteFormReject {
+				m.requestLineRejections.WithLabelValues("absolute_form").Inc()
+				http.Error(w, "Request line must not carry an absolute URI", http.StatusBadRequest)
+				return
+			}
+			// r.Host is already the URI's host, which takes precedence over any Host header
+			origin := *r.URL
+			origin.Scheme, origin.Opaque, origin.User, origin.Host = "", "", nil, ""
+			r = r.WithContext(r.Context())
+			r.URL = &origin
+			r.RequestURI = origin.RequestURI()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+	"github.com/vinzmyko/load-balancer/internal/resolver"
+)
+
+// How often expired backend addresses are looked up again, and expired names that weren't found
+// dropped from the resolver cache
+const (
+	dnsRefreshInterval = 10 * time.Second
+	dnsEvictInterval   = time.Minute
+)
+
+// Resolver backend connections look their hosts up through, set from the config at startup.
+// Nil dials as net.Dialer does, with the uncached system resolver.
+var backendResolver *resolver.Resolver
+
+// Creates the resolver of backend hostnames, exporting its lookups to m
+func newResolver(cfg config.ResolverConfig, m *metrics) *resolver.Resolver {
+	return &resolver.Resolver{
+		Servers:     cfg.Servers,
+		MinTTL:      cfg.MinTTL,
+		MaxTTL:      cfg.MaxTTL,
+		NegativeTTL: cfg.NegativeTTL,
+		Timeout:     cfg.Timeout,
+		OnLookup: func(host string, duration time.Duration, err error) {
+			result := lookupResult(err)
+			m.dnsLookupDuration.WithLabelValues(result).Observe(duration.Seconds())
+			if err != nil {
+				m.dnsLookupFailures.WithLabelValues(host, result).Inc()
+			}
+		},
+		OnCache: func(_ string, hit bool) {
+			if hit {
+				m.dnsCacheLookups.WithLabelValues("hit").Inc()
+			} else {
+				m.dnsCacheLookups.WithLabelValues("miss").Inc()
+			}
+		},
+	}
+}
+
+// Returns the result label of a lookup
+func lookupResult(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return "success"
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return "not_found"
+	default:
+		return "error"
+	}
+}
+
+// Dials addr with dialer, looking its host up through backendResolver if set
+func dialBackend(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	if backendResolver == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return backendResolver.Dial(ctx, dialer, network, addr)
+}
+
+// Adds the jobs keeping the backend resolver's cache fresh, if there is one
+func (lb *balancer) addResolverJobs() {
+	r := backendResolver
+	if r == nil {
+		return
+	}
+	lb.jobs.add("dns_refresh", every(dnsRefreshInterval), false, func(ctx context.Context, _ time.Time) error {
+		return r.Refresh(ctx)
+	})
+	lb.jobs.add("dns_cache_eviction", every(dnsEvictInterval), false, func(context.Context, time.Time) error {
+		r.Evict()
+		return nil
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/bodybuffer"
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+type attemptKey struct{}
+
+// attemptState is shared between proxyHandler and a proxy's ErrorHandler for a single attempt
+type attemptState struct {
+	retryable  bool     // Whether the handler may try another backend if this attempt fails
+	bodyTooBig bool     // Body wasn't fully buffered, so a failure can't be retried
+	retryOn    []string // Error classes that may be retried, empty = all
+	err        error    // Error that was left for the handler to retry, nil if the attempt completed
+	failure    error    // Error the backend request failed with, whether retried or not
+
+	backend     *backend // Backend the attempt went to, told about load signalled in its response
+	loadSignals config.LoadSignalConfig
+
+	requestStart time.Time // When the client's request arrived
+	start        time.Time // When the attempt was sent
+	serverTiming config.ServerTimingConfig
+}
+
+// Buffers the request body so it can be replayed on retries.
+// Returns nil when retries are disabled or there is no body to replay.
+func prepareRetryBody(r *http.Request, cfg config.RetryConfig) (*bodybuffer.Buffer, error) {
+	if cfg.Attempts == 0 || !hasBody(r) {
+		return nil, nil
+	}
+
+	// Known oversized bodies are streamed straight through
+	if r.ContentLength > cfg.MaxBodyBytes {
+		return nil, nil
+	}
+
+	return bodybuffer.Read(r.Body, cfg.MemoryBodyBytes, cfg.MaxBodyBytes)
+}
+
+// Returns the metrics of the balancer a request to a backend's proxy is an attempt of, requests
+// sent to the proxy directly have none
+func attemptMetrics(r *http.Request) *metrics {
+	if state, ok := r.Context().Value(attemptKey{}).(*attemptState); ok && state.backend != nil {
+		return state.backend.metrics
+	}
+	return discardMetrics
+}
+
+// Called from the ErrorHandler, remembers the error the attempt failed with
+func recordAttemptError(r *http.Request, err error) {
+	if state, ok := r.Context().Value(attemptKey{}).(*attemptState); ok {
+		state.failure = err
+	}
+}
+
+// Called from the ErrorHandler, reports whether the error should be left for proxyHandler to retry
+// instead of being written to the client
+func deferToRetry(r *http.Request, err error, class string) bool {
+	state, ok := r.Context().Value(attemptKey{}).(*attemptState)
+	if !ok {
+		return false
+	}
+
+	// No point retrying once the client is gone or the total timeout has passed
+	if r.Context().Err() != nil {
+		return false
+	}
+
+	if !state.retryable {
+		if state.bodyTooBig {
+			state.backend.metrics.retriesSkipped.WithLabelValues("body_too_large").Inc()
+		}
+		return false
+	}
+
+	if len(state.retryOn) > 0 && !slices.Contains(state.retryOn, class) {
+		state.backend.metrics.retriesSkipped.WithLabelValues("error_class").Inc()
+		return false
+	}
+
+	state.err = err
+	return true
+}
+
+// Reports whether the request carries a body that would need replaying
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+}
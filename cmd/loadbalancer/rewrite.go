@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+type rewriteKey struct{}
+
+// responseRewrite carries a route's rewrite rules to the backend's ModifyResponse
+type responseRewrite struct {
+	cfg          config.RewriteConfig
+	publicOrigin string // scheme://host of the configured public URL
+}
+
+// Attaches the route's rewrite rules to the request, if it has any
+func withRewrite(r *http.Request, cfg *config.RewriteConfig) *http.Request {
+	if cfg == nil {
+		return r
+	}
+
+	rewrite := &responseRewrite{cfg: *cfg, publicOrigin: strings.TrimSuffix(cfg.PublicURL, "/")}
+	return r.WithContext(context.WithValue(r.Context(), rewriteKey{}, rewrite))
+}
+
+// Called from ModifyResponse, replaces the backend origin with the public origin in the
+// response headers and body as configured for the request's route
+func rewriteResponse(resp *http.Response, backendURL string) error {
+	rewrite, ok := resp.Request.Context().Value(rewriteKey{}).(*responseRewrite)
+	if !ok {
+		return nil
+	}
+	target, err := url.Parse(backendURL)
+	if err != nil {
+		return err
+	}
+	backendOrigin := target.Scheme + "://" + target.Host
+	if backendOrigin == rewrite.publicOrigin {
+		return nil
+	}
+
+	if rewrite.cfg.Location {
+		for _, name := range []string{"Location", "Content-Location"} {
+			if value := resp.Header.Get(name); strings.HasPrefix(value, backendOrigin) {
+				resp.Header.Set(name, rewrite.publicOrigin+strings.TrimPrefix(value, backendOrigin))
+			}
+		}
+	}
+
+	if rewrite.cfg.Body && rewritableBody(resp, rewrite.cfg.ContentTypes) {
+		return rewriteBody(resp, backendOrigin, rewrite.publicOrigin, rewrite.cfg.MaxBodyBytes)
+	}
+	return nil
+}
+
+// Reports whether the body has one of the content types and isn't compressed
+func rewritableBody(resp *http.Response, contentTypes []string) bool {
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && slices.Contains(contentTypes, mediaType)
+}
+
+// Replaces from with to in the body. Bodies over maxBytes are passed through unchanged.
+func rewriteBody(resp *http.Response, from, to string, maxBytes int64) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxBytes {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	body = bytes.ReplaceAll(body, []byte(from), []byte(to))
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
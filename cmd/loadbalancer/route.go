@@ -0,0 +1,174 @@
+package main
+
+import (
+	"cmp"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// route sends matching requests to the backends whose labels satisfy its selector
+type route struct {
+	name    string
+	match   config.RouteMatch
+	pool    []*backend // Every backend, re-selected from when the selector changes
+	counter uint64     // Round-robin position within the route's backends
+
+	mu       sync.Mutex // Guards selector and serialises selector changes
+	selector map[string]string
+	backends atomic.Pointer[[]*backend] // Backends matching the selector
+	strategy atomic.Pointer[string]     // Overrides the top-level strategy unless nil or empty
+
+	requests      atomic.Uint64 // Requests served, for error rate checks
+	errors        atomic.Uint64 // Requests that ended in a 5xx
+	cutoverActive atomic.Bool   // Set while a blue/green cutover is being watched
+	panicking     atomic.Bool   // Set while too many of the route's backends are failing
+	panicCounter  uint64        // Round-robin position within the panic fallback backends
+
+	canary  *canary                  // nil unless the route has a canary split
+	regions *regionSplit             // nil unless the route is split across regional pools
+	rewrite *config.RewriteConfig    // nil unless responses are rewritten
+	signing *signer                  // nil unless requests must be signed
+	slo     *routeSLO                // nil unless the route has objectives
+	body    *config.BodyPolicyConfig // nil unless request bodies are checked
+
+	cacheControl *config.CacheControlConfig // nil unless caching headers are overridden
+	local        *config.LocalConfig        // nil unless the route answers some requests itself
+	annotations  http.Header                // Set on the requests forwarded on the route, nil for none
+}
+
+// Creates the configured routes followed by a catch-all default route over every backend
+func buildRoutes(routeCfgs []config.RouteConfig, pool []*backend, m *metrics) []*route {
+	routes := make([]*route, 0, len(routeCfgs)+1)
+	for _, routeCfg := range routeCfgs {
+		rt := newRoute(routeCfg.Name, routeCfg.Match, routeCfg.BackendLabels, pool)
+		if routeCfg.Canary != nil {
+			rt.canary = newCanary(rt.name, *routeCfg.Canary, pool, m)
+		}
+		if routeCfg.Regions != nil {
+			rt.regions = newRegionSplit(rt.name, *routeCfg.Regions, m)
+		}
+		rt.rewrite = routeCfg.Rewrite
+		rt.body = routeCfg.Body
+		rt.cacheControl = routeCfg.CacheControl
+		rt.local = routeCfg.Local
+		rt.annotations = annotationHeaders(routeCfg.Annotations)
+		if routeCfg.Strategy != "" {
+			rt.setStrategy(routeCfg.Strategy)
+		}
+		if routeCfg.SLO != nil {
+			rt.slo = newRouteSLO(rt.name, *routeCfg.SLO, m)
+		}
+		if routeCfg.Signing != nil {
+			rt.signing = newSigner(*routeCfg.Signing)
+		}
+		routes = append(routes, rt)
+	}
+
+	return append(routes, newRoute("default", config.RouteMatch{}, nil, pool))
+}
+
+func newRoute(name string, match config.RouteMatch, selector map[string]string, pool []*backend) *route {
+	rt := &route{name: name, match: match, pool: pool, selector: selector}
+	backends := selectByLabels(pool, selector)
+	rt.backends.Store(&backends)
+	return rt
+}
+
+// Returns the backends carrying all the labels in selector
+func selectByLabels(pool []*backend, selector map[string]string) []*backend {
+	var selected []*backend
+	for _, b := range pool {
+		if b.hasLabels(selector) {
+			selected = append(selected, b)
+		}
+	}
+	return selected
+}
+
+// Returns the first route matching the request, the default route always matches
+func matchRoute(routes []*route, r *http.Request) *route {
+	for _, rt := range routes {
+		if rt.matches(r) {
+			return rt
+		}
+	}
+	return routes[len(routes)-1]
+}
+
+func (rt *route) matches(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, rt.match.PathPrefix) {
+		return false
+	}
+	for name, value := range rt.match.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the backends the route currently sends traffic to
+func (rt *route) currentBackends() []*backend {
+	return *rt.backends.Load()
+}
+
+// Returns a copy of the route's current label selector
+func (rt *route) currentSelector() map[string]string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return maps.Clone(rt.selector)
+}
+
+// Atomically points the route at the backends matching selector. Requests already
+// in progress finish on the backends they were sent to.
+func (rt *route) setSelector(selector map[string]string, backends []*backend) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.selector = selector
+	rt.backends.Store(&backends)
+}
+
+// Points the route at new backends and deletes its metric series about the ones it picked from before
+func (lb *balancer) setRouteSelector(rt *route, selector map[string]string, backends []*backend) {
+	rt.setSelector(selector, backends)
+	lb.deleteStaleSeries(rt.name)
+}
+
+// Returns the strategy the route balances with, fallback being the top-level one
+func (rt *route) currentStrategy(fallback string) string {
+	if strategy := rt.strategy.Load(); strategy != nil && *strategy != "" {
+		return *strategy
+	}
+	return cmp.Or(fallback, config.StrategyRoundRobin)
+}
+
+// Switches the route to another strategy, empty to inherit the top-level one. Nothing is reset:
+// in-flight counts live on the backends and the round-robin position on the route, and every
+// strategy reads them, so requests in progress finish where they are and the first pick of the
+// new strategy already balances against them.
+func (rt *route) setStrategy(strategy string) {
+	rt.strategy.Store(&strategy)
+}
+
+// Logs a switch of the route's effective strategy
+func (rt *route) announceStrategy(from, to string) {
+	var inflight int64
+	for _, b := range rt.currentBackends() {
+		inflight += b.inflight.Load()
+	}
+	log.Printf("Route %s switched strategy from %s to %s, carrying over %d in-flight requests", rt.name, from, to, inflight)
+}
+
+// Records the outcome of a request served by the route
+func (rt *route) record(status int) {
+	rt.requests.Add(1)
+	if status >= 500 {
+		rt.errors.Add(1)
+	}
+}
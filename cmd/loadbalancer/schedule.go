@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+	"github.com/vinzmyko/load-balancer/internal/cron"
+)
+
+// Adds a job per configured schedule, applying its actions each time it fires
+func (lb *balancer) addScheduleJobs() {
+	for _, scheduleCfg := range lb.currentConfig().Schedules {
+		schedule, err := cron.Parse(scheduleCfg.Cron)
+		if err != nil {
+			// Already checked by config validation
+			log.Printf("Skipping schedule %s: %v", scheduleCfg.Name, err)
+			continue
+		}
+		lb.jobs.add("schedule:"+scheduleCfg.Name, schedule.Next, false, func(context.Context, time.Time) error {
+			lb.applySchedule(scheduleCfg)
+			return nil
+		})
+	}
+}
+
+// Applies the weight, maintenance mode and pool changes of a schedule
+func (lb *balancer) applySchedule(scheduleCfg config.ScheduleConfig) {
+	log.Printf("Applying schedule %s", scheduleCfg.Name)
+
+	backends := lb.currentConfig().Backends
+	for _, b := range lb.pool {
+		// By the ID of the config entry, so every address of a resolved entry gets the weight
+		if weight, ok := scheduleCfg.Weights[backends[b.entry].ID]; ok {
+			lb.setBackendWeight(b, int64(weight))
+			log.Printf("Schedule %s set weight of %s to %d", scheduleCfg.Name, b.cfg.ID, weight)
+		}
+	}
+
+	if scheduleCfg.Maintenance != nil {
+		lb.maintenance.Store(*scheduleCfg.Maintenance)
+		log.Printf("Schedule %s turned maintenance mode %s", scheduleCfg.Name, onOff(*scheduleCfg.Maintenance))
+	}
+
+	if scheduleCfg.Route != "" {
+		rt := lb.route(scheduleCfg.Route)
+		if rt == nil {
+			log.Printf("Schedule %s refers to unknown route %s", scheduleCfg.Name, scheduleCfg.Route)
+			return
+		}
+		selector := maps.Clone(rt.currentSelector())
+		if selector == nil {
+			selector = make(map[string]string)
+		}
+		selector[poolLabel] = scheduleCfg.Pool
+
+		backends := selectByLabels(rt.pool, selector)
+		if len(backends) == 0 {
+			log.Printf("Schedule %s: pool %s has no backends for route %s, leaving it unchanged", scheduleCfg.Name, scheduleCfg.Pool, rt.name)
+			return
+		}
+		lb.setRouteSelector(rt, selector, backends)
+		log.Printf("Schedule %s switched route %s to pool %s", scheduleCfg.Name, rt.name, scheduleCfg.Pool)
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Called from ModifyResponse, adds Server-Timing entries for the time the request spent in the
+// balancer before the attempt that answered it was sent (queueing, buffering and failed attempts),
+// the backend's time to response headers, and the total. Later browser and CDN entries append.
+func addServerTiming(resp *http.Response) {
+	state, ok := resp.Request.Context().Value(attemptKey{}).(*attemptState)
+	if !ok || !state.serverTiming.Enabled {
+		return
+	}
+	now := time.Now()
+	if state.serverTiming.StripBackend {
+		resp.Header.Del("Server-Timing")
+	}
+	resp.Header.Add("Server-Timing", fmt.Sprintf("lb;dur=%.1f, backend;dur=%.1f, total;dur=%.1f",
+		milliseconds(state.start.Sub(state.requestStart)),
+		milliseconds(now.Sub(state.start)),
+		milliseconds(now.Sub(state.requestStart)),
+	))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Class of requests that match no priority class when no default class is configured
+var unclassified = config.PriorityClassConfig{Name: "unclassified", ShedAtPercent: 100}
+
+// loadShedder admits requests while the balancer has capacity. Each priority class has its own
+// threshold, so as load rises the lowest classes are rejected first and the remaining capacity
+// is kept for higher priority traffic.
+type loadShedder struct {
+	cfg          config.LoadSheddingConfig
+	defaultClass config.PriorityClassConfig
+	inflight     atomic.Int64
+	metrics      *metrics
+}
+
+// Returns nil when load shedding is disabled
+func newLoadShedder(cfg config.LoadSheddingConfig, m *metrics) *loadShedder {
+	if cfg.MaxInflight == 0 {
+		return nil
+	}
+
+	ls := &loadShedder{cfg: cfg, defaultClass: unclassified, metrics: m}
+	for _, class := range cfg.Classes {
+		if class.Name == cfg.DefaultClass {
+			ls.defaultClass = class
+		}
+	}
+	return ls
+}
+
+// Returns the priority class of a request on the given route
+func (ls *loadShedder) classify(r *http.Request, routeName string) config.PriorityClassConfig {
+	for _, class := range ls.cfg.Classes {
+		if len(class.Routes) > 0 && !slices.Contains(class.Routes, routeName) {
+			continue
+		}
+		if len(class.Routes) == 0 && len(class.Headers) == 0 {
+			continue
+		}
+		matches := true
+		for name, value := range class.Headers {
+			if r.Header.Get(name) != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return class
+		}
+	}
+	return ls.defaultClass
+}
+
+// Takes a slot for a request of the given class, returning false if the class is being shed.
+// Admitted requests must call release when done.
+func (ls *loadShedder) admit(class config.PriorityClassConfig) bool {
+	limit := int64(ls.cfg.MaxInflight * class.ShedAtPercent / 100)
+	if ls.inflight.Add(1) > limit {
+		ls.inflight.Add(-1)
+		ls.metrics.shedRequests.WithLabelValues(class.Name).Inc()
+		return false
+	}
+	ls.metrics.priorityRequests.WithLabelValues(class.Name).Inc()
+	ls.metrics.priorityInflight.WithLabelValues(class.Name).Inc()
+	return true
+}
+
+func (ls *loadShedder) release(class config.PriorityClassConfig) {
+	ls.inflight.Add(-1)
+	ls.metrics.priorityInflight.WithLabelValues(class.Name).Dec()
+}
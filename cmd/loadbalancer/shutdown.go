@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// shutdownStage is one step of the shutdown sequence
+type shutdownStage struct {
+	name    string
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+// Runs the stages one after another, each within its own timeout. A stage that fails or runs out
+// of time is logged and the sequence carries on, so the stages after it still release what they hold.
+func shutdown(stages []shutdownStage) {
+	for _, stage := range stages {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), stage.timeout)
+		err := stage.run(ctx)
+		cancel()
+		took := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			log.Printf("Shutdown stage %s failed after %s: %v", stage.name, took, err)
+			continue
+		}
+		log.Printf("Shutdown stage %s done in %s", stage.name, took)
+	}
+}
+
+// Waits for wait to return, or until ctx is done
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeOnceListener is a listener that can be closed ahead of the server serving it, which closes
+// it again as it shuts down
+type closeOnceListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (l *closeOnceListener) Close() error {
+	l.once.Do(func() { l.err = l.Listener.Close() })
+	return l.err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Reasons a signed route rejects a request, used as the metric label
+const (
+	signatureMissing   = "missing"
+	signatureExpired   = "expired"
+	signatureInvalid   = "invalid"
+	signatureReplayed  = "replayed"
+	signatureBodyLarge = "body_too_large"
+	signatureCacheFull = "replay_cache_full" // Valid, but more signatures are in the skew window than the cache holds
+)
+
+// signer verifies the HMAC signatures of a route's requests
+type signer struct {
+	cfg    config.SigningConfig
+	replay *replayCache
+}
+
+func newSigner(cfg config.SigningConfig) *signer {
+	return &signer{cfg: cfg, replay: newReplayCache(cfg.ReplayCache)}
+}
+
+// Checks the request's signature, returning the reason it was rejected or "" if it is valid.
+// The body is read to check it and replaced so it can still be forwarded.
+func (s *signer) verify(r *http.Request, now time.Time) string {
+	signature, err := hex.DecodeString(r.Header.Get(s.cfg.Header))
+	timestamp := r.Header.Get(s.cfg.TimestampHeader)
+	if err != nil || len(signature) == 0 || timestamp == "" {
+		return signatureMissing
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return signatureMissing
+	}
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-s.cfg.MaxSkew)) || signedAt.After(now.Add(s.cfg.MaxSkew)) {
+		return signatureExpired
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.cfg.Key))
+	io.WriteString(mac, timestamp+"\n"+r.Method+"\n"+r.URL.RequestURI()+"\n")
+	if hasBody(r) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, s.cfg.MaxBodyBytes+1))
+		if err != nil {
+			return signatureInvalid
+		}
+		if int64(len(body)) > s.cfg.MaxBodyBytes {
+			return signatureBodyLarge
+		}
+		mac.Write(body)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{bytes.NewReader(body), r.Body}
+	}
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return signatureInvalid
+	}
+
+	// Checked last so forged signatures can't fill the cache. Once the timestamp is past the skew
+	// window the request is rejected as expired anyway, so that's when a signature can be forgotten.
+	return s.replay.add(string(signature), signedAt.Add(s.cfg.MaxSkew), now)
+}
+
+// replayCache remembers the signatures seen until their timestamp leaves the skew window, up to a
+// fixed number. When it's full new signatures are refused, forgetting one that can still be
+// replayed would let it through.
+type replayCache struct {
+	mu         sync.Mutex
+	seen       map[string]time.Time // Signature to when it can be forgotten
+	nextExpiry time.Time            // Earliest of those, nothing can be forgotten before
+	limit      int
+}
+
+func newReplayCache(limit int) *replayCache {
+	return &replayCache{seen: make(map[string]time.Time), limit: limit}
+}
+
+// Records a signature, returning why it was refused: signatureReplayed if it was already seen and
+// hasn't expired, signatureCacheFull if there's no room for it. Empty if it was recorded.
+func (c *replayCache) add(signature string, expires, now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until, ok := c.seen[signature]; ok && now.Before(until) {
+		return signatureReplayed
+	}
+
+	if len(c.seen) >= c.limit && !now.Before(c.nextExpiry) {
+		c.nextExpiry = time.Time{}
+		for seen, until := range c.seen {
+			if !now.Before(until) {
+				delete(c.seen, seen)
+			} else if c.nextExpiry.IsZero() || until.Before(c.nextExpiry) {
+				c.nextExpiry = until
+			}
+		}
+	}
+	if len(c.seen) >= c.limit {
+		return signatureCacheFull
+	}
+	c.seen[signature] = expires
+	if c.nextExpiry.IsZero() || expires.Before(c.nextExpiry) {
+		c.nextExpiry = expires
+	}
+	return ""
+}
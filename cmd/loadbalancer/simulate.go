@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+	"github.com/vinzmyko/load-balancer/internal/health"
+)
+
+// Timestamp the standard logger prefixes access log lines with
+const accessLogTimeLayout = "2006/01/02 15:04:05"
+
+// simRequest is one request replayed by the simulator
+type simRequest struct {
+	method   string
+	path     string
+	header   http.Header
+	arrival  time.Duration // Since the first request
+	duration time.Duration // How long the backend holds it
+}
+
+// simSpec describes synthetic traffic to simulate instead of an access log
+type simSpec struct {
+	Rate     float64          `yaml:"rate"`     // Requests per second
+	Requests int              `yaml:"requests"` // Total to send
+	Mix      []simSpecRequest `yaml:"mix"`
+}
+
+type simSpecRequest struct {
+	Method   string            `yaml:"method"`
+	Path     string            `yaml:"path"`
+	Headers  map[string]string `yaml:"headers"`
+	Weight   int               `yaml:"weight"`   // Share of the mix, default 1
+	Duration time.Duration     `yaml:"duration"` // Backend response time
+}
+
+// Runs the simulate subcommand, which replays an access log or a traffic spec through a config's
+// routing and strategy offline and prints where the requests would have gone
+func runSimulate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFile := flags.String("config", configPath, "config to simulate")
+	logFile := flags.String("log", "", "access log to replay")
+	specFile := flags.String("spec", "", "YAML traffic spec to generate requests from")
+	down := flags.String("down", "", "comma separated IDs of backends to treat as unhealthy")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if (*logFile == "") == (*specFile == "") {
+		fmt.Fprintln(stderr, "simulate needs exactly one of -log or -spec")
+		return 2
+	}
+
+	requests, err := loadSimRequests(*logFile, *specFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load traffic: %v\n", err)
+		return 1
+	}
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load config: %s\n", describeConfigError(err))
+		return 1
+	}
+	lb, err := newSimBalancer(cfg, *down)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to set up simulation: %v\n", err)
+		return 1
+	}
+	simulate(lb, requests).print(stdout)
+	return 0
+}
+
+func loadSimRequests(logFile, specFile string) ([]simRequest, error) {
+	name := logFile
+	if name == "" {
+		name = specFile
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	if logFile != "" {
+		return parseAccessLog(f)
+	}
+	var spec simSpec
+	if err := yaml.NewDecoder(f).Decode(&spec); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return spec.generate()
+}
+
+// Reads the request lines of an access log written by the balancer. Lines are logged when a
+// request finishes with one second resolution, so requests logged in the same second are
+// spread across it and each arrives its duration before it finished.
+func parseAccessLog(r io.Reader) ([]simRequest, error) {
+	type logged struct {
+		req      simRequest
+		finished time.Time
+	}
+	var lines []logged
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		_, attrs, ok := strings.Cut(line, " INFO request ")
+		if !ok {
+			continue
+		}
+		fields := parseLogAttrs(attrs)
+		if fields["path"] == "" {
+			continue
+		}
+		req := simRequest{method: fields["method"], path: fields["path"], header: make(http.Header)}
+		if ms, err := strconv.ParseFloat(fields["duration_ms"], 64); err == nil {
+			req.duration = time.Duration(ms * float64(time.Millisecond))
+		}
+		finished, _ := time.Parse(accessLogTimeLayout, line[:min(len(accessLogTimeLayout), len(line))])
+		lines = append(lines, logged{req, finished})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read access log: %w", err)
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("no request lines in access log")
+	}
+
+	requests := make([]simRequest, len(lines))
+	start := lines[0].finished
+	for i := 0; i < len(lines); {
+		// Lines logged in the same second
+		end := i + 1
+		for end < len(lines) && lines[end].finished.Equal(lines[i].finished) {
+			end++
+		}
+		for j := i; j < end; j++ {
+			offset := lines[j].finished.Sub(start) + time.Second*time.Duration(j-i)/time.Duration(end-i)
+			requests[j] = lines[j].req
+			requests[j].arrival = offset - lines[j].req.duration
+		}
+		i = end
+	}
+	slices.SortStableFunc(requests, func(a, b simRequest) int { return cmp.Compare(a.arrival, b.arrival) })
+	return requests, nil
+}
+
+// Splits key=value pairs as written by slog's text handler, which quotes values with spaces
+func parseLogAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				break
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+		attrs[key] = value
+		s = rest
+	}
+	return attrs
+}
+
+// Generates the spec's requests at its rate, picking from the mix with a fixed seed so runs
+// against different configs see the same traffic
+func (s simSpec) generate() ([]simRequest, error) {
+	if s.Rate <= 0 || s.Requests <= 0 || len(s.Mix) == 0 {
+		return nil, errors.New("traffic spec needs a positive rate and requests and at least one mix entry")
+	}
+	var total int
+	for _, entry := range s.Mix {
+		if entry.Path == "" {
+			return nil, errors.New("every mix entry needs a path")
+		}
+		total += max(entry.Weight, 1)
+	}
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	interval := time.Duration(float64(time.Second) / s.Rate)
+	requests := make([]simRequest, s.Requests)
+	for i := range requests {
+		pick := rng.IntN(total)
+		entry := s.Mix[0]
+		for _, candidate := range s.Mix {
+			if pick -= max(candidate.Weight, 1); pick < 0 {
+				entry = candidate
+				break
+			}
+		}
+		header := make(http.Header)
+		for name, value := range entry.Headers {
+			header.Set(name, value)
+		}
+		requests[i] = simRequest{
+			method:   cmp.Or(entry.Method, http.MethodGet),
+			path:     entry.Path,
+			header:   header,
+			arrival:  time.Duration(i) * interval,
+			duration: entry.Duration,
+		}
+	}
+	return requests, nil
+}
+
+// Builds a balancer for cfg that never sends anything, with every backend healthy except those in down.
+// Entries with resolve set aren't resolved offline, each stands for all of its addresses.
+func newSimBalancer(cfg *config.Config, down string) (*balancer, error) {
+	pool := make([]*backend, len(cfg.Backends))
+	for i, backendCfg := range cfg.Backends {
+		var err error
+		pool[i], err = newBackend(i, backendCfg, cfg.Timeouts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backend %s: %w", backendCfg.URL, err)
+		}
+	}
+	hc := health.NewChecker(len(pool))
+	for _, id := range strings.Split(down, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		idx := slices.IndexFunc(pool, func(b *backend) bool { return b.cfg.ID == id })
+		if idx == -1 {
+			return nil, fmt.Errorf("no backend with id %q", id)
+		}
+		hc.SetHealthy(idx, false)
+	}
+	return newBalancer(pool, cfg, hc), nil
+}
+
+// simResult is where simulated requests went
+type simResult struct {
+	routes    []string                  // In config order
+	counts    map[string]map[string]int // Requests per route and backend ID
+	noBackend map[string]int            // Requests per route that found no available backend
+	peak      map[string]int64          // Most requests a backend held at once
+	backends  []string                  // Backend IDs in config order
+}
+
+// Replays requests through the balancer's routing and strategy, holding each on its backend for
+// its duration so in-flight counts, and so least connections and spilling, behave as they would.
+// Backends are chosen as ServeHTTP chooses them, on a clock that starts now and moves with the
+// requests' arrivals, and completed requests feed the latencies deadlines and regions go by.
+func simulate(lb *balancer, requests []simRequest) *simResult {
+	cfg := lb.currentConfig()
+	result := &simResult{
+		counts:    make(map[string]map[string]int),
+		noBackend: make(map[string]int),
+		peak:      make(map[string]int64),
+	}
+	for _, rt := range lb.routes {
+		result.routes = append(result.routes, rt.name)
+	}
+	for _, b := range lb.pool {
+		result.backends = append(result.backends, b.cfg.ID)
+	}
+
+	start := time.Now()
+	var active simCompletions
+	for _, sr := range requests {
+		for len(active) > 0 && active[0].at <= sr.arrival {
+			done := heap.Pop(&active).(simCompletion)
+			done.backend.inflight.Add(-1)
+			done.backend.latency.record(start.Add(done.at), done.took)
+		}
+		now := start.Add(sr.arrival)
+
+		r, err := http.NewRequest(sr.method, sr.path, nil)
+		if err != nil {
+			continue
+		}
+		r.Header = sr.header
+		if cfg.Timeouts.Total > 0 {
+			// Only the deadline is read, for the time budget
+			ctx, cancel := context.WithDeadline(r.Context(), now.Add(cfg.Timeouts.Total))
+			cancel()
+			r = r.WithContext(ctx)
+		}
+		rt := matchRoute(lb.routes, r)
+		choice := lb.chooseBackends(rt, lb.synthetic != nil && lb.synthetic.matches(r), now)
+		if len(choice.backends) == 0 || !lb.anyChoice(choice) {
+			result.noBackend[rt.name]++
+			continue
+		}
+
+		var budget time.Duration
+		hasBudget := false
+		if lb.deadlines != nil {
+			budget, hasBudget = lb.deadlines.budget(r, now)
+		}
+		exclude := lb.skipped(rt, choice, nil, budget, hasBudget, now)
+		b := choice.backends[pickBackend(rt.currentStrategy(cfg.Strategy), choice.backends, choice.view, exclude, choice.next)]
+		if result.counts[rt.name] == nil {
+			result.counts[rt.name] = make(map[string]int)
+		}
+		result.counts[rt.name][b.cfg.ID]++
+		result.peak[b.cfg.ID] = max(result.peak[b.cfg.ID], b.inflight.Add(1))
+		heap.Push(&active, simCompletion{sr.arrival + sr.duration, sr.duration, b})
+	}
+	for _, c := range active {
+		c.backend.inflight.Add(-1)
+	}
+	return result
+}
+
+func (res *simResult) print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tBACKEND\tREQUESTS\tSHARE")
+	for _, route := range res.routes {
+		var total int
+		for _, n := range res.counts[route] {
+			total += n
+		}
+		total += res.noBackend[route]
+		if total == 0 {
+			continue
+		}
+		for _, id := range res.backends {
+			if n := res.counts[route][id]; n > 0 {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%.1f%%\n", route, id, n, 100*float64(n)/float64(total))
+			}
+		}
+		if n := res.noBackend[route]; n > 0 {
+			fmt.Fprintf(tw, "%s\t(none available)\t%d\t%.1f%%\n", route, n, 100*float64(n)/float64(total))
+		}
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "BACKEND\tPEAK IN-FLIGHT")
+	for _, id := range res.backends {
+		fmt.Fprintf(tw, "%s\t%d\n", id, res.peak[id])
+	}
+	tw.Flush()
+}
+
+// simCompletion is when a simulated request frees its backend
+type simCompletion struct {
+	at      time.Duration
+	took    time.Duration
+	backend *backend
+}
+
+// simCompletions is a min-heap of completions by time
+type simCompletions []simCompletion
+
+func (h simCompletions) Len() int           { return len(h) }
+func (h simCompletions) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h simCompletions) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *simCompletions) Push(x any)        { *h = append(*h, x.(simCompletion)) }
+func (h *simCompletions) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Windows burn rates are exported over, short ones catch fast burns and long ones slow leaks
+var sloBurnWindows = []struct {
+	name   string
+	length time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+// How often the SLO metrics are recomputed
+const sloExportInterval = 15 * time.Second
+
+// sloCounts are request outcomes over some span of time
+type sloCounts struct {
+	requests uint64
+	errors   uint64 // Ended in a 5xx
+	slow     uint64 // Took longer than the latency objective
+}
+
+// routeSLO tracks a route's requests against its objectives
+type routeSLO struct {
+	route   string
+	cfg     config.SLOConfig
+	metrics *metrics
+
+	mu      sync.Mutex
+	minutes sloRing // Covers the longest burn rate window
+	hours   sloRing // Covers the error budget period
+}
+
+func newRouteSLO(route string, cfg config.SLOConfig, m *metrics) *routeSLO {
+	longest := sloBurnWindows[len(sloBurnWindows)-1].length
+	s := &routeSLO{
+		route:   route,
+		cfg:     cfg,
+		metrics: m,
+		minutes: newSLORing(time.Minute, longest),
+		hours:   newSLORing(time.Hour, cfg.Period),
+	}
+	if cfg.Availability > 0 {
+		m.sloObjective.WithLabelValues(route, "availability").Set(cfg.Availability / 100)
+	}
+	if cfg.Latency > 0 {
+		m.sloObjective.WithLabelValues(route, "latency").Set(cfg.LatencyTarget / 100)
+	}
+	return s
+}
+
+// Records a request served on the route
+func (s *routeSLO) record(status int, duration time.Duration, now time.Time) {
+	counts := sloCounts{requests: 1}
+	if status >= 500 {
+		counts.errors = 1
+	}
+	if s.cfg.Latency > 0 && duration > s.cfg.Latency {
+		counts.slow = 1
+	}
+	s.mu.Lock()
+	s.minutes.add(now, counts)
+	s.hours.add(now, counts)
+	s.mu.Unlock()
+}
+
+// Sets the burn rate and error budget gauges from the requests seen up to now
+func (s *routeSLO) export(now time.Time) {
+	s.mu.Lock()
+	windows := make([]sloCounts, len(sloBurnWindows))
+	for i, window := range sloBurnWindows {
+		windows[i] = s.minutes.sum(now, window.length)
+	}
+	period := s.hours.sum(now, s.cfg.Period)
+	s.mu.Unlock()
+
+	objectives := []struct {
+		name    string
+		enabled bool
+		target  float64
+		bad     func(sloCounts) uint64
+	}{
+		{"availability", s.cfg.Availability > 0, s.cfg.Availability, func(c sloCounts) uint64 { return c.errors }},
+		{"latency", s.cfg.Latency > 0, s.cfg.LatencyTarget, func(c sloCounts) uint64 { return c.slow }},
+	}
+	for _, objective := range objectives {
+		if !objective.enabled {
+			continue
+		}
+		budget := 1 - objective.target/100
+		for i, window := range sloBurnWindows {
+			s.metrics.sloBurnRate.WithLabelValues(s.route, objective.name, window.name).Set(burnRate(objective.bad(windows[i]), windows[i].requests, budget))
+		}
+		// 1 with nothing spent, 0 once the period's budget is used up and negative beyond that
+		s.metrics.sloBudgetRemaining.WithLabelValues(s.route, objective.name).Set(1 - burnRate(objective.bad(period), period.requests, budget))
+	}
+}
+
+// Returns how many times faster than sustainable the budget is being spent: the bad fraction
+// of requests over the fraction the objective allows
+func burnRate(bad, requests uint64, budget float64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return float64(bad) / float64(requests) / budget
+}
+
+// Adds a job recomputing every route's SLO metrics
+func (lb *balancer) addSLOJob() {
+	var slos []*routeSLO
+	for _, rt := range lb.routes {
+		if rt.slo != nil {
+			slos = append(slos, rt.slo)
+		}
+	}
+	if len(slos) == 0 {
+		return
+	}
+	lb.jobs.add("slo_export", every(sloExportInterval), false, func(_ context.Context, now time.Time) error {
+		for _, slo := range slos {
+			slo.export(now)
+		}
+		return nil
+	})
+}
+
+// sloRing holds counts in fixed width buckets, overwriting the oldest as time moves on
+type sloRing struct {
+	width   time.Duration
+	buckets []sloCounts
+	starts  []int64 // Bucket number, time divided by width, each slot currently holds
+}
+
+func newSLORing(width, span time.Duration) sloRing {
+	n := int(span / width)
+	return sloRing{width: width, buckets: make([]sloCounts, n), starts: make([]int64, n)}
+}
+
+func (r *sloRing) add(now time.Time, counts sloCounts) {
+	bucket := now.UnixNano() / int64(r.width)
+	slot := int(bucket % int64(len(r.buckets)))
+	if r.starts[slot] != bucket {
+		r.starts[slot] = bucket
+		r.buckets[slot] = sloCounts{}
+	}
+	r.buckets[slot].requests += counts.requests
+	r.buckets[slot].errors += counts.errors
+	r.buckets[slot].slow += counts.slow
+}
+
+// Sums the buckets of the window ending now, the current bucket counting in full
+func (r *sloRing) sum(now time.Time, window time.Duration) sloCounts {
+	current := now.UnixNano() / int64(r.width)
+	oldest := current - int64(window/r.width) + 1
+	var total sloCounts
+	for slot, start := range r.starts {
+		if start >= oldest && start <= current {
+			total.requests += r.buckets[slot].requests
+			total.errors += r.buckets[slot].errors
+			total.slow += r.buckets[slot].slow
+		}
+	}
+	return total
+}
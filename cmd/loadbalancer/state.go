@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/circuitbreaker"
+)
+
+// savedState is what is written to the state file on shutdown
+type savedState struct {
+	SavedAt  time.Time      `json:"saved_at"`
+	Backends []savedBackend `json:"backends"`
+}
+
+// savedBackend is a backend's state, matched up by URL and address when restoring
+type savedBackend struct {
+	URL     string                  `json:"url"`
+	Address string                  `json:"address,omitempty"` // Set for the addresses of resolved backends
+	Healthy bool                    `json:"healthy"`
+	Circuit circuitbreaker.Snapshot `json:"circuit"`
+}
+
+// Writes every backend's health and circuit breaker state to path
+func (lb *balancer) saveState(path string) error {
+	state := savedState{SavedAt: time.Now()}
+	for _, b := range lb.pool {
+		state.Backends = append(state.Backends, savedBackend{
+			URL:     b.cfg.URL,
+			Address: b.addr,
+			Healthy: lb.healthChecker.IsHealthy(b.idx),
+			Circuit: b.breaker.Snapshot(),
+		})
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	// Written next to the target and renamed over it so a crash never leaves half a file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
+
+// Restores backend state saved at most maxAge ago. A missing file isn't an error, and backends
+// that were added since the state was saved keep their defaults.
+func (lb *balancer) restoreState(path string, maxAge time.Duration) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to decode state file: %w", err)
+	}
+	if age := time.Since(state.SavedAt); age > maxAge {
+		log.Printf("Ignoring saved state from %s ago, older than %s", age.Round(time.Second), maxAge)
+		return nil
+	}
+
+	saved := make(map[[2]string]savedBackend, len(state.Backends))
+	for _, sb := range state.Backends {
+		saved[[2]string{sb.URL, sb.Address}] = sb
+	}
+	restored := 0
+	for _, b := range lb.pool {
+		sb, ok := saved[[2]string{b.cfg.URL, b.addr}]
+		if !ok {
+			continue
+		}
+		lb.healthChecker.SetHealthy(b.idx, sb.Healthy)
+		if sb.Healthy {
+			lb.metrics.backendHealthy.WithLabelValues(b.cfg.URL, b.cfg.ID).Set(1)
+		} else {
+			lb.metrics.backendHealthy.WithLabelValues(b.cfg.URL, b.cfg.ID).Set(0)
+		}
+		b.breaker.Restore(sb.Circuit)
+		restored++
+	}
+	log.Printf("Restored state of %d backends saved at %s", restored, state.SavedAt.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// healthView is the backend health selection goes by, the health checker's own unless a route is
+// in panic
+type healthView interface {
+	IsHealthy(idx int) bool
+	Latency(idx int) time.Duration
+}
+
+// Picks a backend for a request using the configured strategy, skipping backends in exclude while others are available.
+// next is the caller's round-robin position, it advances on every call.
+func pickBackend(strategy string, backends []*backend, healthChecker healthView, exclude map[int]bool, next *uint64) int {
+	pos := atomic.AddUint64(next, 1)
+
+	switch strategy {
+	case config.StrategyWeightedLeastConnections:
+		return selectWeightedLeastConnections(backends, healthChecker, exclude, pos)
+	case config.StrategyProbeLatency:
+		return selectProbeLatency(backends, healthChecker, exclude, pos)
+	default:
+		return selectBackendExcluding(backends, healthChecker, exclude, pos)
+	}
+}
+
+// Reports whether a backend can take a request. Full backends are only used once every other backend is full as well.
+func usable(b *backend, healthChecker healthView, excluded bool, allowFull bool) bool {
+	if excluded {
+		return false
+	}
+
+	if !healthChecker.IsHealthy(b.idx) {
+		return false
+	}
+
+	if b.drained.Load() || b.warmup.warming.Load() || !b.breaker.CanAttempt() {
+		return false
+	}
+
+	return allowFull || !b.full()
+}
+
+func selectBackend(backends []*backend, healthChecker healthView) int {
+	return selectBackendExcluding(backends, healthChecker, nil, atomic.AddUint64(&counter, 1))
+}
+
+// Round-robin selection starting at next, skipping backends in exclude (e.g. already tried by a retry) while others are available
+func selectBackendExcluding(backends []*backend, healthChecker healthView, exclude map[int]bool, next uint64) int {
+	backendCount := len(backends)
+
+	for _, allowFull := range []bool{false, true} {
+		for i := range backendCount {
+			idx := int((next + uint64(i)) % uint64(backendCount))
+
+			if usable(backends[idx], healthChecker, exclude[idx], allowFull) {
+				return idx
+			}
+		}
+	}
+
+	// All backends unhealthy, drained or circuits open just return the first one
+	return int(next % uint64(len(backends)))
+}
+
+// Picks the backend with the fewest in-flight requests relative to its weight.
+// Ties are broken in round-robin order so idle backends share the load evenly.
+func selectWeightedLeastConnections(backends []*backend, healthChecker healthView, exclude map[int]bool, next uint64) int {
+	backendCount := len(backends)
+
+	for _, allowFull := range []bool{false, true} {
+		best := -1
+		var bestInflight, bestWeight int64
+		for i := range backendCount {
+			idx := int((next + uint64(i)) % uint64(backendCount))
+
+			if !usable(backends[idx], healthChecker, exclude[idx], allowFull) {
+				continue
+			}
+
+			inflight, weight := backends[idx].inflight.Load(), backends[idx].effectiveWeight()
+			if best == -1 || compareLoad(inflight, weight, bestInflight, bestWeight) < 0 {
+				best, bestInflight, bestWeight = idx, inflight, weight
+			}
+		}
+		if best != -1 {
+			return best
+		}
+	}
+
+	return int(next % uint64(len(backends)))
+}
+
+// Compares the in-flight requests per weight of two backends without dividing: a/wa < b/wb  <=>
+// a*wb < b*wa. A backend without weight, such as one a load signal took out, counts as infinitely
+// loaded so any backend with weight is picked over it.
+func compareLoad(inflightA, weightA, inflightB, weightB int64) int {
+	switch {
+	case weightA == 0 && weightB == 0:
+		return 0
+	case weightA == 0:
+		return 1
+	case weightB == 0:
+		return -1
+	}
+	return cmp.Compare(inflightA*weightB, inflightB*weightA)
+}
+
+// Probe latencies are rounded up to this, so sub-millisecond differences on a fast network
+// don't swing the weights
+const minProbeLatency = time.Millisecond
+
+// Picks a backend at random with probability proportional to its weight over its last health
+// probe latency, so faster backends get more traffic. Backends without a successful probe yet
+// count as being as fast as the average of the others.
+func selectProbeLatency(backends []*backend, healthChecker healthView, exclude map[int]bool, next uint64) int {
+	for _, allowFull := range []bool{false, true} {
+		scores, total := probeLatencyScores(backends, healthChecker, exclude, allowFull)
+		if total == 0 {
+			continue
+		}
+
+		pick := rand.Float64() * total
+		last := 0
+		for idx, score := range scores {
+			if score == 0 {
+				continue
+			}
+			pick -= score
+			if pick < 0 {
+				return idx
+			}
+			last = idx
+		}
+		// Only reached through rounding
+		return last
+	}
+
+	return int(next % uint64(len(backends)))
+}
+
+// Scores each backend by its weight over its last probe latency, 0 for backends that aren't
+// usable, and returns the scores along with their sum
+func probeLatencyScores(backends []*backend, healthChecker healthView, exclude map[int]bool, allowFull bool) ([]float64, float64) {
+	latencies := make([]time.Duration, len(backends))
+	var measuredSum time.Duration
+	var measured int
+	for idx, b := range backends {
+		latencies[idx] = healthChecker.Latency(b.idx)
+		if latencies[idx] > 0 {
+			measuredSum += latencies[idx]
+			measured++
+		}
+	}
+	average := minProbeLatency
+	if measured > 0 {
+		average = measuredSum / time.Duration(measured)
+	}
+
+	scores := make([]float64, len(backends))
+	var total float64
+	for idx, b := range backends {
+		if !usable(b, healthChecker, exclude[idx], allowFull) {
+			continue
+		}
+		latency := latencies[idx]
+		if latency == 0 {
+			latency = average
+		}
+		scores[idx] = float64(b.effectiveWeight()) / max(latency, minProbeLatency).Seconds()
+		total += scores[idx]
+	}
+	return scores, total
+}
+
+// Returns the chance each backend has of being picked by pickBackend with the same arguments: an
+// even one among the usable backends under round-robin, an even one among those tied for the
+// fewest in-flight requests per weight under weighted least connections, and its score under probe
+// latency. Returns nil when no backend is usable, the pick then falls back to any of them.
+func expectedShares(strategy string, backends []*backend, healthChecker healthView, exclude map[int]bool) []float64 {
+	for _, allowFull := range []bool{false, true} {
+		var scores []float64
+		var total float64
+		switch strategy {
+		case config.StrategyWeightedLeastConnections:
+			scores, total = leastConnectionsTies(backends, healthChecker, exclude, allowFull)
+		case config.StrategyProbeLatency:
+			scores, total = probeLatencyScores(backends, healthChecker, exclude, allowFull)
+		default:
+			scores = make([]float64, len(backends))
+			for idx, b := range backends {
+				if usable(b, healthChecker, exclude[idx], allowFull) {
+					scores[idx] = 1
+					total++
+				}
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		for idx := range scores {
+			scores[idx] /= total
+		}
+		return scores
+	}
+	return nil
+}
+
+// Scores 1 for each usable backend tied for the fewest in-flight requests relative to its weight,
+// 0 for the others, and returns the scores along with their sum
+func leastConnectionsTies(backends []*backend, healthChecker healthView, exclude map[int]bool, allowFull bool) ([]float64, float64) {
+	candidates := make([]bool, len(backends))
+	inflight := make([]int64, len(backends))
+	weights := make([]int64, len(backends))
+	best := -1
+	for idx, b := range backends {
+		if !usable(b, healthChecker, exclude[idx], allowFull) {
+			continue
+		}
+		candidates[idx] = true
+		inflight[idx], weights[idx] = b.inflight.Load(), b.effectiveWeight()
+		if best == -1 || compareLoad(inflight[idx], weights[idx], inflight[best], weights[best]) < 0 {
+			best = idx
+		}
+	}
+
+	scores := make([]float64, len(backends))
+	var total float64
+	if best == -1 {
+		return scores, total
+	}
+	for idx := range backends {
+		if candidates[idx] && compareLoad(inflight[idx], weights[idx], inflight[best], weights[best]) == 0 {
+			scores[idx] = 1
+			total++
+		}
+	}
+	return scores, total
+}
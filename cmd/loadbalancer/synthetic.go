@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// syntheticTraffic recognises load test traffic so it can be kept off production backends and metrics
+type syntheticTraffic struct {
+	cfg      config.SyntheticConfig
+	backends []*backend // Pool synthetic requests go to, nil = routed like other requests
+	counter  uint64     // Round-robin position within the pool
+}
+
+func newSyntheticTraffic(cfg config.SyntheticConfig, pool []*backend) *syntheticTraffic {
+	s := &syntheticTraffic{cfg: cfg}
+	if len(cfg.BackendLabels) > 0 {
+		s.backends = selectByLabels(pool, cfg.BackendLabels)
+	}
+	return s
+}
+
+// Reports whether the request is marked as synthetic with the configured value, which keeps
+// clients from taking their traffic out of the metrics. The header is passed on so backends can
+// tell as well.
+func (s *syntheticTraffic) matches(r *http.Request) bool {
+	value := r.Header.Get(s.cfg.Header)
+	return value != "" && secureEqual(value, s.cfg.Value)
+}
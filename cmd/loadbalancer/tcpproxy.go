@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+const tcpDialTimeout = 5 * time.Second
+
+// tcpProxy forwards raw TCP connections to the configured backends round-robin
+type tcpProxy struct {
+	cfg      config.TCPConfig
+	backends []string
+	counter  atomic.Uint64
+	metrics  *metrics
+}
+
+// Returns nil when no TCP backends are configured
+func newTCPProxy(cfg config.TCPConfig, m *metrics) *tcpProxy {
+	if len(cfg.Backends) == 0 {
+		return nil
+	}
+	return &tcpProxy{cfg: cfg, backends: cfg.Backends, metrics: m}
+}
+
+// Connects client to a backend, trying the next one on dial failures, and copies both ways until
+// either side closes
+func (p *tcpProxy) serve(client net.Conn) {
+	defer client.Close()
+	start := time.Now()
+
+	var upstream net.Conn
+	var addr string
+	for range p.backends {
+		addr = p.backends[(p.counter.Add(1)-1)%uint64(len(p.backends))]
+		conn, err := dialBackend(context.Background(), &net.Dialer{Timeout: tcpDialTimeout}, "tcp", addr)
+		if err == nil {
+			upstream = conn
+			break
+		}
+		log.Printf("Failed to connect to tcp backend %s: %v", addr, err)
+		p.metrics.tcpConnectErrors.WithLabelValues(addr).Inc()
+	}
+	if upstream == nil {
+		return
+	}
+	defer upstream.Close()
+
+	p.metrics.tcpConnectionsTotal.WithLabelValues(addr).Inc()
+	p.metrics.tcpConnectionsActive.WithLabelValues(addr).Inc()
+	defer p.metrics.tcpConnectionsActive.WithLabelValues(addr).Dec()
+
+	// Closing both ends unblocks the copies. The first reason to fire is the one reported.
+	var closedBy atomic.Pointer[string]
+	closeBoth := func(reason string) {
+		if closedBy.CompareAndSwap(nil, &reason) {
+			client.Close()
+			upstream.Close()
+		}
+	}
+	var src, dst io.Reader = client, upstream
+	if p.cfg.IdleTimeout > 0 {
+		idle := time.AfterFunc(p.cfg.IdleTimeout, func() { closeBoth("idle_timeout") })
+		defer idle.Stop()
+		src = &activityReader{Reader: client, timer: idle, timeout: p.cfg.IdleTimeout}
+		dst = &activityReader{Reader: upstream, timer: idle, timeout: p.cfg.IdleTimeout}
+	}
+	if p.cfg.MaxLifetime > 0 {
+		lifetime := time.AfterFunc(p.cfg.MaxLifetime, func() { closeBoth("max_lifetime") })
+		defer lifetime.Stop()
+	}
+
+	var bytesIn, bytesOut int64
+	var wg sync.WaitGroup
+	wg.Go(func() { bytesIn = pipe(upstream, src) })
+	wg.Go(func() { bytesOut = pipe(client, dst) })
+	wg.Wait()
+
+	closeReason := "eof"
+	if reason := closedBy.Load(); reason != nil {
+		closeReason = *reason
+	}
+	p.metrics.tcpConnectionsClosed.WithLabelValues(addr, closeReason).Inc()
+
+	duration := time.Since(start)
+	p.metrics.tcpBytes.WithLabelValues(addr, "in").Add(float64(bytesIn))
+	p.metrics.tcpBytes.WithLabelValues(addr, "out").Add(float64(bytesOut))
+	p.metrics.tcpConnectionDuration.WithLabelValues(addr).Observe(duration.Seconds())
+	slog.Info("tcp connection",
+		"backend", addr,
+		"remote_addr", client.RemoteAddr().String(),
+		"duration_ms", float64(duration.Microseconds())/1000,
+		"bytes_in", bytesIn,
+		"bytes_out", bytesOut,
+		"closed_by", closeReason,
+	)
+}
+
+// Copies src to dst, then half-closes dst so the other side sees EOF. Returns the bytes copied.
+func pipe(dst net.Conn, src io.Reader) int64 {
+	n, _ := io.Copy(dst, src)
+	if tcpConn, ok := dst.(interface{ CloseWrite() error }); ok {
+		tcpConn.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
+
+// activityReader pushes back the idle timer whenever data arrives
+type activityReader struct {
+	io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/clock"
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+const (
+	tenantAnonymous = "anonymous" // Requests without credentials of a tenant
+	tenantOther     = "other"     // Tenants seen while max_tenants others were tracked
+)
+
+// tenantQuotas tracks per-tenant usage in fixed minute and UTC day windows and rejects
+// requests from tenants that have used up their quota
+type tenantQuotas struct {
+	cfg     config.TenantQuotaConfig
+	metrics *metrics
+	clock   clock.Clock
+	mu      sync.Mutex
+	usage   map[string]*tenantUsage
+}
+
+// tenantUsage is a tenant's usage in the current windows plus running totals for reporting
+type tenantUsage struct {
+	Tenant         string `json:"tenant"`
+	MinuteRequests int64  `json:"minute_requests"`
+	DayRequests    int64  `json:"day_requests"`
+	DayBytes       int64  `json:"day_bytes"`
+	TotalRequests  int64  `json:"total_requests"`
+	TotalBytes     int64  `json:"total_bytes"`
+	Rejected       int64  `json:"rejected"`
+	minute, day    time.Time
+	limits         config.QuotaLimits
+}
+
+func newTenantQuotas(cfg config.TenantQuotaConfig, m *metrics) *tenantQuotas {
+	return &tenantQuotas{cfg: cfg, metrics: m, clock: clock.Real, usage: make(map[string]*tenantUsage)}
+}
+
+// Makes the quota windows and token expiry go by c (for testing)
+func (q *tenantQuotas) setClock(c clock.Clock) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.clock = c
+}
+
+// Returns the tenant of r, from a configured API key in the header or the claim of a JWT signed
+// with the configured secret. Anything a client can make up counts as anonymous, so it can't
+// dodge its quota or grow the usage map by sending new tenant IDs.
+func (q *tenantQuotas) tenant(r *http.Request) string {
+	if q.cfg.Header != "" {
+		if key := r.Header.Get(q.cfg.Header); key != "" {
+			for known, tenant := range q.cfg.APIKeys {
+				if secureEqual(key, known) {
+					return tenant
+				}
+			}
+		}
+	}
+	if q.cfg.Claim != "" {
+		q.mu.Lock()
+		now := q.clock.Now()
+		q.mu.Unlock()
+		switch claim := verifiedClaims(r, q.cfg.JWTSecret, now)[q.cfg.Claim].(type) {
+		case string:
+			if claim != "" {
+				return claim
+			}
+		case float64:
+			return strconv.FormatFloat(claim, 'f', -1, 64)
+		}
+	}
+	return tenantAnonymous
+}
+
+// Returns the usage of tenant, rolling its windows over if they have passed. Once max_tenants are
+// tracked, tenants without usage today are dropped, and new tenants share the "other" usage while
+// none can be. Caller holds q.mu.
+func (q *tenantQuotas) current(tenant string, now time.Time) *tenantUsage {
+	u, ok := q.usage[tenant]
+	if !ok {
+		if q.tracked() >= q.cfg.MaxTenants {
+			q.evictIdle(now)
+		}
+		if q.tracked() >= q.cfg.MaxTenants && tenant != tenantOther {
+			return q.current(tenantOther, now)
+		}
+		limits, ok := q.cfg.Tenants[tenant]
+		if !ok {
+			limits = q.cfg.Default
+		}
+		u = &tenantUsage{Tenant: tenant, limits: limits}
+		q.usage[tenant] = u
+	}
+
+	if minute := now.Truncate(time.Minute); !minute.Equal(u.minute) {
+		u.minute, u.MinuteRequests = minute, 0
+	}
+	if day := now.Truncate(24 * time.Hour); !day.Equal(u.day) {
+		u.day, u.DayRequests, u.DayBytes = day, 0, 0
+	}
+	return u
+}
+
+// Returns how many tenants have their own usage, not counting "other". Caller holds q.mu.
+func (q *tenantQuotas) tracked() int {
+	if _, ok := q.usage[tenantOther]; ok {
+		return len(q.usage) - 1
+	}
+	return len(q.usage)
+}
+
+// Drops the usage of tenants that haven't sent a request today, which no quota depends on any
+// more. Caller holds q.mu.
+func (q *tenantQuotas) evictIdle(now time.Time) {
+	today := now.Truncate(24 * time.Hour)
+	for tenant, u := range q.usage {
+		if u.day.Before(today) {
+			delete(q.usage, tenant)
+		}
+	}
+}
+
+// Counts a request against the tenant's quota. When a limit is exhausted the request is not
+// counted and the time until that window resets is returned.
+func (q *tenantQuotas) admit(tenant string) (retryAfter time.Duration, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.clock.Now().UTC()
+	u := q.current(tenant, now)
+	limits := u.limits
+	var exceeded string
+	switch {
+	case limits.RequestsPerDay > 0 && u.DayRequests >= limits.RequestsPerDay:
+		exceeded, retryAfter = "requests_per_day", u.day.Add(24*time.Hour).Sub(now)
+	case limits.BytesPerDay > 0 && u.DayBytes >= limits.BytesPerDay:
+		exceeded, retryAfter = "bytes_per_day", u.day.Add(24*time.Hour).Sub(now)
+	case limits.RequestsPerMinute > 0 && u.MinuteRequests >= limits.RequestsPerMinute:
+		exceeded, retryAfter = "requests_per_minute", u.minute.Add(time.Minute).Sub(now)
+	}
+	if exceeded != "" {
+		u.Rejected++
+		q.metrics.quotaRejections.WithLabelValues(exceeded).Inc()
+		return retryAfter, false
+	}
+
+	u.MinuteRequests++
+	u.DayRequests++
+	u.TotalRequests++
+	return 0, true
+}
+
+// Adds the bytes of a finished request to the tenant's usage
+func (q *tenantQuotas) recordBytes(tenant string, bytes int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.current(tenant, q.clock.Now().UTC())
+	u.DayBytes += bytes
+	u.TotalBytes += bytes
+}
+
+// Returns a copy of every tenant's usage sorted by tenant ID
+func (q *tenantQuotas) snapshot() []tenantUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.clock.Now().UTC()
+	usage := make([]tenantUsage, 0, len(q.usage))
+	for tenant := range q.usage {
+		usage = append(usage, *q.current(tenant, now))
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	return usage
+}
+
+// Formats a Retry-After value in whole seconds, rounding up
+func retryAfterSeconds(d time.Duration) string {
+	return fmt.Sprint(int64((d + time.Second - 1) / time.Second))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// requestTrace records the balancer's decisions for a request sent with the debug header
+type requestTrace struct {
+	RequestID  string           `json:"request_id"`
+	Route      string           `json:"route"`
+	Canary     bool             `json:"canary"`
+	Strategy   string           `json:"strategy"`
+	Candidates []candidateTrace `json:"candidates"`
+	Attempts   []attemptTrace   `json:"attempts"`
+	Status     int              `json:"status"` // Final status returned by the backend or the balancer
+	DurationMs float64          `json:"duration_ms"`
+}
+
+// candidateTrace is a backend's state when the request arrived
+type candidateTrace struct {
+	Backend  string `json:"backend"`
+	Healthy  bool   `json:"healthy"`
+	Circuit  string `json:"circuit"`
+	Inflight int64  `json:"inflight"`
+	Weight   int64  `json:"weight"`
+	Full     bool   `json:"full"`
+}
+
+// attemptTrace is the outcome of forwarding to one backend
+type attemptTrace struct {
+	Backend    string  `json:"backend"`
+	Status     int     `json:"status,omitempty"` // Left out when the attempt was retried
+	Error      string  `json:"error,omitempty"`  // Set when the backend request failed
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// Reports whether r asked for a trace with the token and tracing is switched on. Traces show the
+// backends and their state, so there are none without a token.
+func (lb *balancer) tracing(r *http.Request) bool {
+	cfg := lb.currentConfig().DebugTrace
+	value := r.Header.Get(cfg.Header)
+	if value == "" || cfg.Token == "" || !lb.traceEnabled.Load() {
+		return false
+	}
+	return secureEqual(value, cfg.Token)
+}
+
+func (lb *balancer) newTrace(requestID string, rt *route, toCanary bool, backends []*backend) *requestTrace {
+	strategy := rt.currentStrategy(lb.currentConfig().Strategy)
+	trace := &requestTrace{RequestID: requestID, Route: rt.name, Canary: toCanary, Strategy: strategy}
+	for _, b := range backends {
+		trace.Candidates = append(trace.Candidates, candidateTrace{
+			Backend:  b.cfg.URL,
+			Healthy:  lb.healthChecker.IsHealthy(b.idx),
+			Circuit:  b.breaker.State().String(),
+			Inflight: b.inflight.Load(),
+			Weight:   b.weight.Load(),
+			Full:     b.full(),
+		})
+	}
+	return trace
+}
+
+// Describes the outcome of an attempt, status is what was written to the client unless it was retried
+func newAttemptTrace(b *backend, state *attemptState, status int, start time.Time) attemptTrace {
+	attempt := attemptTrace{Backend: b.cfg.URL, DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+	if state.failure != nil {
+		attempt.Error = state.failure.Error()
+	}
+	if state.err == nil {
+		attempt.Status = status
+	}
+	return attempt
+}
+
+// discardWriter takes the backend response while tracing so the trace can be sent instead
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// upgradeSet tracks the client connections of a backend's switched protocol (e.g. WebSocket)
+// streams, which the HTTP server forgets about once ReverseProxy hijacks them
+type upgradeSet struct {
+	mu    sync.Mutex
+	conns map[*upgradedConn]struct{}
+}
+
+// Wraps a hijacked client connection and tracks it until it is closed
+func (s *upgradeSet) add(conn net.Conn, websocket bool) *upgradedConn {
+	c := &upgradedConn{Conn: conn, websocket: websocket, done: make(chan struct{})}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*upgradedConn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	c.onClose = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.conns, c)
+	}
+	return c
+}
+
+// Returns the connections currently open
+func (s *upgradeSet) open() []*upgradedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]*upgradedConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Winds down every open connection: WebSocket clients get a close frame with cfg's close code, and
+// connections still open after cfg's deadline are closed. Returns once all of them are.
+func closeUpgraded(conns []*upgradedConn, cfg config.DrainConfig, reason string) {
+	if len(conns) == 0 {
+		return
+	}
+	log.Printf("Closing %d upgraded connections: %s", len(conns), reason)
+	for _, c := range conns {
+		if c.websocket {
+			c.sendClose(cfg.CloseCode, reason)
+		}
+	}
+
+	deadline := time.NewTimer(cfg.Deadline)
+	defer deadline.Stop()
+	for i, c := range conns {
+		select {
+		case <-c.done:
+			continue
+		case <-deadline.C:
+		}
+		for _, c := range conns[i:] {
+			c.Close()
+		}
+		return
+	}
+}
+
+// Closes the WebSockets and other upgraded streams of a backend that was just drained, in the
+// background so the weight change doesn't wait for them
+func (lb *balancer) drainUpgraded(b *backend) {
+	conns := b.upgrades.open()
+	if len(conns) == 0 {
+		return
+	}
+	cfg := lb.currentConfig().Drain
+	go closeUpgraded(conns, cfg, "backend drained")
+}
+
+// Changes a backend's weight, winding down its upgraded streams when that drains it
+func (lb *balancer) setBackendWeight(b *backend, weight int64) {
+	wasDrained := b.drained.Load()
+	b.setWeight(weight)
+	if weight == 0 && !wasDrained {
+		lb.drainUpgraded(b)
+	}
+}
+
+// Closes the upgraded streams of every backend at shutdown
+func (lb *balancer) closeAllUpgraded(cfg config.DrainConfig) {
+	var conns []*upgradedConn
+	for _, b := range lb.pool {
+		conns = append(conns, b.upgrades.open()...)
+	}
+	closeUpgraded(conns, cfg, "server shutting down")
+}
+
+// upgradedConn is a hijacked client connection. For WebSockets it follows the frames the backend
+// sends so a close frame can be slipped in between two of them.
+type upgradedConn struct {
+	net.Conn
+	websocket bool
+
+	mu      sync.Mutex
+	frames  frameTracker
+	pending []byte // Close frame waiting for the backend's current frame to end
+	closed  bool   // Close frame sent, later frames from the backend are dropped
+
+	done      chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func (c *upgradedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return len(p), nil
+	}
+	if !c.websocket {
+		return c.Conn.Write(p)
+	}
+	if c.pending == nil {
+		n, err := c.Conn.Write(p)
+		c.frames.advance(p[:n], false)
+		return n, err
+	}
+
+	// Finish the frame in progress, then send the close frame in place of the rest
+	end := c.frames.advance(p, true)
+	if _, err := c.Conn.Write(p[:end]); err != nil {
+		return 0, err
+	}
+	if c.frames.atBoundary() {
+		c.Conn.Write(c.pending)
+		c.closed = true
+	}
+	return len(p), nil
+}
+
+// Sends a WebSocket close frame as soon as the backend's current frame has been written
+func (c *upgradedConn) sendClose(code int, reason string) {
+	frame := []byte{0x88, byte(2 + len(reason)), 0, 0} // FIN and opcode 8, unmasked
+	binary.BigEndian.PutUint16(frame[2:], uint16(code))
+	frame = append(frame, reason...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if c.frames.atBoundary() {
+		c.Conn.Write(frame)
+		c.closed = true
+		return
+	}
+	c.pending = frame
+}
+
+func (c *upgradedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.onClose()
+	})
+	return c.Conn.Close()
+}
+
+// frameTracker follows WebSocket frame boundaries in a byte stream (RFC 6455 section 5.2)
+type frameTracker struct {
+	header    []byte // Header bytes of the next frame read so far
+	remaining uint64 // Payload bytes of the current frame still to come
+}
+
+// Consumes p and returns how many bytes it took, stopping at the first frame boundary if stop is set
+func (t *frameTracker) advance(p []byte, stop bool) int {
+	i := 0
+	for i < len(p) {
+		if stop && t.atBoundary() {
+			return i
+		}
+		if t.remaining > 0 {
+			n := int(min(t.remaining, uint64(len(p)-i)))
+			t.remaining -= uint64(n)
+			i += n
+			continue
+		}
+		t.header = append(t.header, p[i])
+		i++
+		if size, ok := t.headerSize(); ok && len(t.header) == size {
+			t.remaining = t.payloadLength()
+			t.header = t.header[:0]
+		}
+	}
+	return i
+}
+
+// Reports whether the stream is between two frames
+func (t *frameTracker) atBoundary() bool {
+	return t.remaining == 0 && len(t.header) == 0
+}
+
+// Returns the full size of the header being read, once enough of it is known
+func (t *frameTracker) headerSize() (int, bool) {
+	if len(t.header) < 2 {
+		return 0, false
+	}
+	size := 2
+	switch t.header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if t.header[1]&0x80 != 0 {
+		size += 4 // Masking key
+	}
+	return size, true
+}
+
+// Returns the payload length of the complete header read
+func (t *frameTracker) payloadLength() uint64 {
+	switch length := t.header[1] & 0x7f; length {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(t.header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(t.header[2:10])
+	default:
+		return uint64(length)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// warmupState tracks a recovered backend's progress through the warm-up sequence
+type warmupState struct {
+	warming   atomic.Bool  // Set from recovery until the sequence is done, the backend gets no live traffic meanwhile
+	probes    atomic.Int64 // Consecutive successful health probes since recovering
+	mirrors   atomic.Int64 // Consecutive successful mirrored requests
+	mirroring atomic.Bool  // A mirrored request is in flight, only one is sent at a time
+}
+
+// Holds a recovered backend out of rotation until it has warmed up. Backends that were
+// healthy at startup don't warm up.
+func (lb *balancer) startWarmup(b *backend) {
+	if !lb.currentConfig().Warmup.Enabled() {
+		return
+	}
+	b.warmup.probes.Store(0)
+	b.warmup.mirrors.Store(0)
+	b.warmup.warming.Store(true)
+	lb.metrics.backendWarming.WithLabelValues(b.cfg.URL).Set(1)
+	log.Printf("Backend %s recovered, warming up before rejoining rotation", b.cfg.URL)
+}
+
+// Called with every health probe result, a failed probe restarts the sequence
+func (lb *balancer) warmupProbe(b *backend, healthy bool) {
+	if !b.warmup.warming.Load() {
+		return
+	}
+	if !healthy {
+		b.warmup.probes.Store(0)
+		b.warmup.mirrors.Store(0)
+		return
+	}
+	b.warmup.probes.Add(1)
+	lb.finishWarmup(b)
+}
+
+// Returns the backend to rotation once it has passed enough probes and mirrored requests
+func (lb *balancer) finishWarmup(b *backend) {
+	cfg := lb.currentConfig().Warmup
+	if b.warmup.probes.Load() < int64(cfg.Probes) || b.warmup.mirrors.Load() < int64(cfg.MirroredRequests) {
+		return
+	}
+	if b.warmup.warming.CompareAndSwap(true, false) {
+		lb.metrics.backendWarming.WithLabelValues(b.cfg.URL).Set(0)
+		log.Printf("Backend %s warmed up, rejoining rotation", b.cfg.URL)
+	}
+}
+
+// Sends a copy of a body-less GET to each of the backends that has passed its warm-up
+// probes and still needs mirrored requests. Responses are discarded.
+func (lb *balancer) mirrorToWarming(r *http.Request, backends []*backend) {
+	cfg := lb.currentConfig().Warmup
+	if cfg.MirroredRequests == 0 || r.Method != http.MethodGet || hasBody(r) {
+		return
+	}
+	for _, b := range backends {
+		if !b.warmup.warming.Load() || b.warmup.probes.Load() < int64(cfg.Probes) || !lb.healthChecker.IsHealthy(b.idx) {
+			continue
+		}
+		if !b.warmup.mirroring.CompareAndSwap(false, true) {
+			continue
+		}
+		// Not tied to the client's request, which may well finish first
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), cfg.MirrorTimeout)
+		req := r.Clone(ctx)
+		go func() {
+			defer cancel()
+			defer b.warmup.mirroring.Store(false)
+			lb.mirror(b, req)
+		}()
+	}
+}
+
+// Sends a mirrored request to a warming backend and records whether it succeeded
+func (lb *balancer) mirror(b *backend, req *http.Request) {
+	req.RequestURI = ""
+	b.proxy.Director(req)
+
+	resp, err := b.transport.RoundTrip(req)
+	if err != nil {
+		log.Printf("Warm-up mirrored request to %s failed: %v", b.cfg.URL, err)
+		b.warmup.mirrors.Store(0)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		log.Printf("Warm-up mirrored request to %s failed with status %d", b.cfg.URL, resp.StatusCode)
+		b.warmup.mirrors.Store(0)
+		return
+	}
+	b.warmup.mirrors.Add(1)
+	lb.finishWarmup(b)
+}
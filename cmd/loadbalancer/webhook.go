@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// POSTs payload as JSON to a webhook in the background, logging failures under the given name
+func postWebhook(url, name string, payload any) {
+	body, _ := json.Marshal(payload)
+	go func() {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("%s webhook failed: %v", name, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,90 @@
+// Package bodybuffer buffers request bodies so they can be replayed when a request is retried.
+package bodybuffer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Buffer holds a copy of a request body, in memory up to a limit and in a temp file beyond it
+type Buffer struct {
+	mem      []byte    // First part of the body
+	file     *os.File  // Spill file for the part that didn't fit in memory, nil if unused
+	fileSize int64     // Bytes written to the spill file
+	rest     io.Reader // Unread remainder of the original body when it was too large
+}
+
+// Read copies body into a Buffer, keeping up to memLimit bytes in memory and spilling the rest
+// to a temp file. Reading stops once more than maxSize bytes have been seen, in which case the
+// buffer is incomplete: its Reader then yields the whole original body but only once, so the
+// request can still be forwarded but must not be retried.
+func Read(body io.Reader, memLimit, maxSize int64) (*Buffer, error) {
+	memLimit = min(memLimit, maxSize)
+	buf := &Buffer{}
+
+	var mem bytes.Buffer
+	n, err := io.CopyN(&mem, body, memLimit+1)
+	buf.mem = mem.Bytes()
+	if err == io.EOF {
+		return buf, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	// The body didn't fit in memory, so keep the overflow byte with the rest in the spill file
+	buf.mem = buf.mem[:memLimit]
+	overflow := bytes.NewReader(mem.Bytes()[memLimit:n])
+
+	file, err := os.CreateTemp("", "loadbalancer-body-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create body spill file: %w", err)
+	}
+	buf.file = file
+
+	written, err := io.CopyN(file, io.MultiReader(overflow, body), maxSize-memLimit+1)
+	buf.fileSize = written
+	if err == io.EOF {
+		return buf, nil
+	}
+	if err != nil {
+		buf.Close()
+		return nil, fmt.Errorf("failed to spill body: %w", err)
+	}
+
+	buf.rest = body
+	return buf, nil
+}
+
+// Complete reports whether the whole body was buffered and can be replayed
+func (b *Buffer) Complete() bool {
+	return b.rest == nil
+}
+
+// Size returns the number of buffered bytes
+func (b *Buffer) Size() int64 {
+	return int64(len(b.mem)) + b.fileSize
+}
+
+// Reader returns a reader positioned at the start of the body
+func (b *Buffer) Reader() io.ReadCloser {
+	readers := []io.Reader{bytes.NewReader(b.mem)}
+	if b.file != nil {
+		readers = append(readers, io.NewSectionReader(b.file, 0, b.fileSize))
+	}
+	if b.rest != nil {
+		readers = append(readers, b.rest)
+	}
+	return io.NopCloser(io.MultiReader(readers...))
+}
+
+// Close removes the spill file, if any
+func (b *Buffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
@@ -2,11 +2,18 @@
 package circuitbreaker
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/clock"
 )
 
+// ErrOpen is returned by Allow while the circuit is open
+var ErrOpen = errors.New("circuit breaker is open")
+
 type CircuitState int
 
 const (
@@ -15,6 +22,17 @@ const (
 	stateHalfOpen
 )
 
+func (s CircuitState) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
 // CircuitBreaker implements the circuit breaker pattern
 type CircuitBreaker struct {
 	backendURL       string
@@ -23,6 +41,7 @@ type CircuitBreaker struct {
 	lastFailureTime  time.Time
 	failureThreshold int
 	timeout          time.Duration
+	clock            clock.Clock
 	mu               sync.Mutex
 }
 
@@ -34,7 +53,58 @@ func New(backendURL string, failureThreshold int, timeout time.Duration) *Circui
 		failures:         0,
 		failureThreshold: failureThreshold,
 		timeout:          timeout,
+		clock:            clock.Real,
+	}
+}
+
+// SetClock makes the breaker time its open timeout with c (for testing)
+func (cb *CircuitBreaker) SetClock(c clock.Clock) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.clock = c
+}
+
+// State returns the current state without moving an open circuit to half-open
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Snapshot is a breaker's state, saved across restarts
+type Snapshot struct {
+	State       string    `json:"state"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+}
+
+// Snapshot returns the breaker's current state
+func (cb *CircuitBreaker) Snapshot() Snapshot {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return Snapshot{State: cb.state.String(), Failures: cb.failures, LastFailure: cb.lastFailureTime}
+}
+
+// Restore puts the breaker back into a saved state. An open circuit still moves to half-open
+// once the timeout has passed since the saved last failure.
+func (cb *CircuitBreaker) Restore(s Snapshot) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch s.State {
+	case "open":
+		cb.state = stateOpen
+	case "half_open":
+		cb.state = stateHalfOpen
+	default:
+		cb.state = stateClosed
 	}
+	cb.failures = s.Failures
+	cb.lastFailureTime = s.LastFailure
+}
+
+// IsOpen reports whether the circuit is open and rejecting requests, without moving it to half-open
+func (cb *CircuitBreaker) IsOpen() bool {
+	return cb.State() == stateOpen
 }
 
 // CanAttempt checks if request should be allowed
@@ -48,7 +118,7 @@ func (cb *CircuitBreaker) CanAttempt() bool {
 
 	case stateOpen:
 		// Check if timeout has passed
-		if time.Since(cb.lastFailureTime) > cb.timeout {
+		if cb.clock.Now().Sub(cb.lastFailureTime) > cb.timeout {
 			cb.state = stateHalfOpen
 			log.Printf("Circuit HALF-OPEN for backend %s - testing recovery", cb.backendURL)
 			return true
@@ -63,6 +133,14 @@ func (cb *CircuitBreaker) CanAttempt() bool {
 	}
 }
 
+// Allow is CanAttempt for callers that handle errors, returning ErrOpen if the request should be rejected
+func (cb *CircuitBreaker) Allow() error {
+	if !cb.CanAttempt() {
+		return fmt.Errorf("backend %s: %w", cb.backendURL, ErrOpen)
+	}
+	return nil
+}
+
 // RecordSuccess records a successful request
 func (cb *CircuitBreaker) RecordSuccess() {
 	cb.mu.Lock()
@@ -81,7 +159,7 @@ func (cb *CircuitBreaker) RecordFailure() {
 	defer cb.mu.Unlock()
 
 	cb.failures++
-	cb.lastFailureTime = time.Now()
+	cb.lastFailureTime = cb.clock.Now()
 
 	if cb.state == stateHalfOpen {
 		// Failed so open the state (Unhealthy)
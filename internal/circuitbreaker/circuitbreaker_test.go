@@ -0,0 +1,46 @@
+package circuitbreaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/clock"
+)
+
+func TestOpenTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	cb := New("http://a", 2, 30*time.Second)
+	cb.SetClock(clk)
+
+	cb.RecordFailure()
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("Breaker rejected a request below the failure threshold: %v", err)
+	}
+	cb.RecordFailure()
+	if err := cb.Allow(); !errors.Is(err, ErrOpen) {
+		t.Fatalf("Breaker at the failure threshold returned %v, want ErrOpen", err)
+	}
+
+	clk.Advance(30 * time.Second)
+	if cb.CanAttempt() {
+		t.Error("Breaker let a request through before the timeout passed")
+	}
+	clk.Advance(time.Second)
+	if !cb.CanAttempt() || cb.State().String() != "half_open" {
+		t.Errorf("Breaker is %s after the timeout, want half_open", cb.State())
+	}
+
+	// A failure while half-open opens it again for another full timeout
+	cb.RecordFailure()
+	clk.Advance(29 * time.Second)
+	if cb.CanAttempt() {
+		t.Error("Breaker reopened by a half-open failure let a request through early")
+	}
+	clk.Advance(2 * time.Second)
+	cb.CanAttempt()
+	cb.RecordSuccess()
+	if cb.State().String() != "closed" {
+		t.Errorf("Breaker is %s after a half-open success, want closed", cb.State())
+	}
+}
@@ -0,0 +1,192 @@
+// Package clock lets time-based code run against a fake clock in tests instead of sleeping.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes tickers and timers
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker is a time.Ticker made by a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is a time.Timer made by a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the system clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (t realTimer) Stop() {
+	t.Timer.Stop()
+}
+
+// Fake is a clock that only moves when told to
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []*fakeTimer
+}
+
+// NewFake returns a fake clock reading now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{clock: f, c: make(chan time.Time, 1), interval: d, next: f.now.Add(d)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// NewTimer returns a timer firing once the clock has advanced by d, straight away if d isn't positive
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1), at: f.now.Add(d)}
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+	f.timers = append(f.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the tickers and timers that come due. Like
+// time.Ticker a ticker whose last tick hasn't been received drops the new ones.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for _, t := range f.tickers {
+		for !t.next.After(f.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.interval)
+		}
+	}
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.at.After(f.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- t.at
+	}
+	clear(f.timers[len(pending):])
+	f.timers = pending
+}
+
+// Tickers returns how many tickers are running, so tests can wait for code to start one
+func (f *Fake) Tickers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.tickers)
+}
+
+// Timers returns how many timers are waiting to fire, so tests can wait for code to set one
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+type fakeTicker struct {
+	clock    *Fake
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, other := range f.tickers {
+		if other == t {
+			f.tickers = append(f.tickers[:i], f.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock *Fake
+	c     chan time.Time
+	at    time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, other := range f.timers {
+		if other == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return
+		}
+	}
+}
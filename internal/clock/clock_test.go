@@ -0,0 +1,79 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeTicker(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewFake(start)
+	ticker := clk.NewTicker(10 * time.Second)
+
+	clk.Advance(9 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("Ticker fired before its interval")
+	default:
+	}
+
+	// Ticks that aren't received in time are dropped, like time.Ticker does
+	clk.Advance(25 * time.Second)
+	if got := <-ticker.C(); !got.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("First tick is at %s, want %s", got, start.Add(10*time.Second))
+	}
+	select {
+	case got := <-ticker.C():
+		t.Errorf("Got a second buffered tick at %s", got)
+	default:
+	}
+
+	ticker.Stop()
+	if clk.Tickers() != 0 {
+		t.Error("Stopped ticker is still running")
+	}
+	clk.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Error("Stopped ticker fired")
+	default:
+	}
+	if !clk.Now().Equal(start.Add(94 * time.Second)) {
+		t.Errorf("Clock reads %s after advancing 94s", clk.Now())
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewFake(start)
+	timer := clk.NewTimer(10 * time.Second)
+	stopped := clk.NewTimer(10 * time.Second)
+	stopped.Stop()
+	if clk.Timers() != 1 {
+		t.Fatalf("%d timers waiting, want 1", clk.Timers())
+	}
+
+	clk.Advance(9 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("Timer fired early")
+	default:
+	}
+	clk.Advance(time.Minute)
+	if got := <-timer.C(); !got.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("Timer fired at %s, want %s", got, start.Add(10*time.Second))
+	}
+	if clk.Timers() != 0 {
+		t.Error("Fired timer is still waiting")
+	}
+	select {
+	case <-stopped.C():
+		t.Error("Stopped timer fired")
+	default:
+	}
+
+	// Like time.NewTimer, a timer for no time at all fires straight away
+	if got := <-clk.NewTimer(0).C(); !got.Equal(clk.Now()) {
+		t.Errorf("Timer for 0 fired at %s, want %s", got, clk.Now())
+	}
+}
@@ -3,51 +3,1718 @@ package config
 
 import (
 	"fmt"
+	"maps"
+	"math"
+	"mime"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/vinzmyko/load-balancer/internal/cron"
+)
+
+// Valid Prometheus label names
+var metricLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Valid HTTP header names, tokens as of RFC 9110 section 5.1
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// Headers annotations can't set, as the proxy or the transport own them
+var reservedAnnotations = []string{"Host", "Connection", "Content-Length", "Transfer-Encoding", "Upgrade"}
+
+// Config represents the load balancer configuration
+type Config struct {
+	Server   ServerConfig    `yaml:"server"`
+	Backends []BackendConfig `yaml:"backends"`
+
+	// Egress proxies of the backends without a proxy of their own, by the value of their "pool"
+	// label (PoolLabel). Every key must be the pool of at least one backend.
+	PoolProxies map[string]EgressProxyConfig `yaml:"pool_proxies"`
+
+	// Headers set on requests to the backends in each pool (by their pool label), see RouteConfig.Annotations
+	PoolAnnotations map[string]map[string]string `yaml:"pool_annotations"`
+
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+	Retry    RetryConfig   `yaml:"retry"`
+	Strategy string        `yaml:"strategy"` // Load balancing strategy, see the Strategy constants
+
+	// Skipping backends too slow for the time a request has left
+	Deadlines DeadlineConfig `yaml:"deadlines"`
+
+	// How backend hostnames are looked up and cached
+	Resolver ResolverConfig `yaml:"resolver"`
+
+	// Optional gate on the initial health probe, see the StartupCheck constants
+	StartupCheck string `yaml:"startup_check"`
+
+	IdentityMetrics IdentityMetricsConfig `yaml:"identity_metrics"`
+	Metrics         MetricsConfig         `yaml:"metrics"`
+	Admin           AdminConfig           `yaml:"admin"`
+
+	// The balancer's own readiness endpoint on the main port
+	HealthEndpoint HealthEndpointConfig `yaml:"health_endpoint"`
+
+	// Evaluated in order, requests matching none of them go to every backend
+	Routes []RouteConfig `yaml:"routes"`
+
+	Schedules    []ScheduleConfig   `yaml:"schedules"`
+	LoadShedding LoadSheddingConfig `yaml:"load_shedding"`
+	TenantQuotas TenantQuotaConfig  `yaml:"tenant_quotas"`
+
+	TCP TCPConfig `yaml:"tcp"`
+
+	// Load test and probe traffic kept away from production backends and metrics
+	Synthetic SyntheticConfig `yaml:"synthetic"`
+
+	// What to do with requests when none of a route's backends is healthy
+	NoHealthyBackends NoHealthyConfig `yaml:"no_healthy_backends"`
+
+	// What to do with requests once too many of a route's backends are failing
+	Panic PanicConfig `yaml:"panic"`
+
+	DebugTrace DebugTraceConfig `yaml:"debug_trace"`
+
+	// Server-Timing on proxied responses, splitting their latency between the balancer and the backend
+	ServerTiming ServerTimingConfig `yaml:"server_timing"`
+
+	// Recent failed requests kept in memory for the admin API
+	FailureJournal FailureJournalConfig `yaml:"failure_journal"`
+
+	// Backend responses asking for less traffic
+	LoadSignals LoadSignalConfig `yaml:"load_signals"`
+
+	// Checks a recovered backend must pass before it gets live traffic again
+	Warmup WarmupConfig `yaml:"warmup"`
+
+	Alerts AlertConfig `yaml:"alerts"`
+
+	// Per-pool utilization signals for scaling the backend fleets
+	Autoscaling AutoscalingConfig `yaml:"autoscaling"`
+
+	// Checks of where backend selection sends requests against where the strategy should
+	FairnessAudit FairnessAuditConfig `yaml:"fairness_audit"`
+
+	// Circuit breaker and health state kept across restarts
+	State StateConfig `yaml:"state"`
+
+	// Warnings logged as the listener and backend client certificates near their expiry
+	CertExpiry CertExpiryConfig `yaml:"cert_expiry"`
+
+	// Winding down of long-lived connections at shutdown and when a backend is drained
+	Drain DrainConfig `yaml:"drain"`
+
+	// Closing of backend connections left idle too long or open past a max age
+	IdleConnections IdleConnectionsConfig `yaml:"idle_connections"`
+
+	// Time limits of the other stages of shutdown
+	Shutdown ShutdownConfig `yaml:"shutdown"`
+
+	// Instances sharing config pulled from a remote source by an elected leader
+	Cluster ClusterConfig `yaml:"cluster"`
+
+	// DNS responder answering with healthy nodes, for crude load balancing across regions
+	DNS DNSConfig `yaml:"dns"`
+
+	// HTML template rendered for errors shown to browsers, empty = plain text
+	ErrorPage string `yaml:"error_page"`
+
+	// Translate gRPC-Web requests from browsers to gRPC, backends must use protocol http2
+	GRPCWeb bool `yaml:"grpc_web"`
+
+	// Reject configs with risky combinations of settings instead of only warning about them
+	Strict bool `yaml:"strict"`
+}
+
+// Load balancing strategies
+const (
+	StrategyRoundRobin               = "round_robin" // Default
+	StrategyWeightedLeastConnections = "weighted_least_connections"
+	StrategyProbeLatency             = "probe_latency" // Random, weighted by weight over health probe latency
+)
+
+// ValidStrategy reports whether strategy is one of the Strategy constants or empty for the default
+func ValidStrategy(strategy string) bool {
+	switch strategy {
+	case "", StrategyRoundRobin, StrategyWeightedLeastConnections, StrategyProbeLatency:
+		return true
+	}
+	return false
+}
+
+// Startup check modes
+const (
+	StartupRequireOneHealthy = "require_one_healthy"     // Report not ready on /health until a backend passes a probe
+	StartupExitUnlessHealthy = "exit_unless_one_healthy" // Exit at startup if no backend passes the initial probe
+)
+
+// HealthEndpointConfig places the readiness endpoint the balancer answers itself on the main port.
+// It's also served at GET /health on the admin port, which never collides with routed paths.
+type HealthEndpointConfig struct {
+	Path        string `yaml:"path"`        // Default /health
+	Passthrough bool   `yaml:"passthrough"` // Forward requests for the path to the backends instead of answering them
+}
+
+// PanicConfig keeps a route from piling all its traffic onto the few backends still passing health
+// checks once too many fail, which tends to take those down too, like Envoy's panic threshold
+type PanicConfig struct {
+	// Share of a route's backends failing health checks or with an open circuit above which the
+	// route panics, drained backends aside. 0 = never.
+	UnhealthyPercent float64 `yaml:"unhealthy_percent"`
+
+	Mode           string            `yaml:"mode"`            // See the Panic constants, default spread
+	FallbackLabels map[string]string `yaml:"fallback_labels"` // Backends used by the fallback mode
+}
+
+// What a route does in panic
+const (
+	PanicSpread   = "spread"   // Spread traffic over all the route's backends as if every one was healthy
+	PanicFallback = "fallback" // Send traffic to the backends matching fallback_labels instead
+)
+
+// ServerTimingConfig adds a Server-Timing header to proxied responses, so CDNs and browser devtools
+// can tell time spent at the edge, in the balancer and at the origin apart
+type ServerTimingConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	StripBackend bool `yaml:"strip_backend"` // Drop the backends' own Server-Timing entries, which may reveal internals
+}
+
+// DebugTraceConfig lets requests carrying the debug header get a JSON trace of the balancer's
+// decisions in place of the backend's response body
+type DebugTraceConfig struct {
+	Enabled bool   `yaml:"enabled"` // Initial state, can be switched at runtime through the admin API
+	Header  string `yaml:"header"`  // Default X-LB-Debug
+	Token   string `yaml:"token"`   // Header value required, tracing can't be enabled without one
+}
+
+// FailureJournalConfig keeps the last requests that ended in a 5xx or needed a retry, served by
+// GET /admin/debug/failures, to look into intermittent errors without full access logging
+type FailureJournalConfig struct {
+	Entries *int     `yaml:"entries"` // Failed requests kept, 0 turns the journal off, default 100
+	Headers []string `yaml:"headers"` // Request headers recorded, credentials as REDACTED, default User-Agent, Content-Type and Content-Length
+}
+
+// CertExpiryConfig sets how far ahead of their expiry loaded certificates are warned about. Warnings
+// are logged once a day inside the warn window, then at every hourly check inside the critical one.
+type CertExpiryConfig struct {
+	WarnBefore     time.Duration `yaml:"warn_before"`     // Default 720h (30 days)
+	CriticalBefore time.Duration `yaml:"critical_before"` // Default 168h (7 days), or warn_before if that is shorter
+}
+
+// WarmupConfig holds a backend back from rotation after it recovers until it has passed
+// further health probes and answered copies of real requests
+type WarmupConfig struct {
+	Probes           int           `yaml:"probes"`            // Consecutive successful probes, including the one it recovered on
+	MirroredRequests int           `yaml:"mirrored_requests"` // Successful mirrored GET requests, answered below 500
+	MirrorTimeout    time.Duration `yaml:"mirror_timeout"`    // Limit on each mirrored request, default 5s
+}
+
+// Enabled reports whether recovered backends have to warm up at all
+func (w WarmupConfig) Enabled() bool {
+	return w.Probes > 1 || w.MirroredRequests > 0
+}
+
+// SyntheticConfig marks requests carrying a header as synthetic, e.g. load tests. They can be
+// sent to a pool of their own and are left out of the request metrics and route error rates.
+type SyntheticConfig struct {
+	Header           string            `yaml:"header"`             // e.g. X-Synthetic, empty = off
+	Value            string            `yaml:"value"`              // Required header value, needed with a header
+	BackendLabels    map[string]string `yaml:"backend_labels"`     // Backends synthetic requests go to, empty = routed as usual
+	IncludeInMetrics bool              `yaml:"include_in_metrics"` // Count them like other requests as well
+}
+
+// LoadSignalConfig lets backends ask the weighted strategies for less traffic through their
+// responses, lowering their effective weight for a while
+type LoadSignalConfig struct {
+	Header           string        `yaml:"header"`             // Response header carrying the backend's load from 0 to 1, empty = ignored
+	Duration         time.Duration `yaml:"duration"`           // How long a load value holds without a newer one, default 10s
+	RetryAfter       bool          `yaml:"retry_after"`        // Treat 429 and 503 with Retry-After as full load until it elapses
+	MaxRetryAfter    time.Duration `yaml:"max_retry_after"`    // Longest Retry-After honoured, default 60s
+	MinWeightPercent *int          `yaml:"min_weight_percent"` // Share of its weight a fully loaded backend keeps, 0 takes it out, default 10
+}
+
+// ClusterConfig makes a group of instances converge on a config document pulled from a remote
+// source. The first reachable peer in list order is the leader: it polls the source and rolls a
+// changed document out to every peer, staging it on all of them before any of them applies it.
+type ClusterConfig struct {
+	Self         string        `yaml:"self"`          // This instance's admin API URL as the peers reach it
+	Peers        []string      `yaml:"peers"`         // Admin API URLs of every instance including this one, in leader order
+	ConfigURL    string        `yaml:"config_url"`    // Remote config document, empty = clustering off
+	PollInterval time.Duration `yaml:"poll_interval"` // Default 30s
+}
+
+// StateConfig saves circuit breaker and health check state on shutdown and restores it at
+// startup, so a quick restart doesn't send traffic to backends known to be failing
+type StateConfig struct {
+	File   string        `yaml:"file"`    // Empty = state isn't kept
+	MaxAge time.Duration `yaml:"max_age"` // Older saved state is ignored, default 5m
+}
+
+// DrainConfig controls how long-lived connections are wound down. At shutdown HTTP/2 clients get a
+// GOAWAY and WebSocket clients a close frame, and whatever is still open after the deadline is
+// closed. WebSockets to a backend whose weight drops to 0 are closed the same way.
+type DrainConfig struct {
+	CloseCode int           `yaml:"close_code"` // WebSocket close status code sent, default 1001 (going away)
+	Deadline  time.Duration `yaml:"deadline"`   // Time given to requests and streams to finish, default 30s
+}
+
+// IdleConnectionsConfig closes backend connections that sat unused in the pool for longer than
+// idle_timeout, through the transport's idle timeout, and has a reaper close those opened more
+// than max_age ago, for backends and NATs that drop long-lived connections without telling either
+// end. The reaper only closes connections between requests.
+type IdleConnectionsConfig struct {
+	IdleTimeout time.Duration `yaml:"idle_timeout"` // 0 = the transport's own 90s
+	MaxAge      time.Duration `yaml:"max_age"`      // 0 = no limit
+	Interval    time.Duration `yaml:"interval"`     // How often the reaper checks connections' age, default 10s
+}
+
+// ShutdownConfig limits the stages of shutdown, which run in order: the listeners are closed, open
+// requests and streams are drained (within drain.deadline), health probes and background jobs stop
+// and state is saved, then the metrics and admin servers finish the calls they have in flight.
+type ShutdownConfig struct {
+	Listeners    time.Duration `yaml:"listeners"`     // Default 5s
+	HealthChecks time.Duration `yaml:"health_checks"` // Default 5s
+	Metrics      time.Duration `yaml:"metrics"`       // Default 5s
+}
+
+// DNSConfig serves A and AAAA records over UDP for configured names, answering with the
+// addresses of nodes whose backend is healthy in a weighted random order
+type DNSConfig struct {
+	Listen  string            `yaml:"listen"`  // UDP address e.g. ":53", empty = off
+	TTL     time.Duration     `yaml:"ttl"`     // Of answers, default 30s, kept short so clients follow health changes
+	Answers int               `yaml:"answers"` // Addresses per answer, 0 = every healthy node
+	Records []DNSRecordConfig `yaml:"records"`
+}
+
+// DNSRecordConfig is a name and the nodes that can answer for it
+type DNSRecordConfig struct {
+	Name  string          `yaml:"name"`
+	Nodes []DNSNodeConfig `yaml:"nodes"`
+}
+
+// DNSNodeConfig is one address a name can resolve to
+type DNSNodeConfig struct {
+	Address string `yaml:"address"` // IPv4 or IPv6 address
+	Weight  int    `yaml:"weight"`  // Relative chance of being listed first, default 1
+	Backend string `yaml:"backend"` // ID of the backend whose health checks decide if it's listed, empty = always
+}
+
+// AlertConfig holds built-in alert rules that log and call a webhook, for deployments without
+// an alerting stack of their own
+type AlertConfig struct {
+	Interval time.Duration     `yaml:"interval"` // How often rules are evaluated, default 10s
+	Webhook  string            `yaml:"webhook"`  // POSTed to when a rule fires or resolves, empty = log only
+	Rules    []AlertRuleConfig `yaml:"rules"`
+}
+
+// AutoscalingConfig exports the utilization of each pool (backends by their pool label) as seen
+// from the balancer: Prometheus gauges for the Kubernetes HPA through an external metrics adapter,
+// GET /admin/autoscaling and an optional webhook. Each pool also gets a suggested backend count.
+type AutoscalingConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	Interval          time.Duration `yaml:"interval"`           // How often signals are computed, default 15s
+	BackendCapacity   int           `yaml:"backend_capacity"`   // In-flight requests a backend without max_conns handles when fully used, default 100
+	TargetUtilization float64       `yaml:"target_utilization"` // Utilization the suggested backend count aims for, default 0.7
+	LatencyTarget     time.Duration `yaml:"latency_target"`     // p95 latency the suggested backend count aims for, 0 = latency not considered
+	Webhook           string        `yaml:"webhook"`            // POSTed the signals every interval, empty = none
+}
+
+// FairnessAuditConfig records each request's backend selection over a sliding window, along with
+// the share of it every candidate backend was due at that moment: an even one under round_robin,
+// an even one among those tied for the fewest in-flight requests per weight under
+// weighted_least_connections and one by weight over probe latency under probe_latency. Routes whose
+// actual distribution strays from the expected one are exported and logged, flagging selection
+// bugs like hot spots. Retries aren't recorded.
+type FairnessAuditConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Window        time.Duration `yaml:"window"`         // Span of recent selections compared, default 5m
+	Interval      time.Duration `yaml:"interval"`       // How often the distributions are compared, default 30s
+	Threshold     float64       `yaml:"threshold"`      // Divergence logged as a warning, 0-1, default 0.1
+	MinSelections int           `yaml:"min_selections"` // Selections a route needs in the window to be compared, default 1000
+}
+
+// DeadlineConfig makes backend selection aware of how long a request has left. Backends whose p95
+// latency over recent attempts exceeds the remaining budget are skipped while a faster one is available.
+// The remaining budget is also capped by timeouts.total.
+type DeadlineConfig struct {
+	Header     string        `yaml:"header"`      // Request header with the client's budget, in milliseconds or as a duration like 250ms
+	Budget     time.Duration `yaml:"budget"`      // Budget of requests without the header, 0 = only requests sending it
+	Window     time.Duration `yaml:"window"`      // Span of recent attempts the p95 is computed over, default 1m
+	MinSamples int           `yaml:"min_samples"` // Attempts a backend needs in the window before it can be skipped, default 20
+}
+
+// Enabled reports whether any request can have a budget
+func (d DeadlineConfig) Enabled() bool {
+	return d.Header != "" || d.Budget > 0
+}
+
+// ResolverConfig sets how backend hostnames are looked up for resolve entries, health checks and
+// connections to backends
+type ResolverConfig struct {
+	Servers     []string      `yaml:"servers"`      // DNS servers (host or host:port) tried in order, empty = the system resolver
+	MinTTL      time.Duration `yaml:"min_ttl"`      // Shortest time answers are cached for, also used for the system resolver's answers which carry no TTL
+	MaxTTL      time.Duration `yaml:"max_ttl"`      // Longest time answers are cached for, default 5m
+	NegativeTTL time.Duration `yaml:"negative_ttl"` // How long names that don't exist are cached for, 0 = not cached
+	Timeout     time.Duration `yaml:"timeout"`      // Time a query to one server may take, default 2s
+}
+
+// Enabled reports whether lookups go anywhere but the uncached system resolver
+func (r ResolverConfig) Enabled() bool {
+	return len(r.Servers) > 0 || r.MinTTL > 0 || r.NegativeTTL > 0
+}
+
+// AlertRuleConfig fires once a metric has stayed above the threshold for the given time
+type AlertRuleConfig struct {
+	Name        string        `yaml:"name"`
+	Metric      string        `yaml:"metric"`       // See the AlertMetric constants
+	Threshold   float64       `yaml:"threshold"`    // Fires while the metric is above this
+	For         time.Duration `yaml:"for"`          // How long it must stay above, 0 = on the first evaluation
+	MinRequests uint64        `yaml:"min_requests"` // Requests per interval before an error rate counts, a rule keeps its state through quieter ones, default 20
+}
+
+// Metrics alert rules can watch
+const (
+	AlertMetricUnhealthyPercent = "unhealthy_percent"  // Percentage of backends failing health checks
+	AlertMetricErrorRatePercent = "error_rate_percent" // Percentage of requests in the last interval ending in a 5xx
+	AlertMetricOpenCircuits     = "open_circuits"      // Backends with an open circuit breaker
 )
 
-// Config represents the load balancer configuration
-type Config struct {
-	Server   ServerConfig    `yaml:"server"`
-	Backends []BackendConfig `yaml:"backends"`
+// Policies for requests arriving when no backend is healthy
+const (
+	NoHealthyForward = "forward" // Default, try a backend anyway in case the health checks are wrong
+	NoHealthyReject  = "reject"  // Answer 503 with Retry-After straight away
+	NoHealthyCache   = "cache"   // Serve the last good response to the same GET, 503 without one
+)
+
+// NoHealthyConfig sets the behaviour when every backend of a route is unhealthy or has an open circuit
+type NoHealthyConfig struct {
+	Policy         string        `yaml:"policy"`           // See the NoHealthy constants
+	RetryAfter     time.Duration `yaml:"retry_after"`      // Sent with 503s, default 5s
+	CacheEntries   int           `yaml:"cache_entries"`    // Responses kept for the cache policy, default 1000
+	CacheBodyBytes int64         `yaml:"cache_body_bytes"` // Larger responses aren't cached, default 1 MiB
+}
+
+// Validate the configuration file
+func (cfg *Config) Validate() error {
+	isValidServerPort := cfg.Server.Port >= 1 && cfg.Server.Port <= 65535
+	hasAtLeastOneBackendServer := len(cfg.Backends) > 0
+
+	if !isValidServerPort {
+		return invalid("server.port", "invalid port %d: must be 1-65535", cfg.Server.Port)
+	}
+	if _, err := cfg.Server.ListenPorts(); err != nil {
+		return invalid("server.ports", "%w", err)
+	}
+	if cfg.Server.MaxConns < 0 || cfg.Server.AcceptRate < 0 || cfg.Server.AcceptBurst < 0 {
+		return invalid("server", "server connection limits cannot be negative")
+	}
+	for _, bind := range cfg.Server.Bind {
+		if strings.Trim(bind, "[]") == "" {
+			return invalid("server.bind", "server bind addresses cannot be empty")
+		}
+	}
+	if tls := cfg.Server.TLS; tls != nil && (tls.CertFile == "" || tls.KeyFile == "") {
+		return invalid("server.tls", "server tls needs both cert_file and key_file")
+	}
+	switch cfg.Server.HTTP10 {
+	case "", HTTP10KeepAlive, HTTP10Close, HTTP10Reject:
+	default:
+		return invalid("server.http10", "unknown server http10 %q", cfg.Server.HTTP10)
+	}
+	switch cfg.Server.AbsoluteForm {
+	case "", AbsoluteFormOrigin, AbsoluteFormReject:
+	default:
+		return invalid("server.absolute_form", "unknown server absolute_form %q", cfg.Server.AbsoluteForm)
+	}
+	if len(cfg.TCP.Backends) > 0 && !cfg.Server.DetectProtocol {
+		return invalid("server.detect_protocol", "tcp backends need server detect_protocol")
+	}
+	if cfg.TCP.IdleTimeout < 0 || cfg.TCP.MaxLifetime < 0 {
+		return invalid("tcp", "tcp timeouts cannot be negative")
+	}
+	for i, addr := range cfg.TCP.Backends {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return invalid(fmt.Sprintf("tcp.backends[%d]", i), "invalid tcp backend %q: %w", addr, err)
+		}
+	}
+
+	if path := cfg.HealthEndpoint.Path; path != "" && (!strings.HasPrefix(path, "/") || strings.ContainsAny(path, "{} \t")) {
+		return invalid("health_endpoint.path", "health_endpoint path %q must be an absolute path without wildcards", path)
+	}
+
+	if cfg.Admin.Port < 0 || cfg.Admin.Port > 65535 {
+		return invalid("admin.port", "invalid admin port %d: must be 1-65535", cfg.Admin.Port)
+	}
+	if cfg.Admin.Port > 0 && cfg.Admin.Bind != "" && !loopback(cfg.Admin.Bind) && !cfg.Admin.Authenticated() {
+		return invalid("admin.bind", "admin API bound to %s needs basic_auth or bearer_token", cfg.Admin.Bind)
+	}
+	if cfg.Admin.Persist && !cfg.Admin.Authenticated() {
+		return invalid("admin.persist", "admin persist needs basic_auth or bearer_token")
+	}
+	if auth := cfg.Admin.BasicAuth; auth != nil && (auth.Username == "" || auth.Password == "") {
+		return invalid("admin.basic_auth", "admin basic_auth needs a username and password")
+	}
+	if !hasAtLeastOneBackendServer {
+		return invalid("backends", "%w", ErrNoBackends)
+	}
+
+	backendURLs := make(map[string]int)
+	backendIDs := make(map[string]int)
+	for i, backendServer := range cfg.Backends {
+		field := fmt.Sprintf("backends[%d]", i)
+		if backendServer.URL == "" {
+			return invalid(field+".url", "backend server #%d is empty", i)
+		}
+		key, err := normalizeBackendURL(backendServer.URL)
+		if err != nil {
+			return invalid(field+".url", "backend server #%d: %w", i, err)
+		}
+		if first, ok := backendURLs[key]; ok {
+			return invalid(field+".url", "backend server #%d %s duplicates backend server #%d", i, backendServer.URL, first)
+		}
+		backendURLs[key] = i
+		if id := backendServer.ID; id != "" {
+			if first, ok := backendIDs[id]; ok {
+				return invalid(field+".id", "backend server #%d has the same id %q as backend server #%d", i, id, first)
+			}
+			backendIDs[id] = i
+		}
+		if backendServer.HealthURL != "" {
+			if _, err := normalizeBackendURL(backendServer.HealthURL); err != nil {
+				return invalid(field+".health_url", "backend server #%d health_url: %w", i, err)
+			}
+		}
+		if backendServer.Weight <= 0 {
+			return invalid(field+".weight", "backend server #%d weight must be at least 1", i)
+		}
+		if backendServer.MaxConns < 0 {
+			return invalid(field+".max_conns", "backend server #%d has a negative max_conns", i)
+		}
+		switch backendServer.MaxConnsPolicy {
+		case "", MaxConnsQueue, MaxConnsSpill:
+		default:
+			return invalid(field+".max_conns_policy", "backend server #%d has unknown max_conns_policy %q", i, backendServer.MaxConnsPolicy)
+		}
+		switch backendServer.Protocol {
+		case "", ProtocolHTTP1, ProtocolHTTP2:
+		default:
+			return invalid(field+".protocol", "backend server #%d has unknown protocol %q", i, backendServer.Protocol)
+		}
+		switch backendServer.AddressFamily {
+		case "", AddressFamilyIPv4, AddressFamilyIPv6:
+		default:
+			return invalid(field+".address_family", "backend server #%d has unknown address_family %q", i, backendServer.AddressFamily)
+		}
+		if tls := backendServer.TLS; tls != nil && (tls.CertFile == "") != (tls.KeyFile == "") {
+			return invalid(field+".tls", "backend server #%d tls needs both cert_file and key_file for a client certificate", i)
+		}
+		if proxy := backendServer.Proxy; proxy != nil {
+			if err := validateEgressProxy(field+".proxy", *proxy); err != nil {
+				return err
+			}
+		}
+		// Connections to a resolved address can't be handed to a proxy, it resolves the host itself
+		if backendServer.Resolve && cfg.BackendProxy(backendServer) != nil {
+			return invalid(field+".resolve", "backend server #%d can't resolve its host when it goes through a proxy", i)
+		}
+	}
+	for _, pool := range slices.Sorted(maps.Keys(cfg.PoolAnnotations)) {
+		if err := validateAnnotations(fmt.Sprintf("pool_annotations[%s]", pool), cfg.PoolAnnotations[pool]); err != nil {
+			return err
+		}
+	}
+	for _, pool := range slices.Sorted(maps.Keys(cfg.PoolProxies)) {
+		field := fmt.Sprintf("pool_proxies[%s]", pool)
+		if !slices.ContainsFunc(cfg.Backends, func(b BackendConfig) bool { return b.Labels[PoolLabel] == pool }) {
+			return invalid(field, "pool_proxies has pool %q, but no backend has a %s label of %q", pool, PoolLabel, pool)
+		}
+		if err := validateEgressProxy(field, cfg.PoolProxies[pool]); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Timeouts.FirstByte < 0 || cfg.Timeouts.Total < 0 {
+		return invalid("timeouts", "timeouts cannot be negative")
+	}
+	if cfg.Timeouts.Total > 0 && cfg.Timeouts.FirstByte > cfg.Timeouts.Total {
+		return invalid("timeouts.first_byte", "first_byte timeout %s is longer than total timeout %s", cfg.Timeouts.FirstByte, cfg.Timeouts.Total)
+	}
+
+	if cfg.Metrics.Port < 0 || cfg.Metrics.Port > 65535 {
+		return invalid("metrics.port", "invalid metrics port %d: must be 1-65535", cfg.Metrics.Port)
+	}
+	if auth := cfg.Metrics.BasicAuth; auth != nil && (auth.Username == "" || auth.Password == "") {
+		return invalid("metrics.basic_auth", "metrics basic_auth needs a username and password")
+	}
+	if cfg.Metrics.Namespace != "" && !metricLabelName.MatchString(cfg.Metrics.Namespace) {
+		return invalid("metrics.namespace", "invalid metrics namespace %q", cfg.Metrics.Namespace)
+	}
+	for _, name := range cfg.Metrics.BackendLabels {
+		if !metricLabelName.MatchString(name) || name == "backend" || name == "backend_id" {
+			return invalid("metrics.backend_labels", "invalid metrics backend label %q", name)
+		}
+	}
+
+	routeNames := make(map[string]bool)
+	for i, route := range cfg.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if route.Name == "" {
+			return invalid(field+".name", "route #%d has no name", i)
+		}
+		if routeNames[route.Name] {
+			return invalid(field+".name", "duplicate route name %q", route.Name)
+		}
+		routeNames[route.Name] = true
+		if !cfg.anyBackendHasLabels(route.BackendLabels) {
+			return invalid(field+".backend_labels", "route %q matches no backends", route.Name)
+		}
+		if !ValidStrategy(route.Strategy) {
+			return invalid(field+".strategy", "unknown strategy %q for route %q", route.Strategy, route.Name)
+		}
+		if err := validateAnnotations(field+".annotations", route.Annotations); err != nil {
+			return err
+		}
+		if canary := route.Canary; canary != nil {
+			if !cfg.anyBackendHasLabels(canary.BackendLabels) {
+				return invalid(field+".canary.backend_labels", "canary of route %q matches no backends", route.Name)
+			}
+			if canary.Weight < 0 || canary.Weight > 100 {
+				return invalid(field+".canary.weight", "canary weight of route %q must be 0-100", route.Name)
+			}
+			if canary.Window < 0 || canary.MaxErrorRateIncrease < 0 || canary.MaxLatencyRatio < 0 {
+				return invalid(field+".canary", "canary thresholds of route %q cannot be negative", route.Name)
+			}
+		}
+		if regions := route.Regions; regions != nil {
+			if err := cfg.validateRegions(field+".regions", route); err != nil {
+				return err
+			}
+		}
+		if rewrite := route.Rewrite; rewrite != nil {
+			if u, err := url.Parse(rewrite.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+				return invalid(field+".rewrite.public_url", "rewrite public_url of route %q must be set to an absolute URL", route.Name)
+			}
+			if rewrite.MaxBodyBytes < 0 {
+				return invalid(field+".rewrite.max_body_bytes", "rewrite max_body_bytes of route %q cannot be negative", route.Name)
+			}
+		}
+		if slo := route.SLO; slo != nil {
+			if slo.Availability < 0 || slo.Availability >= 100 || slo.LatencyTarget < 0 || slo.LatencyTarget >= 100 {
+				return invalid(field+".slo", "slo targets of route %q must be percentages below 100", route.Name)
+			}
+			if slo.Availability == 0 && slo.Latency == 0 {
+				return invalid(field+".slo", "slo of route %q has no objectives", route.Name)
+			}
+			if slo.Latency < 0 || slo.Period < 0 || slo.Period%time.Hour != 0 {
+				return invalid(field+".slo", "slo latency of route %q cannot be negative and its period must be whole hours", route.Name)
+			}
+		}
+		if body := route.Body; body != nil {
+			if body.MaxJSONDepth < 0 || body.MaxBodyBytes < 0 {
+				return invalid(field+".body", "body limits of route %q cannot be negative", route.Name)
+			}
+			for _, contentType := range body.ContentTypes {
+				if _, _, err := mime.ParseMediaType(contentType); err != nil {
+					return invalid(field+".body.content_types", "route %q allows invalid content type %q", route.Name, contentType)
+				}
+			}
+		}
+		if cc := route.CacheControl; cc != nil && (cc.MaxAge < 0 || cc.MaxAge%time.Second != 0) {
+			return invalid(field+".cache_control.max_age", "cache_control max_age of route %q must be whole seconds", route.Name)
+		}
+		if local := route.Local; local != nil {
+			if local.Preflight && len(local.AllowOrigins) == 0 {
+				return invalid(field+".local.allow_origins", "local preflight answers of route %q need allow_origins", route.Name)
+			}
+			if local.MaxAge < 0 || local.MaxAge%time.Second != 0 {
+				return invalid(field+".local.max_age", "local max_age of route %q must be whole seconds", route.Name)
+			}
+		}
+		if signing := route.Signing; signing != nil {
+			if signing.Key == "" {
+				return invalid(field+".signing.key", "signing of route %q has no key", route.Name)
+			}
+			if signing.MaxSkew < 0 || signing.ReplayCache < 0 || signing.MaxBodyBytes < 0 {
+				return invalid(field+".signing", "signing limits of route %q cannot be negative", route.Name)
+			}
+		}
+	}
+
+	if err := cfg.validateSchedules(); err != nil {
+		return err
+	}
+
+	if err := validateQuotaLimits("tenant_quotas.default", "default", cfg.TenantQuotas.Default); err != nil {
+		return err
+	}
+	for tenant, limits := range cfg.TenantQuotas.Tenants {
+		if err := validateQuotaLimits("tenant_quotas.tenants."+tenant, tenant, limits); err != nil {
+			return err
+		}
+	}
+	if quotas := cfg.TenantQuotas; quotas.Header != "" && len(quotas.APIKeys) == 0 {
+		return invalid("tenant_quotas.api_keys", "tenant_quotas header needs api_keys to tell tenants apart")
+	}
+	for _, tenant := range cfg.TenantQuotas.APIKeys {
+		if tenant == "" {
+			return invalid("tenant_quotas.api_keys", "tenant_quotas api_keys must each name a tenant")
+		}
+	}
+	if cfg.TenantQuotas.Claim != "" && cfg.TenantQuotas.JWTSecret == "" {
+		return invalid("tenant_quotas.jwt_secret", "tenant_quotas claim needs a jwt_secret to verify tokens with")
+	}
+	if cfg.TenantQuotas.MaxTenants < 0 {
+		return invalid("tenant_quotas.max_tenants", "tenant_quotas max_tenants cannot be negative")
+	}
+
+	if err := cfg.validateLoadShedding(); err != nil {
+		return err
+	}
+
+	if !ValidStrategy(cfg.Strategy) {
+		return invalid("strategy", "unknown strategy %q", cfg.Strategy)
+	}
+
+	switch cfg.NoHealthyBackends.Policy {
+	case "", NoHealthyForward, NoHealthyReject, NoHealthyCache:
+	default:
+		return invalid("no_healthy_backends.policy", "unknown no_healthy_backends policy %q", cfg.NoHealthyBackends.Policy)
+	}
+	if cfg.NoHealthyBackends.RetryAfter < 0 || cfg.NoHealthyBackends.CacheEntries < 0 || cfg.NoHealthyBackends.CacheBodyBytes < 0 {
+		return invalid("no_healthy_backends", "no_healthy_backends limits cannot be negative")
+	}
+
+	if ls := cfg.LoadSignals; ls.Duration < 0 || ls.MaxRetryAfter < 0 || (ls.MinWeightPercent != nil && (*ls.MinWeightPercent < 0 || *ls.MinWeightPercent > 100)) {
+		return invalid("load_signals", "load_signals durations cannot be negative and min_weight_percent must be 0-100")
+	}
+
+	if cfg.Synthetic.Header != "" && cfg.Synthetic.Value == "" {
+		return invalid("synthetic.value", "synthetic needs a value, any client can send the header")
+	}
+	if len(cfg.Synthetic.BackendLabels) > 0 && !cfg.anyBackendHasLabels(cfg.Synthetic.BackendLabels) {
+		return invalid("synthetic.backend_labels", "synthetic backend_labels match no backends")
+	}
+
+	if err := cfg.validateDNS(); err != nil {
+		return err
+	}
+
+	if c := cfg.Cluster; c.ConfigURL != "" {
+		if c.Self == "" || !slices.Contains(c.Peers, c.Self) {
+			return invalid("cluster.self", "cluster self must be set and listed in peers")
+		}
+		if c.PollInterval < 0 {
+			return invalid("cluster.poll_interval", "cluster poll_interval cannot be negative")
+		}
+	}
+
+	if cfg.State.MaxAge < 0 {
+		return invalid("state.max_age", "state max_age cannot be negative")
+	}
+
+	// Codes 1004-1006 and 1015 are reserved for reporting, they must not be sent in a close frame
+	if code := cfg.Drain.CloseCode; code != 0 && (code < 1000 || code > 4999 || (code >= 1004 && code <= 1006) || code == 1015) {
+		return invalid("drain.close_code", "drain close_code %d is not a WebSocket close code that can be sent", code)
+	}
+	if ic := cfg.IdleConnections; ic.IdleTimeout < 0 || ic.MaxAge < 0 || ic.Interval < 0 {
+		return invalid("idle_connections", "idle_connections settings cannot be negative")
+	}
+	if sd := cfg.Shutdown; sd.Listeners < 0 || sd.HealthChecks < 0 || sd.Metrics < 0 {
+		return invalid("shutdown", "shutdown timeouts cannot be negative")
+	}
+	if cfg.Drain.Deadline < 0 {
+		return invalid("drain.deadline", "drain deadline cannot be negative")
+	}
+
+	if err := cfg.validateAlerts(); err != nil {
+		return err
+	}
+
+	if as := cfg.Autoscaling; as.Interval < 0 || as.BackendCapacity < 0 || as.LatencyTarget < 0 {
+		return invalid("autoscaling", "autoscaling settings cannot be negative")
+	}
+	if target := cfg.Autoscaling.TargetUtilization; target < 0 || target > 1 {
+		return invalid("autoscaling.target_utilization", "autoscaling target_utilization must be 0-1")
+	}
+
+	if fa := cfg.FairnessAudit; fa.Window < 0 || fa.Interval < 0 || fa.MinSelections < 0 {
+		return invalid("fairness_audit", "fairness audit settings cannot be negative")
+	}
+	if threshold := cfg.FairnessAudit.Threshold; threshold < 0 || threshold > 1 {
+		return invalid("fairness_audit.threshold", "fairness audit threshold must be 0-1")
+	}
+
+	if cfg.Warmup.Probes < 0 || cfg.Warmup.MirroredRequests < 0 || cfg.Warmup.MirrorTimeout < 0 {
+		return invalid("warmup", "warmup settings cannot be negative")
+	}
+
+	switch cfg.StartupCheck {
+	case "", StartupRequireOneHealthy, StartupExitUnlessHealthy:
+	default:
+		return invalid("startup_check", "unknown startup_check %q", cfg.StartupCheck)
+	}
+
+	if cfg.CertExpiry.WarnBefore < 0 || cfg.CertExpiry.CriticalBefore < 0 {
+		return invalid("cert_expiry", "cert_expiry windows cannot be negative")
+	}
+	if cfg.CertExpiry.CriticalBefore > cfg.CertExpiry.WarnBefore {
+		return invalid("cert_expiry.critical_before", "cert_expiry critical_before %s is longer than warn_before %s", cfg.CertExpiry.CriticalBefore, cfg.CertExpiry.WarnBefore)
+	}
+
+	if cfg.DebugTrace.Enabled && cfg.DebugTrace.Token == "" {
+		return invalid("debug_trace.token", "debug_trace needs a token to be enabled")
+	}
+	if cfg.FailureJournal.Entries != nil && *cfg.FailureJournal.Entries < 0 {
+		return invalid("failure_journal.entries", "failure_journal entries cannot be negative")
+	}
+
+	if cfg.IdentityMetrics.MaxIdentities < 0 {
+		return invalid("identity_metrics.max_identities", "identity_metrics max_identities cannot be negative")
+	}
+
+	if cfg.Retry.Attempts < 0 {
+		return invalid("retry.attempts", "retry attempts cannot be negative")
+	}
+
+	if p := cfg.Panic.UnhealthyPercent; p < 0 || p >= 100 {
+		return invalid("panic.unhealthy_percent", "panic unhealthy_percent must be a percentage below 100")
+	}
+	switch cfg.Panic.Mode {
+	case "", PanicSpread:
+	case PanicFallback:
+		if len(cfg.Panic.FallbackLabels) == 0 || !cfg.anyBackendHasLabels(cfg.Panic.FallbackLabels) {
+			return invalid("panic.fallback_labels", "panic fallback_labels must match some backends")
+		}
+	default:
+		return invalid("panic.mode", "unknown panic mode %q", cfg.Panic.Mode)
+	}
+
+	if d := cfg.Deadlines; d.Budget < 0 || d.Window < 0 || d.MinSamples < 0 {
+		return invalid("deadlines", "deadlines settings cannot be negative")
+	}
+	if r := cfg.Resolver; r.MinTTL < 0 || r.MaxTTL < 0 || r.NegativeTTL < 0 || r.Timeout < 0 {
+		return invalid("resolver", "resolver durations cannot be negative")
+	}
+	if cfg.Resolver.MaxTTL > 0 && cfg.Resolver.MinTTL > cfg.Resolver.MaxTTL {
+		return invalid("resolver.min_ttl", "resolver min_ttl %s is longer than max_ttl %s", cfg.Resolver.MinTTL, cfg.Resolver.MaxTTL)
+	}
+	for i, server := range cfg.Resolver.Servers {
+		if _, port, err := net.SplitHostPort(server); err != nil || port == "" {
+			return invalid(fmt.Sprintf("resolver.servers[%d]", i), "resolver server %q must be a host or host:port", server)
+		}
+	}
+	if cfg.Retry.MaxBodyBytes < 0 || cfg.Retry.MemoryBodyBytes < 0 {
+		return invalid("retry", "retry body limits cannot be negative")
+	}
+	for _, class := range cfg.Retry.On {
+		if !slices.Contains(errorClasses, class) {
+			return invalid("retry.on", "unknown retry error class %q", class)
+		}
+	}
+
+	return nil
+}
+
+func (cfg *Config) validateRegions(field string, route RouteConfig) error {
+	regions := route.Regions
+	if regions.MinHealthyPercent < 0 || regions.MinHealthyPercent > 100 {
+		return invalid(field+".min_healthy_percent", "regions min_healthy_percent of route %q must be 0-100", route.Name)
+	}
+	if regions.MaxLatency < 0 {
+		return invalid(field+".max_latency", "regions max_latency of route %q cannot be negative", route.Name)
+	}
+	if len(regions.Pools) == 0 {
+		return invalid(field+".pools", "regions of route %q has no pools", route.Name)
+	}
+	names := make(map[string]bool)
+	weighted := false
+	for i, region := range regions.Pools {
+		poolField := fmt.Sprintf("%s.pools[%d]", field, i)
+		if region.Name == "" || names[region.Name] {
+			return invalid(poolField+".name", "region #%d of route %q needs a unique name", i, route.Name)
+		}
+		names[region.Name] = true
+		selector := maps.Clone(route.BackendLabels)
+		if selector == nil {
+			selector = make(map[string]string)
+		}
+		maps.Copy(selector, region.BackendLabels)
+		if len(region.BackendLabels) == 0 || !cfg.anyBackendHasLabels(selector) {
+			return invalid(poolField+".backend_labels", "region %q of route %q matches none of its backends", region.Name, route.Name)
+		}
+		if region.Weight < 0 {
+			return invalid(poolField+".weight", "weight of region %q of route %q cannot be negative", region.Name, route.Name)
+		}
+		weighted = weighted || region.Weight > 0
+	}
+	if !weighted {
+		return invalid(field+".pools", "regions of route %q are all standbys, one needs a weight", route.Name)
+	}
+	return nil
+}
+
+func (cfg *Config) validateSchedules() error {
+	for i, schedule := range cfg.Schedules {
+		field := fmt.Sprintf("schedules[%d]", i)
+		if schedule.Name == "" {
+			return invalid(field+".name", "schedule #%d has no name", i)
+		}
+		if _, err := cron.Parse(schedule.Cron); err != nil {
+			return invalid(field+".cron", "schedule %q: %w", schedule.Name, err)
+		}
+		if len(schedule.Weights) == 0 && schedule.Maintenance == nil && schedule.Route == "" {
+			return invalid(field, "schedule %q has no actions", schedule.Name)
+		}
+		for id, weight := range schedule.Weights {
+			if !slices.ContainsFunc(cfg.Backends, func(b BackendConfig) bool { return b.ID == id }) {
+				return invalid(field+".weights", "schedule %q sets the weight of unknown backend id %q", schedule.Name, id)
+			}
+			if weight <= 0 {
+				return invalid(field+".weights", "schedule %q sets a non-positive weight for %s", schedule.Name, id)
+			}
+		}
+		if (schedule.Route == "") != (schedule.Pool == "") {
+			return invalid(field, "schedule %q must set both route and pool to switch pools", schedule.Name)
+		}
+		if schedule.Route != "" && schedule.Route != "default" &&
+			!slices.ContainsFunc(cfg.Routes, func(r RouteConfig) bool { return r.Name == schedule.Route }) {
+			return invalid(field+".route", "schedule %q refers to unknown route %q", schedule.Name, schedule.Route)
+		}
+	}
+	return nil
+}
+
+func validateQuotaLimits(field, tenant string, limits QuotaLimits) error {
+	if limits.RequestsPerMinute < 0 || limits.RequestsPerDay < 0 || limits.BytesPerDay < 0 {
+		return invalid(field, "tenant quota %q limits cannot be negative", tenant)
+	}
+	return nil
+}
+
+func (cfg *Config) validateLoadShedding() error {
+	shedding := cfg.LoadShedding
+	if shedding.MaxInflight < 0 {
+		return invalid("load_shedding.max_inflight", "load_shedding max_inflight cannot be negative")
+	}
+
+	classNames := make(map[string]bool)
+	for i, class := range shedding.Classes {
+		field := fmt.Sprintf("load_shedding.classes[%d]", i)
+		if class.Name == "" {
+			return invalid(field+".name", "priority class #%d has no name", i)
+		}
+		if classNames[class.Name] {
+			return invalid(field+".name", "duplicate priority class %q", class.Name)
+		}
+		classNames[class.Name] = true
+		if class.ShedAtPercent < 1 || class.ShedAtPercent > 100 {
+			return invalid(field+".shed_at_percent", "priority class %q shed_at_percent must be 1-100", class.Name)
+		}
+	}
+	if shedding.DefaultClass != "" && !classNames[shedding.DefaultClass] {
+		return invalid("load_shedding.default_class", "load_shedding default_class %q is not a defined class", shedding.DefaultClass)
+	}
+	return nil
+}
+
+// Checks DNS records have unique names and nodes with IP addresses and known backends
+func (cfg *Config) validateDNS() error {
+	if cfg.DNS.TTL < 0 || cfg.DNS.Answers < 0 {
+		return invalid("dns", "dns ttl and answers cannot be negative")
+	}
+	names := make(map[string]bool)
+	for i, record := range cfg.DNS.Records {
+		field := fmt.Sprintf("dns.records[%d]", i)
+		name := strings.ToLower(strings.TrimSuffix(record.Name, "."))
+		if name == "" {
+			return invalid(field+".name", "dns record has no name")
+		}
+		if names[name] {
+			return invalid(field+".name", "dns record %s is defined twice", record.Name)
+		}
+		names[name] = true
+		if len(record.Nodes) == 0 {
+			return invalid(field+".nodes", "dns record %s has no nodes", record.Name)
+		}
+		for j, node := range record.Nodes {
+			nodeField := fmt.Sprintf("%s.nodes[%d]", field, j)
+			if net.ParseIP(node.Address) == nil {
+				return invalid(nodeField+".address", "dns record %s has invalid address %q", record.Name, node.Address)
+			}
+			if node.Weight < 1 {
+				return invalid(nodeField+".weight", "dns record %s weight for %s must be at least 1", record.Name, node.Address)
+			}
+			if node.Backend != "" && !slices.ContainsFunc(cfg.Backends, func(b BackendConfig) bool { return b.ID == node.Backend }) {
+				return invalid(nodeField+".backend", "dns record %s refers to unknown backend %q", record.Name, node.Backend)
+			}
+		}
+	}
+	return nil
 }
 
-// Validate the configuration file
-func (cfg *Config) Validate() error {
-	isValidServerPort := cfg.Server.Port >= 1 && cfg.Server.Port <= 65535
-	hasAtLeastOneBackendServer := len(cfg.Backends) > 0
+// Checks alert rules have unique names and known metrics
+func (cfg *Config) validateAlerts() error {
+	if cfg.Alerts.Interval < 0 {
+		return invalid("alerts.interval", "alerts interval cannot be negative")
+	}
+	names := make(map[string]bool)
+	for i, rule := range cfg.Alerts.Rules {
+		field := fmt.Sprintf("alerts.rules[%d]", i)
+		if rule.Name == "" {
+			return invalid(field+".name", "alert rule #%d has no name", i)
+		}
+		if names[rule.Name] {
+			return invalid(field+".name", "alert rule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+		switch rule.Metric {
+		case AlertMetricUnhealthyPercent, AlertMetricErrorRatePercent, AlertMetricOpenCircuits:
+		default:
+			return invalid(field+".metric", "alert rule %s has unknown metric %q", rule.Name, rule.Metric)
+		}
+		if rule.For < 0 {
+			return invalid(field+".for", "alert rule %s has a negative for", rule.Name)
+		}
+	}
+	return nil
+}
 
-	if !isValidServerPort {
-		return fmt.Errorf("invalid port %d: must be 1-65535", cfg.Server.Port)
+// Returns a canonical form of a backend URL so spellings of the same backend compare equal,
+// e.g. http://Host:80/base/ and http://host/base
+func normalizeBackendURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %q: %w", rawURL, err)
 	}
-	if !hasAtLeastOneBackendServer {
-		return fmt.Errorf("needs to have at least one backend server")
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("url %q must use http or https", rawURL)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("url %q has no host", rawURL)
 	}
 
-	for i, backendServer := range cfg.Backends {
-		if backendServer.URL == "" {
-			return fmt.Errorf("backend server #%d is empty", i)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" || (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	} else {
+		port = ":" + port
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return scheme + "://" + host + port + strings.TrimSuffix(u.EscapedPath(), "/") + "?" + u.RawQuery, nil
+}
+
+// Reports whether at least one backend carries all the given labels
+func (cfg *Config) anyBackendHasLabels(selector map[string]string) bool {
+	for _, backend := range cfg.Backends {
+		matches := true
+		for name, value := range selector {
+			if backend.Labels[name] != value {
+				matches = false
+			}
 		}
-		if backendServer.Weight <= 0 {
-			return fmt.Errorf("backend server #%d has a negative weight", i)
+		if matches {
+			return true
 		}
-
 	}
+	return false
+}
 
-	return nil
+// Fills in defaults for settings left out of the config file
+func (cfg *Config) setDefaults() {
+	for i := range cfg.Backends {
+		if cfg.Backends[i].ID == "" {
+			cfg.Backends[i].ID = strconv.Itoa(i)
+		}
+	}
+	if cfg.Retry.MaxBodyBytes == 0 {
+		cfg.Retry.MaxBodyBytes = 1 << 20 // 1 MiB
+	}
+	if cfg.Retry.MemoryBodyBytes == 0 {
+		cfg.Retry.MemoryBodyBytes = 64 << 10 // 64 KiB
+	}
+	for _, route := range cfg.Routes {
+		if regions := route.Regions; regions != nil && regions.MinHealthyPercent == 0 {
+			regions.MinHealthyPercent = 50
+		}
+		if canary := route.Canary; canary != nil {
+			if canary.Window == 0 {
+				canary.Window = time.Minute
+			}
+			if canary.MinRequests == 0 {
+				canary.MinRequests = 20
+			}
+			if canary.MaxErrorRateIncrease == 0 {
+				canary.MaxErrorRateIncrease = 0.05
+			}
+			if canary.MaxLatencyRatio == 0 {
+				canary.MaxLatencyRatio = 2
+			}
+		}
+		if rewrite := route.Rewrite; rewrite != nil {
+			if len(rewrite.ContentTypes) == 0 {
+				rewrite.ContentTypes = []string{"text/html", "application/json"}
+			}
+			if rewrite.MaxBodyBytes == 0 {
+				rewrite.MaxBodyBytes = 1 << 20 // 1 MiB
+			}
+		}
+		if slo := route.SLO; slo != nil {
+			if slo.LatencyTarget == 0 {
+				slo.LatencyTarget = 99
+			}
+			if slo.Period == 0 {
+				slo.Period = 28 * 24 * time.Hour
+			}
+		}
+		if local := route.Local; local != nil {
+			if len(local.AllowMethods) == 0 {
+				local.AllowMethods = []string{"GET", "HEAD", "POST"}
+			}
+			if local.MaxAge == 0 {
+				local.MaxAge = 10 * time.Minute
+			}
+		}
+		if body := route.Body; body != nil && body.MaxBodyBytes == 0 {
+			body.MaxBodyBytes = 1 << 20 // 1 MiB
+		}
+		if signing := route.Signing; signing != nil {
+			if signing.Header == "" {
+				signing.Header = "X-Signature"
+			}
+			if signing.TimestampHeader == "" {
+				signing.TimestampHeader = "X-Signature-Timestamp"
+			}
+			if signing.MaxSkew == 0 {
+				signing.MaxSkew = 5 * time.Minute
+			}
+			if signing.ReplayCache == 0 {
+				signing.ReplayCache = 10000
+			}
+			if signing.MaxBodyBytes == 0 {
+				signing.MaxBodyBytes = 1 << 20 // 1 MiB
+			}
+		}
+	}
+	if cfg.IdentityMetrics.MaxIdentities == 0 {
+		cfg.IdentityMetrics.MaxIdentities = 100
+	}
+	if cfg.TenantQuotas.MaxTenants == 0 {
+		cfg.TenantQuotas.MaxTenants = 10000
+	}
+	if cfg.Panic.Mode == "" {
+		cfg.Panic.Mode = PanicSpread
+	}
+	if cfg.Resolver.MaxTTL == 0 {
+		cfg.Resolver.MaxTTL = 5 * time.Minute
+	}
+	if cfg.Resolver.Timeout == 0 {
+		cfg.Resolver.Timeout = 2 * time.Second
+	}
+	for i, server := range cfg.Resolver.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil && server != "" {
+			cfg.Resolver.Servers[i] = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+	}
+	if cfg.Deadlines.Window == 0 {
+		cfg.Deadlines.Window = time.Minute
+	}
+	if cfg.Deadlines.MinSamples == 0 {
+		cfg.Deadlines.MinSamples = 20
+	}
+	if cfg.HealthEndpoint.Path == "" {
+		cfg.HealthEndpoint.Path = "/health"
+	}
+	if cfg.DebugTrace.Header == "" {
+		cfg.DebugTrace.Header = "X-LB-Debug"
+	}
+	if cfg.FailureJournal.Entries == nil {
+		entries := 100
+		cfg.FailureJournal.Entries = &entries
+	}
+	if cfg.CertExpiry.WarnBefore == 0 {
+		cfg.CertExpiry.WarnBefore = 30 * 24 * time.Hour
+	}
+	if cfg.CertExpiry.CriticalBefore == 0 {
+		cfg.CertExpiry.CriticalBefore = min(7*24*time.Hour, cfg.CertExpiry.WarnBefore)
+	}
+	if cfg.FailureJournal.Headers == nil {
+		cfg.FailureJournal.Headers = []string{"User-Agent", "Content-Type", "Content-Length"}
+	}
+	if cfg.Admin.Bind == "" {
+		cfg.Admin.Bind = "127.0.0.1"
+	}
+	if cfg.Metrics.Port == 0 {
+		cfg.Metrics.Port = 9090
+	}
+	if cfg.Server.AcceptBurst == 0 {
+		cfg.Server.AcceptBurst = int(math.Ceil(cfg.Server.AcceptRate))
+	}
+	if cfg.LoadSignals.Duration == 0 {
+		cfg.LoadSignals.Duration = 10 * time.Second
+	}
+	if cfg.LoadSignals.MaxRetryAfter == 0 {
+		cfg.LoadSignals.MaxRetryAfter = time.Minute
+	}
+	if cfg.LoadSignals.MinWeightPercent == nil {
+		minWeight := 10
+		cfg.LoadSignals.MinWeightPercent = &minWeight
+	}
+	if cfg.DNS.TTL == 0 {
+		cfg.DNS.TTL = 30 * time.Second
+	}
+	for _, record := range cfg.DNS.Records {
+		for i := range record.Nodes {
+			if record.Nodes[i].Weight == 0 {
+				record.Nodes[i].Weight = 1
+			}
+		}
+	}
+	if cfg.Cluster.PollInterval == 0 {
+		cfg.Cluster.PollInterval = 30 * time.Second
+	}
+	if cfg.State.MaxAge == 0 {
+		cfg.State.MaxAge = 5 * time.Minute
+	}
+	if cfg.Drain.CloseCode == 0 {
+		cfg.Drain.CloseCode = 1001
+	}
+	if cfg.Drain.Deadline == 0 {
+		cfg.Drain.Deadline = 30 * time.Second
+	}
+	if cfg.IdleConnections.Interval == 0 {
+		cfg.IdleConnections.Interval = 10 * time.Second
+	}
+	for _, timeout := range []*time.Duration{&cfg.Shutdown.Listeners, &cfg.Shutdown.HealthChecks, &cfg.Shutdown.Metrics} {
+		if *timeout == 0 {
+			*timeout = 5 * time.Second
+		}
+	}
+	if cfg.Alerts.Interval == 0 {
+		cfg.Alerts.Interval = 10 * time.Second
+	}
+	for i := range cfg.Alerts.Rules {
+		if cfg.Alerts.Rules[i].MinRequests == 0 {
+			cfg.Alerts.Rules[i].MinRequests = 20
+		}
+	}
+	if cfg.Autoscaling.Interval == 0 {
+		cfg.Autoscaling.Interval = 15 * time.Second
+	}
+	if cfg.Autoscaling.BackendCapacity == 0 {
+		cfg.Autoscaling.BackendCapacity = 100
+	}
+	if cfg.Autoscaling.TargetUtilization == 0 {
+		cfg.Autoscaling.TargetUtilization = 0.7
+	}
+	if cfg.FairnessAudit.Window == 0 {
+		cfg.FairnessAudit.Window = 5 * time.Minute
+	}
+	if cfg.FairnessAudit.Interval == 0 {
+		cfg.FairnessAudit.Interval = 30 * time.Second
+	}
+	if cfg.FairnessAudit.Threshold == 0 {
+		cfg.FairnessAudit.Threshold = 0.1
+	}
+	if cfg.FairnessAudit.MinSelections == 0 {
+		cfg.FairnessAudit.MinSelections = 1000
+	}
+	if cfg.Warmup.MirrorTimeout == 0 {
+		cfg.Warmup.MirrorTimeout = 5 * time.Second
+	}
+	if cfg.NoHealthyBackends.Policy == "" {
+		cfg.NoHealthyBackends.Policy = NoHealthyForward
+	}
+	if cfg.NoHealthyBackends.RetryAfter == 0 {
+		cfg.NoHealthyBackends.RetryAfter = 5 * time.Second
+	}
+	if cfg.NoHealthyBackends.CacheEntries == 0 {
+		cfg.NoHealthyBackends.CacheEntries = 1000
+	}
+	if cfg.NoHealthyBackends.CacheBodyBytes == 0 {
+		cfg.NoHealthyBackends.CacheBodyBytes = 1 << 20 // 1 MiB
+	}
 }
 
 // ServerConfig holds the server specific settings
 type ServerConfig struct {
 	Port int `yaml:"port"`
+
+	// IP addresses or interface names to listen on, a single value or a list. Empty = all interfaces.
+	Bind StringList `yaml:"bind"`
+
+	// Further ports or ranges e.g. "9000-9010" served like port, for clients pinned to odd ports
+	Ports []string `yaml:"ports"`
+
+	// Limits on client connections over all listeners, connections beyond them are closed straight away
+	MaxConns    int     `yaml:"max_conns"`    // Open at once, 0 = unlimited
+	AcceptRate  float64 `yaml:"accept_rate"`  // New connections per second, 0 = unlimited
+	AcceptBurst int     `yaml:"accept_burst"` // Accepted above the rate in a burst, default the rate rounded up
+
+	// Detect TLS, HTTP/1.1, HTTP/2 prior knowledge and raw TCP on the port from the first bytes
+	DetectProtocol bool       `yaml:"detect_protocol"`
+	TLS            *TLSConfig `yaml:"tls"` // Serve TLS with this certificate, alongside plaintext when detecting
+
+	// How requests of HTTP/1.0 clients are treated, see the HTTP10 constants
+	HTTP10 string `yaml:"http10"`
+
+	// How request lines with an absolute URI (GET http://host/path HTTP/1.1) are treated, see the
+	// AbsoluteForm constants. They are never forwarded to the host they name.
+	AbsoluteForm string `yaml:"absolute_form"`
+}
+
+// Ways of treating HTTP/1.0 clients
+const (
+	HTTP10KeepAlive = "keep_alive" // Default, keep the connection open for clients sending Connection: keep-alive
+	HTTP10Close     = "close"      // Close the connection after every response
+	HTTP10Reject    = "reject"     // Answer 505 HTTP Version Not Supported
+)
+
+// Ways of treating request lines with an absolute URI
+const (
+	AbsoluteFormOrigin = "origin" // Default, serve the URI's path and query for the host in it, as RFC 9112 asks of servers
+	AbsoluteFormReject = "reject" // Answer 400 Bad Request
+)
+
+// Most ports the server may listen on, so a typo in a range doesn't open thousands of listeners
+const maxListenPorts = 1024
+
+// ListenPorts returns port followed by the extra ports in order, without duplicates
+func (s ServerConfig) ListenPorts() ([]int, error) {
+	ports := []int{s.Port}
+	seen := map[int]bool{s.Port: true}
+	for _, entry := range s.Ports {
+		first, last, err := parsePortRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		for port := first; port <= last; port++ {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+		if len(ports) > maxListenPorts {
+			return nil, fmt.Errorf("server listens on more than %d ports", maxListenPorts)
+		}
+	}
+	return ports, nil
+}
+
+// Parses "9000" or "9000-9010"
+func parsePortRange(entry string) (first, last int, err error) {
+	low, high, isRange := strings.Cut(entry, "-")
+	first, err = strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid server port %q", entry)
+	}
+	last = first
+	if isRange {
+		last, err = strconv.Atoi(strings.TrimSpace(high))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid server port range %q", entry)
+		}
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid server port range %q: must be 1-65535, low to high", entry)
+	}
+	return first, last, nil
+}
+
+// StringList is a list of strings that can also be written as a single string
+type StringList []string
+
+// UnmarshalYAML accepts a scalar as a list of one
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = StringList{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// TLSConfig holds a PEM certificate and key
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// BackendTLSConfig is the TLS client side of connections to a backend, its health probes included
+type BackendTLSConfig struct {
+	CAFile     string `yaml:"ca_file"`   // PEM CA bundle to verify the backend with, empty = system roots
+	CertFile   string `yaml:"cert_file"` // Client certificate presented to the backend, with key_file
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"` // Name verified and sent as SNI, default the URL's host
+}
+
+// EgressProxyConfig sends a backend's connections and health probes through a proxy, e.g. a
+// corporate one. HTTP proxies tunnel https:// backends with CONNECT and get plain http:// requests
+// in absolute form, SOCKS5 proxies are asked to connect by the backend's hostname.
+type EgressProxyConfig struct {
+	URL      string `yaml:"url"`      // http://, https:// or socks5:// address of the proxy
+	Username string `yaml:"username"` // Sent as Proxy-Authorization basic auth or SOCKS5 credentials, empty = none
+	Password string `yaml:"password"`
+}
+
+// Schemes an egress proxy can use
+var egressProxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+// Label naming the pool (e.g. blue or green) a backend belongs to
+const PoolLabel = "pool"
+
+// BackendProxy returns the egress proxy of a backend: its own, else that of its pool, nil for none
+func (cfg *Config) BackendProxy(backend BackendConfig) *EgressProxyConfig {
+	if backend.Proxy != nil {
+		return backend.Proxy
+	}
+	if proxy, ok := cfg.PoolProxies[backend.Labels[PoolLabel]]; ok {
+		return &proxy
+	}
+	return nil
+}
+
+func validateEgressProxy(field string, proxy EgressProxyConfig) error {
+	u, err := url.Parse(proxy.URL)
+	if err != nil || !slices.Contains(egressProxySchemes, strings.ToLower(u.Scheme)) || u.Hostname() == "" {
+		return invalid(field+".url", "proxy url %q must be an http://, https:// or socks5:// address", proxy.URL)
+	}
+	if proxy.Password != "" && proxy.Username == "" {
+		return invalid(field+".username", "proxy password needs a username")
+	}
+	return nil
+}
+
+func validateAnnotations(field string, annotations map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(annotations)) {
+		if !headerName.MatchString(name) {
+			return invalid(field, "annotation %q is not a valid header name", name)
+		}
+		if slices.ContainsFunc(reservedAnnotations, func(reserved string) bool { return strings.EqualFold(name, reserved) }) {
+			return invalid(field, "annotation %s can't be set, the proxy manages that header", name)
+		}
+		// Checked as sent, with the environment variables it references expanded
+		if strings.ContainsAny(os.ExpandEnv(annotations[name]), "\r\n") {
+			return invalid(field, "annotation %s has a line break in its value or the environment variables it references", name)
+		}
+	}
+	return nil
+}
+
+// TCPConfig holds the raw TCP forwarding used for connections that aren't HTTP
+type TCPConfig struct {
+	Backends    []string      `yaml:"backends"`     // host:port addresses, used round-robin
+	IdleTimeout time.Duration `yaml:"idle_timeout"` // Close connections without traffic either way for this long, 0 = never
+	MaxLifetime time.Duration `yaml:"max_lifetime"` // Close connections after this long so clients reconnect and rebalance, 0 = never
 }
 
 // BackendConfig represents a single backend server configuration
 type BackendConfig struct {
-	URL    string `yaml:"url"`
-	Weight int    `yaml:"weight"`
+	ID             string `yaml:"id"` // Stable identifier in metrics and the admin API, default the backend's position
+	URL            string `yaml:"url"`
+	Weight         int    `yaml:"weight"`
+	MaxConns       int    `yaml:"max_conns"`        // Max concurrent connections to the backend, 0 = unlimited
+	MaxConnsPolicy string `yaml:"max_conns_policy"` // What happens at the limit: "queue" (default) or "spill"
+	Drained        bool   `yaml:"drained"`          // Start with weight 0, set when a weight of 0 is persisted from the admin API
+
+	// Base URL of the health probe, e.g. a management port or plain HTTP for an HTTPS backend.
+	// /health is appended as for url, which it defaults to.
+	HealthURL string `yaml:"health_url"`
+
+	Protocol          string `yaml:"protocol"`            // Pin the upstream protocol to "http1" or "http2", empty = negotiate
+	DisableKeepAlives bool   `yaml:"disable_keep_alives"` // Use a fresh connection per request for backends that misbehave with pooling
+
+	// Dual-stack hosts are dialled Happy Eyeballs style, IPv6 first with IPv4 started after the
+	// fallback delay. Pinning a family avoids a broken path entirely.
+	AddressFamily string        `yaml:"address_family"` // "ipv4" or "ipv6", empty = both
+	FallbackDelay time.Duration `yaml:"fallback_delay"` // Default 300ms, negative = dial both families at once
+
+	// Resolve the host at startup and balance and health check each of its addresses (of the pinned
+	// family, if any) as a backend of its own with the id <id>@<address>. Requests and probes still
+	// name the host, for virtual hosting and TLS verification.
+	Resolve bool `yaml:"resolve"`
+
+	// TLS settings for https:// backends, e.g. a client certificate for mTLS
+	TLS *BackendTLSConfig `yaml:"tls"`
+
+	// Egress proxy the backend is only reachable through, overriding its pool's
+	Proxy *EgressProxyConfig `yaml:"proxy"`
+
+	Labels map[string]string `yaml:"labels"` // Arbitrary metadata e.g. version, zone, tier, matched by routes
+}
+
+// Upstream protocols a backend can be pinned to
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolHTTP2 = "http2" // Over plain http:// this is HTTP/2 with prior knowledge (h2c)
+)
+
+// Address families a backend can be pinned to
+const (
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// Policies for requests arriving at a backend that's at its connection limit
+const (
+	MaxConnsQueue = "queue" // Wait for a connection to the same backend to free up
+	MaxConnsSpill = "spill" // Send the request to another backend with spare capacity
+)
+
+// TimeoutConfig holds the response timeouts applied to proxied requests.
+// A zero value disables that timeout.
+type TimeoutConfig struct {
+	FirstByte time.Duration `yaml:"first_byte"` // Max wait for the backend's response headers (backend hung)
+	Total     time.Duration `yaml:"total"`      // Max duration of the whole request, including the body transfer
+}
+
+// RetryConfig controls retrying failed requests on another backend.
+// Request bodies are buffered so they can be replayed, bodies over MaxBodyBytes are streamed and never retried.
+type RetryConfig struct {
+	Attempts        int   `yaml:"attempts"`          // Extra attempts after a transport error, 0 = disabled
+	MaxBodyBytes    int64 `yaml:"max_body_bytes"`    // Largest body that is buffered for replay
+	MemoryBodyBytes int64 `yaml:"memory_body_bytes"` // Part of a buffered body kept in memory before spilling to a temp file
+
+	On []string `yaml:"on"` // Error classes that are retried, see the ErrorClass constants, empty = all
+}
+
+// Classes of backend transport errors, used in metrics and to choose which errors are retried
+const (
+	ErrorClassConnectionRefused = "connection_refused"
+	ErrorClassConnectionReset   = "connection_reset"
+	ErrorClassDNS               = "dns"
+	ErrorClassTLS               = "tls"
+	ErrorClassTimeout           = "timeout"
+	ErrorClassOther             = "other"
+)
+
+var errorClasses = []string{
+	ErrorClassConnectionRefused, ErrorClassConnectionReset, ErrorClassDNS, ErrorClassTLS, ErrorClassTimeout, ErrorClassOther,
+}
+
+// IdentityMetricsConfig enables per-client request and error counters.
+// Clients are identified by a hash of their API key or JWT subject.
+type IdentityMetricsConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	Header        string `yaml:"header"`         // Header carrying the API key, Authorization bearer JWTs are always checked
+	MaxIdentities int    `yaml:"max_identities"` // Distinct identities tracked before grouping the rest as "other"
+}
+
+// AdminConfig holds the settings of the admin API listener. With credentials set every endpoint
+// but GET /health requires them, and binding beyond loopback requires credentials.
+type AdminConfig struct {
+	Port    int    `yaml:"port"`    // 0 = admin API disabled
+	Bind    string `yaml:"bind"`    // Address listened on, default 127.0.0.1
+	Persist bool   `yaml:"persist"` // Let ?persist=true and weight changes write to the config file, needs credentials
+
+	// Credentials required to call the API, either or both. Cluster peers send their own, so
+	// they need the same ones.
+	BasicAuth   *BasicAuthConfig `yaml:"basic_auth"`
+	BearerToken string           `yaml:"bearer_token"`
+}
+
+// Authenticated reports whether the API requires credentials
+func (a AdminConfig) Authenticated() bool {
+	return a.BasicAuth != nil || a.BearerToken != ""
+}
+
+// MetricsConfig controls where metrics are served and optional metric labels
+type MetricsConfig struct {
+	BackendLabels []string `yaml:"backend_labels"` // Backend labels added to per-backend request metrics
+	Namespace     string   `yaml:"namespace"`      // Prefixed to metric names with an underscore, to tell instances apart
+
+	Port       int  `yaml:"port"`         // Separate metrics listener, default 9090
+	OnMainPort bool `yaml:"on_main_port"` // Serve /metrics on the main port instead, hiding any backend /metrics
+
+	// Optional credentials required to scrape, either or both
+	BasicAuth   *BasicAuthConfig `yaml:"basic_auth"`
+	BearerToken string           `yaml:"bearer_token"`
+}
+
+// BasicAuthConfig holds HTTP basic auth credentials
+type BasicAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// RouteConfig sends matching requests to the backends carrying the given labels
+type RouteConfig struct {
+	Name          string              `yaml:"name"`
+	Match         RouteMatch          `yaml:"match"`
+	BackendLabels map[string]string   `yaml:"backend_labels"` // Backends must have all of these labels
+	Strategy      string              `yaml:"strategy"`       // Overrides the top-level strategy for this route, empty = inherit it
+	Canary        *CanaryConfig       `yaml:"canary"`         // Optional canary split of the route's traffic
+	Regions       *RegionsConfig      `yaml:"regions"`        // Optional split of the route's traffic across regional pools
+	Rewrite       *RewriteConfig      `yaml:"rewrite"`        // Optional rewriting of backend URLs in responses
+	Signing       *SigningConfig      `yaml:"signing"`        // Optional HMAC signature check before forwarding
+	SLO           *SLOConfig          `yaml:"slo"`            // Optional objectives exported as burn rate metrics
+	Body          *BodyPolicyConfig   `yaml:"body"`           // Optional checks on request bodies before forwarding
+	CacheControl  *CacheControlConfig `yaml:"cache_control"`  // Optional overrides of the backends' caching headers
+	Local         *LocalConfig        `yaml:"local"`          // Optional answers to preflight, OPTIONS and HEAD requests without the backends
+
+	// Headers set on the requests forwarded on the route, e.g. X-Service-Tier: internal, replacing
+	// any the client sent and taking precedence over the pool's. Values can take ${VAR} from the
+	// balancer's environment, to tell instances or environments apart.
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// LocalConfig lets a route answer CORS preflights, OPTIONS and HEAD requests itself instead of
+// forwarding them, taking the load of preflight-heavy browser apps off the backends
+type LocalConfig struct {
+	Preflight    bool          `yaml:"preflight"`     // Answer OPTIONS requests carrying Access-Control-Request-Method
+	AllowOrigins []string      `yaml:"allow_origins"` // Origins preflights succeed for, "*" = any, others get a 403
+	AllowMethods []string      `yaml:"allow_methods"` // Default GET, HEAD and POST
+	AllowHeaders []string      `yaml:"allow_headers"` // Request headers allowed, empty = whichever the preflight asks for
+	MaxAge       time.Duration `yaml:"max_age"`       // How long browsers may cache a preflight, default 10m
+	Options      bool          `yaml:"options"`       // Answer other OPTIONS requests with 204 and an Allow header of allow_methods
+	Head         bool          `yaml:"head"`          // Answer HEAD requests with an empty 200, e.g. for client connectivity checks
+}
+
+// CacheControlConfig overrides the caching headers of a route's responses, to tune caching at
+// the edge without changing the backends. Responses setting cookies and responses to requests
+// with an Authorization header are left alone.
+type CacheControlConfig struct {
+	MaxAge           time.Duration `yaml:"max_age"`           // Forces Cache-Control max-age on cacheable statuses not marked no-store or private and drops Expires, 0 = keep the backend's
+	StripPrivate     bool          `yaml:"strip_private"`     // Removes the private directive so shared caches can store responses
+	SurrogateControl string        `yaml:"surrogate_control"` // Surrogate-Control for CDNs, e.g. max-age=3600, replacing the backend's
+}
+
+// BodyPolicyConfig restricts the request bodies a route forwards
+type BodyPolicyConfig struct {
+	ContentTypes []string `yaml:"content_types"`  // Allowed media types e.g. application/json or text/*, empty = any
+	MaxJSONDepth int      `yaml:"max_json_depth"` // JSON bodies must be well-formed and nested at most this deep, 0 = not inspected
+	MaxBodyBytes int64    `yaml:"max_body_bytes"` // Largest JSON body inspected, larger ones get a 413, default 1 MiB
+}
+
+// SLOConfig declares a route's service level objectives. The balancer exports burn rates over
+// several windows and the error budget left in the period from the requests it served.
+type SLOConfig struct {
+	Availability  float64       `yaml:"availability"`   // Percentage of requests not ending in a 5xx e.g. 99.9, 0 = none
+	Latency       time.Duration `yaml:"latency"`        // Threshold of the latency objective e.g. 300ms, 0 = none
+	LatencyTarget float64       `yaml:"latency_target"` // Percentage of requests faster than latency, default 99
+	Period        time.Duration `yaml:"period"`         // Error budget period in whole hours, default 672h (28 days)
+}
+
+// SigningConfig rejects requests that don't carry a fresh HMAC-SHA256 signature made with a
+// shared key. The signature is the hex HMAC of the timestamp, method, path with query and body,
+// separated by newlines.
+type SigningConfig struct {
+	Key             string        `yaml:"key"`              // Shared secret
+	Header          string        `yaml:"header"`           // Default X-Signature
+	TimestampHeader string        `yaml:"timestamp_header"` // Unix seconds, default X-Signature-Timestamp
+	MaxSkew         time.Duration `yaml:"max_skew"`         // Accepted clock difference either way, default 5m
+	ReplayCache     int           `yaml:"replay_cache"`     // Signatures remembered to reject replays, requests past it get a 503, default 10000
+	MaxBodyBytes    int64         `yaml:"max_body_bytes"`   // Largest signed body, default 1 MiB
+}
+
+// RewriteConfig replaces the backend's origin with the public one in responses, for backends
+// that don't know they are behind a proxy
+type RewriteConfig struct {
+	PublicURL    string   `yaml:"public_url"`     // Origin clients use, required as the request's Host is the client's to choose
+	Location     bool     `yaml:"location"`       // Rewrite Location and Content-Location headers
+	Body         bool     `yaml:"body"`           // Rewrite bodies with one of the content types
+	ContentTypes []string `yaml:"content_types"`  // Default text/html and application/json
+	MaxBodyBytes int64    `yaml:"max_body_bytes"` // Larger bodies are passed through unchanged, default 1 MiB
+}
+
+// CanaryConfig sends a percentage of a route's traffic to canary backends and rolls the
+// split back automatically if the canary does worse than the stable backends
+type CanaryConfig struct {
+	BackendLabels map[string]string `yaml:"backend_labels"` // Selects the canary backends
+	Weight        int               `yaml:"weight"`         // Percentage of the route's traffic, 0-100
+
+	Window               time.Duration `yaml:"window"`                  // Comparison window, default 1m
+	MinRequests          uint64        `yaml:"min_requests"`            // Canary requests needed in a window to judge it, default 20
+	MaxErrorRateIncrease float64       `yaml:"max_error_rate_increase"` // Allowed canary minus stable 5xx rate, default 0.05
+	MaxLatencyRatio      float64       `yaml:"max_latency_ratio"`       // Allowed canary to stable mean latency ratio, default 2
+	Webhook              string        `yaml:"webhook"`                 // URL POSTed to when the canary is rolled back
+}
+
+// RegionsConfig splits a route's traffic across regional pools of its backends by weight. A region
+// whose share of available backends or p95 latency degrades past the thresholds fails over: its
+// traffic goes to the other weighted regions, or to the first healthy standby once none is left.
+type RegionsConfig struct {
+	Pools             []RegionConfig `yaml:"pools"`
+	MinHealthyPercent float64        `yaml:"min_healthy_percent"` // Fail a region over below this share of available backends, default 50
+	MaxLatency        time.Duration  `yaml:"max_latency"`         // Fail a region over once its p95 latency over the last minute exceeds this, 0 = health only
+}
+
+// RegionConfig is one regional pool of a route
+type RegionConfig struct {
+	Name          string            `yaml:"name"`
+	BackendLabels map[string]string `yaml:"backend_labels"` // Selects the region's backends among the route's, e.g. {region: eu-west}
+	Weight        int               `yaml:"weight"`         // Share of the route's traffic, 0 = standby only used once every weighted region failed over
+}
+
+// RouteMatch holds the conditions a request must meet for a route, all of which must hold
+type RouteMatch struct {
+	PathPrefix string            `yaml:"path_prefix"`
+	Headers    map[string]string `yaml:"headers"` // Exact header values
+}
+
+// ScheduleConfig changes traffic policy at the times given by a cron expression.
+// A time window (e.g. a nightly batch window) is a pair of schedules, one at each end.
+type ScheduleConfig struct {
+	Name string `yaml:"name"`
+	Cron string `yaml:"cron"` // minute hour day-of-month month day-of-week, in local time
+
+	Weights     map[string]int `yaml:"weights"`     // Backend ID to new weight, ignored by round_robin
+	Maintenance *bool          `yaml:"maintenance"` // Turn maintenance mode (503 for all requests) on or off
+	Route       string         `yaml:"route"`       // Route to switch to Pool
+	Pool        string         `yaml:"pool"`
+}
+
+// LoadSheddingConfig rejects requests once too many are in flight, lowest priority classes first
+type LoadSheddingConfig struct {
+	MaxInflight  int                   `yaml:"max_inflight"`  // In-flight requests across all routes, 0 = disabled
+	Classes      []PriorityClassConfig `yaml:"classes"`       // Evaluated in order, first match wins
+	DefaultClass string                `yaml:"default_class"` // Class of unmatched requests, empty = only shed at full capacity
+}
+
+// PriorityClassConfig tags matching requests with a priority class
+type PriorityClassConfig struct {
+	Name          string            `yaml:"name"`
+	ShedAtPercent int               `yaml:"shed_at_percent"` // Reject the class once in-flight requests reach this % of max_inflight
+	Routes        []string          `yaml:"routes"`          // Match requests on any of these routes
+	Headers       map[string]string `yaml:"headers"`         // Match requests with all of these header values
+}
+
+// TenantQuotaConfig limits how much each tenant may use. Tenants are only taken from credentials
+// the balancer can check, a known API key or a signed JWT, requests without them count towards
+// the "anonymous" tenant.
+type TenantQuotaConfig struct {
+	Header     string                 `yaml:"header"`      // Header carrying the tenant's API key
+	APIKeys    map[string]string      `yaml:"api_keys"`    // Tenant ID of each API key accepted in header
+	Claim      string                 `yaml:"claim"`       // Claim carrying the tenant ID of a bearer JWT, when no API key is sent
+	JWTSecret  string                 `yaml:"jwt_secret"`  // HS256 key bearer JWTs must be signed with for claim to be used
+	MaxTenants int                    `yaml:"max_tenants"` // Tenants tracked at once before the rest share the "other" tenant, default 10000
+	Default    QuotaLimits            `yaml:"default"`     // Limits for tenants without an override
+	Tenants    map[string]QuotaLimits `yaml:"tenants"`     // Per-tenant overrides keyed by tenant ID
+}
+
+// Enabled reports whether tenants are identified, and so tracked, at all
+func (q TenantQuotaConfig) Enabled() bool {
+	return q.Header != "" || q.Claim != ""
+}
+
+// QuotaLimits holds a tenant's limits, 0 means unlimited
+type QuotaLimits struct {
+	RequestsPerMinute int64 `yaml:"requests_per_minute"`
+	RequestsPerDay    int64 `yaml:"requests_per_day"`
+	BytesPerDay       int64 `yaml:"bytes_per_day"` // Request and response bytes
 }
 
 // Load reads and parses the configuration file
@@ -56,17 +1723,133 @@ func Load(path string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
+	return Parse(bytes)
+}
 
+// Parse decodes a configuration document (YAML, or JSON which is also YAML), applies defaults
+// and validates it, treating warnings as errors in strict mode
+func Parse(bytes []byte) (*Config, error) {
 	var cfg Config
-	err = yaml.Unmarshal(bytes, &cfg)
+	err := yaml.Unmarshal(bytes, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config file: %w", err)
 	}
 
+	cfg.setDefaults()
+
 	err = cfg.Validate()
 	if err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
+	if warnings := cfg.Warnings(); cfg.Strict && len(warnings) > 0 {
+		return nil, fmt.Errorf("config validation failed: %w", invalid(warnings[0].Field, "strict mode: %s", warnings[0].Message))
+	}
 
 	return &cfg, nil
 }
+
+// Reports whether host, an IP address or name, only reaches this machine
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Redacted returns a copy of the config with credentials and shared secrets replaced, safe to
+// include in bug reports
+func (cfg *Config) Redacted() *Config {
+	const redacted = "REDACTED"
+	hide := func(secret *string) {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+
+	c := *cfg
+	hide(&c.DebugTrace.Token)
+	hide(&c.Synthetic.Value)
+	hide(&c.Admin.BearerToken)
+	if c.Admin.BasicAuth != nil {
+		auth := *c.Admin.BasicAuth
+		hide(&auth.Password)
+		c.Admin.BasicAuth = &auth
+	}
+	hide(&c.Metrics.BearerToken)
+	if c.Metrics.BasicAuth != nil {
+		auth := *c.Metrics.BasicAuth
+		hide(&auth.Password)
+		c.Metrics.BasicAuth = &auth
+	}
+	// Webhooks and config documents often take their token in the path or query, so only the
+	// scheme and host of those are kept
+	hideURL := func(rawURL *string) {
+		if *rawURL == "" {
+			return
+		}
+		if u, err := url.Parse(*rawURL); err == nil && u.Host != "" {
+			*rawURL = u.Scheme + "://" + u.Host + "/" + redacted
+		} else {
+			*rawURL = redacted
+		}
+	}
+	hideURL(&c.Alerts.Webhook)
+	hideURL(&c.Autoscaling.Webhook)
+	hideURL(&c.Cluster.ConfigURL)
+	// Other URLs keep everything but the password, and a URL that doesn't parse can't be trusted to
+	// have none
+	hidePassword := func(rawURL *string) {
+		if *rawURL == "" {
+			return
+		}
+		if u, err := url.Parse(*rawURL); err == nil {
+			*rawURL = u.Redacted()
+		} else {
+			*rawURL = redacted
+		}
+	}
+	hideProxy := func(proxy EgressProxyConfig) EgressProxyConfig {
+		hide(&proxy.Password)
+		hidePassword(&proxy.URL)
+		return proxy
+	}
+	c.Backends = slices.Clone(c.Backends)
+	for i := range c.Backends {
+		hidePassword(&c.Backends[i].URL)
+		hidePassword(&c.Backends[i].HealthURL)
+		if proxy := c.Backends[i].Proxy; proxy != nil {
+			hidden := hideProxy(*proxy)
+			c.Backends[i].Proxy = &hidden
+		}
+	}
+	if c.PoolProxies != nil {
+		pools := make(map[string]EgressProxyConfig, len(c.PoolProxies))
+		for pool, proxy := range c.PoolProxies {
+			pools[pool] = hideProxy(proxy)
+		}
+		c.PoolProxies = pools
+	}
+	hide(&c.TenantQuotas.JWTSecret)
+	if c.TenantQuotas.APIKeys != nil {
+		keys := make(map[string]string, len(c.TenantQuotas.APIKeys))
+		for i, key := range slices.Sorted(maps.Keys(c.TenantQuotas.APIKeys)) {
+			keys[fmt.Sprintf("%s-%d", redacted, i+1)] = c.TenantQuotas.APIKeys[key]
+		}
+		c.TenantQuotas.APIKeys = keys
+	}
+	c.Routes = slices.Clone(c.Routes)
+	for i := range c.Routes {
+		if signing := c.Routes[i].Signing; signing != nil {
+			copied := *signing
+			hide(&copied.Key)
+			c.Routes[i].Signing = &copied
+		}
+		if canary := c.Routes[i].Canary; canary != nil {
+			copied := *canary
+			hideURL(&copied.Webhook)
+			c.Routes[i].Canary = &copied
+		}
+	}
+	return &c
+}
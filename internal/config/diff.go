@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Change is one difference between two configs. Path names the setting by its YAML keys,
+// with backends keyed by URL and routes by name e.g. "backends[http://a:8080].weight".
+// From is nil for additions and To is nil for removals.
+type Change struct {
+	Path string `json:"path"`
+	From any    `json:"from"`
+	To   any    `json:"to"`
+}
+
+// Diff returns the settings that differ between two configs. Sections are compared setting by
+// setting, backends and routes entry by entry.
+func Diff(from, to *Config) []Change {
+	var changes []Change
+	fromValue, toValue := reflect.ValueOf(*from), reflect.ValueOf(*to)
+	for i := range fromValue.NumField() {
+		name := yamlName(fromValue.Type().Field(i))
+		switch name {
+		case "backends":
+			changes = append(changes, diffEntries(name, from.Backends, to.Backends, func(b BackendConfig) string { return b.URL })...)
+		case "routes":
+			changes = append(changes, diffEntries(name, from.Routes, to.Routes, func(r RouteConfig) string { return r.Name })...)
+		default:
+			changes = append(changes, diffValues(name, fromValue.Field(i), toValue.Field(i))...)
+		}
+	}
+	return changes
+}
+
+// Compares two lists of entries by key, then the common entries setting by setting. A change
+// in the order of the common entries is reported on the list itself.
+func diffEntries[T any](path string, from, to []T, key func(T) string) []Change {
+	var changes []Change
+	fromKeys, toKeys := make([]string, len(from)), make([]string, len(to))
+	fromByKey := make(map[string]T)
+	for i, entry := range from {
+		fromKeys[i] = key(entry)
+		fromByKey[fromKeys[i]] = entry
+	}
+	toByKey := make(map[string]T)
+	for i, entry := range to {
+		toKeys[i] = key(entry)
+		toByKey[toKeys[i]] = entry
+	}
+
+	for _, k := range fromKeys {
+		if _, ok := toByKey[k]; !ok {
+			changes = append(changes, Change{Path: fmt.Sprintf("%s[%s]", path, k), From: fromByKey[k]})
+		}
+	}
+	for _, k := range toKeys {
+		entryPath := fmt.Sprintf("%s[%s]", path, k)
+		old, ok := fromByKey[k]
+		if !ok {
+			changes = append(changes, Change{Path: entryPath, To: toByKey[k]})
+			continue
+		}
+		changes = append(changes, diffValues(entryPath, reflect.ValueOf(old), reflect.ValueOf(toByKey[k]))...)
+	}
+
+	common := func(keys []string, other map[string]T) []string {
+		return slices.DeleteFunc(slices.Clone(keys), func(k string) bool { _, ok := other[k]; return !ok })
+	}
+	if fromOrder, toOrder := common(fromKeys, toByKey), common(toKeys, fromByKey); !slices.Equal(fromOrder, toOrder) {
+		changes = append(changes, Change{Path: path + ".order", From: fromOrder, To: toOrder})
+	}
+	return changes
+}
+
+// Compares structs field by field and anything else as a whole
+func diffValues(path string, from, to reflect.Value) []Change {
+	if from.Kind() != reflect.Struct || from.Type().String() == "time.Time" {
+		if reflect.DeepEqual(from.Interface(), to.Interface()) {
+			return nil
+		}
+		return []Change{{Path: path, From: from.Interface(), To: to.Interface()}}
+	}
+
+	var changes []Change
+	for i := range from.NumField() {
+		field := from.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		changes = append(changes, diffValues(path+"."+yamlName(field), from.Field(i), to.Field(i))...)
+	}
+	return changes
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoBackends is returned in a ValidationError when a config has no backends
+var ErrNoBackends = errors.New("needs to have at least one backend server")
+
+// ValidationError reports a setting that failed validation. Use errors.As to get it from the
+// errors returned by Validate, Parse and Load.
+type ValidationError struct {
+	Field   string // Path of the setting in the config document, e.g. backends[2].weight
+	Message string // What is wrong with it, readable on its own
+	Err     error  // Underlying cause, if any
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Returns a ValidationError for field with a message formatted as by fmt.Errorf, whose %w
+// operand becomes the cause
+func invalid(field, format string, args ...any) *ValidationError {
+	err := fmt.Errorf(format, args...)
+	return &ValidationError{Field: field, Message: err.Error(), Err: errors.Unwrap(err)}
+}
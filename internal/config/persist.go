@@ -0,0 +1,116 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SaveBackendWeight writes a backend's weight back to the config file at path, keeping the
+// rest of the file and its comments. Weight 0 is stored as drained: true, since a weight of 0
+// isn't a valid configured weight.
+func SaveBackendWeight(path string, idx int, weight int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return fmt.Errorf("config file is empty")
+	}
+	backends := mappingValue(doc.Content[0], "backends")
+	if backends == nil || backends.Kind != yaml.SequenceNode || idx < 0 || idx >= len(backends.Content) {
+		return fmt.Errorf("config file has no backend #%d", idx)
+	}
+
+	entry := backends.Content[idx]
+	if weight == 0 {
+		setMappingValue(entry, "drained", "true", "!!bool")
+	} else {
+		setMappingValue(entry, "weight", strconv.Itoa(weight), "!!int")
+		removeMappingKey(entry, "drained")
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to encode config file: %w", err)
+	}
+
+	return writeFileAtomic(path, out.Bytes())
+}
+
+// SaveConfig replaces the config file at path with a whole new document
+func SaveConfig(path string, data []byte) error {
+	return writeFileAtomic(path, data)
+}
+
+// Replaces the file at path through a temporary file, so a crash can't leave it half written
+func writeFileAtomic(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat config file: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace config file: %w", err)
+	}
+	return nil
+}
+
+// Returns the value node of key in a mapping node, nil if it isn't there
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(mapping *yaml.Node, key, value, tag string) {
+	if node := mappingValue(mapping, key); node != nil {
+		node.Kind, node.Tag, node.Value, node.Style = yaml.ScalarNode, tag, value, 0
+		return
+	}
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value},
+	)
+}
+
+func removeMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Retry body limit above which buffering for replay is as good as uncapped
+const largeRetryBodyBytes = 64 << 20 // 64 MiB
+
+// Warning is a valid but risky combination of settings
+type Warning struct {
+	Field   string `json:"field"`   // Path of the setting at fault, as in ValidationError
+	Message string `json:"message"` // What could go wrong, readable on its own
+}
+
+// Warnings returns the risky combinations of settings in a validated config. They are logged at
+// startup, or fail the load when strict is set.
+func (cfg *Config) Warnings() []Warning {
+	var warnings []Warning
+	warn := func(field, format string, args ...any) {
+		warnings = append(warnings, Warning{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	allDrained := true
+	for _, backend := range cfg.Backends {
+		allDrained = allDrained && backend.Drained
+	}
+	if allDrained {
+		warn("backends", "every backend is drained with weight 0, so requests only reach them as a last resort")
+	}
+
+	if cfg.Timeouts.FirstByte == 0 && cfg.Timeouts.Total == 0 {
+		warn("timeouts", "no timeouts are set, so a hung backend holds requests open indefinitely")
+	}
+
+	if cfg.Retry.Attempts > 0 && cfg.Retry.MaxBodyBytes > largeRetryBodyBytes {
+		warn("retry.max_body_bytes", "retries buffer request bodies up to %d bytes for replay, every in-flight upload may hold that much in memory or a temp file", cfg.Retry.MaxBodyBytes)
+	}
+
+	if cfg.onlyRoundRobin() {
+		if cfg.LoadSignals.Header != "" || cfg.LoadSignals.RetryAfter {
+			warn("load_signals", "load signals lower backend weights, which round_robin ignores on every route")
+		}
+		for i, schedule := range cfg.Schedules {
+			if len(schedule.Weights) > 0 {
+				warn(fmt.Sprintf("schedules[%d].weights", i), "schedule %q sets backend weights, which round_robin ignores on every route", schedule.Name)
+			}
+		}
+	}
+
+	// The balancer answers these paths itself, so they never reach a route's backends
+	var ownPaths []string
+	if !cfg.HealthEndpoint.Passthrough {
+		ownPaths = append(ownPaths, cfg.HealthEndpoint.Path)
+	}
+	if cfg.Metrics.OnMainPort {
+		ownPaths = append(ownPaths, "/metrics")
+	}
+	for i, route := range cfg.Routes {
+		prefix := route.Match.PathPrefix
+		if prefix == "" || prefix == "/" {
+			continue
+		}
+		for _, path := range ownPaths {
+			if strings.HasPrefix(path, prefix) {
+				warn(fmt.Sprintf("routes[%d].match.path_prefix", i), "route %q matches %s, which the balancer answers itself instead of forwarding", route.Name, path)
+			}
+		}
+	}
+
+	return warnings
+}
+
+// Reports whether every route balances round-robin, which ignores backend weights
+func (cfg *Config) onlyRoundRobin() bool {
+	if cfg.Strategy != "" && cfg.Strategy != StrategyRoundRobin {
+		return false
+	}
+	for _, route := range cfg.Routes {
+		if route.Strategy != "" && route.Strategy != StrategyRoundRobin {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+// Package cron parses standard five field cron expressions and works out when they next fire.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression: minute hour day-of-month month day-of-week
+type Schedule struct {
+	minute, hour, dom, month, dow uint64 // Bit sets of allowed values
+	domAny, dowAny                bool   // Whether the day fields were "*"
+}
+
+// Allowed range of each field
+var fieldBounds = [5]struct{ min, max int }{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, 0 and 7 are both Sunday
+}
+
+// Parse parses a cron expression such as "*/15 9-17 * * 1-5".
+// Fields support "*", single values, ranges "a-b", lists "a,b" and steps "*/n" or "a-b/n".
+func Parse(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, got %d", spec, len(fields))
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseField(field, fieldBounds[i].min, fieldBounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", spec, err)
+		}
+		sets[i] = set
+	}
+
+	// Sunday can be written as 0 or 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &Schedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}, nil
+}
+
+// Parses one field into a bit set of the values it allows
+func parseField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			loPart, hiPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(loPart); err != nil {
+				return 0, fmt.Errorf("invalid value %q", loPart)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiPart); err != nil {
+					return 0, fmt.Errorf("invalid value %q", hiPart)
+				}
+			} else if hasStep {
+				hi = max // "a/n" means every n starting at a
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// Matches reports whether the schedule fires in the minute containing t
+func (s *Schedule) Matches(t time.Time) bool {
+	return s.month&(1<<int(t.Month())) != 0 && s.dayMatches(t) &&
+		s.hour&(1<<t.Hour()) != 0 && s.minute&(1<<t.Minute()) != 0
+}
+
+// Next returns the first time after t at which the schedule fires, or the zero time if it
+// never fires within five years (e.g. "0 0 31 2 *")
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Reports whether the day fields allow t's date. Like standard cron, when both day fields
+// are restricted either one matching is enough.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<t.Day()) != 0
+	dowMatch := s.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dowMatch
+	case s.dowAny:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
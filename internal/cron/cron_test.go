@@ -0,0 +1,44 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// Wednesday
+	from := time.Date(2026, time.January, 14, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, time.January, 14, 10, 31, 0, 0, time.UTC)},
+		{"0 1 * * *", time.Date(2026, time.January, 15, 1, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2026, time.January, 14, 10, 40, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2026, time.January, 14, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2026, time.January, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, time.January, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 3 *", time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{"15 10 1,14 * 6", time.Date(2026, time.January, 17, 10, 15, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		schedule, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.spec, err)
+		}
+		if got := schedule.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next() = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{"* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "a * * * *", "* * 0 * *"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", spec)
+		}
+	}
+}
@@ -2,8 +2,14 @@
 package health
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
@@ -12,9 +18,26 @@ import (
 
 // Checker manages health checking for multiple backends
 type Checker struct {
-	healthStatus map[int]bool    // All the backend server's health status
-	healthMutex  sync.RWMutex    // Mutex for health related operations
-	stopChans    []chan struct{} // One stop channel per backend
+	healthStatus map[int]bool          // All the backend server's health status
+	healthMutex  sync.RWMutex          // Mutex for health related operations
+	probeURLs    map[int]string        // Where to probe backends that aren't probed at their own URL
+	probeAddrs   map[int]string        // Addresses to connect to instead of resolving the probe URL's host
+	probeProxies map[int]*url.URL      // Proxies probes of backends only reachable through one go through
+	probeTLS     map[int]*tls.Config   // TLS client settings of backends with their own CA, client certificate or server name
+	latencies    map[int]time.Duration // Duration of each backend's last successful probe
+	lastErrors   map[int]error         // Why each backend's last probe failed, nil after a success
+
+	// Time between probes, default 10s. Set before probing starts.
+	Interval time.Duration
+
+	// Opens the probes' connections, default a net.Dialer. Set before probing starts.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Called, if set, whenever a backend's health status changes (e.g. to drop its pooled connections)
+	OnStatusChange func(idx int, healthy bool)
+
+	// Called, if set, with the result of every probe after any OnStatusChange call
+	OnCheck func(idx int, healthy bool)
 }
 
 // NewChecker creates a health checker for the given number of backends
@@ -29,45 +52,111 @@ func NewChecker(backendCount int) *Checker {
 	}
 }
 
-// StartChecking starts a background health checker for a backend
-func (hc *Checker) StartChecking(idx int, backendURL string, gauge *prometheus.GaugeVec) {
-	stopChan := make(chan struct{})
-	hc.stopChans = append(hc.stopChans, stopChan)
-
-	go func() {
-		ticker := time.NewTicker(10 * time.Second)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				isHealthy := checkHealth(backendURL)
-
-				hc.healthMutex.Lock()
-				if hc.healthStatus[idx] != isHealthy {
-					if isHealthy {
-						log.Printf("Backend %d (%s) is now HEALTHY", idx, backendURL)
-						gauge.WithLabelValues(backendURL).Set(1)
-					} else {
-						log.Printf("Backend %d (%s) is now UNHEALTHY", idx, backendURL)
-						gauge.WithLabelValues(backendURL).Set(0)
-					}
-					hc.healthStatus[idx] = isHealthy
-				}
-				hc.healthMutex.Unlock()
-			case <-stopChan:
-				log.Printf("Stopping health checker for %s", backendURL)
-				return
-			}
+// ProbeInterval returns the time between probes
+func (hc *Checker) ProbeInterval() time.Duration {
+	if hc.Interval == 0 {
+		return 10 * time.Second
+	}
+	return hc.Interval
+}
+
+// Check probes a backend once, records the result and returns whether it is healthy. A probe
+// cut short by ctx isn't recorded, the backend keeps its last status.
+func (hc *Checker) Check(ctx context.Context, idx int, backendURL string, gauge prometheus.Gauge) bool {
+	hc.healthMutex.RLock()
+	target := probeTarget{
+		url:   backendURL,
+		addr:  hc.probeAddrs[idx],
+		proxy: hc.probeProxies[idx],
+		tls:   hc.probeTLS[idx],
+	}
+	if probeURL, ok := hc.probeURLs[idx]; ok {
+		target.url = probeURL
+	}
+	hc.healthMutex.RUnlock()
+	probeStart := time.Now()
+	probeErr := checkHealth(ctx, target, hc.Dial)
+	latency := time.Since(probeStart)
+	if ctx.Err() != nil && errors.Is(probeErr, ctx.Err()) {
+		return hc.IsHealthy(idx)
+	}
+	isHealthy := probeErr == nil
+
+	hc.healthMutex.Lock()
+	if hc.lastErrors == nil {
+		hc.lastErrors = make(map[int]error)
+	}
+	hc.lastErrors[idx] = probeErr
+	if isHealthy {
+		if hc.latencies == nil {
+			hc.latencies = make(map[int]time.Duration)
+		}
+		hc.latencies[idx] = latency
+	}
+	changed := hc.healthStatus[idx] != isHealthy
+	if changed {
+		if isHealthy {
+			log.Printf("Backend %d (%s) is now HEALTHY", idx, backendURL)
+			gauge.Set(1)
+		} else {
+			log.Printf("Backend %d (%s) is now UNHEALTHY: %v", idx, backendURL, probeErr)
+			gauge.Set(0)
 		}
-	}()
+		hc.healthStatus[idx] = isHealthy
+	}
+	hc.healthMutex.Unlock()
+
+	if changed && hc.OnStatusChange != nil {
+		hc.OnStatusChange(idx, isHealthy)
+	}
+	if hc.OnCheck != nil {
+		hc.OnCheck(idx, isHealthy)
+	}
+
+	return isHealthy
+}
+
+// SetProbeURL makes the checks of a backend go to a different base URL, e.g. a management port
+func (hc *Checker) SetProbeURL(idx int, probeURL string) {
+	hc.healthMutex.Lock()
+	defer hc.healthMutex.Unlock()
+	if hc.probeURLs == nil {
+		hc.probeURLs = make(map[int]string)
+	}
+	hc.probeURLs[idx] = probeURL
+}
+
+// SetProbeAddress makes the checks of a backend connect to addr (host:port), e.g. one of several
+// addresses its hostname resolves to, while still naming the hostname in the request and TLS handshake
+func (hc *Checker) SetProbeAddress(idx int, addr string) {
+	hc.healthMutex.Lock()
+	defer hc.healthMutex.Unlock()
+	if hc.probeAddrs == nil {
+		hc.probeAddrs = make(map[int]string)
+	}
+	hc.probeAddrs[idx] = addr
+}
+
+// SetProbeProxy makes the checks of a backend go through an HTTP or SOCKS5 proxy, with any
+// credentials in its URL
+func (hc *Checker) SetProbeProxy(idx int, proxyURL *url.URL) {
+	hc.healthMutex.Lock()
+	defer hc.healthMutex.Unlock()
+	if hc.probeProxies == nil {
+		hc.probeProxies = make(map[int]*url.URL)
+	}
+	hc.probeProxies[idx] = proxyURL
 }
 
-// Stop sends signal to goroutine to stop
-func (hc *Checker) Stop() {
-	for _, stopChan := range hc.stopChans {
-		close(stopChan)
+// SetProbeTLS makes the checks of an https:// backend use the TLS client settings of its traffic,
+// so a backend requiring a client certificate or signed by a private CA can pass them
+func (hc *Checker) SetProbeTLS(idx int, tlsConfig *tls.Config) {
+	hc.healthMutex.Lock()
+	defer hc.healthMutex.Unlock()
+	if hc.probeTLS == nil {
+		hc.probeTLS = make(map[int]*tls.Config)
 	}
+	hc.probeTLS[idx] = tlsConfig
 }
 
 // IsHealthy returns whether a backend is currently healthy
@@ -77,22 +166,107 @@ func (hc *Checker) IsHealthy(idx int) bool {
 	return hc.healthStatus[idx]
 }
 
-// SetHealthy manually sets health status (for testing)
+// Latency returns how long the backend's last successful probe took, 0 before one has succeeded
+func (hc *Checker) Latency(idx int) time.Duration {
+	hc.healthMutex.RLock()
+	defer hc.healthMutex.RUnlock()
+	return hc.latencies[idx]
+}
+
+// LastError returns why the backend's last probe failed, a *ProbeError, or nil if it succeeded
+func (hc *Checker) LastError(idx int) error {
+	hc.healthMutex.RLock()
+	defer hc.healthMutex.RUnlock()
+	return hc.lastErrors[idx]
+}
+
+// SetLatency manually sets a backend's probe latency (for testing)
+func (hc *Checker) SetLatency(idx int, latency time.Duration) {
+	hc.healthMutex.Lock()
+	defer hc.healthMutex.Unlock()
+	if hc.latencies == nil {
+		hc.latencies = make(map[int]time.Duration)
+	}
+	hc.latencies[idx] = latency
+}
+
+// SetHealthy manually sets health status (for testing and restoring saved state)
 func (hc *Checker) SetHealthy(idx int, healthy bool) {
 	hc.healthMutex.Lock()
 	defer hc.healthMutex.Unlock()
 	hc.healthStatus[idx] = healthy
 }
 
-// Performs a single health check for a backend
-func checkHealth(backendURL string) bool {
+// ProbeError is why a health probe failed
+type ProbeError struct {
+	URL        string // Probed URL
+	StatusCode int    // Status the backend answered with, 0 if there was no response
+	Err        error  // Why the request failed, nil when the backend answered
+}
+
+func (e *ProbeError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("health probe of %s failed: %v", e.URL, e.Err)
+	}
+	return fmt.Sprintf("health probe of %s returned status %d", e.URL, e.StatusCode)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// probeTarget is where and how a backend is probed
+type probeTarget struct {
+	url   string      // Base URL /health is joined onto
+	addr  string      // Address connected to instead of resolving the URL's host, empty = resolve it
+	proxy *url.URL    // Proxy connected through, nil = none
+	tls   *tls.Config // TLS client settings, nil = the defaults
+}
+
+// Performs a single health check of a target, connecting through dial if set, and returns a
+// *ProbeError if it fails
+func checkHealth(ctx context.Context, target probeTarget, dial func(ctx context.Context, network, addr string) (net.Conn, error)) error {
+	backendURL, addr, proxy := target.url, target.addr, target.proxy
 	client := &http.Client{Timeout: 2 * time.Second}
+	if addr != "" || dial != nil || proxy != nil || target.tls != nil {
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		// Not pooled, as the client only lives for this probe
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DisableKeepAlives = true
+		transport.DialContext = func(ctx context.Context, network, target string) (net.Conn, error) {
+			if addr != "" {
+				target = addr
+			}
+			return dial(ctx, network, target)
+		}
+		if proxy != nil {
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+		if target.tls != nil {
+			transport.TLSClientConfig = target.tls
+		}
+		client.Transport = transport
+	}
 
-	resp, err := client.Get(backendURL + "/health")
+	// Joined onto any base path in the backend URL
+	healthURL, err := url.JoinPath(backendURL, "health")
 	if err != nil {
-		return false
+		return &ProbeError{URL: backendURL, Err: err}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err != nil {
+		return &ProbeError{URL: healthURL, Err: err}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &ProbeError{URL: healthURL, Err: err}
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode == 200
+	if resp.StatusCode != 200 {
+		return &ProbeError{URL: healthURL, StatusCode: resp.StatusCode}
+	}
+	return nil
 }
@@ -0,0 +1,73 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCheckCancelledNotRecorded(t *testing.T) {
+	probed := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		probed <- struct{}{}
+		// Hang until the probe is cancelled
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	hc := NewChecker(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-probed
+		cancel()
+	}()
+	if !hc.Check(ctx, 0, server.URL, prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_backend_up"})) {
+		t.Error("Cancelled probe reported the backend unhealthy")
+	}
+	if !hc.IsHealthy(0) || hc.LastError(0) != nil {
+		t.Errorf("Cancelled probe was recorded: healthy %v, error %v", hc.IsHealthy(0), hc.LastError(0))
+	}
+}
+
+func TestCheckRecordsProbeError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	hc := NewChecker(1)
+	if hc.Check(t.Context(), 0, server.URL, prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_backend_up"})) {
+		t.Fatal("Backend answering 503 is healthy")
+	}
+	probeErr, ok := hc.LastError(0).(*ProbeError)
+	if !ok || probeErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Last error is %v, want a ProbeError with status 503", hc.LastError(0))
+	}
+}
+
+func TestCheckWithTLSConfig(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_backend_up"})
+
+	// Without the client certificate and the private CA the handshake fails
+	hc := NewChecker(1)
+	if hc.Check(t.Context(), 0, server.URL, gauge) {
+		t.Fatal("mTLS backend is healthy to a probe without a client certificate")
+	}
+
+	// The test certificate is self-signed, so it serves as CA and client certificate
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	hc.SetProbeTLS(0, &tls.Config{RootCAs: roots, Certificates: server.TLS.Certificates})
+	if !hc.Check(t.Context(), 0, server.URL, gauge) {
+		t.Errorf("Probe with the backend's TLS settings failed: %v", hc.LastError(0))
+	}
+}
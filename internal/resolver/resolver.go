@@ -0,0 +1,380 @@
+// Package resolver looks up backend hostnames, through the system resolver or chosen DNS servers,
+// and caches the answers, failed lookups included.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/clock"
+)
+
+// Resolver looks up host addresses and caches the answers. Set its fields before the first lookup.
+type Resolver struct {
+	// DNS servers (host:port) queried in turn until one answers, empty = the system resolver
+	Servers []string
+
+	// Bounds on how long answers are cached. Record TTLs are clamped into them, answers of the
+	// system resolver, which doesn't report TTLs, are cached for MinTTL. 0 MaxTTL = no upper bound.
+	MinTTL, MaxTTL time.Duration
+
+	// How long a name that doesn't exist, or has no addresses, is remembered as such. 0 = not cached.
+	NegativeTTL time.Duration
+
+	// Time a query to one of the Servers may take, default 2s
+	Timeout time.Duration
+
+	// Times the cache entries, default the real clock
+	Clock clock.Clock
+
+	// Called, if set, after every lookup that wasn't answered from the cache or another lookup
+	OnLookup func(host string, duration time.Duration, err error)
+
+	// Called, if set, for every lookup with whether the cache answered it
+	OnCache func(host string, hit bool)
+
+	mu       sync.Mutex
+	cache    map[string]cacheEntry
+	inflight map[string]*lookupCall
+}
+
+type cacheEntry struct {
+	addrs   []string
+	err     error // Set for negative entries
+	expires time.Time
+}
+
+// lookupCall is a lookup going out for a host, which concurrent lookups of it wait for instead of
+// sending queries of their own
+type lookupCall struct {
+	done  chan struct{} // Closed once addrs and err are set
+	addrs []string
+	err   error
+}
+
+// LookupHost returns the addresses of host, IPv4 ones first. A host that doesn't exist or has
+// no addresses gets a *net.DNSError with IsNotFound set. IP literals are returned as they are.
+// Concurrent lookups of a host that isn't cached share one lookup.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	now := r.now()
+	r.mu.Lock()
+	entry, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		if r.OnCache != nil {
+			r.OnCache(host, true)
+		}
+		return entry.addrs, entry.err
+	}
+	if r.OnCache != nil {
+		r.OnCache(host, false)
+	}
+
+	return r.resolve(ctx, host, now)
+}
+
+// Looks host up, or waits for the lookup of it already going out, and caches the answer
+func (r *Resolver) resolve(ctx context.Context, host string, now time.Time) ([]string, error) {
+	call, leader := r.join(host)
+	if !leader {
+		select {
+		case <-call.done:
+			return call.addrs, call.err
+		case <-ctx.Done():
+			return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: errors.Is(ctx.Err(), context.DeadlineExceeded)}
+		}
+	}
+
+	start := time.Now()
+	addrs, ttl, err := r.lookup(ctx, host)
+	if r.OnLookup != nil {
+		r.OnLookup(host, time.Since(start), err)
+	}
+
+	var fresh cacheEntry
+	var keep time.Duration
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		ttl = max(ttl, r.MinTTL)
+		if r.MaxTTL > 0 {
+			ttl = min(ttl, r.MaxTTL)
+		}
+		fresh, keep = cacheEntry{addrs: addrs, expires: now.Add(ttl)}, ttl
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		fresh, keep = cacheEntry{err: err, expires: now.Add(r.NegativeTTL)}, r.NegativeTTL
+	}
+	r.finish(host, call, fresh, keep, addrs, err)
+	return addrs, err
+}
+
+// Refresh looks up again the hosts whose cached addresses have expired, so the next connection
+// to them doesn't wait for the lookup. Returns the lookups that failed.
+func (r *Resolver) Refresh(ctx context.Context) error {
+	now := r.now()
+	var hosts []string
+	r.mu.Lock()
+	for host, entry := range r.cache {
+		if entry.err == nil && !now.Before(entry.expires) {
+			hosts = append(hosts, host)
+		}
+	}
+	r.mu.Unlock()
+
+	var errs []error
+	for _, host := range hosts {
+		if _, err := r.resolve(ctx, host, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Evict drops the expired cache entries of names that weren't found, returning how many. Expired
+// addresses are kept for Refresh to renew.
+func (r *Resolver) Evict() int {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var evicted int
+	for host, entry := range r.cache {
+		if entry.err != nil && !now.Before(entry.expires) {
+			delete(r.cache, host)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Returns the lookup going out for host, and whether it's a new one the caller is to make
+func (r *Resolver) join(host string) (*lookupCall, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if call, ok := r.inflight[host]; ok {
+		return call, false
+	}
+	if r.inflight == nil {
+		r.inflight = make(map[string]*lookupCall)
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	r.inflight[host] = call
+	return call, true
+}
+
+// Hands the lookup's result to the lookups waiting for it, caching entry at the same time if
+// it's to be kept for a while, so a lookup coming after finds one or the other
+func (r *Resolver) finish(host string, call *lookupCall, entry cacheEntry, keep time.Duration, addrs []string, err error) {
+	r.mu.Lock()
+	if keep > 0 {
+		if r.cache == nil {
+			r.cache = make(map[string]cacheEntry)
+		}
+		r.cache[host] = entry
+	}
+	delete(r.inflight, host)
+	r.mu.Unlock()
+	call.addrs, call.err = addrs, err
+	close(call.done)
+}
+
+// Looks host up without the cache, returning its addresses and how long they may be cached for
+func (r *Resolver) lookup(ctx context.Context, host string) ([]string, time.Duration, error) {
+	if len(r.Servers) == 0 {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, 0, err
+		}
+		var v4, v6 []string
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				v4 = append(v4, ip.String())
+			} else {
+				v6 = append(v6, ip.String())
+			}
+		}
+		return append(v4, v6...), 0, nil
+	}
+
+	var lastErr error
+	for _, server := range r.Servers {
+		addrs, ttl, err := r.query(ctx, server, host)
+		var dnsErr *net.DNSError
+		if err == nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			return addrs, ttl, err
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// Asks server for the IPv4 and IPv6 addresses of host at the same time
+func (r *Resolver) query(ctx context.Context, server, host string) ([]string, time.Duration, error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type answer struct {
+		records []record
+		err     error
+	}
+	v6 := make(chan answer, 1)
+	go func() {
+		records, err := exchange(ctx, server, host, typeAAAA)
+		v6 <- answer{records, err}
+	}()
+	v4Records, v4Err := exchange(ctx, server, host, typeA)
+	v6Answer := <-v6
+
+	var addrs []string
+	var ttl time.Duration
+	for i, record := range append(v4Records, v6Answer.records...) {
+		addrs = append(addrs, record.ip.String())
+		if i == 0 || record.ttl < ttl {
+			ttl = record.ttl
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, ttl, nil
+	}
+	// Not found only if both queries say so, any other failure is worth another server
+	for _, err := range []error{v4Err, v6Answer.err} {
+		var dnsErr *net.DNSError
+		if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+}
+
+func (r *Resolver) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+	return r.Clock.Now()
+}
+
+// Dial connects to address like dialer does, but looks its host up through r. With addresses
+// of both families it races them after the dialer's FallbackDelay like net.Dialer.
+func (r *Resolver) Dial(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	// The family of the first address is tried first, the other one after the fallback delay
+	var primaries, fallbacks []string
+	for _, addr := range addrs {
+		v4 := net.ParseIP(addr).To4() != nil
+		if (network == "tcp4" && !v4) || (network == "tcp6" && v4) {
+			continue
+		}
+		if len(primaries) == 0 || (net.ParseIP(primaries[0]).To4() != nil) == v4 {
+			primaries = append(primaries, net.JoinHostPort(addr, port))
+		} else {
+			fallbacks = append(fallbacks, net.JoinHostPort(addr, port))
+		}
+	}
+	if len(primaries) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "no suitable address found", Addr: host}}
+	}
+	if len(fallbacks) == 0 || dialer.FallbackDelay < 0 {
+		return dialSerial(ctx, dialer, network, append(primaries, fallbacks...))
+	}
+	return dialParallel(ctx, dialer, network, primaries, fallbacks)
+}
+
+// Dials each address in turn until one connects
+func dialSerial(ctx context.Context, dialer *net.Dialer, network string, addrs []string) (net.Conn, error) {
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// Dials the primaries and, after the fallback delay or once they fail, the fallbacks, returning
+// the first connection made
+func dialParallel(ctx context.Context, dialer *net.Dialer, network string, primaries, fallbacks []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	start := func(addrs []string) {
+		go func() {
+			conn, err := dialSerial(ctx, dialer, network, addrs)
+			results <- result{conn, err}
+		}()
+	}
+
+	delay := dialer.FallbackDelay
+	if delay == 0 {
+		delay = 300 * time.Millisecond // As net.Dialer
+	}
+	fallback := time.NewTimer(delay)
+	defer fallback.Stop()
+
+	start(primaries)
+	pending, fellBack := 1, false
+	var firstErr error
+	for {
+		select {
+		case <-fallback.C:
+			if !fellBack {
+				start(fallbacks)
+				pending, fellBack = pending+1, true
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// The other dial is cancelled, a connection it made anyway is closed
+				if pending > 0 {
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !fellBack {
+				start(fallbacks)
+				pending, fellBack = pending+1, true
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vinzmyko/load-balancer/internal/clock"
+)
+
+// fakeZone is a DNS server answering from a fixed set of records, over UDP and TCP on the same port
+type fakeZone struct {
+	Addr     string
+	records  map[string][]net.IP // By name, names not in it are NXDOMAIN
+	ttl      uint32
+	truncate atomic.Bool // Answer UDP queries with just the truncated flag
+	hold     sync.Mutex  // Answers wait while it's locked
+
+	mu      sync.Mutex
+	queries map[string]int // By network
+}
+
+func startZone(t *testing.T, ttl uint32, records map[string][]net.IP) *fakeZone {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	z := &fakeZone{Addr: udp.LocalAddr().String(), records: records, ttl: ttl, queries: make(map[string]int)}
+	go func() {
+		buf := make([]byte, maxUDPLen)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(z.answer("udp", buf[:n]), from)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			io.ReadFull(conn, length[:])
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			io.ReadFull(conn, query)
+			resp := z.answer("tcp", query)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			conn.Close()
+		}
+	}()
+	return z
+}
+
+func (z *fakeZone) answer(network string, query []byte) []byte {
+	z.mu.Lock()
+	z.queries[network]++
+	z.mu.Unlock()
+	z.hold.Lock()
+	z.hold.Unlock()
+
+	var labels []string
+	offset := headerLen
+	for query[offset] != 0 {
+		labels = append(labels, string(query[offset+1:offset+1+int(query[offset])]))
+		offset += 1 + int(query[offset])
+	}
+	question := query[headerLen : offset+5]
+	qtype := binary.BigEndian.Uint16(query[offset+1:])
+
+	resp := append([]byte(nil), query[:headerLen]...)
+	flags := uint16(flagResponse | flagRecursion)
+	ips, ok := z.records[strings.Join(labels, ".")]
+	if !ok {
+		flags |= rcodeNXDomain
+	}
+	if network == "udp" && z.truncate.Load() {
+		flags |= flagTruncated
+		ips = nil
+	}
+	var answers []net.IP
+	for _, ip := range ips {
+		if (qtype == typeA) == (ip.To4() != nil) {
+			answers = append(answers, ip)
+		}
+	}
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, ip := range answers {
+		data := ip.To4()
+		if qtype == typeAAAA {
+			data = ip.To16()
+		}
+		resp = append(resp, 0xc0, headerLen) // Pointer to the question's name
+		resp = binary.BigEndian.AppendUint16(resp, qtype)
+		resp = binary.BigEndian.AppendUint16(resp, classIN)
+		resp = binary.BigEndian.AppendUint32(resp, z.ttl)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(data)))
+		resp = append(resp, data...)
+	}
+	return resp
+}
+
+func (z *fakeZone) count(network string) int {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.queries[network]
+}
+
+func TestLookupCachesWithinTTLBounds(t *testing.T) {
+	records := map[string][]net.IP{"api.test": {net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.1")}}
+	for _, tc := range []struct {
+		name    string
+		ttl     uint32
+		min     time.Duration
+		max     time.Duration
+		expires time.Duration
+	}{
+		{"record ttl", 30, 0, 0, 30 * time.Second},
+		{"raised to min", 1, 10 * time.Second, time.Minute, 10 * time.Second},
+		{"lowered to max", 3600, 0, time.Minute, time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			zone := startZone(t, tc.ttl, records)
+			clk := clock.NewFake(time.Now())
+			r := &Resolver{Servers: []string{zone.Addr}, MinTTL: tc.min, MaxTTL: tc.max, Clock: clk}
+
+			addrs, err := r.LookupHost(context.Background(), "api.test")
+			if err != nil {
+				t.Fatalf("Lookup failed: %v", err)
+			}
+			if want := []string{"10.0.0.1", "2001:db8::1"}; !slices.Equal(addrs, want) {
+				t.Errorf("Addresses are %v, want %v", addrs, want)
+			}
+			clk.Advance(tc.expires - time.Second)
+			r.LookupHost(context.Background(), "api.test")
+			if got := zone.count("udp"); got != 2 {
+				t.Errorf("Server got %d queries before the entry expired, want the 2 of the first lookup", got)
+			}
+			clk.Advance(time.Second)
+			r.LookupHost(context.Background(), "api.test")
+			if got := zone.count("udp"); got != 4 {
+				t.Errorf("Server got %d queries after the entry expired, want 4", got)
+			}
+		})
+	}
+}
+
+func TestLookupNegativeCache(t *testing.T) {
+	zone := startZone(t, 60, nil)
+	clk := clock.NewFake(time.Now())
+	var lookups, hits int
+	r := &Resolver{
+		Servers:     []string{zone.Addr},
+		NegativeTTL: 5 * time.Second,
+		Clock:       clk,
+		OnLookup:    func(string, time.Duration, error) { lookups++ },
+		OnCache: func(_ string, hit bool) {
+			if hit {
+				hits++
+			}
+		},
+	}
+
+	for range 3 {
+		_, err := r.LookupHost(context.Background(), "missing.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("Lookup of a missing name returned %v, want a not found error", err)
+		}
+	}
+	if lookups != 1 || hits != 2 {
+		t.Errorf("Got %d lookups and %d cache hits, want 1 lookup answering the others from the cache", lookups, hits)
+	}
+	clk.Advance(5 * time.Second)
+	r.LookupHost(context.Background(), "missing.test")
+	if lookups != 2 {
+		t.Errorf("Got %d lookups after the negative entry expired, want 2", lookups)
+	}
+}
+
+func TestLookupSharesConcurrentQueries(t *testing.T) {
+	zone := startZone(t, 60, map[string][]net.IP{"api.test": {net.ParseIP("10.0.0.1")}})
+	zone.hold.Lock()
+	var misses atomic.Int32
+	r := &Resolver{
+		Servers: []string{zone.Addr},
+		OnCache: func(_ string, hit bool) {
+			if !hit {
+				misses.Add(1)
+			}
+		},
+	}
+
+	const lookups = 5
+	var wg sync.WaitGroup
+	results := make(chan []string, lookups)
+	for range lookups {
+		wg.Go(func() {
+			addrs, err := r.LookupHost(context.Background(), "api.test")
+			if err != nil {
+				t.Errorf("Lookup failed: %v", err)
+			}
+			results <- addrs
+		})
+	}
+	for misses.Load() < lookups {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // For the last ones to join the first lookup
+	zone.hold.Unlock()
+	wg.Wait()
+	close(results)
+
+	for addrs := range results {
+		if !slices.Equal(addrs, []string{"10.0.0.1"}) {
+			t.Errorf("Lookup returned %v, want 10.0.0.1", addrs)
+		}
+	}
+	if got := zone.count("udp"); got != 2 {
+		t.Errorf("Server got %d queries for %d concurrent lookups, want the 2 of one", got, lookups)
+	}
+}
+
+func TestRefreshAndEvict(t *testing.T) {
+	zone := startZone(t, 30, map[string][]net.IP{"api.test": {net.ParseIP("10.0.0.1")}})
+	clk := clock.NewFake(time.Now())
+	r := &Resolver{Servers: []string{zone.Addr}, NegativeTTL: 5 * time.Second, Clock: clk}
+	r.LookupHost(context.Background(), "api.test")
+	r.LookupHost(context.Background(), "missing.test")
+
+	if err := r.Refresh(context.Background()); err != nil || zone.count("udp") != 4 {
+		t.Errorf("Refresh before anything expired returned %v after %d queries, want nothing looked up again", err, zone.count("udp"))
+	}
+	if evicted := r.Evict(); evicted != 0 {
+		t.Errorf("Evicted %d entries before anything expired, want none", evicted)
+	}
+
+	clk.Advance(30 * time.Second)
+	if err := r.Refresh(context.Background()); err != nil {
+		t.Errorf("Refresh failed: %v", err)
+	}
+	if got := zone.count("udp"); got != 6 {
+		t.Errorf("Server got %d queries after the refresh, want 6 with api.test looked up again", got)
+	}
+	if evicted := r.Evict(); evicted != 1 {
+		t.Errorf("Evicted %d entries, want the expired missing.test", evicted)
+	}
+	r.LookupHost(context.Background(), "api.test")
+	if got := zone.count("udp"); got != 6 {
+		t.Errorf("Server got %d queries, want the refreshed api.test answered from the cache", got)
+	}
+}
+
+func TestParseAnswerChecksQuestion(t *testing.T) {
+	zone := &fakeZone{records: map[string][]net.IP{"api.test": {net.ParseIP("10.0.0.1")}, "other.test": {net.ParseIP("10.0.0.2")}}, ttl: 60, queries: make(map[string]int)}
+	query, err := buildQuery("api.test", typeA)
+	if err != nil {
+		t.Fatalf("Failed to build query: %v", err)
+	}
+	// Answers query to a question of its own, under the ID of the one sent
+	answerTo := func(host string, qtype uint16) []byte {
+		other, _ := buildQuery(host, qtype)
+		copy(other[0:2], query[0:2])
+		return zone.answer("udp", other)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		resp   []byte
+		wantOK bool
+	}{
+		{"same question", answerTo("api.test", typeA), true},
+		{"name in other case", bytes.Replace(answerTo("api.test", typeA), []byte("api"), []byte("API"), 1), true},
+		{"other name", answerTo("other.test", typeA), false},
+		{"other type", answerTo("api.test", typeAAAA), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseAnswer(tc.resp, query, typeA)
+			if (err == nil) != tc.wantOK {
+				t.Errorf("Parsing the answer returned %v, want accepted = %v", err, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestLookupFallsBack(t *testing.T) {
+	zone := startZone(t, 60, map[string][]net.IP{"api.test": {net.ParseIP("10.0.0.1")}})
+
+	// Nothing listens on a port that was just released, the query is refused
+	closed, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	closed.Close()
+	r := &Resolver{Servers: []string{closed.LocalAddr().String(), zone.Addr}, Timeout: time.Second}
+	if addrs, err := r.LookupHost(context.Background(), "api.test"); err != nil || !slices.Equal(addrs, []string{"10.0.0.1"}) {
+		t.Errorf("Lookup past a failing server returned %v, %v, want 10.0.0.1 from the second one", addrs, err)
+	}
+
+	zone.truncate.Store(true)
+	r = &Resolver{Servers: []string{zone.Addr}}
+	if addrs, err := r.LookupHost(context.Background(), "api.test"); err != nil || !slices.Equal(addrs, []string{"10.0.0.1"}) {
+		t.Errorf("Lookup of a truncated answer returned %v, %v, want 10.0.0.1 over TCP", addrs, err)
+	}
+	if zone.count("tcp") == 0 {
+		t.Error("Truncated answer wasn't retried over TCP")
+	}
+}
+
+func TestDialResolvesHost(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// IPv4 addresses are tried first, nothing listens on the IPv6 one
+	zone := startZone(t, 60, map[string][]net.IP{"backend.test": {net.ParseIP("::1"), net.ParseIP("127.0.0.1")}})
+	r := &Resolver{Servers: []string{zone.Addr}}
+	conn, err := r.Dial(context.Background(), &net.Dialer{}, "tcp", net.JoinHostPort("backend.test", port))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if greeting, _ := io.ReadAll(conn); string(greeting) != "hello" {
+		t.Errorf("Read %q from the dialled connection, want hello", greeting)
+	}
+
+	if _, err := r.Dial(context.Background(), &net.Dialer{}, "tcp6", net.JoinHostPort("backend.test", port)); err == nil {
+		t.Error("Dial over tcp6 connected, want it to only try the IPv6 address")
+	}
+}
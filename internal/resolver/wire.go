@@ -0,0 +1,223 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS wire format values, RFC 1035
+const (
+	headerLen = 12
+	maxUDPLen = 512 // Without EDNS, longer answers are truncated
+
+	typeA    = 1
+	typeAAAA = 28
+	classIN  = 1
+
+	flagResponse  = 1 << 15
+	flagTruncated = 1 << 9
+	flagRecursion = 1 << 8
+
+	rcodeOK       = 0
+	rcodeNXDomain = 3
+)
+
+// record is an address in an answer
+type record struct {
+	ip  net.IP
+	ttl time.Duration
+}
+
+// Asks server for the records of type qtype of host over UDP, again over TCP if the answer was
+// truncated
+func exchange(ctx context.Context, server, host string, qtype uint16) ([]record, error) {
+	query, err := buildQuery(host, qtype)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, Server: server}
+	}
+	resp, err := roundTrip(ctx, "udp", server, query)
+	if err == nil && binary.BigEndian.Uint16(resp[2:4])&flagTruncated != 0 {
+		resp, err = roundTrip(ctx, "tcp", server, query)
+	}
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, Server: server, IsTimeout: errors.Is(err, context.DeadlineExceeded) || isTimeout(err)}
+	}
+	records, err := parseAnswer(resp, query, qtype)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			dnsErr.Name, dnsErr.Server = host, server
+			return nil, dnsErr
+		}
+		return nil, &net.DNSError{Err: err.Error(), Name: host, Server: server}
+	}
+	return records, nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Builds a recursive query for host under a random ID
+func buildQuery(host string, qtype uint16) ([]byte, error) {
+	id := uint16(rand.Uint32())
+	msg := make([]byte, headerLen, headerLen+len(host)+6)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], flagRecursion)
+	binary.BigEndian.PutUint16(msg[4:6], 1) // One question
+	for label := range strings.SplitSeq(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, classIN)
+	return msg, nil
+}
+
+// Sends query to server and reads the response, with a length prefix over TCP
+func roundTrip(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, maxUDPLen)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		if n < headerLen {
+			return nil, errors.New("short response")
+		}
+		return resp[:n], nil
+	}
+
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < headerLen {
+		return nil, errors.New("short response")
+	}
+	return resp, nil
+}
+
+// Returns the records of type qtype in the answer section of a response to query. Records of
+// other types, such as the CNAMEs leading to the addresses, are skipped. Responses whose ID or
+// question differ from the query's, spoofed or late answers to another query, are rejected.
+func parseAnswer(msg, query []byte, qtype uint16) ([]record, error) {
+	if binary.BigEndian.Uint16(msg[0:2]) != binary.BigEndian.Uint16(query[0:2]) {
+		return nil, errors.New("response ID doesn't match the query")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&flagResponse == 0 {
+		return nil, errors.New("not a response")
+	}
+	if !sameQuestion(msg, query) {
+		return nil, errors.New("response question doesn't match the query")
+	}
+	switch rcode := flags & 0xf; rcode {
+	case rcodeOK:
+	case rcodeNXDomain:
+		return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+	default:
+		return nil, fmt.Errorf("server answered with rcode %d", rcode)
+	}
+
+	answers := binary.BigEndian.Uint16(msg[6:8])
+	offset := len(query) // Past the question, the same length as the query's
+
+	var records []record
+	for range answers {
+		end, err := skipName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if end+10 > len(msg) {
+			return nil, errors.New("truncated record")
+		}
+		rtype := binary.BigEndian.Uint16(msg[end:])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[end+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(msg[end+8:]))
+		data := end + 10
+		if data+length > len(msg) {
+			return nil, errors.New("truncated record")
+		}
+		if rtype == qtype && ((qtype == typeA && length == net.IPv4len) || (qtype == typeAAAA && length == net.IPv6len)) {
+			records = append(records, record{ip: net.IP(append([]byte(nil), msg[data:data+length]...)), ttl: ttl})
+		}
+		offset = data + length
+	}
+	if len(records) == 0 {
+		return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+	}
+	return records, nil
+}
+
+// Reports whether the response holds the query's one question: the same name, in any case as
+// servers may change it, type and class
+func sameQuestion(msg, query []byte) bool {
+	question := query[headerLen:]
+	if binary.BigEndian.Uint16(msg[4:6]) != 1 || len(msg) < len(query) {
+		return false
+	}
+	got := msg[headerLen:len(query)]
+	name := len(question) - 4
+	for i := range name {
+		if lower(got[i]) != lower(question[i]) {
+			return false
+		}
+	}
+	return string(got[name:]) == string(question[name:])
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// Returns the offset just past the (possibly compressed) name at offset
+func skipName(msg []byte, offset int) (int, error) {
+	for offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0: // Pointer to the rest of the name
+			return offset + 2, nil
+		default:
+			offset += 1 + length
+		}
+	}
+	return 0, errors.New("truncated name")
+}
@@ -0,0 +1,125 @@
+// Package testutil has helpers for testing load balancing strategies.
+package testutil
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// Significance level used by AssertDistribution. Low enough that a correct strategy fails about
+// once in 10000 runs, while real skews still show up clearly with a few thousand selections.
+const DefaultAlpha = 0.0001
+
+// Distribution calls pick n times and counts how often each of the buckets was chosen.
+// Picks outside [0, buckets) are counted in an extra final bucket so they fail the check.
+func Distribution(n, buckets int, pick func() int) []int {
+	counts := make([]int, buckets+1)
+	for range n {
+		idx := pick()
+		if idx < 0 || idx >= buckets {
+			idx = buckets
+		}
+		counts[idx]++
+	}
+	if counts[buckets] == 0 {
+		counts = counts[:buckets]
+	}
+	return counts
+}
+
+// ChiSquared returns Pearson's chi-squared statistic for the observed counts against counts
+// expected in proportion to weights, and its p-value
+func ChiSquared(observed []int, weights []float64) (statistic, pValue float64, err error) {
+	if len(observed) != len(weights) {
+		return 0, 0, fmt.Errorf("%d observed counts for %d weights", len(observed), len(weights))
+	}
+
+	var total, weightSum float64
+	for i, count := range observed {
+		total += float64(count)
+		weightSum += weights[i]
+	}
+	if total == 0 || weightSum <= 0 {
+		return 0, 0, fmt.Errorf("need observations and a positive total weight")
+	}
+
+	degrees := -1
+	for i, count := range observed {
+		expected := total * weights[i] / weightSum
+		if expected == 0 {
+			if count > 0 {
+				return math.Inf(1), 0, nil
+			}
+			continue
+		}
+		diff := float64(count) - expected
+		statistic += diff * diff / expected
+		degrees++
+	}
+	if degrees < 1 {
+		return 0, 1, nil
+	}
+	return statistic, upperGamma(float64(degrees)/2, statistic/2), nil
+}
+
+// AssertDistribution fails the test if the counts are unlikely to come from selections in
+// proportion to weights, at the DefaultAlpha significance level
+func AssertDistribution(t testing.TB, observed []int, weights []float64) {
+	t.Helper()
+	statistic, pValue, err := ChiSquared(observed, weights)
+	if err != nil {
+		t.Fatalf("Invalid distribution: %v", err)
+	}
+	if pValue < DefaultAlpha {
+		t.Errorf("Selections %v don't follow weights %v (chi-squared %.2f, p=%.2g)", observed, weights, statistic, pValue)
+	}
+}
+
+// Regularised upper incomplete gamma function Q(a, x), the chi-squared survival function for
+// 2a degrees of freedom at 2x. Series for small x, continued fraction otherwise.
+func upperGamma(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	lgamma, _ := math.Lgamma(a)
+	prefix := math.Exp(a*math.Log(x) - x - lgamma)
+
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1.0; n < 1000; n++ {
+			term *= x / (a + n)
+			sum += term
+			if term < sum*1e-15 {
+				break
+			}
+		}
+		return 1 - prefix*sum
+	}
+
+	// Lentz's method
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1.0; i < 1000; i++ {
+		an := -i * (i - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return prefix * h
+}
@@ -0,0 +1,57 @@
+package testutil
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestChiSquaredPValue(t *testing.T) {
+	tests := []struct {
+		observed []int
+		weights  []float64
+		want     float64
+	}{
+		{[]int{100, 100}, []float64{1, 1}, 1},
+		{[]int{60, 40}, []float64{1, 1}, 0.0455},     // chi-squared 4 with 1 degree of freedom
+		{[]int{50, 100, 150}, []float64{1, 2, 3}, 1}, // exactly proportional
+		{[]int{120, 100, 80}, []float64{1, 1, 1}, 0.0183},
+	}
+
+	for _, tt := range tests {
+		_, pValue, err := ChiSquared(tt.observed, tt.weights)
+		if err != nil {
+			t.Fatalf("ChiSquared(%v, %v) failed: %v", tt.observed, tt.weights, err)
+		}
+		if math.Abs(pValue-tt.want) > 0.0005 {
+			t.Errorf("ChiSquared(%v, %v) p-value = %.4f, want %.4f", tt.observed, tt.weights, pValue, tt.want)
+		}
+	}
+}
+
+func TestAssertDistribution(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	weights := []float64{1, 2, 5}
+	weighted := func() int {
+		switch n := rng.IntN(8); {
+		case n < 1:
+			return 0
+		case n < 3:
+			return 1
+		default:
+			return 2
+		}
+	}
+	AssertDistribution(t, Distribution(8000, 3, weighted), weights)
+
+	// An even split must be rejected against skewed weights
+	var next int
+	even := func() int {
+		next++
+		return next % 3
+	}
+	_, pValue, _ := ChiSquared(Distribution(8000, 3, even), weights)
+	if pValue >= DefaultAlpha {
+		t.Errorf("Even split passed against weights %v with p=%.2g", weights, pValue)
+	}
+}
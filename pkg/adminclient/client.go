@@ -0,0 +1,258 @@
+// Package adminclient is a typed client for the load balancer's admin API, for automation written
+// in Go. Failed requests are retried and every request carries the configured credentials.
+package adminclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrRestartRequired is returned by Reload when the document changes settings the balancer only
+// reads at startup. Nothing was applied.
+var ErrRestartRequired = errors.New("config changes need a restart")
+
+// Client calls the admin API of one balancer. Set its fields before the first call.
+type Client struct {
+	// Admin API address, e.g. http://10.0.0.5:8081
+	BaseURL string
+
+	// Sent as a bearer token, for admin APIs with admin.bearer_token set. Empty = none.
+	Token string
+
+	// Sent as basic auth instead of the token if Username is set
+	Username, Password string
+
+	// Times a request is retried after a connection error or a 502, 503 or 504, default 2.
+	// Negative = never retried.
+	Retries int
+
+	// Wait before the first retry, doubled for each one after, default 200ms
+	RetryWait time.Duration
+
+	// Client the requests are sent with, default one with a 10s timeout
+	HTTPClient *http.Client
+}
+
+// New returns a client for the admin API at baseURL with the default retries
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is an admin API answer other than 2xx
+type Error struct {
+	StatusCode int
+	Message    string // The API's error message, empty if it gave none
+	Field      string // Setting at fault for an invalid config document
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("admin API returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("admin API returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// Backend is a backend as listed by ListBackends
+type Backend struct {
+	ID       string            `json:"id"`
+	URL      string            `json:"url"`
+	Pool     string            `json:"pool"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Weight   int64             `json:"weight"`
+	Healthy  bool              `json:"healthy"`
+	State    string            `json:"state"`   // active, drained or warming
+	Circuit  string            `json:"circuit"` // closed, open or half_open
+	Inflight int64             `json:"inflight"`
+}
+
+// BackendFilter narrows down ListBackends. Empty fields match every backend.
+type BackendFilter struct {
+	Pool   string
+	Health string // healthy or unhealthy
+	State  string // active, drained or warming
+}
+
+// WeightChange is the outcome of SetWeight and Drain
+type WeightChange struct {
+	Backend   string `json:"backend"` // URL of the backend
+	Weight    int64  `json:"weight"`
+	Previous  int64  `json:"previous"`
+	Persisted bool   `json:"persisted"`
+}
+
+// ReloadOptions controls how Reload applies a document
+type ReloadOptions struct {
+	DryRun  bool // Only report the changes
+	Persist bool // Also write the document to the balancer's config file
+}
+
+// ReloadResult is the outcome of Reload
+type ReloadResult struct {
+	Applied  bool      `json:"applied"`
+	Changes  []Change  `json:"changes"`
+	Restart  []string  `json:"restart,omitempty"` // Changed settings that need a restart
+	Warnings []Warning `json:"warnings,omitempty"`
+}
+
+// Change is a setting a reload changes
+type Change struct {
+	Path string `json:"path"`
+	From any    `json:"from"`
+	To   any    `json:"to"`
+}
+
+// Warning is a risky combination of settings in a reloaded document
+type Warning struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ListBackends returns every backend matching filter
+func (c *Client) ListBackends(ctx context.Context, filter BackendFilter) ([]Backend, error) {
+	query := url.Values{}
+	for name, value := range map[string]string{"pool": filter.Pool, "health": filter.Health, "state": filter.State} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	path := "/admin/backends"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var backends []Backend
+	if err := c.do(ctx, http.MethodGet, path, nil, &backends); err != nil {
+		return nil, err
+	}
+	return backends, nil
+}
+
+// SetWeight changes the weight of the backend with the given id, writing it to the balancer's
+// config file as well if persist is set
+func (c *Client) SetWeight(ctx context.Context, id string, weight int, persist bool) (WeightChange, error) {
+	body, err := json.Marshal(map[string]any{"weight": weight, "persist": persist})
+	if err != nil {
+		return WeightChange{}, err
+	}
+	var change WeightChange
+	err = c.do(ctx, http.MethodPut, "/admin/backends/"+url.PathEscape(id)+"/weight", body, &change)
+	return change, err
+}
+
+// Drain stops new requests going to the backend with the given id, by setting its weight to 0
+func (c *Client) Drain(ctx context.Context, id string) (WeightChange, error) {
+	return c.SetWeight(ctx, id, 0, false)
+}
+
+// Reload converges the balancer to a complete config document. Documents changing settings that
+// need a restart are refused with ErrRestartRequired, the result then lists them.
+func (c *Client) Reload(ctx context.Context, document []byte, opts ReloadOptions) (ReloadResult, error) {
+	query := url.Values{}
+	if opts.DryRun {
+		query.Set("dry_run", "true")
+	}
+	if opts.Persist {
+		query.Set("persist", "true")
+	}
+	path := "/admin/config"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var result ReloadResult
+	err := c.do(ctx, http.MethodPut, path, document, &result)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict && len(result.Restart) > 0 {
+		return result, fmt.Errorf("%w: %s", ErrRestartRequired, strings.Join(result.Restart, ", "))
+	}
+	return result, err
+}
+
+// Sends a request, retrying it as configured, and decodes the JSON response into out. Error
+// responses are returned as *Error and, as 409s carry a result too, also decoded into out.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out any) error {
+	retries := c.Retries
+	if retries == 0 {
+		retries = 2
+	}
+	wait := c.RetryWait
+	if wait == 0 {
+		wait = 200 * time.Millisecond
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = c.send(ctx, method, path, body, out)
+		if !retry || attempt >= retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait << attempt):
+		}
+	}
+}
+
+// Sends a request once, reporting whether it's worth retrying
+func (c *Client) send(ctx context.Context, method, path string, body []byte, out any) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ctx.Err() == nil, fmt.Errorf("failed to read response of %s %s: %w", method, path, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, apiError(resp.StatusCode, data)
+	}
+	if resp.StatusCode/100 != 2 {
+		if resp.StatusCode == http.StatusConflict {
+			json.Unmarshal(data, out)
+		}
+		return false, apiError(resp.StatusCode, data)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return false, fmt.Errorf("failed to decode response of %s %s: %w", method, path, err)
+	}
+	return false, nil
+}
+
+// Builds the error for an answer with status, from its {"error": ..., "field": ...} body if it has one
+func apiError(status int, data []byte) *Error {
+	var body struct {
+		Error string `json:"error"`
+		Field string `json:"field"`
+	}
+	json.Unmarshal(data, &body)
+	return &Error{StatusCode: status, Message: body.Error, Field: body.Field}
+}
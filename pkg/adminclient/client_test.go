@@ -0,0 +1,139 @@
+package adminclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListBackends(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/backends" || r.URL.Query().Get("pool") != "web" || r.URL.Query().Get("health") != "" {
+			t.Errorf("Got request for %s, want /admin/backends?pool=web", r.URL)
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Authorization header is %q, want the bearer token", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`[{"id": "web-1", "url": "http://10.0.0.1", "pool": "web", "weight": 3, "healthy": true, "state": "active", "circuit": "closed"}]`))
+	}))
+	defer server.Close()
+
+	c := New(server.URL + "/")
+	c.Token = "secret"
+	backends, err := c.ListBackends(context.Background(), BackendFilter{Pool: "web"})
+	if err != nil {
+		t.Fatalf("ListBackends failed: %v", err)
+	}
+	if len(backends) != 1 || backends[0].ID != "web-1" || backends[0].Weight != 3 || !backends[0].Healthy {
+		t.Errorf("Got backends %+v, want web-1 with weight 3", backends)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Weight  *int `json:"weight"`
+			Persist bool `json:"persist"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Method != http.MethodPut || r.URL.Path != "/admin/backends/web-1/weight" || body.Weight == nil || *body.Weight != 0 {
+			t.Errorf("Got %s %s with weight %v, want PUT /admin/backends/web-1/weight with weight 0", r.Method, r.URL.Path, body.Weight)
+		}
+		if user, password, _ := r.BasicAuth(); user != "ops" || password != "pw" {
+			t.Errorf("Basic auth is %q:%q, want ops:pw", user, password)
+		}
+		w.Write([]byte(`{"backend": "http://10.0.0.1", "weight": 0, "previous": 3}`))
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	c.Username, c.Password, c.Token = "ops", "pw", "ignored"
+	change, err := c.Drain(context.Background(), "web-1")
+	if err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if change.Weight != 0 || change.Previous != 3 {
+		t.Errorf("Got %+v, want weight 0 from 3", change)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	c := &Client{BaseURL: server.URL, RetryWait: time.Millisecond}
+	if _, err := c.ListBackends(context.Background(), BackendFilter{}); err != nil {
+		t.Errorf("ListBackends failed after 2 retries: %v", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("Server got %d requests, want 3", got)
+	}
+
+	// Errors other than unavailability are returned straight away
+	requests.Store(0)
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "unknown backend \"nope\""}`))
+	}))
+	defer notFound.Close()
+	c.BaseURL = notFound.URL
+	_, err := c.SetWeight(context.Background(), "nope", 1, false)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Message != `unknown backend "nope"` {
+		t.Errorf("SetWeight returned %v, want the API's 404", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("Server got %d requests for a 404, want 1", got)
+	}
+}
+
+func TestReload(t *testing.T) {
+	var restart atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); string(body) != "strategy: random\n" {
+			t.Errorf("Got document %q", body)
+		}
+		if restart.Load() {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"applied": false, "changes": [{"path": "server.port", "from": 8080, "to": 9000}], "restart": ["server.port"]}`))
+			return
+		}
+		if r.URL.Query().Get("dry_run") != "true" {
+			t.Errorf("Got query %q, want a dry run", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"applied": false, "changes": [{"path": "strategy", "from": "round-robin", "to": "random"}]}`))
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	result, err := c.Reload(context.Background(), []byte("strategy: random\n"), ReloadOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if len(result.Changes) != 1 || result.Changes[0].Path != "strategy" {
+		t.Errorf("Got changes %+v, want the strategy", result.Changes)
+	}
+
+	restart.Store(true)
+	result, err = c.Reload(context.Background(), []byte("strategy: random\n"), ReloadOptions{})
+	if !errors.Is(err, ErrRestartRequired) {
+		t.Errorf("Reload of a restart-only change returned %v, want ErrRestartRequired", err)
+	}
+	if len(result.Restart) != 1 || result.Restart[0] != "server.port" {
+		t.Errorf("Got restart settings %v, want server.port", result.Restart)
+	}
+}
@@ -0,0 +1,241 @@
+//go:build e2e
+
+// Package e2e runs the load balancer binary against in-process backends and checks whole
+// scenarios through its main, admin and metrics ports. Run with go test -tags e2e ./test/e2e.
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+// Path of the balancer binary built once for the whole suite
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "loadbalancer-e2e")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create build directory: %v\n", err)
+		os.Exit(1)
+	}
+	binary = filepath.Join(dir, "loadbalancer")
+	build := exec.Command("go", "build", "-o", binary, "../../cmd/loadbalancer")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to build the balancer: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testBackend answers every request with its name, followed by the request body if there is one,
+// and counts the requests it served, health probes aside
+type testBackend struct {
+	*httptest.Server
+	name string
+	hits atomic.Int64
+}
+
+// Starts backends with the given names, closed when the test ends
+func startBackends(t *testing.T, names ...string) []*testBackend {
+	t.Helper()
+	backends := make([]*testBackend, len(names))
+	for i, name := range names {
+		b := &testBackend{name: name}
+		b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				b.hits.Add(1)
+			}
+			fmt.Fprint(w, name)
+			if body, _ := io.ReadAll(r.Body); len(body) > 0 {
+				fmt.Fprintf(w, ":%s", body)
+			}
+		}))
+		t.Cleanup(b.Close)
+		backends[i] = b
+	}
+	return backends
+}
+
+// runningBalancer is a balancer process started by startBalancer
+type runningBalancer struct {
+	URL        string // Main port
+	AdminURL   string
+	MetricsURL string
+	ConfigFile string
+
+	mu     sync.Mutex
+	output bytes.Buffer // Logs written so far
+}
+
+func (lb *runningBalancer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.output.Write(p)
+}
+
+// Runs the balancer with cfg, its ports replaced by free ones, and waits until it reports ready on
+// the admin port.
+// It's stopped with SIGTERM when the test ends, and its logs are printed if the test failed.
+func startBalancer(t *testing.T, cfg *config.Config) *runningBalancer {
+	t.Helper()
+	cfg.Server.Port = freePort(t)
+	cfg.Admin.Port = freePort(t)
+	cfg.Metrics.Port = freePort(t)
+	document, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, document, 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	lb := &runningBalancer{
+		URL:        fmt.Sprintf("http://127.0.0.1:%d", cfg.Server.Port),
+		AdminURL:   fmt.Sprintf("http://127.0.0.1:%d", cfg.Admin.Port),
+		MetricsURL: fmt.Sprintf("http://127.0.0.1:%d/metrics", cfg.Metrics.Port),
+		ConfigFile: configFile,
+	}
+	cmd := exec.Command(binary)
+	cmd.Dir = dir // The balancer reads config.yaml from its working directory
+	cmd.Stdout, cmd.Stderr = lb, lb
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start the balancer: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+		if t.Failed() {
+			lb.mu.Lock()
+			t.Logf("Balancer logs:\n%s", lb.output.String())
+			lb.mu.Unlock()
+		}
+	})
+
+	eventually(t, 10*time.Second, "balancer to become ready", func() bool {
+		select {
+		case <-exited:
+			t.Fatalf("Balancer exited at startup")
+		default:
+		}
+		resp, err := http.Get(lb.AdminURL + "/health")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	return lb
+}
+
+// Sends a request to the balancer, returning the status and body
+func (lb *runningBalancer) do(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(respBody)
+}
+
+// Sends n GET requests for path to the main port and counts the responses by body. Failed
+// requests are counted under their status.
+func (lb *runningBalancer) spread(t *testing.T, n int, path string) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for range n {
+		status, body := lb.do(t, "GET", lb.URL+path, "")
+		if status != http.StatusOK {
+			body = http.StatusText(status)
+		}
+		counts[body]++
+	}
+	return counts
+}
+
+// Returns the value of the first series in the metrics whose line starts with prefix, 0 if none
+func (lb *runningBalancer) metric(t *testing.T, prefix string) float64 {
+	t.Helper()
+	_, body := lb.do(t, "GET", lb.MetricsURL, "")
+	for line := range strings.SplitSeq(body, "\n") {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			var value float64
+			fmt.Sscan(strings.TrimSpace(rest[strings.LastIndex(rest, " "):]), &value)
+			return value
+		}
+	}
+	return 0
+}
+
+// Returns a port nothing is listening on at the moment
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// Fails the test unless cond holds within timeout
+func eventually(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Returns a config with the given backends, each with its name as id, that only reports ready
+// once they have been probed
+func configFor(backends ...*testBackend) *config.Config {
+	cfg := &config.Config{
+		StartupCheck: config.StartupRequireOneHealthy,
+		Timeouts:     config.TimeoutConfig{FirstByte: 5 * time.Second},
+		Retry:        config.RetryConfig{Attempts: 1, MaxBodyBytes: 1 << 20},
+	}
+	for _, b := range backends {
+		cfg.Backends = append(cfg.Backends, config.BackendConfig{ID: b.name, URL: b.URL, Weight: 1})
+	}
+	return cfg
+}
@@ -0,0 +1,144 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/vinzmyko/load-balancer/internal/config"
+)
+
+func TestFailoverWithRetries(t *testing.T) {
+	backends := startBackends(t, "a", "b", "c")
+	lb := startBalancer(t, configFor(backends...))
+
+	// Connections to the stopped backend are refused, so its requests are retried on another
+	// one well before health checks notice, bodies included
+	backends[1].Close()
+	for range 9 {
+		status, body := lb.do(t, "POST", lb.URL+"/orders", "order")
+		if status != http.StatusOK || (body != "a:order" && body != "c:order") {
+			t.Fatalf("POST with a backend down got %d %q, want 200 from a or c with the body", status, body)
+		}
+	}
+	if got := lb.metric(t, `loadbalancer_retries_total{backend="`+backends[1].URL+`"}`); got == 0 {
+		t.Error("No retries counted away from the stopped backend")
+	}
+	if got := lb.metric(t, `loadbalancer_responses_by_attempt_total{attempt="2"`); got == 0 {
+		t.Error("No responses counted as served by a second attempt")
+	}
+}
+
+func TestReloadThroughAdminAPI(t *testing.T) {
+	backends := startBackends(t, "blue", "green")
+	cfg := configFor(backends...)
+	cfg.Backends[0].Labels = map[string]string{"pool": "blue"}
+	cfg.Backends[1].Labels = map[string]string{"pool": "green"}
+	cfg.Routes = []config.RouteConfig{{Name: "api", Match: config.RouteMatch{PathPrefix: "/api"}, BackendLabels: map[string]string{"pool": "blue"}}}
+	lb := startBalancer(t, cfg)
+
+	if got := lb.spread(t, 10, "/api/items"); !maps.Equal(got, map[string]int{"blue": 10}) {
+		t.Fatalf("Requests before the reload went to %v, want all to blue", got)
+	}
+
+	cfg.Routes[0].BackendLabels = map[string]string{"pool": "green"}
+	document, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+	status, body := lb.do(t, "PUT", lb.AdminURL+"/admin/config", string(document))
+	var applied struct {
+		Applied bool `json:"applied"`
+	}
+	if json.Unmarshal([]byte(body), &applied); status != http.StatusOK || !applied.Applied {
+		t.Fatalf("Reload got %d %s, want it applied", status, body)
+	}
+
+	if got := lb.spread(t, 10, "/api/items"); !maps.Equal(got, map[string]int{"green": 10}) {
+		t.Errorf("Requests after the reload went to %v, want all to green", got)
+	}
+}
+
+func TestDrainAndRestoreBackend(t *testing.T) {
+	backends := startBackends(t, "a", "b")
+	lb := startBalancer(t, configFor(backends...))
+
+	if status, body := lb.do(t, "PUT", lb.AdminURL+"/admin/backends/a/weight", `{"weight": 0}`); status != http.StatusOK {
+		t.Fatalf("Draining a got %d %s", status, body)
+	}
+	if got := lb.spread(t, 10, "/"); !maps.Equal(got, map[string]int{"b": 10}) {
+		t.Errorf("Requests with a drained went to %v, want all to b", got)
+	}
+
+	if status, body := lb.do(t, "PUT", lb.AdminURL+"/admin/backends/a/weight", `{"weight": 1}`); status != http.StatusOK {
+		t.Fatalf("Restoring a got %d %s", status, body)
+	}
+	if got := lb.spread(t, 10, "/"); !maps.Equal(got, map[string]int{"a": 5, "b": 5}) {
+		t.Errorf("Requests after restoring a went to %v, want round-robin across both", got)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	backends := startBackends(t, "a", "b")
+	lb := startBalancer(t, configFor(backends...))
+
+	lb.spread(t, 6, "/")
+	for _, b := range backends {
+		series := `loadbalancer_requests_total{backend="` + b.URL + `",backend_id="` + b.name + `"}`
+		if got := lb.metric(t, series); got != float64(b.hits.Load()) {
+			t.Errorf("%s is %v, want the %d requests the backend served", series, got, b.hits.Load())
+		}
+	}
+	if got := lb.metric(t, `loadbalancer_responses_by_attempt_total{attempt="1",route="default"}`); got != 6 {
+		t.Errorf("First attempt responses are %v, want 6", got)
+	}
+}
+
+func TestHealthPassthrough(t *testing.T) {
+	backends := startBackends(t, "a")
+	cfg := configFor(backends...)
+	cfg.HealthEndpoint.Passthrough = true
+	lb := startBalancer(t, cfg)
+
+	if status, body := lb.do(t, "GET", lb.URL+"/health", ""); status != http.StatusOK || body != "a" {
+		t.Errorf("GET /health on the main port got %d %q, want the backend's answer", status, body)
+	}
+	if status, body := lb.do(t, "GET", lb.AdminURL+"/health", ""); status != http.StatusOK || body != "OK" {
+		t.Errorf("GET /health on the admin port got %d %q, want the balancer's readiness", status, body)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	backends := startBackends(t, "a", "b")
+	lb := startBalancer(t, configFor(backends...))
+	check := func() (int, string) {
+		out, err := exec.Command(binary, "check", "-target", lb.URL, "-config", lb.ConfigFile, "-requests", "6").CombinedOutput()
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return exit.ExitCode(), string(out)
+		} else if err != nil {
+			t.Fatalf("Failed to run check: %v", err)
+		}
+		return 0, string(out)
+	}
+
+	// Metrics and admin API are found through the config
+	if code, out := check(); code != 0 || !strings.Contains(out, "PASS: 5 checks") {
+		t.Fatalf("check against a healthy balancer exited %d:\n%s", code, out)
+	}
+
+	backends[1].Close()
+	code, out := check()
+	if code != 1 || !regexp.MustCompile(`(?m)^backend b\s+FAIL\s`).MatchString(out) {
+		t.Errorf("check with b stopped exited %d, want 1 with b failing:\n%s", code, out)
+	}
+}